@@ -8,9 +8,11 @@ import (
 	"log"
 	"os"
 	"sort"
+	"strings"
 	"time"
 
 	_ "github.com/mattn/go-sqlite3"
+	"github.com/stupiduntilnot/autonous/internal/db"
 )
 
 // Event represents a row from the events table.
@@ -30,6 +32,7 @@ func main() {
 		maxDepth  int
 		jsonOut   bool
 		noPayload bool
+		turnID    int64
 	)
 
 	flag.StringVar(&dbPath, "db", envOrDefault("AUTONOUS_DB_PATH", "/state/agent.db"), "SQLite database path")
@@ -37,6 +40,7 @@ func main() {
 	flag.IntVar(&maxDepth, "L", 0, "limit display depth (0 = unlimited)")
 	flag.BoolVar(&jsonOut, "json", false, "output JSON format")
 	flag.BoolVar(&noPayload, "no-payload", false, "hide payload details")
+	flag.Int64Var(&turnID, "turn", 0, "print the exact prompt and raw completion of a turn.started event ID")
 	flag.Parse()
 
 	db, err := sql.Open("sqlite3", dbPath+"?mode=ro&_journal_mode=WAL")
@@ -49,6 +53,19 @@ func main() {
 		log.Fatalf("ping db: %v", err)
 	}
 
+	if turnID != 0 {
+		turn, err := loadTurn(db, turnID)
+		if err != nil {
+			log.Fatalf("load turn: %v", err)
+		}
+		if jsonOut {
+			printTurnJSON(turn)
+		} else {
+			printTurn(turn)
+		}
+		return
+	}
+
 	// Determine root event ID.
 	rootID := eventID
 	if rootID == 0 {
@@ -283,3 +300,120 @@ func printJSON(root *Event, maxDepth int, noPayload bool) {
 	}
 }
 
+// Turn is one model call reconstructed from its captured prompt and reply.
+type Turn struct {
+	ID        int64              `json:"turn_id"`
+	Timestamp int64              `json:"timestamp"`
+	ModelName string             `json:"model_name,omitempty"`
+	Prompt    []db.PromptMessage `json:"prompt"`
+	// CompletionID is the turn.completed event, 0 when the call failed.
+	CompletionID int64             `json:"completion_event_id,omitempty"`
+	Completion   *db.PromptMessage `json:"completion,omitempty"`
+}
+
+// loadTurn reads the prompt captured on a turn.started event and the reply
+// captured on the turn.completed event that follows it under the same agent.
+func loadTurn(database *sql.DB, turnID int64) (*Turn, error) {
+	ev := &Event{}
+	err := database.QueryRow(
+		`SELECT id, timestamp, parent_id, event_type, payload FROM events WHERE id = ?`, turnID,
+	).Scan(&ev.ID, &ev.Timestamp, &ev.ParentID, &ev.EventType, &ev.Payload)
+	if err == sql.ErrNoRows {
+		return nil, fmt.Errorf("event %d not found", turnID)
+	}
+	if err != nil {
+		return nil, err
+	}
+	if ev.EventType != "turn.started" {
+		return nil, fmt.Errorf("event %d is %s, not turn.started", turnID, ev.EventType)
+	}
+	var started struct {
+		ModelName  string `json:"model_name"`
+		PromptBlob string `json:"prompt_blob"`
+	}
+	if ev.Payload.Valid {
+		if err := json.Unmarshal([]byte(ev.Payload.String), &started); err != nil {
+			return nil, fmt.Errorf("decode turn %d payload: %w", turnID, err)
+		}
+	}
+	if started.PromptBlob == "" {
+		return nil, fmt.Errorf("turn %d has no captured prompt", turnID)
+	}
+	turn := &Turn{ID: ev.ID, Timestamp: ev.Timestamp, ModelName: started.ModelName}
+	if turn.Prompt, err = db.GetPrompt(database, started.PromptBlob); err != nil {
+		return nil, fmt.Errorf("load prompt %s: %w", started.PromptBlob, err)
+	}
+
+	var nextID int64
+	var nextType string
+	var nextPayload sql.NullString
+	err = database.QueryRow(
+		`SELECT id, event_type, payload FROM events
+		 WHERE parent_id IS ? AND id > ? AND event_type IN ('turn.started', 'turn.completed')
+		 ORDER BY id LIMIT 1`,
+		ev.ParentID, ev.ID,
+	).Scan(&nextID, &nextType, &nextPayload)
+	if err == sql.ErrNoRows || (err == nil && nextType != "turn.completed") {
+		return turn, nil
+	}
+	if err != nil {
+		return nil, err
+	}
+	turn.CompletionID = nextID
+	var completed struct {
+		CompletionBlob string `json:"completion_blob"`
+	}
+	if nextPayload.Valid {
+		if err := json.Unmarshal([]byte(nextPayload.String), &completed); err != nil {
+			return nil, fmt.Errorf("decode turn.completed %d payload: %w", nextID, err)
+		}
+	}
+	if completed.CompletionBlob != "" {
+		reply, err := db.GetPromptMessage(database, completed.CompletionBlob)
+		if err != nil {
+			return nil, fmt.Errorf("load completion %s: %w", completed.CompletionBlob, err)
+		}
+		turn.Completion = &reply
+	}
+	return turn, nil
+}
+
+// printTurn prints every prompt message and the completion in full.
+func printTurn(turn *Turn) {
+	ts := time.Unix(turn.Timestamp, 0).UTC().Format("2006-01-02 15:04:05")
+	fmt.Printf("turn [%d] %s  model_name=%s\n", turn.ID, ts, turn.ModelName)
+	fmt.Printf("=== prompt (%d messages) ===\n", len(turn.Prompt))
+	for i, m := range turn.Prompt {
+		printPromptMessage(fmt.Sprintf("[%d] %s", i+1, m.Role), m)
+	}
+	switch {
+	case turn.CompletionID == 0:
+		fmt.Println("=== completion: none (the model call did not complete) ===")
+	case turn.Completion == nil:
+		fmt.Printf("=== completion [%d]: not captured ===\n", turn.CompletionID)
+	default:
+		fmt.Printf("=== completion [%d] ===\n", turn.CompletionID)
+		printPromptMessage(turn.Completion.Role, *turn.Completion)
+	}
+}
+
+func printPromptMessage(title string, m db.PromptMessage) {
+	if m.ToolCallID != "" {
+		title += " (" + m.ToolCallID + ")"
+	}
+	fmt.Printf("--- %s ---\n", title)
+	if m.Content != "" {
+		fmt.Println(strings.TrimRight(m.Content, "\n"))
+	}
+	for _, c := range m.ToolCalls {
+		fmt.Printf("tool_call %s %s %s\n", c.ID, c.Name, c.Arguments)
+	}
+}
+
+func printTurnJSON(turn *Turn) {
+	enc := json.NewEncoder(os.Stdout)
+	enc.SetIndent("", "  ")
+	if err := enc.Encode(turn); err != nil {
+		log.Fatalf("encode json: %v", err)
+	}
+}
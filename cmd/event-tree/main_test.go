@@ -444,3 +444,48 @@ func TestSubtreeFromSpecificID(t *testing.T) {
 	}
 }
 
+func TestLoadTurn_ReconstructsPromptAndCompletion(t *testing.T) {
+	database := testDB(t)
+	prompt := []db.PromptMessage{
+		{Role: "system", Content: "be brief"},
+		{Role: "user", Content: "list files"},
+	}
+	promptHash, err := db.PutPrompt(database, prompt)
+	if err != nil {
+		t.Fatal(err)
+	}
+	reply := db.PromptMessage{Role: "assistant", ToolCalls: []db.PromptToolCall{{ID: "c1", Name: "bash", Arguments: `{"cmd":"ls"}`}}}
+	replyHash, err := db.PutPromptMessage(database, reply)
+	if err != nil {
+		t.Fatal(err)
+	}
+	agentID, _ := db.LogEvent(database, nil, db.EventAgentStarted, map[string]any{"task_id": 1})
+	turnID, _ := db.LogEvent(database, &agentID, db.EventTurnStarted, map[string]any{"model_name": "gpt-4o", "prompt_blob": promptHash})
+	db.LogEvent(database, &agentID, db.EventToolCallStarted, map[string]any{"tool_name": "bash"})
+	completedID, _ := db.LogEvent(database, &agentID, db.EventTurnCompleted, map[string]any{"completion_blob": replyHash})
+	failedTurnID, _ := db.LogEvent(database, &agentID, db.EventTurnStarted, map[string]any{"model_name": "gpt-4o", "prompt_blob": promptHash})
+	db.LogEvent(database, &agentID, db.EventAgentFailed, map[string]any{"error": "timeout"})
+
+	turn, err := loadTurn(database, turnID)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if turn.ModelName != "gpt-4o" || len(turn.Prompt) != 2 || turn.CompletionID != completedID || turn.Completion == nil {
+		t.Fatalf("unexpected turn %+v", turn)
+	}
+	out := captureStdout(t, func() { printTurn(turn) })
+	for _, want := range []string{"=== prompt (2 messages) ===", "--- [1] system ---\nbe brief", "--- [2] user ---\nlist files",
+		"=== completion [", "tool_call c1 bash {\"cmd\":\"ls\"}"} {
+		if !strings.Contains(out, want) {
+			t.Fatalf("expected %q in output:\n%s", want, out)
+		}
+	}
+
+	failed, err := loadTurn(database, failedTurnID)
+	if err != nil || failed.CompletionID != 0 || failed.Completion != nil {
+		t.Fatalf("a turn without turn.completed has no completion, got %+v err=%v", failed, err)
+	}
+	if _, err := loadTurn(database, agentID); err == nil {
+		t.Fatal("expected an error for an event that is not turn.started")
+	}
+}
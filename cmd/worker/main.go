@@ -11,23 +11,39 @@ import (
 	"fmt"
 	"io"
 	"log"
+	"math"
 	"os"
 	"os/exec"
 	"path/filepath"
 	"regexp"
+	"strconv"
 	"strings"
+	"sync"
+	"sync/atomic"
 	"time"
 
+	"github.com/mattn/go-sqlite3"
+	"github.com/stupiduntilnot/autonous/internal/anthropic"
+	"github.com/stupiduntilnot/autonous/internal/cassette"
 	cmdpkg "github.com/stupiduntilnot/autonous/internal/commander"
 	"github.com/stupiduntilnot/autonous/internal/config"
 	ctxpkg "github.com/stupiduntilnot/autonous/internal/context"
 	"github.com/stupiduntilnot/autonous/internal/control"
+	"github.com/stupiduntilnot/autonous/internal/cost"
 	"github.com/stupiduntilnot/autonous/internal/db"
 	"github.com/stupiduntilnot/autonous/internal/dummy"
+	"github.com/stupiduntilnot/autonous/internal/memory"
 	modelpkg "github.com/stupiduntilnot/autonous/internal/model"
 	"github.com/stupiduntilnot/autonous/internal/openai"
+	"github.com/stupiduntilnot/autonous/internal/prompt"
+	"github.com/stupiduntilnot/autonous/internal/redact"
+	"github.com/stupiduntilnot/autonous/internal/repomap"
+	"github.com/stupiduntilnot/autonous/internal/router"
+	"github.com/stupiduntilnot/autonous/internal/summary"
 	"github.com/stupiduntilnot/autonous/internal/telegram"
+	"github.com/stupiduntilnot/autonous/internal/tokenizer"
 	toolpkg "github.com/stupiduntilnot/autonous/internal/tool"
+	"github.com/stupiduntilnot/autonous/internal/vector"
 )
 
 func main() {
@@ -61,20 +77,8 @@ func main() {
 		log.Printf("[worker] failed to log process.started: %v", err)
 	}
 
-	systemPrompt, promptSource, promptSize, promptReadErr := loadSystemPrompt(&cfg)
-	cfg.SystemPrompt = systemPrompt
-	if promptReadErr != nil {
-		log.Printf("[worker] system prompt file read failed path=%s err=%v", cfg.SystemPromptFile, promptReadErr)
-		db.LogEvent(database, &workerEventID, "system_prompt.load_failed", map[string]any{
-			"path":  cfg.SystemPromptFile,
-			"error": truncate(promptReadErr.Error(), 1000),
-		})
-	}
-	db.LogEvent(database, &workerEventID, "system_prompt.loaded", map[string]any{
-		"source":     promptSource,
-		"config_dir": cfg.ConfigDir,
-		"size_bytes": promptSize,
-	})
+	prompts := newPromptLoader(&cfg)
+	cfg.SystemPrompt = resolveSystemPrompt(database, workerEventID, prompts, &cfg, nil, 0)
 
 	commander, err := newCommander(&cfg)
 	if err != nil {
@@ -84,17 +88,68 @@ func main() {
 	if err != nil {
 		log.Fatalf("[worker] failed to init model provider: %v", err)
 	}
-	ctxProvider := &ctxpkg.SQLiteProvider{DB: database}
-	ctxCompressor := &ctxpkg.SimpleCompressor{MaxMessages: cfg.HistoryWindow}
-	ctxAssembler := &ctxpkg.StandardAssembler{}
+	commander, modelProvider, replay, err := applyCassette(&cfg, commander, modelProvider)
+	if err != nil {
+		log.Fatalf("[worker] failed to open cassette: %v", err)
+	}
+	if cfg.StreamReplies {
+		if reason := streamingUnavailable(commander, modelProvider); reason != "" {
+			log.Printf("[worker] streaming replies disabled: %s", reason)
+		}
+	}
+	var ctxProvider ctxpkg.Provider = &ctxpkg.SQLiteProvider{DB: database}
+	maxMessages := cfg.HistoryWindow
+	if cfg.RetrievalTopK > 0 {
+		enabled, err := db.HistoryFTSEnabled(database)
+		switch {
+		case err != nil:
+			log.Printf("[worker] failed to check history full-text index, retrieval disabled: %v", err)
+		case !enabled:
+			log.Printf("[worker] history full-text index unavailable (build with -tags sqlite_fts5), retrieval disabled")
+		default:
+			ctxProvider = &ctxpkg.FTSProvider{DB: database, TopK: cfg.RetrievalTopK}
+			maxMessages += cfg.RetrievalTopK
+		}
+	}
+	if cfg.EmbeddingsProvider != "" {
+		embedder, err := newEmbedder(&cfg)
+		if err != nil {
+			log.Fatalf("[worker] failed to init embedder: %v", err)
+		}
+		indexer := &vector.Indexer{DB: database, Embedder: embedder}
+		ctxProvider = &vector.Provider{
+			Next:     ctxProvider,
+			Indexer:  indexer,
+			TopK:     cfg.SemanticTopK,
+			FileTopK: cfg.SemanticFileTopK,
+			MinScore: float32(cfg.SemanticMinScore),
+		}
+		maxMessages += cfg.SemanticTopK + cfg.SemanticFileTopK
+		go backfillEmbeddings(indexer, &cfg)
+	}
+	ctxCompressor, err := newContextChain(&cfg, database, maxMessages)
+	if err != nil {
+		log.Fatalf("[worker] failed to build context chain: %v", err)
+	}
+	log.Printf("[worker] context stages: %s", strings.Join(contextStages(&cfg), ","))
+	_, nativeTools := modelProvider.(modelpkg.ToolCaller)
+	ctxAssembler := &ctxpkg.StandardAssembler{FlattenToolCalls: !nativeTools}
+	if cfg.RepoMapTokens > 0 {
+		ctxAssembler.Injectors = append(ctxAssembler.Injectors, repomap.New(cfg.WorkspaceDir, tokenizer.ForModel(cfg.ModelName()), cfg.RepoMapTokens))
+	}
 	policy := control.Policy{
-		MaxTurns:    cfg.ControlMaxTurns,
-		MaxWallTime: time.Duration(cfg.ControlMaxWallTimeSeconds) * time.Second,
-		MaxTokens:   control.DefaultPolicy().MaxTokens,
-		MaxRetries:  cfg.ControlMaxRetries,
+		MaxTurns:          cfg.ControlMaxTurns,
+		MaxWallTime:       time.Duration(cfg.ControlMaxWallTimeSeconds) * time.Second,
+		MaxTokens:         control.DefaultPolicy().MaxTokens,
+		MaxRetries:        cfg.ControlMaxRetries,
+		MaxDailyCostUSD:   cfg.BudgetDailyUSD,
+		MaxMonthlyCostUSD: cfg.BudgetMonthlyUSD,
+	}
+	breakers := newBreakerSet(database, &cfg)
+	limiter := newRateLimiter(&cfg)
+	if err := restoreBreakers(database, breakers); err != nil {
+		log.Printf("[worker] failed to restore circuit breakers: %v", err)
 	}
-	circuit := control.NewCircuitBreaker(5, 30*time.Second)
-	const noProgressK = 3
 	toolPolicy, err := toolpkg.NewPolicy(cfg.ToolAllowedRoots, cfg.ToolBashDenylist)
 	if err != nil {
 		log.Fatalf("[worker] invalid tool policy: %v", err)
@@ -156,6 +211,9 @@ func main() {
 	)); err != nil {
 		log.Fatalf("[worker] failed to register tool bash: %v", err)
 	}
+	if err := registry.Register(memory.NewTool(database)); err != nil {
+		log.Fatalf("[worker] failed to register tool memory: %v", err)
+	}
 	toolRunner := toolpkg.NewRunner(registry)
 	if policy.MaxTurns < 2 {
 		policy.MaxTurns = 2
@@ -176,219 +234,434 @@ func main() {
 		}
 	}
 
+	pool := newTaskPool(&executor{
+		database:      database,
+		commander:     commander,
+		cfg:           &cfg,
+		workerEventID: workerEventID,
+		prompts:       prompts,
+		model:         modelProvider,
+		ctxProvider:   ctxProvider,
+		compressor:    ctxCompressor,
+		assembler:     ctxAssembler,
+		policy:        policy,
+		registry:      registry,
+		runner:        toolRunner,
+		breakers:      breakers,
+	}, cfg.WorkerConcurrency)
+	leaseTTL := pool.exec.leaseTTL()
+	reclaimExpiredLeases(database, commander, workerEventID, policy, leaseTTL, time.Now())
+
 	log.Printf(
-		"worker running id=%s model=%s provider=%s source=%s",
+		"worker running id=%s model=%s provider=%s source=%s executors=%d",
 		cfg.WorkerInstanceID,
-		cfg.OpenAIModel,
+		cfg.ModelName(),
 		cfg.ModelProvider,
 		cfg.Commander,
+		cfg.WorkerConcurrency,
 	)
 
-	var handledCount uint64
-
 	for {
-		prevState := circuit.State()
-		if !circuit.Allow(time.Now()) {
-			time.Sleep(time.Duration(cfg.SleepSeconds) * time.Second)
-			continue
-		}
-		if prevState == control.CircuitOpen && circuit.State() == control.CircuitHalfOpen {
+		allowed, halfOpened := breakers.Allow(time.Now())
+		for _, class := range halfOpened {
 			db.LogEvent(database, &workerEventID, db.EventCircuitHalfOpen, map[string]any{
-				"error_class": circuit.OpenedClass(),
+				"error_class": class,
 			})
 		}
+		if !allowed {
+			offset = pollWhileOpen(database, commander, &cfg, breakers, limiter, &pool.exec.running, workerEventID, offset)
+			continue
+		}
 
+		reclaimExpiredLeases(database, commander, workerEventID, policy, leaseTTL, time.Now())
 		pollTimeout := cfg.Timeout
-		if hasRunnableTasks(database, policy) {
+		if pool.idle() && hasRunnableTasks(database, policy) {
 			pollTimeout = 0
 		}
 
 		updates, err := commander.GetUpdates(offset, pollTimeout)
 		if err != nil {
 			log.Printf("getUpdates error: %v", err)
-			errClass := classifyError(err)
-			prevCircuit := circuit.State()
-			circuit.RecordFailure(errClass, time.Now())
-			if prevCircuit != control.CircuitOpen && circuit.State() == control.CircuitOpen {
-				db.LogEvent(database, &workerEventID, db.EventCircuitOpened, map[string]any{
-					"error_class":      errClass,
-					"threshold":        circuit.Threshold,
-					"cooldown_seconds": int(circuit.Cooldown.Seconds()),
-				})
-			}
+			recordCircuitFailure(database, workerEventID, breakers, classifyError(err))
 			time.Sleep(time.Duration(cfg.SleepSeconds) * time.Second)
 			continue
 		}
-		if circuit.State() == control.CircuitHalfOpen && circuit.OpenedClass() == "command_source_api" {
-			circuit.RecordSuccess()
-			db.LogEvent(database, &workerEventID, db.EventCircuitClosed, map[string]any{"recovered": true})
+		closeCircuits(database, workerEventID, breakers, "command_source_api")
+		offset = enqueueUpdates(database, commander, limiter, workerEventID, updates, offset, func(chatID int64, text string) bool {
+			return handleStop(database, commander, &pool.exec.running, chatID, text)
+		})
+		if replay != nil && len(updates) == 0 && replay.PollsReplayed() && pool.drained() && !hasPendingTasks(database, policy) {
+			finishReplay(replay)
+		}
+
+		if pool.dispatch() == 0 {
+			time.Sleep(time.Duration(cfg.SleepSeconds) * time.Second)
 		}
+	}
+}
 
-		for _, update := range updates {
-			offset = update.UpdateID + 1
+// noProgressK is the number of identical retry fingerprints after which a
+// task counts as stalled.
+const noProgressK = 3
+
+// executor runs claimed tasks. It is shared by every goroutine of a
+// taskPool, so everything it holds must be safe for concurrent use.
+type executor struct {
+	database      *sql.DB
+	commander     cmdpkg.Commander
+	cfg           *config.WorkerConfig
+	workerEventID int64
+	prompts       *prompt.Loader
+	model         modelpkg.Provider
+	ctxProvider   ctxpkg.Provider
+	compressor    ctxpkg.Compressor
+	assembler     ctxpkg.Assembler
+	policy        control.Policy
+	registry      *toolpkg.Registry
+	runner        *toolpkg.Runner
+	breakers      *control.BreakerSet
+
+	running runningTasks
+	handled atomic.Uint64
+}
 
-			if update.Message == nil {
-				continue
-			}
-			if update.Message.Text == nil {
-				continue
-			}
-			text := *update.Message.Text
-			if len(text) == 0 {
-				continue
-			}
+// runningTask is a task whose agent run is in progress.
+type runningTask struct {
+	chatID  int64
+	cancel  context.CancelFunc
+	stopped bool
+}
 
-			chatID := update.Message.Chat.ID
-			_, err := enqueueMessage(database, update.UpdateID, chatID, text, update.Message.Date)
-			if err != nil {
-				log.Printf("enqueue error update_id=%d: %v", update.UpdateID, err)
-				continue
-			}
-		}
+// runningTasks tracks the runs in progress so that /stop, handled while
+// polling, can cancel them.
+type runningTasks struct {
+	mu    sync.Mutex
+	tasks map[int64]*runningTask
+}
 
-		task, err := claimNextTask(database, policy)
-		if err != nil {
-			log.Printf("claim_next_task error: %v", err)
-			time.Sleep(time.Duration(cfg.SleepSeconds) * time.Second)
-			continue
-		}
-		if task == nil {
-			time.Sleep(time.Duration(cfg.SleepSeconds) * time.Second)
-			continue
+// start registers task and returns the context its run uses and a func that
+// unregisters it.
+func (r *runningTasks) start(task *queueTask) (context.Context, func()) {
+	ctx, cancel := context.WithCancel(context.Background())
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	if r.tasks == nil {
+		r.tasks = map[int64]*runningTask{}
+	}
+	r.tasks[task.ID] = &runningTask{chatID: task.ChatID, cancel: cancel}
+	return ctx, func() {
+		r.mu.Lock()
+		defer r.mu.Unlock()
+		delete(r.tasks, task.ID)
+		cancel()
+	}
+}
+
+// stop cancels the run of taskID, or with taskID 0 the run of chatID, and
+// returns the stopped task's id. Only a chat's own runs can be stopped.
+func (r *runningTasks) stop(chatID, taskID int64) (int64, bool) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	for id, t := range r.tasks {
+		if t.chatID == chatID && (taskID == 0 || id == taskID) {
+			t.stopped = true
+			t.cancel()
+			return id, true
 		}
+	}
+	return 0, false
+}
 
-		handledCount++
-		log.Printf("process task_id=%d chat_id=%d text=%s", task.ID, task.ChatID, truncate(task.Text, 200))
+// stopped reports whether /stop cancelled taskID's run.
+func (r *runningTasks) stopped(taskID int64) bool {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	t, ok := r.tasks[taskID]
+	return ok && t.stopped
+}
 
-		// Log agent.started (child of worker process.started).
-		agentEventID, _ := db.LogEvent(database, &workerEventID, db.EventAgentStarted, map[string]any{
-			"chat_id":   task.ChatID,
-			"task_id":   task.ID,
-			"update_id": task.UpdateID,
-			"text":      truncate(task.Text, 1000),
-		})
+// taskPool runs up to size tasks at once. Tasks of one chat run one at a
+// time, in order, because claimNextTask skips chats with a task in
+// progress; tasks of different chats run in parallel.
+type taskPool struct {
+	exec  *executor
+	slots chan struct{}
+	wg    sync.WaitGroup
+
+	// claimMu serializes claims, so two goroutines never race to lease
+	// the same chat.
+	claimMu  sync.Mutex
+	exitOnce sync.Once
+	exiting  atomic.Bool
+}
 
-		if handled, directReply, shouldExit, directErr := processDirectCommand(database, commander, &cfg, task, agentEventID); handled {
-			if directErr != nil {
-				msg := directErr.Error()
-				markTaskFailed(database, task.ID, msg)
-				db.LogEvent(database, &workerEventID, db.EventAgentFailed, map[string]any{
-					"task_id": task.ID,
-					"error":   truncate(msg, 1000),
-				})
-				notify := fmt.Sprintf("任务处理失败：%s", truncate(msg, 600))
-				if err := commander.SendMessage(task.ChatID, notify); err != nil {
-					log.Printf("task %d failed to notify chat_id=%d: %v", task.ID, task.ChatID, err)
-				}
-				log.Printf("task %d failed: %s", task.ID, msg)
-			} else {
-				if strings.TrimSpace(directReply) != "" {
-					if err := commander.SendMessage(task.ChatID, directReply); err != nil {
-						markTaskFailed(database, task.ID, err.Error())
-						db.LogEvent(database, &workerEventID, db.EventAgentFailed, map[string]any{
-							"task_id": task.ID,
-							"error":   truncate(err.Error(), 1000),
-						})
-						log.Printf("task %d failed to send direct reply: %v", task.ID, err)
-						continue
-					}
-				}
-				db.LogEvent(database, &agentEventID, db.EventReplySent, map[string]any{
-					"chat_id": task.ChatID,
-				})
-				markTaskDone(database, task.ID)
-				db.LogEvent(database, &workerEventID, db.EventAgentCompleted, map[string]any{
-					"task_id": task.ID,
-				})
-				appendHistory(database, task.ChatID, "user", task.Text)
-				if strings.TrimSpace(directReply) != "" {
-					appendHistory(database, task.ChatID, "assistant", directReply)
-				}
-				if shouldExit {
-					os.Exit(0)
-				}
+func newTaskPool(exec *executor, size int) *taskPool {
+	return &taskPool{exec: exec, slots: make(chan struct{}, max(size, 1))}
+}
+
+// idle reports whether an executor is free.
+func (p *taskPool) idle() bool {
+	return len(p.slots) < cap(p.slots)
+}
+
+// drained reports whether no task is running.
+func (p *taskPool) drained() bool {
+	return len(p.slots) == 0
+}
+
+// dispatch claims tasks and starts them while executors are free, returning
+// how many it started. A finishing task dispatches again, so a chat's next
+// task starts without waiting for the poll loop. While a breaker is
+// half-open only one task runs at a time: it is the probe that closes or
+// reopens the breaker.
+func (p *taskPool) dispatch() int {
+	p.claimMu.Lock()
+	defer p.claimMu.Unlock()
+	started := 0
+	for !p.exiting.Load() && !p.exec.breakers.Blocked(time.Now()) {
+		if p.exec.breakers.HalfOpen() && !p.drained() {
+			return started
+		}
+		select {
+		case p.slots <- struct{}{}:
+		default:
+			return started
+		}
+		task, err := claimNextTask(p.exec.database, p.exec.policy)
+		if err != nil || task == nil {
+			<-p.slots
+			if err != nil {
+				log.Printf("claim_next_task error: %v", err)
 			}
-			continue
+			return started
 		}
-		processErr := processTask(database, commander, modelProvider, &cfg, task, agentEventID, ctxProvider, ctxCompressor, ctxAssembler, policy, registry, toolRunner)
-		if processErr != nil {
-			msg := processErr.Error()
-			markTaskFailed(database, task.ID, msg)
-			errClass := classifyError(processErr)
-			prevCircuit := circuit.State()
-			circuit.RecordFailure(errClass, time.Now())
-			if prevCircuit != control.CircuitOpen && circuit.State() == control.CircuitOpen {
-				db.LogEvent(database, &workerEventID, db.EventCircuitOpened, map[string]any{
-					"error_class":      errClass,
-					"threshold":        circuit.Threshold,
-					"cooldown_seconds": int(circuit.Cooldown.Seconds()),
-				})
+		started++
+		p.wg.Add(1)
+		go func() {
+			defer p.wg.Done()
+			release := renewLease(p.exec.database, task.ID, p.exec.leaseTTL()/3)
+			exit, code := p.exec.run(task)
+			release()
+			<-p.slots
+			if exit {
+				p.exit(code)
+				return
 			}
+			p.dispatch()
+		}()
+	}
+	return started
+}
 
-			if control.ShouldRetry(policy, int(task.Attempts)) {
-				fp := buildStateFingerprint(database, cfg.HistoryWindow, task.ChatID, task.ID, errClass, "")
-				if progressStalled(database, task.ID, fp, noProgressK) {
-					db.LogEvent(database, &agentEventID, db.EventProgressStalled, map[string]any{
-						"task_id":           task.ID,
-						"k":                 noProgressK,
-						"state_fingerprint": fp,
-					})
-					markTaskExhausted(database, task.ID, msg, policy.MaxRetries)
-					db.LogEvent(database, &workerEventID, db.EventRetryExhausted, map[string]any{
-						"task_id":          task.ID,
-						"attempts":         task.Attempts,
-						"last_error_class": errClass,
-					})
-				} else {
-					backoff := control.RetryBackoffSeconds(int(task.Attempts))
-					db.LogEvent(database, &workerEventID, db.EventRetryScheduled, map[string]any{
-						"task_id":           task.ID,
-						"attempt":           task.Attempts,
-						"backoff_seconds":   backoff,
-						"error_class":       errClass,
-						"state_fingerprint": fp,
-					})
+// exit stops claiming and ends the process with code once the tasks in
+// flight finish. The first requested code wins.
+func (p *taskPool) exit(code int) {
+	p.exitOnce.Do(func() {
+		p.exiting.Store(true)
+		go func() {
+			p.wg.Wait()
+			os.Exit(code)
+		}()
+	})
+}
+
+// leaseTTL is how long the lease on a claimed task lasts unless renewed.
+func (e *executor) leaseTTL() time.Duration {
+	return time.Duration(e.cfg.TaskLeaseSeconds) * time.Second
+}
+
+// renewLease keeps the lease on a running task alive by moving its
+// locked_at forward every interval, until the returned func is called.
+func renewLease(database *sql.DB, taskID int64, every time.Duration) func() {
+	done := make(chan struct{})
+	var wg sync.WaitGroup
+	wg.Add(1)
+	go func() {
+		defer wg.Done()
+		ticker := time.NewTicker(every)
+		defer ticker.Stop()
+		for {
+			select {
+			case <-done:
+				return
+			case <-ticker.C:
+				if _, err := database.Exec("UPDATE inbox SET locked_at = unixepoch() WHERE id = ? AND status = 'in_progress'", taskID); err != nil {
+					log.Printf("[worker] task %d lease renewal failed: %v", taskID, err)
 				}
-			} else {
-				backoff := control.RetryBackoffSeconds(int(task.Attempts))
-				db.LogEvent(database, &workerEventID, db.EventRetryExhausted, map[string]any{
-					"task_id":          task.ID,
-					"attempts":         task.Attempts,
-					"last_error_class": errClass,
-					"last_backoff":     backoff,
-				})
 			}
+		}
+	}()
+	return func() {
+		close(done)
+		wg.Wait()
+	}
+}
+
+// run processes one claimed task. It reports whether the worker should exit
+// once the tasks in flight finish, and with which code.
+func (e *executor) run(task *queueTask) (exit bool, code int) {
+	database, commander, cfg, policy, breakers := e.database, e.commander, e.cfg, e.policy, e.breakers
+	workerEventID := e.workerEventID
+	handled := e.handled.Add(1)
+	log.Printf("process task_id=%d chat_id=%d text=%s", task.ID, task.ChatID, truncate(task.Text, 200))
+
+	// Log agent.started (child of worker process.started).
+	agentEventID, _ := db.LogEvent(database, &workerEventID, db.EventAgentStarted, map[string]any{
+		"chat_id":   task.ChatID,
+		"task_id":   task.ID,
+		"update_id": task.UpdateID,
+		"text":      truncate(task.Text, 1000),
+	})
+
+	if handled, directReply, shouldExit, directErr := processDirectCommand(database, commander, cfg, task, agentEventID); handled {
+		if directErr != nil {
+			msg := directErr.Error()
+			markTaskFailed(database, task.ID, msg, 0)
 			db.LogEvent(database, &workerEventID, db.EventAgentFailed, map[string]any{
 				"task_id": task.ID,
 				"error":   truncate(msg, 1000),
 			})
 			notify := fmt.Sprintf("任务处理失败：%s", truncate(msg, 600))
-			if err := commander.SendMessage(task.ChatID, notify); err != nil {
+			if err := commander.SendMessage(context.Background(), task.ChatID, notify); err != nil {
 				log.Printf("task %d failed to notify chat_id=%d: %v", task.ID, task.ChatID, err)
 			}
 			log.Printf("task %d failed: %s", task.ID, msg)
 		} else {
-			prevCircuit := circuit.State()
-			circuit.RecordSuccess()
-			if prevCircuit != control.CircuitClosed {
-				db.LogEvent(database, &workerEventID, db.EventCircuitClosed, map[string]any{
-					"recovered": true,
-				})
+			if strings.TrimSpace(directReply) != "" {
+				if err := commander.SendMessage(context.Background(), task.ChatID, directReply); err != nil {
+					markTaskFailed(database, task.ID, err.Error(), 0)
+					db.LogEvent(database, &workerEventID, db.EventAgentFailed, map[string]any{
+						"task_id": task.ID,
+						"error":   truncate(err.Error(), 1000),
+					})
+					log.Printf("task %d failed to send direct reply: %v", task.ID, err)
+					return false, 0
+				}
 			}
+			db.LogEvent(database, &agentEventID, db.EventReplySent, map[string]any{
+				"chat_id": task.ChatID,
+			})
 			markTaskDone(database, task.ID)
 			db.LogEvent(database, &workerEventID, db.EventAgentCompleted, map[string]any{
 				"task_id": task.ID,
 			})
+			if !isControlCommand(task.Text) {
+				appendHistory(database, task.ChatID, "user", task.Text)
+				if strings.TrimSpace(directReply) != "" {
+					appendHistory(database, task.ChatID, "assistant", directReply)
+				}
+			}
+			if shouldExit {
+				return true, 0
+			}
+		}
+		return false, 0
+	}
+	limitErr, budgetErr := checkSpendBudget(database, policy, time.Now())
+	if budgetErr != nil {
+		log.Printf("task %d spend budget check failed: %v", task.ID, budgetErr)
+	}
+	if limitErr != nil {
+		recordLimitEvent(database, agentEventID, task.ID, limitErr)
+		markTaskExhausted(database, task.ID, limitErr.Error(), policy.MaxRetries)
+		db.LogEvent(database, &workerEventID, db.EventAgentFailed, map[string]any{
+			"task_id": task.ID,
+			"error":   truncate(limitErr.Error(), 1000),
+		})
+		if err := commander.SendMessage(context.Background(), task.ChatID, budgetExceededReply(limitErr)); err != nil {
+			log.Printf("task %d failed to notify chat_id=%d: %v", task.ID, task.ChatID, err)
+		}
+		log.Printf("task %d rejected: %v", task.ID, limitErr)
+		return false, 0
+	}
+	taskCfg := *cfg
+	taskCfg.SystemPrompt = resolveSystemPrompt(database, agentEventID, e.prompts, cfg, e.registry, task.ChatID)
+	ctx, finish := e.running.start(task)
+	defer finish()
+	processErr := processTask(ctx, database, commander, e.model, &taskCfg, task, agentEventID, e.ctxProvider, e.compressor, e.assembler, policy, e.registry, e.runner)
+	if processErr != nil && e.running.stopped(task.ID) {
+		cancelTask(database, commander, workerEventID, task, agentEventID)
+	} else if processErr != nil {
+		msg := processErr.Error()
+		retryAfter := modelpkg.RetryAfter(processErr)
+		markTaskFailed(database, task.ID, msg, retryAfter)
+		errClass := classifyError(processErr)
+		if tripsCircuit(processErr) {
+			recordCircuitFailure(database, workerEventID, breakers, errClass)
 		}
 
-		if cfg.SuicideEvery > 0 && handledCount%cfg.SuicideEvery == 0 {
-			log.Printf("worker id=%s handled %d messages; exiting intentionally", cfg.WorkerInstanceID, handledCount)
-			os.Exit(17)
+		if !modelpkg.IsRetryable(processErr) {
+			markTaskExhausted(database, task.ID, msg, policy.MaxRetries)
+			db.LogEvent(database, &workerEventID, db.EventRetryExhausted, map[string]any{
+				"task_id":              task.ID,
+				"attempts":             task.Attempts,
+				"last_error_class":     errClass,
+				"provider_error_class": providerErrorClass(processErr),
+				"retryable":            false,
+			})
+		} else if control.ShouldRetry(policy, int(task.Attempts)) {
+			fp := buildStateFingerprint(database, cfg.HistoryWindow, task.ChatID, task.ID, errClass, "")
+			if progressStalled(database, task.ID, fp, noProgressK) {
+				db.LogEvent(database, &agentEventID, db.EventProgressStalled, map[string]any{
+					"task_id":           task.ID,
+					"k":                 noProgressK,
+					"state_fingerprint": fp,
+				})
+				markTaskExhausted(database, task.ID, msg, policy.MaxRetries)
+				db.LogEvent(database, &workerEventID, db.EventRetryExhausted, map[string]any{
+					"task_id":          task.ID,
+					"attempts":         task.Attempts,
+					"last_error_class": errClass,
+				})
+			} else {
+				backoff := control.RetryBackoffSeconds(int(task.Attempts), retryAfter)
+				db.LogEvent(database, &workerEventID, db.EventRetryScheduled, map[string]any{
+					"task_id":              task.ID,
+					"attempt":              task.Attempts,
+					"backoff_seconds":      backoff,
+					"retry_after_seconds":  int(math.Ceil(retryAfter.Seconds())),
+					"error_class":          errClass,
+					"provider_error_class": providerErrorClass(processErr),
+					"state_fingerprint":    fp,
+				})
+			}
+		} else {
+			backoff := control.RetryBackoffSeconds(int(task.Attempts), retryAfter)
+			db.LogEvent(database, &workerEventID, db.EventRetryExhausted, map[string]any{
+				"task_id":              task.ID,
+				"attempts":             task.Attempts,
+				"last_error_class":     errClass,
+				"provider_error_class": providerErrorClass(processErr),
+				"last_backoff":         backoff,
+			})
+		}
+		failedPayload := map[string]any{
+			"task_id": task.ID,
+			"error":   truncate(msg, 1000),
 		}
+		if rerr, ok := router.AsError(processErr); ok {
+			failedPayload["router_failures"] = rerr.Failures
+		}
+		db.LogEvent(database, &workerEventID, db.EventAgentFailed, failedPayload)
+		sendFailureNotice(commander, task, processErr, fmt.Sprintf("任务处理失败：%s", truncate(msg, 600)))
+		log.Printf("task %d failed: %s", task.ID, msg)
+	} else {
+		closeCircuits(database, workerEventID, breakers, taskCircuitClasses...)
+		markTaskDone(database, task.ID)
+		db.LogEvent(database, &workerEventID, db.EventAgentCompleted, map[string]any{
+			"task_id": task.ID,
+		})
+	}
+
+	if cfg.SuicideEvery > 0 && handled%cfg.SuicideEvery == 0 {
+		log.Printf("worker id=%s handled %d messages; exiting intentionally", cfg.WorkerInstanceID, handled)
+		return true, 17
 	}
+	return false, 0
 }
 
 func processTask(
+	ctx context.Context,
 	database *sql.DB,
 	commander cmdpkg.Commander,
 	modelProvider modelpkg.Provider,
@@ -401,8 +674,13 @@ func processTask(
 	policy control.Policy,
 	registry *toolpkg.Registry,
 	runner *toolpkg.Runner,
-) error {
+) (taskErr error) {
 	startedAt := time.Now()
+	// The task context carries the wall-time budget so an over-budget model
+	// call, tool run or send is abandoned mid-request.
+	ctx, cancel := context.WithDeadline(ctx, startedAt.Add(policy.MaxWallTime))
+	defer cancel()
+	ctx = toolpkg.WithChatID(ctx, task.ChatID)
 	usedTurns := 0
 	if err := control.CheckTurnLimit(policy, usedTurns); err != nil {
 		recordLimitEvent(database, agentEventID, task.ID, err)
@@ -413,150 +691,334 @@ func processTask(
 		return err
 	}
 
-	history, err := provider.GetHistory(task.ChatID, cfg.HistoryWindow)
+	session, err := db.ActiveSession(database, task.ChatID)
 	if err != nil {
 		return err
 	}
-	compressed := compressor.Compress(history)
-	messages := assembler.Assemble(cfg.SystemPrompt, compressed, task.Text)
-	toolInstruction := buildToolProtocolInstruction(registry, cfg.ToolAllowedRoots)
-	messages = injectToolInstruction(messages, toolInstruction)
-
-	db.LogEvent(database, &agentEventID, db.EventContextAssembled, map[string]any{
-		"original_count":   len(history),
-		"compressed_count": len(compressed),
-		"max_messages":     cfg.HistoryWindow,
-		"system_tokens":    estimateTokens(cfg.SystemPrompt) + estimateTokens(toolInstruction),
-		"history_tokens":   estimateTokensFromMessages(compressed),
-		"user_tokens":      estimateTokens(task.Text),
-	})
-
-	// Log turn.started.
-	turnEventID, _ := db.LogEvent(database, &agentEventID, db.EventTurnStarted, map[string]any{
-		"model_name": cfg.OpenAIModel,
-	})
-	usedTurns++
-
-	turnStart := time.Now()
-	resp, err := modelProvider.ChatCompletion(messages)
+	var history []ctxpkg.Message
+	qp, retrieving := provider.(ctxpkg.QueryProvider)
+	if retrieving {
+		history, err = qp.GetHistoryFor(ctx, task.ChatID, cfg.HistoryWindow, task.Text)
+	} else {
+		history, err = provider.GetHistory(task.ChatID, cfg.HistoryWindow)
+	}
 	if err != nil {
 		return err
 	}
-	if err := control.CheckWallTime(policy, startedAt, time.Now()); err != nil {
-		recordLimitEvent(database, agentEventID, task.ID, err)
-		return err
+	prices := cost.NewTable(cfg.ModelPrices)
+	totalTokens := 0
+	var activeSummary *db.Summary
+	if s, ok := summarizerOf(compressor); ok {
+		res, err := summarizeHistory(ctx, database, agentEventID, s, modelProvider, cfg, task, history, prices)
+		if err != nil {
+			if ctxErr := taskContextError(ctx, database, agentEventID, task.ID, policy, startedAt); ctxErr != nil {
+				return ctxErr
+			}
+			log.Printf("task %d summarization failed, continuing without it: %v", task.ID, err)
+		}
+		history, activeSummary = res.Messages, res.Summary
+		if res.Created {
+			totalTokens += res.Response.InputTokens + res.Response.OutputTokens
+			if err := control.CheckTokenLimit(policy, totalTokens); err != nil {
+				recordLimitEvent(database, agentEventID, task.ID, err)
+				return err
+			}
+		}
+	}
+	toolCaller, native := modelProvider.(modelpkg.ToolCaller)
+	var toolDefs []modelpkg.ToolDefinition
+	var toolInstruction string
+	toolMode := "text"
+	if native {
+		toolDefs = toolDefinitions(registry)
+		toolInstruction = buildNativeToolInstruction(registry, cfg.ToolAllowedRoots)
+		toolMode = "native"
+	} else {
+		toolInstruction = buildToolProtocolInstruction(registry, cfg.ToolAllowedRoots)
 	}
-	latencyMs := time.Since(turnStart).Milliseconds()
 
-	// Log turn.completed.
-	db.LogEvent(database, &agentEventID, db.EventTurnCompleted, map[string]any{
-		"model_name":    cfg.OpenAIModel,
-		"latency_ms":    latencyMs,
-		"input_tokens":  resp.InputTokens,
-		"output_tokens": resp.OutputTokens,
-	})
-	totalTokens := resp.InputTokens + resp.OutputTokens
-	if err := control.CheckTokenLimit(policy, totalTokens); err != nil {
-		recordLimitEvent(database, agentEventID, task.ID, err)
-		return err
+	var memories []db.Memory
+	if cfg.MemoryTopK > 0 {
+		all, err := db.ListMemories(database, task.ChatID)
+		if err != nil {
+			log.Printf("task %d failed to load memories: %v", task.ID, err)
+		}
+		memories = memory.Rank(all, task.Text, cfg.MemoryTopK)
+	}
+	memoryMessage := memory.Render(memories)
+
+	tok := tokenizer.ForModel(cfg.ModelName())
+	assembled := map[string]any{
+		"session_id":     session.ID,
+		"original_count": len(history),
+		"max_messages":   cfg.HistoryWindow,
+		"tokenizer":      tok.Name(),
+		"tool_mode":      toolMode,
+	}
+	if activeSummary != nil {
+		assembled["summary_id"] = activeSummary.ID
+		assembled["summary_to_history_id"] = activeSummary.ToHistoryID
+	}
+	var compressed []ctxpkg.Message
+	if bc, ok := compressor.(ctxpkg.BudgetCompressor); ok {
+		bare := injectToolInstruction(injectSystemMessage(assembler.Assemble(cfg.SystemPrompt, nil, task.Text), memoryMessage), toolInstruction)
+		reserved := ctxpkg.CountTokens(tok, bare) + toolDefinitionTokens(tok, toolDefs)
+		var report ctxpkg.CompressionReport
+		if chain, ok := compressor.(*ctxpkg.Chain); ok {
+			var stages []ctxpkg.StageReport
+			compressed, report, stages = chain.CompressStages(history, reserved)
+			assembled["stages"] = stagePayloads(stages)
+		} else {
+			compressed, report = bc.CompressWithin(history, reserved)
+		}
+		assembled["budget_tokens"] = report.BudgetTokens
+		assembled["history_budget_tokens"] = report.HistoryBudgetTokens
+		assembled["dropped_count"] = report.DroppedMessages
+		assembled["dropped_tokens"] = report.DroppedTokens
+		assembled["truncated_count"] = report.TruncatedMessages
+		assembled["truncated_tokens"] = report.TruncatedTokens
+		assembled["elided_count"] = report.ElidedMessages
+		assembled["elided_tokens"] = report.ElidedTokens
+	} else {
+		compressed = compressor.Compress(history)
 	}
+	messages := injectToolInstruction(injectSystemMessage(assembler.Assemble(cfg.SystemPrompt, compressed, task.Text), memoryMessage), toolInstruction)
 
-	finalReply := strings.TrimSpace(resp.Content)
-	lastAssistantContent := finalReply
-	toolEnvelope, hasToolProtocol := parseToolProtocol(finalReply)
-	if hasToolProtocol && len(toolEnvelope.ToolCalls) == 0 {
-		finalReply = strings.TrimSpace(toolEnvelope.FinalAnswer)
+	assembled["compressed_count"] = len(compressed)
+	if retrieving {
+		var retrieved []ctxpkg.Message
+		for _, msg := range compressed {
+			if msg.Retrieved {
+				retrieved = append(retrieved, msg)
+			}
+		}
+		assembled["retrieved_count"] = len(retrieved)
+		assembled["retrieved_tokens"] = ctxpkg.CountTokens(tok, retrieved)
 	}
-	for hasToolProtocol && len(toolEnvelope.ToolCalls) > 0 {
-		toolResultsText := executeToolCalls(database, turnEventID, runner, toolEnvelope.ToolCalls)
-		if err := control.CheckTurnLimit(policy, usedTurns); err != nil {
-			recordLimitEvent(database, agentEventID, task.ID, err)
-			return err
+	if len(memories) > 0 {
+		assembled["memory_count"] = len(memories)
+		assembled["memory_tokens"] = tok.Count(memoryMessage)
+	}
+	for _, msg := range messages {
+		if msg.Role == "system" && strings.HasPrefix(msg.Content, repomap.Header) {
+			assembled["repo_map_tokens"] = tok.Count(msg.Content)
 		}
-		usedTurns++
-		messages = append(messages,
-			ctxpkg.Message{Role: "assistant", Content: finalReply},
-			ctxpkg.Message{Role: "user", Content: "Tool results:\n" + toolResultsText + "\nReturn JSON: {\"tool_calls\":[],\"final_answer\":\"...\"}"},
-		)
-		toolTurnEventID, _ := db.LogEvent(database, &agentEventID, db.EventTurnStarted, map[string]any{
-			"model_name": cfg.OpenAIModel,
-		})
-		nextTurnStart := time.Now()
-		nextResp, nextErr := modelProvider.ChatCompletion(messages)
-		if nextErr != nil {
-			return nextErr
-		}
-		db.LogEvent(database, &agentEventID, db.EventTurnCompleted, map[string]any{
-			"model_name":    cfg.OpenAIModel,
-			"latency_ms":    time.Since(nextTurnStart).Milliseconds(),
-			"input_tokens":  nextResp.InputTokens,
-			"output_tokens": nextResp.OutputTokens,
-		})
-		if err := control.CheckWallTime(policy, startedAt, time.Now()); err != nil {
-			recordLimitEvent(database, agentEventID, task.ID, err)
-			return err
+	}
+	assembled["system_tokens"] = tok.Count(cfg.SystemPrompt) + tok.Count(toolInstruction)
+	assembled["history_tokens"] = ctxpkg.CountTokens(tok, compressed)
+	assembled["user_tokens"] = tok.Count(task.Text)
+	db.LogEvent(database, &agentEventID, db.EventContextAssembled, assembled)
+
+	var streamer modelpkg.Streamer
+	var live *liveReply
+	if native && cfg.StreamReplies {
+		if st, ok := modelProvider.(modelpkg.Streamer); ok {
+			if editor, ok := commander.(cmdpkg.MessageEditor); ok {
+				streamer = st
+				live = newLiveReply(ctx, editor, task.ChatID, time.Duration(cfg.StreamEditIntervalMs)*time.Millisecond)
+			}
 		}
-		totalTokens += nextResp.InputTokens + nextResp.OutputTokens
-		if err := control.CheckTokenLimit(policy, totalTokens); err != nil {
-			recordLimitEvent(database, agentEventID, task.ID, err)
-			return err
+	}
+	defer func() {
+		if taskErr != nil && live != nil && live.messageID != 0 {
+			taskErr = &streamedFailure{err: taskErr, messageID: live.messageID}
 		}
-		finalReply = strings.TrimSpace(nextResp.Content)
-		lastAssistantContent = finalReply
-		if parsed, ok := parseToolProtocol(finalReply); ok {
-			toolEnvelope = parsed
-			hasToolProtocol = true
-			if len(parsed.ToolCalls) == 0 {
-				finalReply = strings.TrimSpace(parsed.FinalAnswer)
+	}()
+
+	// runTurn performs one model call bracketed by turn.started/turn.completed
+	// and enforces wall-time and token limits on its result.
+	runTurn := func() (modelpkg.CompletionResponse, int64, error) {
+		if err := taskContextError(ctx, database, agentEventID, task.ID, policy, startedAt); err != nil {
+			return modelpkg.CompletionResponse{}, 0, err
+		}
+		// Earlier turns of this task, and tasks of other chats, spend too, so
+		// the budget checked when the task started may be gone by now.
+		if limitErr, err := checkSpendBudget(database, policy, time.Now()); err != nil {
+			log.Printf("task %d spend budget check failed: %v", task.ID, err)
+		} else if limitErr != nil {
+			recordLimitEvent(database, agentEventID, task.ID, limitErr)
+			return modelpkg.CompletionResponse{}, 0, limitErr
+		}
+		// The backend a router picks is only known once it answers, so it is
+		// logged on turn.completed; turn.started records the chain it tries.
+		startedPayload := map[string]any{"model_name": cfg.ModelName()}
+		if cfg.ModelProvider == "router" {
+			chain := make([]map[string]string, len(cfg.ModelRouterChain))
+			for i, name := range cfg.ModelRouterChain {
+				chain[i] = map[string]string{"backend": name, "model_name": cfg.ModelNameFor(name)}
 			}
-			continue
+			startedPayload["router_chain"] = chain
 		}
-		hasToolProtocol = false
-		_ = toolTurnEventID
-	}
-	if finalReply == "" && hasToolProtocol {
-		if err := control.CheckTurnLimit(policy, usedTurns); err != nil {
-			recordLimitEvent(database, agentEventID, task.ID, err)
-			return err
+		if hash, redacted, err := capturePrompt(database, messages); err != nil {
+			log.Printf("task %d failed to capture prompt: %v", task.ID, err)
+		} else {
+			startedPayload["prompt_blob"] = hash
+			startedPayload["prompt_messages"] = len(messages)
+			if redacted {
+				startedPayload["prompt_redacted"] = true
+			}
 		}
+		turnEventID, _ := db.LogEvent(database, &agentEventID, db.EventTurnStarted, startedPayload)
 		usedTurns++
-		lastTurnEventID, _ := db.LogEvent(database, &agentEventID, db.EventTurnStarted, map[string]any{
-			"model_name": cfg.OpenAIModel,
-		})
-		messages = append(messages,
-			ctxpkg.Message{Role: "assistant", Content: lastAssistantContent},
-			ctxpkg.Message{Role: "user", Content: "Previous final_answer was empty. Return strict JSON with tool_calls=[] and a non-empty final_answer."},
-		)
-		lastTurnStart := time.Now()
-		lastResp, lastErr := modelProvider.ChatCompletion(messages)
-		if lastErr != nil {
-			return lastErr
-		}
-		db.LogEvent(database, &agentEventID, db.EventTurnCompleted, map[string]any{
-			"model_name":    cfg.OpenAIModel,
-			"latency_ms":    time.Since(lastTurnStart).Milliseconds(),
-			"input_tokens":  lastResp.InputTokens,
-			"output_tokens": lastResp.OutputTokens,
-		})
+		turnStart := time.Now()
+		var resp modelpkg.CompletionResponse
+		var err error
+		switch {
+		case streamer != nil:
+			live.beginTurn()
+			resp, err = streamer.ChatCompletionStream(ctx, messages, toolDefs, live.onDelta)
+		case native:
+			resp, err = toolCaller.ChatCompletionWithTools(ctx, messages, toolDefs)
+		default:
+			resp, err = modelProvider.ChatCompletion(ctx, messages)
+		}
+		if err != nil {
+			if ctxErr := taskContextError(ctx, database, agentEventID, task.ID, policy, startedAt); ctxErr != nil {
+				return resp, turnEventID, ctxErr
+			}
+			return resp, turnEventID, err
+		}
+		modelName := cfg.ModelName()
+		if resp.Route != nil {
+			modelName = resp.Route.Model
+		}
+		costUSD, priced := prices.Cost(modelName, resp.InputTokens, resp.OutputTokens)
+		completedPayload := map[string]any{
+			"model_name":    modelName,
+			"latency_ms":    time.Since(turnStart).Milliseconds(),
+			"input_tokens":  resp.InputTokens,
+			"output_tokens": resp.OutputTokens,
+			"cost_usd":      costUSD,
+			"tool_calls":    len(resp.ToolCalls),
+			"streamed":      streamer != nil,
+		}
+		if !priced {
+			completedPayload["price_known"] = false
+		}
+		if resp.Route != nil {
+			completedPayload["backend"] = resp.Route.Backend
+			completedPayload["failovers"] = resp.Route.Failovers
+		}
+		reply, _ := promptMessage(ctxpkg.Message{Role: "assistant", Content: resp.Content, ToolCalls: resp.ToolCalls})
+		if hash, err := db.PutPromptMessage(database, reply); err != nil {
+			log.Printf("task %d failed to capture completion: %v", task.ID, err)
+		} else {
+			completedPayload["completion_blob"] = hash
+		}
+		db.LogEvent(database, &agentEventID, db.EventTurnCompleted, completedPayload)
+		if err := db.RecordSpend(database, task.ChatID, db.SpendDay(time.Now()), costUSD, resp.InputTokens, resp.OutputTokens); err != nil {
+			log.Printf("task %d failed to record spend: %v", task.ID, err)
+		}
 		if err := control.CheckWallTime(policy, startedAt, time.Now()); err != nil {
 			recordLimitEvent(database, agentEventID, task.ID, err)
-			return err
+			return resp, turnEventID, err
 		}
-		totalTokens += lastResp.InputTokens + lastResp.OutputTokens
+		totalTokens += resp.InputTokens + resp.OutputTokens
 		if err := control.CheckTokenLimit(policy, totalTokens); err != nil {
 			recordLimitEvent(database, agentEventID, task.ID, err)
-			return err
+			return resp, turnEventID, err
+		}
+		return resp, turnEventID, nil
+	}
+
+	resp, turnEventID, err := runTurn()
+	if err != nil {
+		return err
+	}
+
+	// toolTurns collects the tool calls and results of this task for history.
+	var toolTurns []ctxpkg.Message
+	var finalReply string
+	if native {
+		for len(resp.ToolCalls) > 0 {
+			assistantMsg := ctxpkg.Message{Role: "assistant", Content: resp.Content, ToolCalls: resp.ToolCalls}
+			toolMsgs := make([]ctxpkg.Message, 0, len(resp.ToolCalls))
+			results := make([]string, 0, len(resp.ToolCalls))
+			for _, call := range resp.ToolCalls {
+				result := executeToolCall(ctx, database, turnEventID, runner, toolCall{Name: call.Name, Arguments: call.Arguments})
+				if strings.TrimSpace(result) == "" {
+					result = "(no output)"
+				}
+				toolMsgs = append(toolMsgs, ctxpkg.Message{Role: "tool", ToolCallID: call.ID, Content: result})
+				results = append(results, result)
+			}
+			toolTurns = append(toolTurns, historyToolTurn(resp.Content, resp.ToolCalls, results, cfg.HistoryToolOutputBytes)...)
+			if err := control.CheckTurnLimit(policy, usedTurns); err != nil {
+				recordLimitEvent(database, agentEventID, task.ID, err)
+				return err
+			}
+			messages = append(messages, assistantMsg)
+			messages = append(messages, toolMsgs...)
+			resp, turnEventID, err = runTurn()
+			if err != nil {
+				return err
+			}
+		}
+		finalReply = strings.TrimSpace(resp.Content)
+	} else {
+		finalReply = strings.TrimSpace(resp.Content)
+		lastAssistantContent := finalReply
+		textCalls := 0
+		toolEnvelope, hasToolProtocol := parseToolProtocol(finalReply)
+		if hasToolProtocol && len(toolEnvelope.ToolCalls) == 0 {
+			finalReply = strings.TrimSpace(toolEnvelope.FinalAnswer)
+		}
+		for hasToolProtocol && len(toolEnvelope.ToolCalls) > 0 {
+			toolResultsText, results := executeToolCalls(ctx, database, turnEventID, runner, toolEnvelope.ToolCalls)
+			// The text protocol has no call ids; number them within the task.
+			calls := make([]ctxpkg.ToolCall, len(toolEnvelope.ToolCalls))
+			for i, c := range toolEnvelope.ToolCalls {
+				textCalls++
+				calls[i] = ctxpkg.ToolCall{ID: fmt.Sprintf("call_%d", textCalls), Name: strings.TrimSpace(c.Name), Arguments: c.Arguments}
+			}
+			toolTurns = append(toolTurns, historyToolTurn("", calls, results, cfg.HistoryToolOutputBytes)...)
+			if err := control.CheckTurnLimit(policy, usedTurns); err != nil {
+				recordLimitEvent(database, agentEventID, task.ID, err)
+				return err
+			}
+			messages = append(messages,
+				ctxpkg.Message{Role: "assistant", Content: finalReply},
+				ctxpkg.Message{Role: "user", Content: "Tool results:\n" + toolResultsText + "\nReturn JSON: {\"tool_calls\":[],\"final_answer\":\"...\"}"},
+			)
+			resp, turnEventID, err = runTurn()
+			if err != nil {
+				return err
+			}
+			finalReply = strings.TrimSpace(resp.Content)
+			lastAssistantContent = finalReply
+			if parsed, ok := parseToolProtocol(finalReply); ok {
+				toolEnvelope = parsed
+				hasToolProtocol = true
+				if len(parsed.ToolCalls) == 0 {
+					finalReply = strings.TrimSpace(parsed.FinalAnswer)
+				}
+				continue
+			}
+			hasToolProtocol = false
 		}
-		finalReply = strings.TrimSpace(lastResp.Content)
-		if parsed, ok := parseToolProtocol(finalReply); ok {
-			finalReply = strings.TrimSpace(parsed.FinalAnswer)
+		if finalReply == "" && hasToolProtocol {
+			if err := control.CheckTurnLimit(policy, usedTurns); err != nil {
+				recordLimitEvent(database, agentEventID, task.ID, err)
+				return err
+			}
+			messages = append(messages,
+				ctxpkg.Message{Role: "assistant", Content: lastAssistantContent},
+				ctxpkg.Message{Role: "user", Content: "Previous final_answer was empty. Return strict JSON with tool_calls=[] and a non-empty final_answer."},
+			)
+			resp, _, err = runTurn()
+			if err != nil {
+				return err
+			}
+			finalReply = strings.TrimSpace(resp.Content)
+			if parsed, ok := parseToolProtocol(finalReply); ok {
+				finalReply = strings.TrimSpace(parsed.FinalAnswer)
+			}
 		}
-		_ = lastTurnEventID
 	}
 	if finalReply == "" {
 		return fmt.Errorf("validation: empty final reply")
 	}
-	if err := commander.SendMessage(task.ChatID, finalReply); err != nil {
+	if err := deliverReply(ctx, commander, live, task.ChatID, finalReply); err != nil {
 		return err
 	}
 
@@ -565,11 +1027,356 @@ func processTask(
 		"chat_id": task.ChatID,
 	})
 
-	appendHistory(database, task.ChatID, "user", task.Text)
-	appendHistory(database, task.ChatID, "assistant", finalReply)
+	turns := []ctxpkg.Message{{Role: "user", Content: task.Text}}
+	if cfg.HistoryToolOutputBytes > 0 {
+		turns = append(turns, toolTurns...)
+	}
+	turns = append(turns, ctxpkg.Message{Role: "assistant", Content: finalReply})
+	if err := appendHistoryMessages(database, task.ChatID, turns); err != nil {
+		log.Printf("task %d failed to append history: %v", task.ID, err)
+	}
+	if ix, ok := provider.(historyIndexer); ok {
+		if _, err := ix.IndexHistory(ctx); err != nil {
+			log.Printf("task %d failed to embed history: %v", task.ID, err)
+		}
+	}
 	return nil
 }
 
+// historyIndexer is implemented by providers that embed history rows after
+// they are written.
+type historyIndexer interface {
+	IndexHistory(ctx context.Context) (int, error)
+}
+
+// backfillEmbeddings embeds history written before embeddings were enabled
+// and, when file retrieval is on, the workspace files. It runs once at
+// startup; later history is embedded as tasks append it.
+func backfillEmbeddings(indexer *vector.Indexer, cfg *config.WorkerConfig) {
+	ctx := context.Background()
+	n, err := indexer.IndexHistory(ctx)
+	if err != nil {
+		log.Printf("[worker] history embedding backfill failed after %d rows: %v", n, err)
+	} else if n > 0 {
+		log.Printf("[worker] embedded %d history rows", n)
+	}
+	if cfg.SemanticFileTopK <= 0 {
+		return
+	}
+	n, err = indexer.IndexFiles(ctx, cfg.WorkspaceDir)
+	if err != nil {
+		log.Printf("[worker] workspace embedding failed after %d chunks: %v", n, err)
+		return
+	}
+	log.Printf("[worker] embedded %d workspace file chunks from %s", n, cfg.WorkspaceDir)
+}
+
+// historyToolTurn builds the history form of one assistant tool-call message
+// and its results: arguments are redacted and results capped to maxBytes.
+func historyToolTurn(content string, calls []ctxpkg.ToolCall, results []string, maxBytes int) []ctxpkg.Message {
+	stored := make([]ctxpkg.ToolCall, len(calls))
+	for i, call := range calls {
+		args, _ := redact.Secrets(string(call.Arguments))
+		if !json.Valid([]byte(args)) {
+			args = "{}"
+		}
+		stored[i] = ctxpkg.ToolCall{ID: call.ID, Name: call.Name, Arguments: json.RawMessage(args)}
+	}
+	out := []ctxpkg.Message{{Role: "assistant", Content: content, ToolCalls: stored}}
+	for i, call := range stored {
+		result := ctxpkg.MissingToolOutput
+		if i < len(results) {
+			result = ctxpkg.CapToolOutput(results[i], maxBytes)
+		}
+		out = append(out, ctxpkg.Message{Role: "tool", ToolCallID: call.ID, Content: result})
+	}
+	return out
+}
+
+// historySummarizer is implemented by compressors that fold old history into
+// a persisted summary with a model call before compressing.
+type historySummarizer interface {
+	Summarize(ctx context.Context, chatID int64, history []ctxpkg.Message, call summary.Caller) (summary.Result, error)
+}
+
+// summarizerOf returns the compressor's summarization step: the compressor
+// itself or, for a chain, its summarize stage. Summarization needs a model
+// call, so it runs before the chain whatever the stage's position.
+func summarizerOf(compressor ctxpkg.Compressor) (historySummarizer, bool) {
+	if chain, ok := compressor.(*ctxpkg.Chain); ok {
+		for _, st := range chain.Stages {
+			if s, ok := st.Compressor.(historySummarizer); ok {
+				return s, true
+			}
+		}
+		return nil, false
+	}
+	s, ok := compressor.(historySummarizer)
+	return s, ok
+}
+
+// contextStages returns the configured context stage chain or, when none is
+// configured, the one the other settings imply: summarize when summaries are
+// enabled, then token_budget when the model has a budget and window
+// otherwise.
+func contextStages(cfg *config.WorkerConfig) []string {
+	if len(cfg.ContextStages) > 0 {
+		return cfg.ContextStages
+	}
+	var names []string
+	if cfg.SummaryThreshold > 0 {
+		names = append(names, "summarize")
+	}
+	if cfg.ContextTokenBudgetFor(cfg.ModelName()) > 0 {
+		return append(names, "token_budget")
+	}
+	return append(names, "window")
+}
+
+// newContextChain builds the context stage chain. maxMessages is the history
+// window plus the room retrieval adds to it.
+func newContextChain(cfg *config.WorkerConfig, database *sql.DB, maxMessages int) (*ctxpkg.Chain, error) {
+	tok := tokenizer.ForModel(cfg.ModelName())
+	registry := ctxpkg.NewStageRegistry()
+	for name, f := range map[string]ctxpkg.StageFactory{
+		"window": func() (ctxpkg.Compressor, error) {
+			return &ctxpkg.SimpleCompressor{MaxMessages: maxMessages}, nil
+		},
+		"dedupe": func() (ctxpkg.Compressor, error) {
+			return &ctxpkg.Deduper{Tokenizer: tok}, nil
+		},
+		"truncate_long": func() (ctxpkg.Compressor, error) {
+			return &ctxpkg.LongMessageTruncator{Tokenizer: tok, MaxTokens: cfg.ContextMaxMessageTokens}, nil
+		},
+		"token_budget": func() (ctxpkg.Compressor, error) {
+			return &ctxpkg.TokenBudgetCompressor{Tokenizer: tok, BudgetTokens: cfg.ContextTokenBudgetFor(cfg.ModelName())}, nil
+		},
+		"summarize": func() (ctxpkg.Compressor, error) {
+			if cfg.SummaryThreshold <= 0 {
+				return nil, fmt.Errorf("AUTONOUS_SUMMARY_THRESHOLD is 0")
+			}
+			return &summary.Compressor{DB: database, Threshold: cfg.SummaryThreshold, Keep: cfg.SummaryKeep}, nil
+		},
+	} {
+		if err := registry.Register(name, f); err != nil {
+			return nil, err
+		}
+	}
+	return registry.Chain(tok, contextStages(cfg))
+}
+
+// stagePayloads renders the per-stage reports of context.assembled, leaving
+// out counts a stage did not touch.
+func stagePayloads(stages []ctxpkg.StageReport) []map[string]any {
+	out := make([]map[string]any, 0, len(stages))
+	for _, st := range stages {
+		p := map[string]any{
+			"name":       st.Name,
+			"in_count":   st.InCount,
+			"out_count":  st.OutCount,
+			"in_tokens":  st.InTokens,
+			"out_tokens": st.OutTokens,
+		}
+		for key, v := range map[string]int{
+			"dropped_count":    st.Report.DroppedMessages,
+			"dropped_tokens":   st.Report.DroppedTokens,
+			"truncated_count":  st.Report.TruncatedMessages,
+			"truncated_tokens": st.Report.TruncatedTokens,
+			"elided_count":     st.Report.ElidedMessages,
+			"elided_tokens":    st.Report.ElidedTokens,
+		} {
+			if v != 0 {
+				p[key] = v
+			}
+		}
+		out = append(out, p)
+	}
+	return out
+}
+
+// summarizeHistory runs the compressor's summarization step. Its model call
+// is logged as summary.* events under the agent run and its spend recorded
+// like a turn's. On error the result still holds usable history.
+func summarizeHistory(
+	ctx context.Context,
+	database *sql.DB,
+	agentEventID int64,
+	s historySummarizer,
+	modelProvider modelpkg.Provider,
+	cfg *config.WorkerConfig,
+	task *queueTask,
+	history []ctxpkg.Message,
+	prices *cost.Table,
+) (summary.Result, error) {
+	called := false
+	var callStart time.Time
+	res, err := s.Summarize(ctx, task.ChatID, history, func(ctx context.Context, messages []ctxpkg.Message) (modelpkg.CompletionResponse, error) {
+		called, callStart = true, time.Now()
+		db.LogEvent(database, &agentEventID, db.EventSummaryStarted, map[string]any{"model_name": cfg.ModelName()})
+		return modelProvider.ChatCompletion(ctx, messages)
+	})
+	if err != nil {
+		if called {
+			db.LogEvent(database, &agentEventID, db.EventSummaryFailed, map[string]any{"error": err.Error()})
+		}
+		return res, err
+	}
+	if !res.Created {
+		return res, nil
+	}
+	resp := res.Response
+	modelName := cfg.ModelName()
+	if resp.Route != nil {
+		modelName = resp.Route.Model
+	}
+	costUSD, priced := prices.Cost(modelName, resp.InputTokens, resp.OutputTokens)
+	payload := map[string]any{
+		"model_name":      modelName,
+		"latency_ms":      time.Since(callStart).Milliseconds(),
+		"input_tokens":    resp.InputTokens,
+		"output_tokens":   resp.OutputTokens,
+		"cost_usd":        costUSD,
+		"summary_id":      res.Summary.ID,
+		"from_history_id": res.Summary.FromHistoryID,
+		"to_history_id":   res.Summary.ToHistoryID,
+		"folded_count":    res.Folded,
+	}
+	if !priced {
+		payload["price_known"] = false
+	}
+	db.LogEvent(database, &agentEventID, db.EventSummaryCompleted, payload)
+	if err := db.RecordSpend(database, task.ChatID, db.SpendDay(time.Now()), costUSD, resp.InputTokens, resp.OutputTokens); err != nil {
+		log.Printf("task %d failed to record summary spend: %v", task.ID, err)
+	}
+	return res, nil
+}
+
+const liveReplyPlaceholder = "正在生成回复…"
+
+// liveReplyMoved replaces a placeholder that could not be edited into the
+// reply, which then arrives as a separate message.
+const liveReplyMoved = "回复见下一条消息。"
+
+// liveReply mirrors a streamed completion into a single chat message: a
+// placeholder is sent on the first delta and then edited at most once per
+// interval as more content arrives.
+type liveReply struct {
+	ctx       context.Context
+	editor    cmdpkg.MessageEditor
+	chatID    int64
+	interval  time.Duration
+	messageID int64
+	failed    bool
+	buf       strings.Builder
+	lastText  string
+	lastEdit  time.Time
+}
+
+func newLiveReply(ctx context.Context, editor cmdpkg.MessageEditor, chatID int64, interval time.Duration) *liveReply {
+	return &liveReply{ctx: ctx, editor: editor, chatID: chatID, interval: interval}
+}
+
+// beginTurn resets the buffered content so each model turn is shown on its own.
+func (l *liveReply) beginTurn() {
+	l.buf.Reset()
+}
+
+func (l *liveReply) onDelta(delta string) {
+	if l.failed {
+		return
+	}
+	l.buf.WriteString(delta)
+	if l.messageID == 0 {
+		id, err := l.editor.SendMessageWithID(l.ctx, l.chatID, liveReplyPlaceholder)
+		if err != nil {
+			log.Printf("live reply placeholder failed chat_id=%d: %v", l.chatID, err)
+			l.failed = true
+			return
+		}
+		l.messageID = id
+		l.lastText = liveReplyPlaceholder
+		l.lastEdit = time.Now()
+		return
+	}
+	if time.Since(l.lastEdit) < l.interval {
+		return
+	}
+	l.edit(strings.TrimSpace(l.buf.String()))
+}
+
+func (l *liveReply) edit(text string) error {
+	if text == "" || text == l.lastText {
+		return nil
+	}
+	l.lastEdit = time.Now()
+	if err := l.editor.EditMessageText(l.ctx, l.chatID, l.messageID, text); err != nil {
+		log.Printf("live reply edit failed chat_id=%d message_id=%d: %v", l.chatID, l.messageID, err)
+		l.failed = true
+		return err
+	}
+	l.lastText = text
+	return nil
+}
+
+// streamingUnavailable explains why AUTONOUS_STREAM_REPLIES has no effect
+// with this commander and provider, or returns "" when replies can stream.
+func streamingUnavailable(commander cmdpkg.Commander, provider modelpkg.Provider) string {
+	_, native := provider.(modelpkg.ToolCaller)
+	_, streams := provider.(modelpkg.Streamer)
+	if !native || !streams {
+		return fmt.Sprintf("model provider %T does not stream native tool calls", provider)
+	}
+	if _, ok := commander.(cmdpkg.MessageEditor); !ok {
+		return fmt.Sprintf("commander %T cannot edit messages", commander)
+	}
+	return ""
+}
+
+// streamedFailure is returned by processTask when it fails after a streamed
+// reply put its placeholder in the chat, so the failure notice can replace
+// the placeholder instead of arriving as a second message.
+type streamedFailure struct {
+	err       error
+	messageID int64
+}
+
+func (e *streamedFailure) Error() string { return e.err.Error() }
+func (e *streamedFailure) Unwrap() error { return e.err }
+
+// sendFailureNotice tells the chat its task failed, editing the streamed
+// reply's placeholder into the notice when err carries one.
+func sendFailureNotice(commander cmdpkg.Commander, task *queueTask, err error, notice string) {
+	var streamed *streamedFailure
+	if errors.As(err, &streamed) {
+		if editor, ok := commander.(cmdpkg.MessageEditor); ok {
+			editErr := editor.EditMessageText(context.Background(), task.ChatID, streamed.messageID, notice)
+			if editErr == nil {
+				return
+			}
+			log.Printf("task %d failed to edit reply into failure notice chat_id=%d: %v", task.ID, task.ChatID, editErr)
+		}
+	}
+	if err := commander.SendMessage(context.Background(), task.ChatID, notice); err != nil {
+		log.Printf("task %d failed to notify chat_id=%d: %v", task.ID, task.ChatID, err)
+	}
+}
+
+// deliverReply sends the final reply, replacing the live placeholder when one
+// was shown and falling back to a regular message otherwise. A placeholder
+// that could not be edited is pointed at the regular message so the chat is
+// not left with a stale partial reply.
+func deliverReply(ctx context.Context, commander cmdpkg.Commander, live *liveReply, chatID int64, text string) error {
+	if live != nil && live.messageID != 0 {
+		if !live.failed && live.edit(text) == nil {
+			return nil
+		}
+		if err := live.editor.EditMessageText(ctx, chatID, live.messageID, liveReplyMoved); err != nil {
+			log.Printf("live reply pointer edit failed chat_id=%d message_id=%d: %v", chatID, live.messageID, err)
+		}
+	}
+	return commander.SendMessage(ctx, chatID, text)
+}
+
 type toolCall struct {
 	Name      string          `json:"name"`
 	Arguments json.RawMessage `json:"arguments"`
@@ -596,6 +1403,22 @@ func parseToolProtocol(content string) (toolProtocol, bool) {
 }
 
 func buildToolProtocolInstruction(registry *toolpkg.Registry, allowedRoots string) string {
+	return buildToolGuidance(registry, allowedRoots) +
+		"Always respond with strict JSON: " +
+		"{\"tool_calls\":[{\"name\":\"...\",\"arguments\":{...}}],\"final_answer\":\"...\"}. " +
+		"If a tool is needed, set final_answer to empty and fill tool_calls. " +
+		"If no tool is needed, set tool_calls to [] and provide final_answer."
+}
+
+// buildNativeToolInstruction is the tool guidance for providers that declare
+// tools through native function calling, so no JSON reply format is imposed.
+func buildNativeToolInstruction(registry *toolpkg.Registry, allowedRoots string) string {
+	return buildToolGuidance(registry, allowedRoots) +
+		"Call tools through function calling when needed. " +
+		"When no tool is needed, reply to the user directly in plain text."
+}
+
+func buildToolGuidance(registry *toolpkg.Registry, allowedRoots string) string {
 	names := registry.MustList()
 	toolNames := make([]string, 0, len(names))
 	for _, meta := range names {
@@ -611,18 +1434,43 @@ func buildToolProtocolInstruction(registry *toolpkg.Registry, allowedRoots strin
 		"For ls/find/read/write/edit, arguments must include a valid \"path\". " +
 		"Use \".\" for current directory; never use \"/\". " +
 		"For read, always set \"limit\" > 0 and optional \"offset\" >= 0. " +
-		"For write, always set non-empty \"content\". " +
-		"Always respond with strict JSON: " +
-		"{\"tool_calls\":[{\"name\":\"...\",\"arguments\":{...}}],\"final_answer\":\"...\"}. " +
-		"If a tool is needed, set final_answer to empty and fill tool_calls. " +
-		"If no tool is needed, set tool_calls to [] and provide final_answer."
+		"For write, always set non-empty \"content\". "
+}
+
+func toolDefinitions(registry *toolpkg.Registry) []modelpkg.ToolDefinition {
+	defs := registry.Definitions()
+	out := make([]modelpkg.ToolDefinition, 0, len(defs))
+	for _, d := range defs {
+		out = append(out, modelpkg.ToolDefinition{
+			Name:        d.Name,
+			Description: d.Description,
+			Parameters:  d.Parameters,
+		})
+	}
+	return out
+}
+
+// toolDefinitionTokens approximates the prompt tokens native tool schemas
+// cost.
+func toolDefinitionTokens(tok tokenizer.Tokenizer, defs []modelpkg.ToolDefinition) int {
+	n := 0
+	for _, def := range defs {
+		n += tok.Count(def.Name) + tok.Count(def.Description) + tok.Count(string(def.Parameters))
+	}
+	return n
 }
 
 func injectToolInstruction(messages []ctxpkg.Message, instruction string) []ctxpkg.Message {
-	if strings.TrimSpace(instruction) == "" {
+	return injectSystemMessage(messages, instruction)
+}
+
+// injectSystemMessage inserts content as a system message right after the
+// system prompt, or first when there is none. Empty content is skipped.
+func injectSystemMessage(messages []ctxpkg.Message, content string) []ctxpkg.Message {
+	if strings.TrimSpace(content) == "" {
 		return messages
 	}
-	inst := ctxpkg.Message{Role: "system", Content: instruction}
+	inst := ctxpkg.Message{Role: "system", Content: content}
 	if len(messages) == 0 {
 		return []ctxpkg.Message{inst}
 	}
@@ -638,73 +1486,82 @@ func injectToolInstruction(messages []ctxpkg.Message, instruction string) []ctxp
 	return out
 }
 
-func executeToolCalls(database *sql.DB, turnEventID int64, runner *toolpkg.Runner, calls []toolCall) string {
+func executeToolCalls(ctx context.Context, database *sql.DB, turnEventID int64, runner *toolpkg.Runner, calls []toolCall) (string, []string) {
 	var out strings.Builder
+	results := make([]string, 0, len(calls))
 	for _, c := range calls {
-		toolName := strings.TrimSpace(c.Name)
-		argsText, argsRedacted := redactSecrets(string(c.Arguments))
-		if toolName == "" {
-			toolEventID, _ := db.LogEvent(database, &turnEventID, db.EventToolCallStarted, map[string]any{
-				"tool_name": "",
-				"arguments": truncate(argsText, 500),
-			})
-			errText := "validation: empty tool name"
-			errText, errRedacted := redactSecrets(errText)
-			db.LogEvent(database, &toolEventID, db.EventToolCallFailed, map[string]any{
-				"tool_name":   "",
-				"error":       errText,
-				"error_class": "validation",
-				"redacted":    argsRedacted || errRedacted,
-			})
-			out.WriteString("tool=\n")
-			out.WriteString("error:\n" + errText + "\n")
-			continue
-		}
+		result := executeToolCall(ctx, database, turnEventID, runner, c)
+		out.WriteString("tool=" + strings.TrimSpace(c.Name) + "\n")
+		out.WriteString(result)
+		results = append(results, result)
+	}
+	return out.String(), results
+}
+
+// executeToolCall runs one tool call, records its events under turnEventID and
+// returns the redacted result text (error/stdout/stderr sections).
+func executeToolCall(ctx context.Context, database *sql.DB, turnEventID int64, runner *toolpkg.Runner, c toolCall) string {
+	var out strings.Builder
+	toolName := strings.TrimSpace(c.Name)
+	argsText, argsRedacted := redact.Secrets(string(c.Arguments))
+	if toolName == "" {
 		toolEventID, _ := db.LogEvent(database, &turnEventID, db.EventToolCallStarted, map[string]any{
-			"tool_name": toolName,
+			"tool_name": "",
 			"arguments": truncate(argsText, 500),
 		})
-		started := time.Now()
-		res, err := runner.RunOne(context.Background(), toolpkg.Call{
-			Name:      toolName,
-			Arguments: c.Arguments,
+		errText := "validation: empty tool name"
+		errText, errRedacted := redact.Secrets(errText)
+		db.LogEvent(database, &toolEventID, db.EventToolCallFailed, map[string]any{
+			"tool_name":   "",
+			"error":       errText,
+			"error_class": "validation",
+			"redacted":    argsRedacted || errRedacted,
 		})
-		stdoutText, stdoutRedacted := redactSecrets(res.Stdout)
-		stderrText, stderrRedacted := redactSecrets(res.Stderr)
-		if err != nil {
-			errText, errRedacted := redactSecrets(err.Error())
-			errClass := classifyToolError(err)
-			redacted := argsRedacted || errRedacted || stdoutRedacted || stderrRedacted
-			db.LogEvent(database, &toolEventID, db.EventToolCallFailed, map[string]any{
-				"tool_name":   toolName,
-				"error":       truncate(errText, 500),
-				"error_class": errClass,
-				"redacted":    redacted,
-			})
-			out.WriteString("tool=" + toolName + "\n")
-			out.WriteString("error:\n" + truncate(errText, 2000) + "\n")
-			if strings.TrimSpace(stdoutText) != "" {
-				out.WriteString("stdout:\n" + stdoutText + "\n")
-			}
-			if strings.TrimSpace(stderrText) != "" {
-				out.WriteString("stderr:\n" + stderrText + "\n")
-			}
-			continue
-		}
-		db.LogEvent(database, &toolEventID, db.EventToolCallDone, map[string]any{
-			"tool_name":       toolName,
-			"latency_ms":      time.Since(started).Milliseconds(),
-			"exit_code":       res.ExitCode,
-			"truncated_lines": res.TruncatedLines,
-			"truncated_bytes": res.TruncatedBytes,
+		out.WriteString("error:\n" + errText + "\n")
+		return out.String()
+	}
+	toolEventID, _ := db.LogEvent(database, &turnEventID, db.EventToolCallStarted, map[string]any{
+		"tool_name": toolName,
+		"arguments": truncate(argsText, 500),
+	})
+	started := time.Now()
+	res, err := runner.RunOne(toolpkg.WithEventID(ctx, toolEventID), toolpkg.Call{
+		Name:      toolName,
+		Arguments: c.Arguments,
+	})
+	stdoutText, stdoutRedacted := redact.Secrets(res.Stdout)
+	stderrText, stderrRedacted := redact.Secrets(res.Stderr)
+	if err != nil {
+		errText, errRedacted := redact.Secrets(err.Error())
+		errClass := classifyToolError(err)
+		redacted := argsRedacted || errRedacted || stdoutRedacted || stderrRedacted
+		db.LogEvent(database, &toolEventID, db.EventToolCallFailed, map[string]any{
+			"tool_name":   toolName,
+			"error":       truncate(errText, 500),
+			"error_class": errClass,
+			"redacted":    redacted,
 		})
-		out.WriteString("tool=" + toolName + "\n")
+		out.WriteString("error:\n" + truncate(errText, 2000) + "\n")
 		if strings.TrimSpace(stdoutText) != "" {
 			out.WriteString("stdout:\n" + stdoutText + "\n")
 		}
 		if strings.TrimSpace(stderrText) != "" {
 			out.WriteString("stderr:\n" + stderrText + "\n")
 		}
+		return out.String()
+	}
+	db.LogEvent(database, &toolEventID, db.EventToolCallDone, map[string]any{
+		"tool_name":       toolName,
+		"latency_ms":      time.Since(started).Milliseconds(),
+		"exit_code":       res.ExitCode,
+		"truncated_lines": res.TruncatedLines,
+		"truncated_bytes": res.TruncatedBytes,
+	})
+	if strings.TrimSpace(stdoutText) != "" {
+		out.WriteString("stdout:\n" + stdoutText + "\n")
+	}
+	if strings.TrimSpace(stderrText) != "" {
+		out.WriteString("stderr:\n" + stderrText + "\n")
 	}
 	return out.String()
 }
@@ -713,26 +1570,7 @@ func classifyToolError(err error) string {
 	if err == nil {
 		return "unknown"
 	}
-	if errors.Is(err, context.DeadlineExceeded) {
-		return "timeout"
-	}
-	msg := strings.ToLower(err.Error())
-	switch {
-	case strings.Contains(msg, "deadline exceeded"), strings.Contains(msg, "timeout"):
-		return "timeout"
-	case strings.Contains(msg, "outside allowlist"), strings.Contains(msg, "denied by policy"):
-		return "policy"
-	case strings.Contains(msg, "validation"), strings.Contains(msg, "required"), strings.Contains(msg, "invalid"), strings.Contains(msg, "unknown tool"), strings.Contains(msg, "must be"):
-		return "validation"
-	default:
-		return "tool_exec"
-	}
-}
-
-var secretPatterns = []*regexp.Regexp{
-	regexp.MustCompile(`(?i)\bBearer\s+[A-Za-z0-9._\-=/+]+`),
-	regexp.MustCompile(`(?i)\b(sk-[A-Za-z0-9\-_]{8,})\b`),
-	regexp.MustCompile(`(?i)\b([A-Za-z0-9_]*(TOKEN|SECRET|PASSWORD|API_KEY))\b\s*[:=]\s*["']?([^\s"']+)`),
+	return string(toolpkg.ClassOf(err))
 }
 
 var approveCommandPattern = regexp.MustCompile(`(?i)^\s*approve\s+([a-z0-9-]+)\s*$`)
@@ -740,25 +1578,43 @@ var updateStageCommandPattern = regexp.MustCompile(`(?i)^\s*update\s+stage\s+([a
 var cancelCommandPattern = regexp.MustCompile(`(?i)^\s*cancel\s+([a-z0-9-]+)\s*$`)
 var rollbackCommandPattern = regexp.MustCompile(`(?i)^\s*rollback\s+([a-z0-9-]+)\s*$`)
 
-func redactSecrets(text string) (string, bool) {
-	out := text
-	redacted := false
-	for _, p := range secretPatterns {
-		next := p.ReplaceAllStringFunc(out, func(m string) string {
-			redacted = true
-			parts := strings.SplitN(m, "=", 2)
-			if len(parts) == 2 && strings.Contains(m, "=") {
-				return parts[0] + "=***REDACTED***"
-			}
-			if strings.Contains(m, ":") {
-				kv := strings.SplitN(m, ":", 2)
-				return kv[0] + ": ***REDACTED***"
-			}
-			return "***REDACTED***"
-		})
-		out = next
+// Session commands accept Telegram's /command@botname form.
+var newSessionCommandPattern = regexp.MustCompile(`(?i)^\s*/new(?:@\w+)?\s*$`)
+var sessionsCommandPattern = regexp.MustCompile(`(?i)^\s*/sessions(?:@\w+)?\s*$`)
+var resumeCommandPattern = regexp.MustCompile(`(?i)^\s*/resume(?:@\w+)?(?:\s+(\S+))?\s*$`)
+
+var statusCommandPattern = regexp.MustCompile(`(?i)^\s*/status(?:@\w+)?\s*$`)
+var stopCommandPattern = regexp.MustCompile(`(?i)^\s*/stop(?:@\w+)?(?:\s+(\S+))?\s*$`)
+
+// sessionListLimit is the number of sessions /sessions shows.
+const sessionListLimit = 10
+
+// capturePrompt stores the exact messages of a model call, with secrets
+// redacted, and returns the prompt's blob hash and whether anything was
+// redacted.
+func capturePrompt(database *sql.DB, messages []ctxpkg.Message) (string, bool, error) {
+	captured := make([]db.PromptMessage, 0, len(messages))
+	anyRedacted := false
+	for _, msg := range messages {
+		m, redacted := promptMessage(msg)
+		captured = append(captured, m)
+		anyRedacted = anyRedacted || redacted
 	}
-	return out, redacted
+	hash, err := db.PutPrompt(database, captured)
+	return hash, anyRedacted, err
+}
+
+// promptMessage converts msg for capture, redacting its content and tool
+// call arguments.
+func promptMessage(msg ctxpkg.Message) (db.PromptMessage, bool) {
+	content, redacted := redact.Secrets(msg.Content)
+	m := db.PromptMessage{Role: msg.Role, Content: content, ToolCallID: msg.ToolCallID}
+	for _, call := range msg.ToolCalls {
+		args, argsRedacted := redact.Secrets(string(call.Arguments))
+		redacted = redacted || argsRedacted
+		m.ToolCalls = append(m.ToolCalls, db.PromptToolCall{ID: call.ID, Name: call.Name, Arguments: args})
+	}
+	return m, redacted
 }
 
 func extractJSONObject(content string) (string, bool) {
@@ -809,6 +1665,26 @@ func extractJSONObject(content string) (string, bool) {
 
 func processDirectCommand(database *sql.DB, commander cmdpkg.Commander, cfg *config.WorkerConfig, task *queueTask, agentEventID int64) (handled bool, reply string, shouldExit bool, err error) {
 	text := strings.TrimSpace(task.Text)
+	if isSessionCommand(text) {
+		reply, err := processSessionCommand(database, task.ChatID, text, agentEventID)
+		return true, reply, false, err
+	}
+	if statusCommandPattern.MatchString(text) {
+		circuits, err := circuitStatusReply(database, cfg, time.Now())
+		if err != nil {
+			return true, "", false, err
+		}
+		spend, err := spendStatusReply(database, task.ChatID)
+		if err != nil {
+			return true, "", false, err
+		}
+		return true, circuits + "\n" + spend, false, nil
+	}
+	if stopCommandPattern.MatchString(text) {
+		// /stop is handled while polling; one that reached the queue found
+		// nothing of its chat running.
+		return true, "当前没有正在执行的任务。", false, nil
+	}
 	if m := updateStageCommandPattern.FindStringSubmatch(text); len(m) == 2 {
 		txID := strings.TrimSpace(strings.ToLower(m[1]))
 		if txID == "" {
@@ -820,9 +1696,9 @@ func processDirectCommand(database *sql.DB, commander cmdpkg.Commander, cfg *con
 		}
 		if strings.HasPrefix(stageReply, "update stage 成功") {
 			if requester, ok := commander.(interface {
-				SendApprovalRequest(chatID int64, text string, txID string) error
+				SendApprovalRequest(ctx context.Context, chatID int64, text string, txID string) error
 			}); ok {
-				if err := requester.SendApprovalRequest(task.ChatID, stageReply, txID); err != nil {
+				if err := requester.SendApprovalRequest(context.Background(), task.ChatID, stageReply, txID); err != nil {
 					return true, "", false, err
 				}
 				return true, "", false, nil
@@ -915,6 +1791,78 @@ func processDirectCommand(database *sql.DB, commander cmdpkg.Commander, cfg *con
 	return false, "", false, nil
 }
 
+func isSessionCommand(text string) bool {
+	return newSessionCommandPattern.MatchString(text) || sessionsCommandPattern.MatchString(text) || resumeCommandPattern.MatchString(text)
+}
+
+// isControlCommand reports whether text is a command about the worker or
+// the conversation itself, which is kept out of history.
+func isControlCommand(text string) bool {
+	return isSessionCommand(text) || statusCommandPattern.MatchString(text) || stopCommandPattern.MatchString(text)
+}
+
+// processSessionCommand handles /new, /sessions and /resume. These commands
+// switch which history the next task sees, so they are not stored in any
+// session themselves.
+func processSessionCommand(database *sql.DB, chatID int64, text string, agentEventID int64) (string, error) {
+	switch {
+	case newSessionCommandPattern.MatchString(text):
+		s, err := db.NewSession(database, chatID)
+		if err != nil {
+			return "", err
+		}
+		db.LogEvent(database, &agentEventID, db.EventSessionStarted, map[string]any{
+			"chat_id":    chatID,
+			"session_id": s.ID,
+		})
+		return fmt.Sprintf("已开始新会话 #%d，之前的对话不再进入上下文；发送 /sessions 查看历史会话", s.ID), nil
+
+	case sessionsCommandPattern.MatchString(text):
+		if _, err := db.ActiveSession(database, chatID); err != nil {
+			return "", err
+		}
+		sessions, err := db.ListSessions(database, chatID, sessionListLimit)
+		if err != nil {
+			return "", err
+		}
+		var b strings.Builder
+		b.WriteString("最近的会话（* 为当前会话）：")
+		for _, s := range sessions {
+			marker := " "
+			if s.Active {
+				marker = "*"
+			}
+			title := s.Title
+			if title == "" {
+				title = "（空）"
+			}
+			fmt.Fprintf(&b, "\n%s #%d %s（%d 条，%s）", marker, s.ID, title, s.MessageCount,
+				time.Unix(s.UpdatedAt, 0).Format("2006-01-02 15:04"))
+		}
+		b.WriteString("\n发送 /resume <编号> 切换会话，/new 开始新会话")
+		return b.String(), nil
+
+	default:
+		m := resumeCommandPattern.FindStringSubmatch(text)
+		id, perr := strconv.ParseInt(m[1], 10, 64)
+		if perr != nil || id <= 0 {
+			return "resume 失败：请提供会话编号，发送 /sessions 查看", nil
+		}
+		s, err := db.ResumeSession(database, chatID, id)
+		if errors.Is(err, db.ErrSessionNotFound) {
+			return fmt.Sprintf("resume 失败：会话 #%d 不存在", id), nil
+		}
+		if err != nil {
+			return "", err
+		}
+		db.LogEvent(database, &agentEventID, db.EventSessionResumed, map[string]any{
+			"chat_id":    chatID,
+			"session_id": s.ID,
+		})
+		return fmt.Sprintf("已切换到会话 #%d：%s（%d 条）", s.ID, s.Title, s.MessageCount), nil
+	}
+}
+
 func runUpdateStagePipeline(database *sql.DB, cfg *config.WorkerConfig, txID string, agentEventID int64) (string, error) {
 	if existing, err := db.GetArtifactByTxID(database, txID); err == nil {
 		switch existing.Status {
@@ -1083,9 +2031,13 @@ func injectConfigMeta(prompt, configDir string) string {
 		return out
 	}
 	meta := fmt.Sprintf(
-		"配置目录: %s\n系统提示符文件: %s\n你可以通过 read/write/edit 工具读取和修改该文件，修改在下次会话启动时生效。",
+		"配置目录: %s\n系统提示符文件: %s\n你可以通过 read/write/edit 工具读取和修改该文件，修改从下一条消息开始生效。"+
+			"该文件是 Go text/template 模板：可用 {{include \"文件名\"}} 引入配置目录中的文件，"+
+			"可用变量 {{.Date}}、{{.ChatID}}、{{.Workspace}}、{{.ConfigDir}}、{{.GitHead}}、{{.Tools}}；"+
+			"%s/<chat_id>.md 存在时替代该文件作为对应 chat 的系统提示符。",
 		configDir,
 		filepath.Join(configDir, "AUTONOUS.md"),
+		filepath.Join(configDir, "chats"),
 	)
 	if strings.TrimSpace(out) == "" {
 		return meta
@@ -1093,20 +2045,57 @@ func injectConfigMeta(prompt, configDir string) string {
 	return strings.TrimRight(out, "\n") + "\n\n" + meta
 }
 
-// loadSystemPrompt resolves prompt source with priority: file > env > builtin.
-func loadSystemPrompt(cfg *config.WorkerConfig) (prompt string, source string, sizeBytes int, readErr error) {
-	data, err := os.ReadFile(cfg.SystemPromptFile)
-	if err == nil {
-		return injectConfigMeta(string(data), cfg.ConfigDir), "file", len(data), nil
+func newPromptLoader(cfg *config.WorkerConfig) *prompt.Loader {
+	return &prompt.Loader{
+		ConfigDir: cfg.ConfigDir,
+		File:      cfg.SystemPromptFile,
+		Env:       cfg.SystemPromptEnv,
+		Builtin:   builtinSystemPrompt(),
 	}
-	if err != nil && !errors.Is(err, os.ErrNotExist) {
-		readErr = err
+}
+
+func promptVars(cfg *config.WorkerConfig, registry *toolpkg.Registry, chatID int64) prompt.Vars {
+	vars := prompt.Vars{
+		Now:       time.Now(),
+		ChatID:    chatID,
+		Workspace: cfg.WorkspaceDir,
+		ConfigDir: cfg.ConfigDir,
+		HeadFunc:  func() string { return gitHeadRev(cfg.WorkspaceDir) },
+	}
+	if registry != nil {
+		for _, meta := range registry.MustList() {
+			vars.Tools = append(vars.Tools, meta.Name)
+		}
+	}
+	return vars
+}
+
+// resolveSystemPrompt renders the system prompt for a chat (0 at startup).
+// When the resolved prompt changed since the chat's last task it is logged
+// as system_prompt.loaded, with any failure as system_prompt.load_failed,
+// both under parentEventID; an unchanged broken file is not re-reported.
+func resolveSystemPrompt(database *sql.DB, parentEventID int64, loader *prompt.Loader, cfg *config.WorkerConfig, registry *toolpkg.Registry, chatID int64) string {
+	res, err := loader.Load(promptVars(cfg, registry, chatID))
+	if err != nil && res.Changed {
+		log.Printf("[worker] system prompt load failed chat_id=%d path=%s err=%v", chatID, res.Path, err)
+		db.LogEvent(database, &parentEventID, "system_prompt.load_failed", map[string]any{
+			"chat_id": chatID,
+			"path":    cfg.SystemPromptFile,
+			"error":   truncate(err.Error(), 1000),
+		})
 	}
-	if strings.TrimSpace(cfg.SystemPromptEnv) != "" {
-		return injectConfigMeta(cfg.SystemPromptEnv, cfg.ConfigDir), "env", len(cfg.SystemPromptEnv), readErr
+	if res.Changed {
+		db.LogEvent(database, &parentEventID, "system_prompt.loaded", map[string]any{
+			"chat_id":    chatID,
+			"source":     res.Source,
+			"path":       res.Path,
+			"includes":   res.Includes,
+			"hash":       res.Hash,
+			"config_dir": cfg.ConfigDir,
+			"size_bytes": res.SizeBytes,
+		})
 	}
-	builtin := builtinSystemPrompt()
-	return injectConfigMeta(builtin, cfg.ConfigDir), "builtin", len(builtin), readErr
+	return injectConfigMeta(res.Text, cfg.ConfigDir)
 }
 
 // --- DB helper functions ---
@@ -1121,13 +2110,47 @@ type queueTask struct {
 }
 
 func appendHistory(database *sql.DB, chatID int64, role, text string) {
-	database.Exec("INSERT INTO history (chat_id, role, text) VALUES (?, ?, ?)", chatID, role, text)
+	db.AppendHistory(database, chatID, role, text, nil, nil)
+}
+
+// appendHistoryMessages stores one task's messages, including tool calls and
+// tool results, in a single transaction.
+func appendHistoryMessages(database *sql.DB, chatID int64, messages []ctxpkg.Message) error {
+	tx, err := database.Begin()
+	if err != nil {
+		return err
+	}
+	defer tx.Rollback()
+	for _, msg := range messages {
+		var toolCalls, toolCallID any
+		if len(msg.ToolCalls) > 0 {
+			data, err := json.Marshal(msg.ToolCalls)
+			if err != nil {
+				return err
+			}
+			toolCalls = string(data)
+		}
+		if msg.ToolCallID != "" {
+			toolCallID = msg.ToolCallID
+		}
+		if err := db.AppendHistory(tx, chatID, msg.Role, msg.Content, toolCalls, toolCallID); err != nil {
+			return err
+		}
+	}
+	return tx.Commit()
 }
 
 func enqueueMessage(database *sql.DB, updateID, chatID int64, text string, messageDate int64) (bool, error) {
+	return insertInbox(database, updateID, chatID, text, messageDate, "queued")
+}
+
+// insertInbox records an update in the inbox with the given status, unless
+// it is there already. Throttled updates are kept, never claimed, so that
+// the polling offset derived from the inbox moves past them.
+func insertInbox(database *sql.DB, updateID, chatID int64, text string, messageDate int64, status string) (bool, error) {
 	result, err := database.Exec(
-		"INSERT OR IGNORE INTO inbox (update_id, chat_id, text, message_date, status, updated_at) VALUES (?, ?, ?, ?, 'queued', unixepoch())",
-		updateID, chatID, text, messageDate,
+		"INSERT OR IGNORE INTO inbox (update_id, chat_id, text, message_date, status, updated_at) VALUES (?, ?, ?, ?, ?, unixepoch())",
+		updateID, chatID, text, messageDate, status,
 	)
 	if err != nil {
 		return false, err
@@ -1136,30 +2159,25 @@ func enqueueMessage(database *sql.DB, updateID, chatID int64, text string, messa
 	return affected > 0, nil
 }
 
-func hasRunnableTasks(database *sql.DB, policy control.Policy) bool {
-	var exists int64
-	err := database.QueryRow("SELECT 1 FROM inbox WHERE status = 'queued' ORDER BY id LIMIT 1").Scan(&exists)
-	if err == nil {
-		return true
-	}
-	rows, err := database.Query("SELECT attempts, updated_at FROM inbox WHERE status='failed' ORDER BY id LIMIT 100")
-	if err != nil {
-		return false
-	}
-	defer rows.Close()
-	now := time.Now().Unix()
-	for rows.Next() {
-		var attempts, updatedAt int64
-		if scanErr := rows.Scan(&attempts, &updatedAt); scanErr != nil {
-			continue
-		}
-		if retryReady(attempts, updatedAt, now, policy) {
-			return true
-		}
-	}
-	return false
+func hasRunnableTasks(database *sql.DB, policy control.Policy) bool {
+	task, err := nextRunnableTask(database, policy)
+	return err == nil && task != nil
+}
+
+// hasPendingTasks reports whether any task is queued, running, or failed with
+// retries left, including one still waiting out its backoff.
+func hasPendingTasks(database *sql.DB, policy control.Policy) bool {
+	var n int
+	err := database.QueryRow(
+		"SELECT COUNT(*) FROM inbox WHERE status IN ('queued', 'in_progress') OR (status = 'failed' AND attempts <= ?)", policy.MaxRetries,
+	).Scan(&n)
+	return err != nil || n > 0
 }
 
+// claimNextTask claims the oldest pending task, if it is runnable, of the
+// chat served least recently, so that chats take turns instead of one busy
+// chat starving the others. A chat with a task in progress is leased to it: none of its other
+// tasks is claimed until that one ends. It returns nil when nothing can run.
 func claimNextTask(database *sql.DB, policy control.Policy) (*queueTask, error) {
 	tx, err := database.Begin()
 	if err != nil {
@@ -1167,65 +2185,172 @@ func claimNextTask(database *sql.DB, policy control.Policy) (*queueTask, error)
 	}
 	defer tx.Rollback()
 
-	var task queueTask
-	err = tx.QueryRow(
-		`SELECT id, chat_id, update_id, text, attempts, updated_at FROM inbox
-		 WHERE status = 'queued'
-		 LIMIT 1`,
-	).Scan(&task.ID, &task.ChatID, &task.UpdateID, &task.Text, &task.Attempts, &task.UpdatedAt)
-	if err == sql.ErrNoRows {
-		// Try failed tasks with retry window.
-		rows, qerr := tx.Query(
-			`SELECT id, chat_id, update_id, text, attempts, updated_at
-			 FROM inbox WHERE status='failed' ORDER BY id LIMIT 200`,
-		)
-		if qerr != nil {
-			return nil, qerr
-		}
-		defer rows.Close()
-		now := time.Now().Unix()
-		found := false
-		for rows.Next() {
-			var cand queueTask
-			if scanErr := rows.Scan(&cand.ID, &cand.ChatID, &cand.UpdateID, &cand.Text, &cand.Attempts, &cand.UpdatedAt); scanErr != nil {
-				continue
-			}
-			if retryReady(cand.Attempts, cand.UpdatedAt, now, policy) {
-				task = cand
-				found = true
-				break
-			}
-		}
-		if !found {
-			return nil, nil
-		}
-	} else if err != nil {
+	task, err := nextRunnableTask(tx, policy)
+	if err != nil || task == nil {
 		return nil, err
 	}
 
-	_, err = tx.Exec(
+	// The guard makes the lease atomic even if another claim got in first.
+	result, err := tx.Exec(
 		`UPDATE inbox SET status = 'in_progress', attempts = attempts + 1,
-		 locked_at = unixepoch(), error = NULL, updated_at = unixepoch()
-		 WHERE id = ?`, task.ID,
+		 locked_at = unixepoch(), error = NULL, updated_at = unixepoch(),
+		 claim_seq = (SELECT MAX(claim_seq) + 1 FROM inbox)
+		 WHERE id = ? AND status IN ('queued', 'failed')
+		 AND NOT EXISTS (SELECT 1 FROM inbox b WHERE b.chat_id = inbox.chat_id AND b.status = 'in_progress')`, task.ID,
 	)
 	if err != nil {
 		return nil, err
 	}
+	if n, err := result.RowsAffected(); err != nil || n == 0 {
+		return nil, err
+	}
 
 	if err := tx.Commit(); err != nil {
 		return nil, err
 	}
 	task.Attempts++
-	return &task, nil
+	return task, nil
+}
+
+// reclaimExpiredLeases hands tasks whose lease expired, because the worker
+// running them died, back to the retry machinery: they become failed tasks
+// that claimNextTask retries after backoff, or exhausted ones once out of
+// retries. The lost run counted as an attempt when it was claimed. It
+// returns how many tasks it reclaimed.
+func reclaimExpiredLeases(database *sql.DB, commander cmdpkg.Commander, workerEventID int64, policy control.Policy, ttl time.Duration, now time.Time) int {
+	cutoff := now.Add(-ttl).Unix()
+	rows, err := database.Query(
+		`SELECT id, chat_id, attempts, COALESCE(locked_at, updated_at) FROM inbox
+		 WHERE status = 'in_progress' AND COALESCE(locked_at, updated_at) <= ? ORDER BY id`, cutoff,
+	)
+	if err != nil {
+		log.Printf("[worker] failed to find expired leases: %v", err)
+		return 0
+	}
+	type lease struct{ id, chatID, attempts, lockedAt int64 }
+	var expired []lease
+	for rows.Next() {
+		var l lease
+		if err := rows.Scan(&l.id, &l.chatID, &l.attempts, &l.lockedAt); err == nil {
+			expired = append(expired, l)
+		}
+	}
+	rows.Close()
+
+	reclaimed := 0
+	for _, l := range expired {
+		msg := "lease expired: worker stopped while running the task"
+		// The guard skips a lease renewed since the select.
+		result, err := database.Exec(
+			`UPDATE inbox SET status = 'failed', updated_at = ?, error = ?, retry_after_seconds = 0
+			 WHERE id = ? AND status = 'in_progress' AND COALESCE(locked_at, updated_at) <= ?`,
+			now.Unix(), msg, l.id, cutoff,
+		)
+		if err != nil {
+			log.Printf("[worker] failed to reclaim task %d: %v", l.id, err)
+			continue
+		}
+		if n, err := result.RowsAffected(); err != nil || n == 0 {
+			continue
+		}
+		reclaimed++
+		log.Printf("[worker] task %d lease expired (locked_at=%d attempts=%d)", l.id, l.lockedAt, l.attempts)
+		db.LogEvent(database, &workerEventID, db.EventTaskLeaseExpired, map[string]any{
+			"task_id":       l.id,
+			"chat_id":       l.chatID,
+			"attempts":      l.attempts,
+			"locked_at":     l.lockedAt,
+			"lease_seconds": int(ttl.Seconds()),
+		})
+		if control.ShouldRetry(policy, int(l.attempts)) {
+			db.LogEvent(database, &workerEventID, db.EventRetryScheduled, map[string]any{
+				"task_id":         l.id,
+				"attempt":         l.attempts,
+				"backoff_seconds": control.RetryBackoffSeconds(int(l.attempts), 0),
+				"error_class":     "lease_expired",
+			})
+			continue
+		}
+		markTaskExhausted(database, l.id, msg, policy.MaxRetries)
+		db.LogEvent(database, &workerEventID, db.EventRetryExhausted, map[string]any{
+			"task_id":          l.id,
+			"attempts":         l.attempts,
+			"last_error_class": "lease_expired",
+		})
+		notify := fmt.Sprintf("任务 #%d 执行期间 worker 意外退出，已尝试 %d 次，不再重试。", l.id, l.attempts)
+		if err := commander.SendMessage(context.Background(), l.chatID, notify); err != nil {
+			log.Printf("task %d failed to notify chat_id=%d: %v", l.id, l.chatID, err)
+		}
+	}
+	return reclaimed
+}
+
+// inboxQuerier is satisfied by both *sql.DB and *sql.Tx.
+type inboxQuerier interface {
+	Query(query string, args ...any) (*sql.Rows, error)
+}
+
+// nextRunnableTask returns the task claimNextTask would claim, without
+// claiming it, or nil when nothing can run. Only the oldest pending task of
+// each chat is a candidate, queued or failed alike, so a chat's messages are
+// answered in order even when an earlier one waits out a retry backoff.
+func nextRunnableTask(q inboxQuerier, policy control.Policy) (*queueTask, error) {
+	rows, err := q.Query(
+		`SELECT id, chat_id, update_id, text, status, attempts, updated_at, retry_after_seconds
+		 FROM inbox q WHERE `+chatPending+` AND `+chatIdle+` AND `+chatHead+`
+		 ORDER BY `+chatTurnOrder+` LIMIT 200`,
+		policy.MaxRetries, policy.MaxRetries,
+	)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+	now := time.Now().Unix()
+	for rows.Next() {
+		var task queueTask
+		var status string
+		var retryAfter int64
+		if err := rows.Scan(&task.ID, &task.ChatID, &task.UpdateID, &task.Text, &status, &task.Attempts, &task.UpdatedAt, &retryAfter); err != nil {
+			continue
+		}
+		if status == "queued" || retryReady(task.Attempts, task.UpdatedAt, retryAfter, now, policy) {
+			return &task, nil
+		}
+	}
+	return nil, rows.Err()
+}
+
+// chatTurnOrder orders inbox rows aliased q by when their chat last had a
+// task claimed, then by arrival.
+const chatTurnOrder = `(SELECT MAX(claim_seq) FROM inbox h WHERE h.chat_id = q.chat_id), id`
+
+// chatPending matches inbox rows aliased q that are queued or failed with
+// retries left. It takes policy.MaxRetries as its argument.
+const chatPending = `(q.status = 'queued' OR (q.status = 'failed' AND q.attempts <= ?))`
+
+// chatHead matches inbox rows aliased q with no older pending row in their
+// chat. It takes policy.MaxRetries as its argument.
+const chatHead = `NOT EXISTS (SELECT 1 FROM inbox e WHERE e.chat_id = q.chat_id AND e.id < q.id
+	AND (e.status = 'queued' OR (e.status = 'failed' AND e.attempts <= ?)))`
+
+// chatIdle matches inbox rows aliased q whose chat has no task in progress.
+const chatIdle = `NOT EXISTS (SELECT 1 FROM inbox b WHERE b.chat_id = q.chat_id AND b.status = 'in_progress')`
+
+// markTaskCancelled records that /stop cancelled the task. Cancelled tasks
+// are never retried.
+func markTaskCancelled(database *sql.DB, taskID int64) {
+	database.Exec("UPDATE inbox SET status = 'cancelled', updated_at = unixepoch(), error = 'stopped by /stop' WHERE id = ?", taskID)
 }
 
 func markTaskDone(database *sql.DB, taskID int64) {
 	database.Exec("UPDATE inbox SET status = 'done', updated_at = unixepoch(), error = NULL WHERE id = ?", taskID)
 }
 
-func markTaskFailed(database *sql.DB, taskID int64, errMsg string) {
-	database.Exec("UPDATE inbox SET status = 'failed', updated_at = unixepoch(), error = ? WHERE id = ?",
-		truncate(errMsg, 1000), taskID)
+// markTaskFailed records a failed attempt. retryAfter is the server-requested
+// delay, if any, that the retry scheduler must honor.
+func markTaskFailed(database *sql.DB, taskID int64, errMsg string, retryAfter time.Duration) {
+	database.Exec("UPDATE inbox SET status = 'failed', updated_at = unixepoch(), error = ?, retry_after_seconds = ? WHERE id = ?",
+		truncate(errMsg, 1000), int64(math.Ceil(retryAfter.Seconds())), taskID)
 }
 
 func markTaskExhausted(database *sql.DB, taskID int64, errMsg string, maxRetries int) {
@@ -1282,25 +2407,89 @@ func newCommander(cfg *config.WorkerConfig) (cmdpkg.Commander, error) {
 	}
 }
 
+// applyCassette records the live commander and provider to the cassette, or
+// replaces both with the cassette, according to AUTONOUS_CASSETTE_MODE. In
+// replay mode it also returns the cassette, for finishReplay.
+func applyCassette(cfg *config.WorkerConfig, commander cmdpkg.Commander, provider modelpkg.Provider) (cmdpkg.Commander, modelpkg.Provider, *cassette.Cassette, error) {
+	switch cfg.CassetteMode {
+	case "record":
+		log.Printf("[worker] recording cassette path=%s", cfg.CassettePath)
+		tape := cassette.Create(cfg.CassettePath)
+		return tape.RecordCommander(commander), tape.RecordProvider(provider), nil, nil
+	case "replay":
+		log.Printf("[worker] replaying cassette path=%s", cfg.CassettePath)
+		tape, err := cassette.Load(cfg.CassettePath)
+		if err != nil {
+			return nil, nil, nil, err
+		}
+		return tape.ReplayCommander(), tape.ReplayProvider(), tape, nil
+	default:
+		return commander, provider, nil, nil
+	}
+}
+
+// finishReplay ends a replay whose commander has no updates left and whose
+// tasks have all settled. Recorded calls the run never made mean it diverged,
+// so the worker exits non-zero.
+func finishReplay(tape *cassette.Cassette) {
+	for _, w := range tape.Warnings() {
+		log.Printf("[worker] cassette replay warning: %s", w)
+	}
+	if err := tape.Finish(); err != nil {
+		log.Printf("[worker] cassette replay diverged: %v", err)
+		os.Exit(1)
+	}
+	log.Printf("[worker] cassette replay finished")
+	os.Exit(0)
+}
+
 func newModelProvider(cfg *config.WorkerConfig) (modelpkg.Provider, error) {
-	switch cfg.ModelProvider {
+	if cfg.ModelProvider == "router" {
+		backends := make([]router.Backend, 0, len(cfg.ModelRouterChain))
+		for _, name := range cfg.ModelRouterChain {
+			p, err := newBackendProvider(cfg, name)
+			if err != nil {
+				return nil, err
+			}
+			backends = append(backends, router.Backend{Name: name, Model: cfg.ModelNameFor(name), Provider: p})
+		}
+		return router.New(backends, cfg.RouterBreakerThreshold, time.Duration(cfg.RouterBreakerCooldownSec)*time.Second)
+	}
+	return newBackendProvider(cfg, cfg.ModelProvider)
+}
+
+func newEmbedder(cfg *config.WorkerConfig) (modelpkg.Embedder, error) {
+	switch cfg.EmbeddingsProvider {
+	case "openai":
+		return openai.NewEmbeddingClient(cfg.OpenAIAPIKey, cfg.OpenAIEmbeddingsURL, cfg.OpenAIEmbeddingsModel, 60*time.Second), nil
+	case "dummy":
+		return dummy.NewEmbedder(64), nil
+	default:
+		return nil, fmt.Errorf("unsupported embeddings provider: %s", cfg.EmbeddingsProvider)
+	}
+}
+
+func newBackendProvider(cfg *config.WorkerConfig, name string) (modelpkg.Provider, error) {
+	switch name {
 	case "openai":
 		return openai.NewClient(cfg.OpenAIAPIKey, cfg.OpenAIChatCompURL, cfg.OpenAIModel, 120*time.Second), nil
+	case "anthropic":
+		return anthropic.NewClient(cfg.AnthropicAPIKey, cfg.AnthropicMessagesURL, cfg.AnthropicModel, cfg.AnthropicMaxTokens, 120*time.Second), nil
 	case "dummy":
 		return dummy.NewProvider(cfg.OpenAIModel, cfg.DummyProviderScript)
 	default:
-		return nil, fmt.Errorf("unsupported model provider: %s", cfg.ModelProvider)
+		return nil, fmt.Errorf("unsupported model provider: %s", name)
 	}
 }
 
-func retryReady(attempts int64, updatedAt int64, nowUnix int64, policy control.Policy) bool {
+func retryReady(attempts int64, updatedAt int64, retryAfterSeconds int64, nowUnix int64, policy control.Policy) bool {
 	if attempts <= 0 {
 		return true
 	}
 	if !control.ShouldRetry(policy, int(attempts)) {
 		return false
 	}
-	backoff := int64(control.RetryBackoffSeconds(int(attempts)))
+	backoff := int64(control.RetryBackoffSeconds(int(attempts), time.Duration(retryAfterSeconds)*time.Second))
 	return nowUnix-updatedAt >= backoff
 }
 
@@ -1308,17 +2497,361 @@ func classifyError(err error) string {
 	if err == nil {
 		return "unknown"
 	}
-	msg := err.Error()
-	switch {
-	case containsAny(msg, "telegram ", "commander"):
-		return "command_source_api"
-	case containsAny(msg, "openai ", "provider", "model"):
+	if _, ok := modelpkg.AsError(err); ok {
 		return "provider_api"
-	case containsAny(msg, "sqlite", "db", "database"):
+	}
+	var sqliteErr sqlite3.Error
+	if errors.As(err, &sqliteErr) || errors.Is(err, sql.ErrConnDone) || errors.Is(err, sql.ErrTxDone) {
 		return "db"
-	default:
-		return "unknown"
 	}
+	if _, ok := cmdpkg.AsError(err); ok {
+		return "command_source_api"
+	}
+	return "unknown"
+}
+
+// providerErrorClass returns the typed provider error class of err, or "".
+func providerErrorClass(err error) string {
+	if perr, ok := modelpkg.AsError(err); ok {
+		return string(perr.Class)
+	}
+	return ""
+}
+
+// enqueueUpdates queues the text messages among updates, except those handle
+// takes care of and those over their chat's rate limit, and returns the
+// offset past them. handle may be nil.
+func enqueueUpdates(database *sql.DB, commander cmdpkg.Commander, limiter *control.RateLimiter, workerEventID int64, updates []cmdpkg.Update, offset int64, handle func(chatID int64, text string) bool) int64 {
+	for _, update := range updates {
+		offset = update.UpdateID + 1
+
+		if update.Message == nil {
+			continue
+		}
+		if update.Message.Text == nil {
+			continue
+		}
+		text := *update.Message.Text
+		if len(text) == 0 {
+			continue
+		}
+
+		chatID := update.Message.Chat.ID
+		if handle != nil && handle(chatID, text) {
+			continue
+		}
+		if ok, wait := limiter.Allow(chatID, time.Now()); !ok {
+			throttleMessage(database, commander, limiter, workerEventID, update, wait)
+			continue
+		}
+		_, err := enqueueMessage(database, update.UpdateID, chatID, text, update.Message.Date)
+		if err != nil {
+			log.Printf("enqueue error update_id=%d: %v", update.UpdateID, err)
+			continue
+		}
+	}
+	return offset
+}
+
+// pollWhileOpen keeps the chat responsive while a circuit breaker blocks new
+// work: /status is answered at once and other messages wait in the queue.
+// While the command source's own breaker is open it only sleeps.
+func pollWhileOpen(database *sql.DB, commander cmdpkg.Commander, cfg *config.WorkerConfig, breakers *control.BreakerSet, limiter *control.RateLimiter, running *runningTasks, workerEventID int64, offset int64) int64 {
+	if breakers.State("command_source_api") == control.CircuitOpen {
+		time.Sleep(time.Duration(cfg.SleepSeconds) * time.Second)
+		return offset
+	}
+	updates, err := commander.GetUpdates(offset, cfg.SleepSeconds)
+	if err != nil {
+		log.Printf("getUpdates error while circuit open: %v", err)
+		time.Sleep(time.Duration(cfg.SleepSeconds) * time.Second)
+		return offset
+	}
+	closeCircuits(database, workerEventID, breakers, "command_source_api")
+	return enqueueUpdates(database, commander, limiter, workerEventID, updates, offset, func(chatID int64, text string) bool {
+		if handleStop(database, commander, running, chatID, text) {
+			return true
+		}
+		if !statusCommandPattern.MatchString(text) {
+			return false
+		}
+		reply, err := circuitStatusReply(database, cfg, time.Now())
+		if err != nil {
+			reply = fmt.Sprintf("读取熔断器状态失败：%v", err)
+		}
+		if err := commander.SendMessage(context.Background(), chatID, reply); err != nil {
+			log.Printf("failed to send status to chat_id=%d: %v", chatID, err)
+		}
+		return true
+	})
+}
+
+// handleStop answers /stop as soon as it is polled, since the chat's queue
+// is blocked behind the task it is meant to stop. /stop stops the chat's
+// running task; /stop <task_id> stops that task, or cancels it if it is
+// still waiting to run. It reports whether text was a /stop.
+func handleStop(database *sql.DB, commander cmdpkg.Commander, running *runningTasks, chatID int64, text string) bool {
+	m := stopCommandPattern.FindStringSubmatch(text)
+	if m == nil {
+		return false
+	}
+	var taskID int64
+	var reply string
+	if m[1] != "" {
+		id, err := strconv.ParseInt(strings.TrimPrefix(m[1], "#"), 10, 64)
+		if err != nil || id <= 0 {
+			reply = fmt.Sprintf("无效的任务编号：%s", m[1])
+		}
+		taskID = id
+	}
+	if reply == "" {
+		if _, ok := running.stop(chatID, taskID); ok {
+			// The run replies with what it had done once it unwinds.
+			return true
+		}
+		reply = "当前没有正在执行的任务。"
+		if taskID > 0 {
+			reply = fmt.Sprintf("任务 #%d 不在执行中。", taskID)
+			result, err := database.Exec(`UPDATE inbox SET status = 'cancelled', updated_at = unixepoch(), error = 'stopped by /stop'
+				WHERE id = ? AND chat_id = ? AND status IN ('queued', 'failed')`, taskID, chatID)
+			if err != nil {
+				reply = fmt.Sprintf("取消任务 #%d 失败：%v", taskID, err)
+			} else if n, _ := result.RowsAffected(); n > 0 {
+				reply = fmt.Sprintf("已取消尚未执行的任务 #%d。", taskID)
+			}
+		}
+	}
+	if err := commander.SendMessage(context.Background(), chatID, reply); err != nil {
+		log.Printf("failed to send stop reply to chat_id=%d: %v", chatID, err)
+	}
+	return true
+}
+
+// cancelTask finishes a run that /stop cancelled: the task is marked
+// cancelled, agent.cancelled is logged and the chat is told what the run
+// had done.
+func cancelTask(database *sql.DB, commander cmdpkg.Commander, workerEventID int64, task *queueTask, agentEventID int64) {
+	turns, calls := runProgress(database, agentEventID)
+	markTaskCancelled(database, task.ID)
+	db.LogEvent(database, &workerEventID, db.EventAgentCancelled, map[string]any{
+		"task_id":    task.ID,
+		"turns":      turns,
+		"tool_calls": len(calls),
+	})
+	var b strings.Builder
+	fmt.Fprintf(&b, "已停止任务 #%d。", task.ID)
+	if len(calls) == 0 {
+		fmt.Fprintf(&b, "已完成 %d 轮模型调用，还没有执行工具调用。", turns)
+	} else {
+		fmt.Fprintf(&b, "已完成 %d 轮模型调用，执行了 %d 个工具调用：", turns, len(calls))
+		for _, c := range calls {
+			b.WriteString("\n- " + c)
+		}
+	}
+	if err := commander.SendMessage(context.Background(), task.ChatID, b.String()); err != nil {
+		log.Printf("task %d failed to notify chat_id=%d: %v", task.ID, task.ChatID, err)
+	}
+	log.Printf("task %d cancelled by /stop", task.ID)
+}
+
+// runProgress returns how many turns the run under agentEventID completed
+// and a line for each tool call it started, in order.
+func runProgress(database *sql.DB, agentEventID int64) (int, []string) {
+	var turns int
+	database.QueryRow(`SELECT COUNT(*) FROM events WHERE parent_id = ? AND event_type = ?`, agentEventID, db.EventTurnCompleted).Scan(&turns)
+	rows, err := database.Query(`
+		SELECT json_extract(s.payload, '$.tool_name'), json_extract(s.payload, '$.arguments'),
+		       (SELECT r.event_type FROM events r WHERE r.parent_id = s.id AND r.event_type IN (?, ?) LIMIT 1)
+		FROM events s JOIN events t ON t.id = s.parent_id
+		WHERE t.parent_id = ? AND t.event_type = ? AND s.event_type = ?
+		ORDER BY s.id`,
+		db.EventToolCallDone, db.EventToolCallFailed, agentEventID, db.EventTurnStarted, db.EventToolCallStarted)
+	if err != nil {
+		return turns, nil
+	}
+	defer rows.Close()
+	var calls []string
+	for rows.Next() {
+		var name, args, outcome sql.NullString
+		if err := rows.Scan(&name, &args, &outcome); err != nil {
+			continue
+		}
+		status := "已中断"
+		switch outcome.String {
+		case db.EventToolCallDone:
+			status = "完成"
+		case db.EventToolCallFailed:
+			status = "失败"
+		}
+		calls = append(calls, fmt.Sprintf("%s %s（%s）", name.String, truncate(args.String, 80), status))
+	}
+	return turns, calls
+}
+
+// newRateLimiter builds the per-chat inbox rate limiter configured in cfg.
+func newRateLimiter(cfg *config.WorkerConfig) *control.RateLimiter {
+	overrides := map[int64]control.RateLimit{}
+	for chatID, r := range cfg.ControlRateChats {
+		overrides[chatID] = control.RateLimit{PerMinute: r.PerMinute, Burst: r.Burst}
+	}
+	return control.NewRateLimiter(control.RateLimit{PerMinute: cfg.ControlRatePerMinute, Burst: cfg.ControlRateBurst}, overrides)
+}
+
+// throttleMessage drops an update over its chat's rate limit: it is recorded
+// as throttled, logged as control.rate_limited and answered at once.
+func throttleMessage(database *sql.DB, commander cmdpkg.Commander, limiter *control.RateLimiter, workerEventID int64, update cmdpkg.Update, wait time.Duration) {
+	msg := update.Message
+	inserted, err := insertInbox(database, update.UpdateID, msg.Chat.ID, *msg.Text, msg.Date, "throttled")
+	if err != nil {
+		log.Printf("failed to record throttled update_id=%d: %v", update.UpdateID, err)
+	}
+	if !inserted {
+		return
+	}
+	limit := limiter.Limit(msg.Chat.ID)
+	retryAfter := int(math.Ceil(wait.Seconds()))
+	db.LogEvent(database, &workerEventID, db.EventControlRateLimited, map[string]any{
+		"chat_id":             msg.Chat.ID,
+		"update_id":           update.UpdateID,
+		"per_minute":          limit.PerMinute,
+		"burst":               limit.Burst,
+		"retry_after_seconds": retryAfter,
+	})
+	reply := fmt.Sprintf("消息太频繁，已忽略这条消息（每分钟最多 %d 条），请 %d 秒后再发。", limit.PerMinute, retryAfter)
+	if err := commander.SendMessage(context.Background(), msg.Chat.ID, reply); err != nil {
+		log.Printf("failed to send throttle notice to chat_id=%d: %v", msg.Chat.ID, err)
+	}
+}
+
+// newBreakerSet builds the per-class circuit breakers configured in cfg and
+// saves every change to database.
+func newBreakerSet(database *sql.DB, cfg *config.WorkerConfig) *control.BreakerSet {
+	policies := map[string]control.BreakerPolicy{}
+	for class, p := range cfg.ControlCircuitClasses {
+		policies[class] = control.BreakerPolicy{Threshold: p.Threshold, Cooldown: time.Duration(p.CooldownSeconds) * time.Second}
+	}
+	breakers := control.NewBreakerSet(control.BreakerPolicy{
+		Threshold: cfg.ControlCircuitThreshold,
+		Cooldown:  time.Duration(cfg.ControlCircuitCooldownSec) * time.Second,
+	}, policies)
+	breakers.OnChange = func(class string, snap control.BreakerSnapshot) {
+		st := db.BreakerState{Class: class, State: string(snap.State), Failures: snap.Failures}
+		if !snap.OpenedAt.IsZero() {
+			st.OpenedAt = snap.OpenedAt.Unix()
+		}
+		if err := db.SaveBreakerState(database, st); err != nil {
+			log.Printf("failed to save %s circuit breaker: %v", class, err)
+		}
+	}
+	return breakers
+}
+
+// restoreBreakers loads the breaker states saved by earlier workers, so that
+// a restart does not close an open breaker and hammer a failing dependency.
+func restoreBreakers(database *sql.DB, breakers *control.BreakerSet) error {
+	states, err := db.ListBreakerStates(database)
+	if err != nil {
+		return err
+	}
+	for _, st := range states {
+		breakers.Restore(st.Class, control.BreakerSnapshot{
+			State:    control.CircuitState(st.State),
+			Failures: st.Failures,
+			OpenedAt: time.Unix(st.OpenedAt, 0),
+		})
+		if st.State != string(control.CircuitClosed) {
+			log.Printf("[worker] restored %s circuit breaker for %s", st.State, st.Class)
+		}
+	}
+	return nil
+}
+
+// recordCircuitFailure counts a failure against errClass's breaker and logs
+// circuit.opened when it trips.
+func recordCircuitFailure(database *sql.DB, workerEventID int64, breakers *control.BreakerSet, errClass string) {
+	if !breakers.RecordFailure(errClass, time.Now()) {
+		return
+	}
+	p := breakers.Policy(errClass)
+	db.LogEvent(database, &workerEventID, db.EventCircuitOpened, map[string]any{
+		"error_class":      errClass,
+		"threshold":        p.Threshold,
+		"cooldown_seconds": int(p.Cooldown.Seconds()),
+	})
+}
+
+// taskCircuitClasses are the breakers a successful task proves healthy. The
+// command source is not among them: its breaker is closed by a successful
+// poll, so a task that happens to succeed cannot hide a failing poll.
+var taskCircuitClasses = []string{"provider_api", "db", "unknown"}
+
+// closeCircuits records a success on the breakers of classes, clearing their
+// failures, and logs circuit.closed for those that were not closed.
+func closeCircuits(database *sql.DB, workerEventID int64, breakers *control.BreakerSet, classes ...string) {
+	for _, class := range classes {
+		if prev, changed := breakers.RecordSuccess(class); changed && prev != control.CircuitClosed {
+			db.LogEvent(database, &workerEventID, db.EventCircuitClosed, map[string]any{
+				"error_class": class,
+				"recovered":   true,
+			})
+		}
+	}
+}
+
+// circuitStatusReply describes the saved breaker state of every error class
+// that has failed.
+func circuitStatusReply(database *sql.DB, cfg *config.WorkerConfig, now time.Time) (string, error) {
+	states, err := db.ListBreakerStates(database)
+	if err != nil {
+		return "", err
+	}
+	var b strings.Builder
+	b.WriteString("熔断器状态：")
+	listed := 0
+	for _, st := range states {
+		if st.State == string(control.CircuitClosed) && st.Failures == 0 {
+			continue
+		}
+		listed++
+		p := cfg.CircuitFor(st.Class)
+		fmt.Fprintf(&b, "\n- %s：%s，连续失败 %d/%d，冷却 %d 秒", st.Class, st.State, st.Failures, p.Threshold, p.CooldownSeconds)
+		if st.State == string(control.CircuitOpen) {
+			if left := st.OpenedAt + int64(p.CooldownSeconds) - now.Unix(); left > 0 {
+				fmt.Fprintf(&b, "，%d 秒后半开探测", left)
+			} else {
+				b.WriteString("，冷却已结束，等待探测")
+			}
+		}
+	}
+	if listed == 0 {
+		b.WriteString("全部关闭，没有失败记录")
+	}
+	return b.String(), nil
+}
+
+// spendStatusReply reports the recorded model spend of chatID and of all
+// chats.
+func spendStatusReply(database *sql.DB, chatID int64) (string, error) {
+	chat, err := db.ChatSpend(database, chatID)
+	if err != nil {
+		return "", err
+	}
+	total, err := db.TotalSpend(database)
+	if err != nil {
+		return "", err
+	}
+	return fmt.Sprintf("累计花费：本聊天 $%.4f，全部聊天 $%.4f", chat, total), nil
+}
+
+// tripsCircuit reports whether err says something about the health of a
+// dependency. Request-shaped provider failures (bad_request,
+// context_length_exceeded) do not count toward opening the circuit.
+func tripsCircuit(err error) bool {
+	perr, ok := modelpkg.AsError(err)
+	if !ok {
+		return true
+	}
+	return perr.Class.Retryable() || perr.Class == modelpkg.ErrAuth
 }
 
 func buildStateFingerprint(database *sql.DB, historyWindow int, chatID int64, taskID int64, errClass string, reply string) string {
@@ -1385,9 +2918,15 @@ func recentFingerprints(database *sql.DB, taskID int64, limit int) []string {
 	return result
 }
 
+// historyCount returns the number of messages in the chat's active session,
+// the history a retried task is built from.
 func historyCount(database *sql.DB, chatID int64) int {
 	var count int
-	if err := database.QueryRow("SELECT COUNT(*) FROM history WHERE chat_id = ?", chatID).Scan(&count); err != nil {
+	if err := database.QueryRow(
+		`SELECT COUNT(*) FROM history
+		 WHERE chat_id = ? AND session_id IS (SELECT session_id FROM active_sessions WHERE chat_id = ?)`,
+		chatID, chatID,
+	).Scan(&count); err != nil {
 		return 0
 	}
 	return count
@@ -1406,28 +2945,23 @@ func numberToInt64(v any) (int64, bool) {
 	}
 }
 
-func containsAny(s string, parts ...string) bool {
-	for _, p := range parts {
-		if p != "" && stringContainsFold(s, p) {
-			return true
-		}
+// taskContextError reports why the task context ended, or nil while it is
+// live. Hitting the wall-time deadline is recorded as a limit event just like
+// the post-call CheckWallTime; other cancellations return ctx.Err().
+func taskContextError(ctx context.Context, database *sql.DB, agentEventID int64, taskID int64, policy control.Policy, startedAt time.Time) error {
+	if ctx.Err() == nil {
+		return nil
 	}
-	return false
-}
-
-func stringContainsFold(s, substr string) bool {
-	return len(substr) == 0 || (len(s) >= len(substr) && (indexFold(s, substr) >= 0))
-}
-
-func indexFold(s, sep string) int {
-	ls := len(s)
-	lp := len(sep)
-	for i := 0; i+lp <= ls; i++ {
-		if strings.EqualFold(s[i:i+lp], sep) {
-			return i
-		}
+	if !errors.Is(ctx.Err(), context.DeadlineExceeded) {
+		return ctx.Err()
 	}
-	return -1
+	err := &control.LimitError{
+		Type:      control.LimitWallTime,
+		Value:     int64(time.Since(startedAt).Seconds()),
+		Threshold: int64(policy.MaxWallTime.Seconds()),
+	}
+	recordLimitEvent(database, agentEventID, taskID, err)
+	return err
 }
 
 func recordLimitEvent(database *sql.DB, agentEventID int64, taskID int64, err error) {
@@ -1435,37 +2969,57 @@ func recordLimitEvent(database *sql.DB, agentEventID int64, taskID int64, err er
 	if !ok {
 		return
 	}
-	db.LogEvent(database, &agentEventID, db.EventControlLimitReached, map[string]any{
+	payload := map[string]any{
 		"task_id":    taskID,
 		"limit_type": string(limitErr.Type),
 		"value":      limitErr.Value,
 		"threshold":  limitErr.Threshold,
-	})
+	}
+	if limitErr.Type == control.LimitCost {
+		payload["period"] = limitErr.Period
+		payload["value_usd"] = float64(limitErr.Value) / 1e6
+		payload["threshold_usd"] = float64(limitErr.Threshold) / 1e6
+	}
+	db.LogEvent(database, &agentEventID, db.EventControlLimitReached, payload)
 }
 
-func truncate(s string, maxChars int) string {
-	runes := []rune(s)
-	if len(runes) <= maxChars {
-		return s
+// checkSpendBudget compares today's and this month's spend across all chats
+// with the policy's budgets. The error is set only when spend could not be
+// read, in which case the task is not blocked.
+func checkSpendBudget(database *sql.DB, policy control.Policy, now time.Time) (*control.LimitError, error) {
+	if policy.MaxDailyCostUSD <= 0 && policy.MaxMonthlyCostUSD <= 0 {
+		return nil, nil
 	}
-	return string(runes[:maxChars])
+	today := db.SpendDay(now)
+	daily, err := db.SpendBetween(database, today, today)
+	if err != nil {
+		return nil, err
+	}
+	monthly, err := db.SpendBetween(database, db.MonthStartDay(now), today)
+	if err != nil {
+		return nil, err
+	}
+	if err := control.CheckCostBudget(policy, daily, monthly); err != nil {
+		return err.(*control.LimitError), nil
+	}
+	return nil, nil
 }
 
-func estimateTokens(text string) int {
-	chars := len([]rune(text))
-	if chars <= 0 {
-		return 0
+func budgetExceededReply(limitErr *control.LimitError) string {
+	period, reset := "每日", "UTC 次日"
+	if limitErr.Period == control.PeriodMonthly {
+		period, reset = "每月", "UTC 下月"
 	}
-	return (chars + 3) / 4
+	return fmt.Sprintf(
+		"已达到%s花费预算（已用 $%.4f / 预算 $%.2f），任务未执行。预算将于%s重置。",
+		period, float64(limitErr.Value)/1e6, float64(limitErr.Threshold)/1e6, reset,
+	)
 }
 
-func estimateTokensFromMessages(messages []ctxpkg.Message) int {
-	totalChars := 0
-	for _, msg := range messages {
-		totalChars += len([]rune(msg.Content))
-	}
-	if totalChars <= 0 {
-		return 0
+func truncate(s string, maxChars int) string {
+	runes := []rune(s)
+	if len(runes) <= maxChars {
+		return s
 	}
-	return (totalChars + 3) / 4
+	return string(runes[:maxChars])
 }
@@ -4,21 +4,33 @@ import (
 	"context"
 	"database/sql"
 	"encoding/json"
+	"errors"
+	"fmt"
 	"os"
 	"path/filepath"
+	"reflect"
+	"slices"
 	"strings"
+	"sync"
 	"testing"
 	"time"
 
-	_ "github.com/mattn/go-sqlite3"
+	"github.com/mattn/go-sqlite3"
+	"github.com/stupiduntilnot/autonous/internal/cassette"
 	cmdpkg "github.com/stupiduntilnot/autonous/internal/commander"
 	"github.com/stupiduntilnot/autonous/internal/config"
 	ctxpkg "github.com/stupiduntilnot/autonous/internal/context"
 	"github.com/stupiduntilnot/autonous/internal/control"
+	"github.com/stupiduntilnot/autonous/internal/cost"
 	"github.com/stupiduntilnot/autonous/internal/db"
 	"github.com/stupiduntilnot/autonous/internal/dummy"
+	"github.com/stupiduntilnot/autonous/internal/memory"
 	modelpkg "github.com/stupiduntilnot/autonous/internal/model"
+	"github.com/stupiduntilnot/autonous/internal/router"
+	"github.com/stupiduntilnot/autonous/internal/summary"
+	"github.com/stupiduntilnot/autonous/internal/tokenizer"
 	toolpkg "github.com/stupiduntilnot/autonous/internal/tool"
+	"github.com/stupiduntilnot/autonous/internal/vector"
 )
 
 func testWorkerDB(t *testing.T) *sql.DB {
@@ -37,13 +49,19 @@ func testWorkerDB(t *testing.T) *sql.DB {
 func TestRetryReady(t *testing.T) {
 	p := control.Policy{MaxRetries: 3}
 	now := time.Now().Unix()
-	if retryReady(1, now, now, p) {
+	if retryReady(1, now, 0, now, p) {
 		t.Fatal("attempt=1 should not be ready immediately (1s backoff)")
 	}
-	if !retryReady(1, now-2, now, p) {
+	if !retryReady(1, now-2, 0, now, p) {
 		t.Fatal("attempt=1 should be ready after backoff")
 	}
-	if retryReady(4, now-100, now, p) {
+	if retryReady(1, now-2, 10, now, p) {
+		t.Fatal("attempt=1 should wait for the server-provided retry-after")
+	}
+	if !retryReady(1, now-11, 10, now, p) {
+		t.Fatal("attempt=1 should be ready once retry-after elapsed")
+	}
+	if retryReady(4, now-100, 0, now, p) {
 		t.Fatal("attempt > max retries should never be ready")
 	}
 }
@@ -85,6 +103,589 @@ func TestClaimNextTask_RespectsRetryWindow(t *testing.T) {
 	}
 }
 
+func TestClaimNextTask_KeepsChatOrderAcrossRetries(t *testing.T) {
+	database := testWorkerDB(t)
+	p := control.Policy{MaxRetries: 3}
+	if _, err := database.Exec(
+		`INSERT INTO inbox (update_id, chat_id, text, message_date, status, attempts, updated_at) VALUES
+		 (1000, 1, 'exhausted', 0, 'failed', 4, 0),
+		 (1001, 1, 'retrying', 0, 'failed', 1, ?),
+		 (1002, 1, 'next', 0, 'queued', 0, ?)`,
+		time.Now().Unix(), time.Now().Unix(),
+	); err != nil {
+		t.Fatal(err)
+	}
+
+	// The queued message waits behind the earlier one still backing off.
+	if task, err := claimNextTask(database, p); err != nil || task != nil {
+		t.Fatalf("expected no task within backoff, got %+v err=%v", task, err)
+	}
+	if hasRunnableTasks(database, p) {
+		t.Fatal("expected nothing runnable within backoff")
+	}
+	database.Exec("UPDATE inbox SET updated_at = updated_at - 2 WHERE update_id = 1001")
+	var got []string
+	for {
+		task, err := claimNextTask(database, p)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if task == nil {
+			break
+		}
+		got = append(got, task.Text)
+		markTaskDone(database, task.ID)
+	}
+	if want := []string{"retrying", "next"}; !slices.Equal(got, want) {
+		t.Fatalf("claim order %v, want %v", got, want)
+	}
+}
+
+func TestReclaimExpiredLeases_RetriesOrExhaustsCrashedTasks(t *testing.T) {
+	database := testWorkerDB(t)
+	p := control.Policy{MaxRetries: 3}
+	now := time.Now()
+	for _, row := range []struct {
+		chat, attempts, lockedAt int64
+	}{
+		{1, 1, now.Unix() - 120}, // crashed, retries left
+		{2, 4, now.Unix() - 120}, // crashed on its last retry
+		{3, 1, now.Unix() - 10},  // still leased
+	} {
+		if _, err := database.Exec(
+			`INSERT INTO inbox (update_id, chat_id, text, message_date, status, attempts, locked_at)
+			 VALUES (?, ?, 'task', 0, 'in_progress', ?, ?)`,
+			1000+row.chat, row.chat, row.attempts, row.lockedAt,
+		); err != nil {
+			t.Fatal(err)
+		}
+	}
+	commander := &syncCommander{}
+	if n := reclaimExpiredLeases(database, commander, 0, p, time.Minute, now); n != 2 {
+		t.Fatalf("expected 2 reclaimed tasks, got %d", n)
+	}
+	var statuses []string
+	rows, err := database.Query("SELECT status || ':' || attempts FROM inbox ORDER BY chat_id")
+	if err != nil {
+		t.Fatal(err)
+	}
+	for rows.Next() {
+		var s string
+		rows.Scan(&s)
+		statuses = append(statuses, s)
+	}
+	rows.Close()
+	if strings.Join(statuses, ",") != "failed:1,failed:4,in_progress:1" {
+		t.Fatalf("unexpected inbox %v", statuses)
+	}
+	for eventType, want := range map[string]int{db.EventTaskLeaseExpired: 2, db.EventRetryScheduled: 1, db.EventRetryExhausted: 1} {
+		var n int
+		if err := database.QueryRow("SELECT COUNT(*) FROM events WHERE event_type = ?", eventType).Scan(&n); err != nil || n != want {
+			t.Fatalf("expected %d %s events, got %d err=%v", want, eventType, n, err)
+		}
+	}
+	if got := commander.take(2); !strings.Contains(got, "不再重试") {
+		t.Fatalf("expected the exhausted chat to be told, got %q", got)
+	}
+	if got := commander.take(1); got != "" {
+		t.Fatalf("expected no message for a task that will retry, got %q", got)
+	}
+
+	// The reclaimed task unblocks its chat and is retried after backoff.
+	if task, err := claimNextTask(database, p); err != nil || task != nil {
+		t.Fatalf("expected no task within backoff, got %+v err=%v", task, err)
+	}
+	database.Exec("UPDATE inbox SET updated_at = updated_at - 2 WHERE chat_id = 1")
+	task, err := claimNextTask(database, p)
+	if err != nil || task == nil || task.ChatID != 1 || task.Attempts != 2 {
+		t.Fatalf("expected chat 1 retried as attempt 2, got %+v err=%v", task, err)
+	}
+}
+
+func TestHasPendingTasks_CountsRetriesWaitingOutBackoff(t *testing.T) {
+	database := testWorkerDB(t)
+	p := control.Policy{MaxRetries: 3}
+	if hasPendingTasks(database, p) {
+		t.Fatal("expected an empty inbox to have nothing pending")
+	}
+	database.Exec(`INSERT INTO inbox (update_id, chat_id, text, message_date, status, attempts, updated_at)
+		VALUES (1, 1, 'done', 0, 'done', 1, 0), (2, 1, 'exhausted', 0, 'failed', 4, 0)`)
+	if hasPendingTasks(database, p) {
+		t.Fatal("expected done and exhausted tasks to be settled")
+	}
+	database.Exec(`INSERT INTO inbox (update_id, chat_id, text, message_date, status, attempts, updated_at)
+		VALUES (3, 1, 'backing off', 0, 'failed', 1, ?)`, time.Now().Unix())
+	if !hasPendingTasks(database, p) {
+		t.Fatal("expected a task waiting out its backoff to be pending")
+	}
+}
+
+func TestRenewLease_KeepsRunningTaskLeased(t *testing.T) {
+	database := testWorkerDB(t)
+	if _, err := database.Exec(
+		`INSERT INTO inbox (update_id, chat_id, text, message_date, status, attempts, locked_at)
+		 VALUES (1001, 1, 'task', 0, 'in_progress', 1, ?)`, time.Now().Unix()-120,
+	); err != nil {
+		t.Fatal(err)
+	}
+	release := renewLease(database, 1, 10*time.Millisecond)
+	time.Sleep(50 * time.Millisecond)
+	release()
+	if n := reclaimExpiredLeases(database, &syncCommander{}, 0, control.Policy{MaxRetries: 3}, time.Minute, time.Now()); n != 0 {
+		t.Fatalf("expected a renewed lease to be kept, reclaimed %d", n)
+	}
+}
+
+func TestClaimNextTask_RoundRobinAcrossChats(t *testing.T) {
+	database := testWorkerDB(t)
+	for i, m := range []struct {
+		chat int64
+		text string
+	}{{1, "a1"}, {1, "a2"}, {1, "a3"}, {2, "b1"}, {3, "c1"}} {
+		if _, err := enqueueMessage(database, int64(100+i), m.chat, m.text, 0); err != nil {
+			t.Fatal(err)
+		}
+	}
+	var got []string
+	for {
+		task, err := claimNextTask(database, control.Policy{})
+		if err != nil {
+			t.Fatal(err)
+		}
+		if task == nil {
+			break
+		}
+		got = append(got, task.Text)
+		markTaskDone(database, task.ID)
+		if task.Text == "a1" {
+			// A chat that shows up later still gets its turn before chat 1's backlog.
+			if _, err := enqueueMessage(database, 200, 4, "d1", 0); err != nil {
+				t.Fatal(err)
+			}
+		}
+	}
+	if want := []string{"a1", "b1", "c1", "d1", "a2", "a3"}; !slices.Equal(got, want) {
+		t.Fatalf("claim order %v, want %v", got, want)
+	}
+}
+
+// gateProvider announces each call's user message on started and answers
+// once release is closed.
+type gateProvider struct {
+	started chan string
+	release chan struct{}
+}
+
+func (g *gateProvider) ChatCompletion(ctx context.Context, messages []ctxpkg.Message) (modelpkg.CompletionResponse, error) {
+	for i := len(messages) - 1; i >= 0; i-- {
+		if messages[i].Role == "user" {
+			g.started <- messages[i].Content
+			break
+		}
+	}
+	<-g.release
+	return modelpkg.CompletionResponse{Content: "{\"tool_calls\":[],\"final_answer\":\"done\"}"}, nil
+}
+
+// syncCommander is a captureCommander safe for concurrent tasks.
+type syncCommander struct {
+	mu    sync.Mutex
+	sends map[int64]int
+	last  map[int64]string
+}
+
+// take returns the last message sent to chatID and forgets it.
+func (c *syncCommander) take(chatID int64) string {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	text := c.last[chatID]
+	delete(c.last, chatID)
+	return text
+}
+
+func (c *syncCommander) GetUpdates(offset int64, timeout int) ([]cmdpkg.Update, error) {
+	return nil, nil
+}
+
+func (c *syncCommander) SendMessage(ctx context.Context, chatID int64, text string) error {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	if c.sends == nil {
+		c.sends, c.last = map[int64]int{}, map[int64]string{}
+	}
+	c.sends[chatID]++
+	c.last[chatID] = text
+	return nil
+}
+
+// testExecutor returns an executor for tasks of database.
+func testExecutor(database *sql.DB, commander cmdpkg.Commander, provider modelpkg.Provider, reg *toolpkg.Registry) *executor {
+	cfg := &config.WorkerConfig{OpenAIModel: "dummy", HistoryWindow: 12, TaskLeaseSeconds: 60}
+	return &executor{
+		database:    database,
+		commander:   commander,
+		cfg:         cfg,
+		prompts:     newPromptLoader(cfg),
+		model:       provider,
+		ctxProvider: &ctxpkg.SQLiteProvider{DB: database},
+		compressor:  &ctxpkg.SimpleCompressor{MaxMessages: 12},
+		assembler:   &ctxpkg.StandardAssembler{},
+		policy:      control.Policy{MaxTurns: 4, MaxWallTime: 30 * time.Second, MaxTokens: 1000, MaxRetries: 3},
+		registry:    reg,
+		runner:      toolpkg.NewRunner(reg),
+		breakers:    newBreakerSet(database, &config.WorkerConfig{ControlCircuitThreshold: 5, ControlCircuitCooldownSec: 30}),
+	}
+}
+
+func TestTaskPool_ParallelAcrossChatsSerialWithinChat(t *testing.T) {
+	database := testWorkerDB(t)
+	for i, m := range []struct {
+		chat int64
+		text string
+	}{{1, "a1"}, {1, "a2"}, {2, "b1"}} {
+		if _, err := enqueueMessage(database, int64(100+i), m.chat, m.text, 0); err != nil {
+			t.Fatal(err)
+		}
+	}
+	gate := &gateProvider{started: make(chan string, 3), release: make(chan struct{})}
+	commander := &syncCommander{}
+	pool := newTaskPool(testExecutor(database, commander, gate, toolpkg.NewRegistry()), 4)
+
+	if n := pool.dispatch(); n != 2 {
+		t.Fatalf("expected one task per chat to start, started %d", n)
+	}
+	var inFlight []string
+	for len(inFlight) < 2 {
+		select {
+		case text := <-gate.started:
+			inFlight = append(inFlight, text)
+		case <-time.After(5 * time.Second):
+			t.Fatalf("expected both chats in flight at once, got %v", inFlight)
+		}
+	}
+	slices.Sort(inFlight)
+	if !slices.Equal(inFlight, []string{"a1", "b1"}) {
+		t.Fatalf("expected a1 and b1 in flight, got %v", inFlight)
+	}
+	if pool.dispatch() != 0 || hasRunnableTasks(database, control.Policy{}) {
+		t.Fatal("expected a2 to wait while chat 1 has a task in progress")
+	}
+	close(gate.release)
+	select {
+	case text := <-gate.started:
+		if text != "a2" {
+			t.Fatalf("expected a2 next, got %s", text)
+		}
+	case <-time.After(5 * time.Second):
+		t.Fatal("expected a2 to start once a1 finished")
+	}
+	pool.wg.Wait()
+
+	var notDone int
+	if err := database.QueryRow(`SELECT COUNT(*) FROM inbox WHERE status != 'done'`).Scan(&notDone); err != nil || notDone != 0 {
+		t.Fatalf("expected every task done, %d are not (err=%v)", notDone, err)
+	}
+	if commander.sends[1] != 2 || commander.sends[2] != 1 {
+		t.Fatalf("unexpected replies per chat %v", commander.sends)
+	}
+	// Every run's events stay under its own agent.started.
+	rows, err := database.Query(`
+		SELECT json_extract(a.payload, '$.chat_id'), json_extract(e.payload, '$.chat_id')
+		FROM events e JOIN events a ON a.id = e.parent_id
+		WHERE a.event_type = ? AND e.event_type = ?`, db.EventAgentStarted, db.EventReplySent)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer rows.Close()
+	replies := 0
+	for rows.Next() {
+		var runChat, replyChat int64
+		if err := rows.Scan(&runChat, &replyChat); err != nil {
+			t.Fatal(err)
+		}
+		if runChat != replyChat {
+			t.Fatalf("reply.sent for chat %d logged under a run of chat %d", replyChat, runChat)
+		}
+		replies++
+	}
+	var runsWithTurns int
+	if err := database.QueryRow(`SELECT COUNT(DISTINCT e.parent_id) FROM events e JOIN events a ON a.id = e.parent_id
+		WHERE a.event_type = ? AND e.event_type = ?`, db.EventAgentStarted, db.EventTurnStarted).Scan(&runsWithTurns); err != nil {
+		t.Fatal(err)
+	}
+	if replies != 3 || runsWithTurns != 3 {
+		t.Fatalf("expected a reply and turns under each of 3 runs, got %d replies, %d runs with turns", replies, runsWithTurns)
+	}
+	var a1Done, a2Started int64
+	if err := database.QueryRow(`SELECT id FROM events WHERE event_type = ? AND json_extract(payload, '$.task_id') = 1`, db.EventAgentCompleted).Scan(&a1Done); err != nil {
+		t.Fatal(err)
+	}
+	if err := database.QueryRow(`SELECT id FROM events WHERE event_type = ? AND json_extract(payload, '$.task_id') = 2`, db.EventAgentStarted).Scan(&a2Started); err != nil {
+		t.Fatal(err)
+	}
+	if a2Started < a1Done {
+		t.Fatalf("a2 started (event %d) before a1 completed (event %d)", a2Started, a1Done)
+	}
+}
+
+// stallProvider asks for ls once, then announces its second call on stalled
+// and waits for the task to be cancelled.
+type stallProvider struct {
+	calls   int
+	stalled chan struct{}
+}
+
+func (p *stallProvider) ChatCompletion(ctx context.Context, messages []ctxpkg.Message) (modelpkg.CompletionResponse, error) {
+	p.calls++
+	if p.calls == 1 {
+		return modelpkg.CompletionResponse{Content: "{\"tool_calls\":[{\"name\":\"ls\",\"arguments\":{\"path\":\".\"}}],\"final_answer\":\"\"}"}, nil
+	}
+	close(p.stalled)
+	<-ctx.Done()
+	return modelpkg.CompletionResponse{}, ctx.Err()
+}
+
+func TestExecutorRun_SuccessClosesOnlyTaskCircuits(t *testing.T) {
+	database := testWorkerDB(t)
+	if _, err := enqueueMessage(database, 100, 1, "hi", 0); err != nil {
+		t.Fatal(err)
+	}
+	provider := &seqProvider{resps: []modelpkg.CompletionResponse{{Content: "hello", InputTokens: 1, OutputTokens: 1}}}
+	exec := testExecutor(database, &syncCommander{}, provider, toolpkg.NewRegistry())
+	recordCircuitFailure(database, 0, exec.breakers, "provider_api")
+	recordCircuitFailure(database, 0, exec.breakers, "command_source_api")
+
+	task, err := claimNextTask(database, exec.policy)
+	if err != nil || task == nil {
+		t.Fatalf("expected a task, got %+v err=%v", task, err)
+	}
+	exec.run(task)
+	var status string
+	if err := database.QueryRow("SELECT status FROM inbox WHERE id = ?", task.ID).Scan(&status); err != nil || status != "done" {
+		t.Fatalf("expected the task done, got %q err=%v", status, err)
+	}
+	if n := exec.breakers.Snapshot("provider_api").Failures; n != 0 {
+		t.Fatalf("expected the task to clear provider_api failures, got %d", n)
+	}
+	// A model success says nothing about the command source.
+	if n := exec.breakers.Snapshot("command_source_api").Failures; n != 1 {
+		t.Fatalf("expected command_source_api failures kept, got %d", n)
+	}
+}
+
+func TestExecutorRun_RouterFailureListsBackends(t *testing.T) {
+	database := testWorkerDB(t)
+	if _, err := enqueueMessage(database, 100, 1, "hi", 0); err != nil {
+		t.Fatal(err)
+	}
+	backends := make([]router.Backend, 0, 2)
+	for _, name := range []string{"primary", "backup"} {
+		p, err := dummy.NewProvider("dummy", "err:provider_api")
+		if err != nil {
+			t.Fatal(err)
+		}
+		backends = append(backends, router.Backend{Name: name, Model: "dummy", Provider: p})
+	}
+	provider, err := router.New(backends, 3, time.Minute)
+	if err != nil {
+		t.Fatal(err)
+	}
+	exec := testExecutor(database, &syncCommander{}, provider, toolpkg.NewRegistry())
+	task, err := claimNextTask(database, exec.policy)
+	if err != nil || task == nil {
+		t.Fatalf("expected a task, got %+v err=%v", task, err)
+	}
+	exec.run(task)
+	var first, second string
+	if err := database.QueryRow(
+		"SELECT json_extract(payload, '$.router_failures[0].backend'), json_extract(payload, '$.router_failures[1].backend') FROM events WHERE event_type = ?",
+		db.EventAgentFailed,
+	).Scan(&first, &second); err != nil {
+		t.Fatal(err)
+	}
+	if first != "primary" || second != "backup" {
+		t.Fatalf("expected both backends in agent.failed, got %q, %q", first, second)
+	}
+}
+
+func TestTaskPool_HalfOpenBreakerAdmitsOneProbe(t *testing.T) {
+	database := testWorkerDB(t)
+	for i, chat := range []int64{1, 2, 3} {
+		if _, err := enqueueMessage(database, int64(100+i), chat, fmt.Sprintf("c%d", chat), 0); err != nil {
+			t.Fatal(err)
+		}
+	}
+	gate := &gateProvider{started: make(chan string, 3), release: make(chan struct{})}
+	exec := testExecutor(database, &syncCommander{}, gate, toolpkg.NewRegistry())
+	exec.breakers.Restore("provider_api", control.BreakerSnapshot{State: control.CircuitHalfOpen, Failures: 5, OpenedAt: time.Now().Add(-time.Hour)})
+	pool := newTaskPool(exec, 4)
+
+	if n := pool.dispatch(); n != 1 {
+		t.Fatalf("expected a single probe while half-open, started %d", n)
+	}
+	<-gate.started
+	if n := pool.dispatch(); n != 0 {
+		t.Fatalf("expected no task beside the probe, started %d", n)
+	}
+	// The probe succeeds and closes the breaker; the others then run together.
+	gate.release <- struct{}{}
+	for i := 0; i < 2; i++ {
+		select {
+		case <-gate.started:
+		case <-time.After(5 * time.Second):
+			t.Fatal("expected the remaining tasks to start once the probe closed the breaker")
+		}
+	}
+	if exec.breakers.State("provider_api") != control.CircuitClosed {
+		t.Fatalf("expected provider_api closed, got %s", exec.breakers.State("provider_api"))
+	}
+	close(gate.release)
+	pool.wg.Wait()
+}
+
+func TestHandleStop_CancelsRunningTask(t *testing.T) {
+	database := testWorkerDB(t)
+	base := t.TempDir()
+	p, err := toolpkg.NewPolicy(base, "")
+	if err != nil {
+		t.Fatal(err)
+	}
+	reg := toolpkg.NewRegistry()
+	if err := reg.Register(toolpkg.NewLS(p, base, 2*time.Second, toolpkg.Limits{MaxLines: 100, MaxBytes: 4096})); err != nil {
+		t.Fatal(err)
+	}
+	provider := &stallProvider{stalled: make(chan struct{})}
+	commander := &syncCommander{}
+	pool := newTaskPool(testExecutor(database, commander, provider, reg), 2)
+	for i, m := range []struct {
+		chat int64
+		text string
+	}{{1, "list files forever"}, {1, "queued behind it"}} {
+		if _, err := enqueueMessage(database, int64(100+i), m.chat, m.text, 0); err != nil {
+			t.Fatal(err)
+		}
+	}
+	running := &pool.exec.running
+
+	stop := func(chatID int64, text string) string {
+		t.Helper()
+		if !handleStop(database, commander, running, chatID, text) {
+			t.Fatalf("%s: not handled as /stop", text)
+		}
+		return commander.take(chatID)
+	}
+	if handleStop(database, commander, running, 1, "/stopwatch") {
+		t.Fatal("expected /stopwatch not to be a /stop")
+	}
+	if reply := stop(1, "/stop"); !strings.Contains(reply, "当前没有正在执行的任务") {
+		t.Fatalf("unexpected reply with nothing running: %s", reply)
+	}
+	if reply := stop(1, "/stop x"); !strings.Contains(reply, "无效的任务编号") {
+		t.Fatalf("unexpected reply for a bad id: %s", reply)
+	}
+
+	if n := pool.dispatch(); n != 1 {
+		t.Fatalf("expected one task started, got %d", n)
+	}
+	select {
+	case <-provider.stalled:
+	case <-time.After(5 * time.Second):
+		t.Fatal("task never reached its second model call")
+	}
+	if reply := stop(2, "/stop 1"); !strings.Contains(reply, "任务 #1 不在执行中") {
+		t.Fatalf("expected another chat unable to stop task 1, got %s", reply)
+	}
+	if reply := stop(1, "/stop 2"); !strings.Contains(reply, "已取消尚未执行的任务 #2") {
+		t.Fatalf("unexpected reply cancelling a queued task: %s", reply)
+	}
+	if !handleStop(database, commander, running, 1, "/stop@autonous_bot") {
+		t.Fatal("expected /stop@bot handled")
+	}
+	pool.wg.Wait()
+
+	if reply := commander.take(1); !strings.Contains(reply, "已停止任务 #1。已完成 1 轮模型调用，执行了 1 个工具调用：") || !strings.Contains(reply, "- ls ") || !strings.Contains(reply, "（完成）") {
+		t.Fatalf("unexpected cancel reply: %s", reply)
+	}
+	if commander.sends[1] != 4 {
+		t.Fatalf("expected the run's reply to be its only message after /stop, got %d messages", commander.sends[1])
+	}
+	var statuses []string
+	rows, err := database.Query(`SELECT status FROM inbox ORDER BY id`)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer rows.Close()
+	for rows.Next() {
+		var status string
+		if err := rows.Scan(&status); err != nil {
+			t.Fatal(err)
+		}
+		statuses = append(statuses, status)
+	}
+	if !slices.Equal(statuses, []string{"cancelled", "cancelled"}) {
+		t.Fatalf("expected both tasks cancelled, got %v", statuses)
+	}
+	var payload string
+	if err := database.QueryRow(`SELECT payload FROM events WHERE event_type = ?`, db.EventAgentCancelled).Scan(&payload); err != nil {
+		t.Fatal(err)
+	}
+	if !strings.Contains(payload, `"task_id":1`) || !strings.Contains(payload, `"tool_calls":1`) {
+		t.Fatalf("unexpected agent.cancelled payload: %s", payload)
+	}
+	var failures int
+	if err := database.QueryRow(`SELECT COUNT(*) FROM events WHERE event_type IN (?, ?, ?)`, db.EventAgentFailed, db.EventRetryScheduled, db.EventCircuitOpened).Scan(&failures); err != nil || failures != 0 {
+		t.Fatalf("expected a stop not to count as a failure, got %d err=%v", failures, err)
+	}
+}
+
+func TestEnqueueUpdates_ThrottlesChatsOverRateLimit(t *testing.T) {
+	database := testWorkerDB(t)
+	commander := &captureCommander{}
+	limiter := newRateLimiter(&config.WorkerConfig{
+		ControlRatePerMinute: 1,
+		ControlRateBurst:     2,
+		ControlRateChats:     map[int64]config.ChatRate{2: {PerMinute: 0, Burst: 1}},
+	})
+	update := func(id, chat int64) cmdpkg.Update {
+		text := fmt.Sprintf("msg %d", id)
+		return cmdpkg.Update{UpdateID: id, Message: &cmdpkg.Message{Chat: cmdpkg.Chat{ID: chat}, Text: &text}}
+	}
+	updates := []cmdpkg.Update{update(1, 1), update(2, 1), update(3, 1), update(4, 2), update(5, 2), update(6, 2)}
+	if offset := enqueueUpdates(database, commander, limiter, 0, updates, 0, nil); offset != 7 {
+		t.Fatalf("expected offset 7, got %d", offset)
+	}
+	counts := map[string]int{}
+	rows, err := database.Query(`SELECT status, COUNT(*) FROM inbox GROUP BY status`)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer rows.Close()
+	for rows.Next() {
+		var status string
+		var n int
+		if err := rows.Scan(&status, &n); err != nil {
+			t.Fatal(err)
+		}
+		counts[status] = n
+	}
+	if counts["queued"] != 5 || counts["throttled"] != 1 {
+		t.Fatalf("expected 5 queued and 1 throttled, got %v", counts)
+	}
+	if !strings.Contains(commander.last, "消息太频繁") || !strings.Contains(commander.last, "60 秒后再发") {
+		t.Fatalf("unexpected throttle reply: %q", commander.last)
+	}
+	var payload string
+	if err := database.QueryRow(`SELECT payload FROM events WHERE event_type = ?`, db.EventControlRateLimited).Scan(&payload); err != nil {
+		t.Fatal(err)
+	}
+	if !strings.Contains(payload, `"update_id":3`) || !strings.Contains(payload, `"per_minute":1`) {
+		t.Fatalf("unexpected rate_limited payload: %s", payload)
+	}
+	if task, err := claimNextTask(database, control.Policy{}); err != nil || task == nil || task.Text != "msg 1" {
+		t.Fatalf("expected the first queued message to be claimed, got %+v err=%v", task, err)
+	}
+}
+
 func TestProcessTask_RecordsLimitEvent(t *testing.T) {
 	database := testWorkerDB(t)
 	commander, err := dummy.NewCommander("ok", "ok")
@@ -123,7 +724,7 @@ func TestProcessTask_RecordsLimitEvent(t *testing.T) {
 
 	reg := toolpkg.NewRegistry()
 	runner := toolpkg.NewRunner(reg)
-	err = processTask(database, commander, provider, cfg, task, agentEventID, ctxProvider, ctxCompressor, ctxAssembler, policy, reg, runner)
+	err = processTask(context.Background(), database, commander, provider, cfg, task, agentEventID, ctxProvider, ctxCompressor, ctxAssembler, policy, reg, runner)
 	if err == nil {
 		t.Fatal("expected limit error")
 	}
@@ -173,7 +774,7 @@ func TestProcessTask_RecordsTokenLimitEvent(t *testing.T) {
 	}
 	reg := toolpkg.NewRegistry()
 	runner := toolpkg.NewRunner(reg)
-	err = processTask(database, commander, provider, cfg, task, agentEventID, ctxProvider, ctxCompressor, ctxAssembler, policy, reg, runner)
+	err = processTask(context.Background(), database, commander, provider, cfg, task, agentEventID, ctxProvider, ctxCompressor, ctxAssembler, policy, reg, runner)
 	if err == nil {
 		t.Fatal("expected token limit error")
 	}
@@ -187,51 +788,163 @@ func TestProcessTask_RecordsTokenLimitEvent(t *testing.T) {
 	}
 }
 
-func TestProgressStalled_UsesRecentFingerprints(t *testing.T) {
+func TestProcessTask_WallTimeCancelsInFlightModelCall(t *testing.T) {
 	database := testWorkerDB(t)
-	taskID := int64(42)
-	fp := "task=42|hist=0|comp=0|err=provider_api|reply="
-
-	payload, _ := json.Marshal(map[string]any{
-		"task_id":           taskID,
-		"state_fingerprint": fp,
-	})
-	if _, err := database.Exec(
-		"INSERT INTO events (event_type, payload) VALUES (?, ?), (?, ?)",
-		db.EventRetryScheduled, string(payload),
-		db.EventRetryScheduled, string(payload),
-	); err != nil {
+	commander, err := dummy.NewCommander("ok", "ok")
+	if err != nil {
 		t.Fatal(err)
 	}
-
-	if !progressStalled(database, taskID, fp, 3) {
-		t.Fatal("expected progress stalled for repeated fingerprints")
+	provider, err := dummy.NewProvider("dummy", "sleep:5000")
+	if err != nil {
+		t.Fatal(err)
 	}
-}
 
-type seqProvider struct {
-	resps []modelpkg.CompletionResponse
-	idx   int
-}
+	cfg := &config.WorkerConfig{
+		OpenAIModel:   "dummy",
+		SystemPrompt:  "sys",
+		HistoryWindow: 12,
+	}
+	task := &queueTask{ID: 3, ChatID: 1, UpdateID: 3, Text: "hello"}
+	ctxProvider := &ctxpkg.SQLiteProvider{DB: database}
+	ctxCompressor := &ctxpkg.SimpleCompressor{MaxMessages: 12}
+	ctxAssembler := &ctxpkg.StandardAssembler{}
+	policy := control.Policy{
+		MaxTurns:    3,
+		MaxWallTime: 200 * time.Millisecond,
+		MaxRetries:  3,
+	}
 
-func (s *seqProvider) ChatCompletion(messages []ctxpkg.Message) (modelpkg.CompletionResponse, error) {
-	if s.idx >= len(s.resps) {
-		return modelpkg.CompletionResponse{Content: "{\"tool_calls\":[],\"final_answer\":\"done\"}"}, nil
+	agentEventID, err := db.LogEvent(database, nil, db.EventAgentStarted, map[string]any{"task_id": 3})
+	if err != nil {
+		t.Fatal(err)
+	}
+	reg := toolpkg.NewRegistry()
+	runner := toolpkg.NewRunner(reg)
+	started := time.Now()
+	err = processTask(context.Background(), database, commander, provider, cfg, task, agentEventID, ctxProvider, ctxCompressor, ctxAssembler, policy, reg, runner)
+	if elapsed := time.Since(started); elapsed > 2*time.Second {
+		t.Fatalf("expected model call abandoned at the deadline, took %s", elapsed)
+	}
+	limitErr, ok := err.(*control.LimitError)
+	if !ok || limitErr.Type != control.LimitWallTime {
+		t.Fatalf("expected wall time limit error, got %v", err)
 	}
-	i := s.idx
-	s.idx++
-	return s.resps[i], nil
-}
 
-type captureCommander struct {
-	last string
+	var limitType string
+	if qerr := database.QueryRow(
+		"SELECT json_extract(payload, '$.limit_type') FROM events WHERE event_type = ?",
+		db.EventControlLimitReached,
+	).Scan(&limitType); qerr != nil {
+		t.Fatal(qerr)
+	}
+	if limitType != string(control.LimitWallTime) {
+		t.Fatalf("expected limit_type %s, got %s", control.LimitWallTime, limitType)
+	}
+}
+
+func TestProcessTask_CancelledContextStopsTask(t *testing.T) {
+	database := testWorkerDB(t)
+	commander, err := dummy.NewCommander("ok", "ok")
+	if err != nil {
+		t.Fatal(err)
+	}
+	provider, err := dummy.NewProvider("dummy", "ok")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	cfg := &config.WorkerConfig{
+		OpenAIModel:   "dummy",
+		SystemPrompt:  "sys",
+		HistoryWindow: 12,
+	}
+	task := &queueTask{ID: 4, ChatID: 1, UpdateID: 4, Text: "hello"}
+	policy := control.Policy{MaxTurns: 3, MaxWallTime: 120 * time.Second, MaxRetries: 3}
+	agentEventID, err := db.LogEvent(database, nil, db.EventAgentStarted, map[string]any{"task_id": 4})
+	if err != nil {
+		t.Fatal(err)
+	}
+	reg := toolpkg.NewRegistry()
+	ctx, cancel := context.WithCancel(context.Background())
+	cancel()
+	err = processTask(ctx, database, commander, provider, cfg, task, agentEventID,
+		&ctxpkg.SQLiteProvider{DB: database}, &ctxpkg.SimpleCompressor{MaxMessages: 12}, &ctxpkg.StandardAssembler{},
+		policy, reg, toolpkg.NewRunner(reg))
+	if err != context.Canceled {
+		t.Fatalf("expected context.Canceled, got %v", err)
+	}
+
+	var cnt int
+	if qerr := database.QueryRow("SELECT COUNT(*) FROM events WHERE event_type = ?", db.EventControlLimitReached).Scan(&cnt); qerr != nil {
+		t.Fatal(qerr)
+	}
+	if cnt != 0 {
+		t.Fatalf("expected cancellation not to be recorded as a limit, got %d events", cnt)
+	}
+}
+
+func TestProgressStalled_UsesRecentFingerprints(t *testing.T) {
+	database := testWorkerDB(t)
+	taskID := int64(42)
+	fp := "task=42|hist=0|comp=0|err=provider_api|reply="
+
+	payload, _ := json.Marshal(map[string]any{
+		"task_id":           taskID,
+		"state_fingerprint": fp,
+	})
+	if _, err := database.Exec(
+		"INSERT INTO events (event_type, payload) VALUES (?, ?), (?, ?)",
+		db.EventRetryScheduled, string(payload),
+		db.EventRetryScheduled, string(payload),
+	); err != nil {
+		t.Fatal(err)
+	}
+
+	if !progressStalled(database, taskID, fp, 3) {
+		t.Fatal("expected progress stalled for repeated fingerprints")
+	}
+}
+
+func TestBuildStateFingerprint_CountsActiveSession(t *testing.T) {
+	database := testWorkerDB(t)
+	appendHistory(database, 1, "user", "old task")
+	appendHistory(database, 1, "assistant", "old answer")
+	appendHistory(database, 2, "user", "other chat")
+	if fp := buildStateFingerprint(database, 12, 1, 42, "provider_api", ""); fp != "task=42|hist=2|comp=2|err=provider_api|reply=" {
+		t.Fatalf("unexpected fingerprint before /new: %s", fp)
+	}
+	if _, err := db.NewSession(database, 1); err != nil {
+		t.Fatal(err)
+	}
+	appendHistory(database, 1, "user", "new task")
+	if fp := buildStateFingerprint(database, 12, 1, 42, "provider_api", ""); fp != "task=42|hist=1|comp=1|err=provider_api|reply=" {
+		t.Fatalf("expected only the new session counted, got %s", fp)
+	}
+}
+
+type seqProvider struct {
+	resps []modelpkg.CompletionResponse
+	idx   int
+}
+
+func (s *seqProvider) ChatCompletion(ctx context.Context, messages []ctxpkg.Message) (modelpkg.CompletionResponse, error) {
+	if s.idx >= len(s.resps) {
+		return modelpkg.CompletionResponse{Content: "{\"tool_calls\":[],\"final_answer\":\"done\"}"}, nil
+	}
+	i := s.idx
+	s.idx++
+	return s.resps[i], nil
+}
+
+type captureCommander struct {
+	last string
 }
 
 func (c *captureCommander) GetUpdates(offset int64, timeout int) ([]cmdpkg.Update, error) {
 	return nil, nil
 }
 
-func (c *captureCommander) SendMessage(chatID int64, text string) error {
+func (c *captureCommander) SendMessage(ctx context.Context, chatID int64, text string) error {
 	c.last = text
 	return nil
 }
@@ -242,7 +955,7 @@ type approvalCaptureCommander struct {
 	approveText string
 }
 
-func (c *approvalCaptureCommander) SendApprovalRequest(chatID int64, text string, txID string) error {
+func (c *approvalCaptureCommander) SendApprovalRequest(ctx context.Context, chatID int64, text string, txID string) error {
 	c.approveText = text
 	c.approveTxID = txID
 	return nil
@@ -286,7 +999,7 @@ func TestProcessTask_ToolLoopLS(t *testing.T) {
 	}
 	runner := toolpkg.NewRunner(reg)
 
-	if err := processTask(database, commander, provider, cfg, task, agentEventID, ctxProvider, ctxCompressor, ctxAssembler, policy, reg, runner); err != nil {
+	if err := processTask(context.Background(), database, commander, provider, cfg, task, agentEventID, ctxProvider, ctxCompressor, ctxAssembler, policy, reg, runner); err != nil {
 		t.Fatalf("processTask failed: %v", err)
 	}
 	if commander.last != "tool done" {
@@ -301,90 +1014,365 @@ func TestProcessTask_ToolLoopLS(t *testing.T) {
 	}
 }
 
-func TestLoadSystemPrompt_FromFile(t *testing.T) {
-	dir := t.TempDir()
-	file := filepath.Join(dir, "AUTONOUS.md")
-	content := "系统指令\n配置目录占位符={AUTONOUS_CONFIG_DIR}"
-	if err := os.WriteFile(file, []byte(content), 0o644); err != nil {
+type nativeSeqProvider struct {
+	seqProvider
+	calls [][]ctxpkg.Message
+	tools []modelpkg.ToolDefinition
+}
+
+func (s *nativeSeqProvider) ChatCompletionWithTools(ctx context.Context, messages []ctxpkg.Message, tools []modelpkg.ToolDefinition) (modelpkg.CompletionResponse, error) {
+	s.calls = append(s.calls, append([]ctxpkg.Message(nil), messages...))
+	s.tools = tools
+	if s.idx >= len(s.resps) {
+		return modelpkg.CompletionResponse{Content: "done"}, nil
+	}
+	i := s.idx
+	s.idx++
+	return s.resps[i], nil
+}
+
+func TestProcessTask_NativeToolCalls(t *testing.T) {
+	database := testWorkerDB(t)
+	base := t.TempDir()
+	if err := os.WriteFile(filepath.Join(base, "hello.txt"), []byte("hello"), 0o644); err != nil {
 		t.Fatal(err)
 	}
+	commander := &captureCommander{}
+	provider := &nativeSeqProvider{seqProvider: seqProvider{
+		resps: []modelpkg.CompletionResponse{
+			{
+				ToolCalls:    []ctxpkg.ToolCall{{ID: "call_1", Name: "ls", Arguments: json.RawMessage(`{"path":"."}`)}},
+				InputTokens:  1,
+				OutputTokens: 1,
+			},
+			{Content: "native done", InputTokens: 1, OutputTokens: 1},
+		},
+	}}
 	cfg := &config.WorkerConfig{
-		ConfigDir:        dir,
-		SystemPromptFile: file,
-		SystemPromptEnv:  "env prompt",
+		OpenAIModel:   "dummy",
+		SystemPrompt:  "sys",
+		HistoryWindow: 12,
+	}
+	task := &queueTask{ID: 6, ChatID: 1, UpdateID: 6, Text: "list files"}
+	ctxProvider := &ctxpkg.SQLiteProvider{DB: database}
+	ctxCompressor := &ctxpkg.SimpleCompressor{MaxMessages: 12}
+	ctxAssembler := &ctxpkg.StandardAssembler{}
+	policy := control.Policy{MaxTurns: 2, MaxWallTime: 120 * time.Second, MaxTokens: 1000, MaxRetries: 3}
+	agentEventID, err := db.LogEvent(database, nil, db.EventAgentStarted, map[string]any{"task_id": 6})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	p, err := toolpkg.NewPolicy(base, "")
+	if err != nil {
+		t.Fatal(err)
 	}
-	prompt, source, size, readErr := loadSystemPrompt(cfg)
-	if readErr != nil {
-		t.Fatal(readErr)
+	reg := toolpkg.NewRegistry()
+	if err := reg.Register(toolpkg.NewLS(p, base, 2*time.Second, toolpkg.Limits{MaxLines: 100, MaxBytes: 4096})); err != nil {
+		t.Fatal(err)
+	}
+	runner := toolpkg.NewRunner(reg)
+
+	if err := processTask(context.Background(), database, commander, provider, cfg, task, agentEventID, ctxProvider, ctxCompressor, ctxAssembler, policy, reg, runner); err != nil {
+		t.Fatalf("processTask failed: %v", err)
+	}
+	if commander.last != "native done" {
+		t.Fatalf("unexpected final reply: %q", commander.last)
+	}
+	if len(provider.tools) != 1 || provider.tools[0].Name != "ls" {
+		t.Fatalf("expected ls tool definition, got %+v", provider.tools)
+	}
+	if len(provider.calls) != 2 {
+		t.Fatalf("expected 2 native calls, got %d", len(provider.calls))
+	}
+	second := provider.calls[1]
+	if len(second) < 2 {
+		t.Fatalf("unexpected second call messages: %+v", second)
 	}
-	if source != "file" {
-		t.Fatalf("unexpected source: %s", source)
+	assistant := second[len(second)-2]
+	toolMsg := second[len(second)-1]
+	if assistant.Role != "assistant" || len(assistant.ToolCalls) != 1 || assistant.ToolCalls[0].ID != "call_1" {
+		t.Fatalf("unexpected assistant tool-call message: %+v", assistant)
 	}
-	if size != len(content) {
-		t.Fatalf("unexpected size: %d", size)
+	if toolMsg.Role != "tool" || toolMsg.ToolCallID != "call_1" || !strings.Contains(toolMsg.Content, "hello.txt") {
+		t.Fatalf("unexpected tool result message: %+v", toolMsg)
 	}
-	if !strings.Contains(prompt, dir) {
-		t.Fatalf("expected prompt contains config dir, got: %s", prompt)
+	for _, m := range provider.calls[0] {
+		if strings.Contains(m.Content, "\"tool_calls\"") {
+			t.Fatalf("native mode should not inject JSON protocol instruction: %q", m.Content)
+		}
 	}
 }
 
-func TestLoadSystemPrompt_FromEnvWhenFileMissing(t *testing.T) {
-	dir := t.TempDir()
-	cfg := &config.WorkerConfig{
-		ConfigDir:        dir,
-		SystemPromptFile: filepath.Join(dir, "AUTONOUS.md"),
-		SystemPromptEnv:  "env-only-prompt",
+func TestProcessTask_RouterLogsServingBackend(t *testing.T) {
+	database := testWorkerDB(t)
+	commander := &captureCommander{}
+	failing, err := dummy.NewProvider("dummy-a", "err:provider_api")
+	if err != nil {
+		t.Fatal(err)
+	}
+	serving := &seqProvider{resps: []modelpkg.CompletionResponse{{Content: "from backup", InputTokens: 2, OutputTokens: 1}}}
+	provider, err := router.New([]router.Backend{
+		{Name: "dummy", Model: "dummy-a", Provider: failing},
+		{Name: "backup", Model: "backup-model", Provider: serving},
+	}, 3, time.Minute)
+	if err != nil {
+		t.Fatal(err)
+	}
+	cfg := &config.WorkerConfig{OpenAIModel: "dummy-a", ModelProvider: "router", ModelRouterChain: []string{"dummy", "backup"}, SystemPrompt: "sys", HistoryWindow: 12}
+	task := &queueTask{ID: 9, ChatID: 1, UpdateID: 9, Text: "hi"}
+	policy := control.Policy{MaxTurns: 1, MaxWallTime: 120 * time.Second, MaxTokens: 1000, MaxRetries: 3}
+	agentEventID, err := db.LogEvent(database, nil, db.EventAgentStarted, map[string]any{"task_id": 9})
+	if err != nil {
+		t.Fatal(err)
+	}
+	reg := toolpkg.NewRegistry()
+	if err := processTask(context.Background(), database, commander, provider, cfg, task, agentEventID,
+		&ctxpkg.SQLiteProvider{DB: database}, &ctxpkg.SimpleCompressor{MaxMessages: 12}, &ctxpkg.StandardAssembler{},
+		policy, reg, toolpkg.NewRunner(reg)); err != nil {
+		t.Fatalf("processTask failed: %v", err)
+	}
+	if commander.last != "from backup" {
+		t.Fatalf("unexpected reply: %q", commander.last)
+	}
+
+	var started, completed string
+	var guessed sql.NullString
+	if err := database.QueryRow(
+		"SELECT payload, json_extract(payload, '$.backend') FROM events WHERE event_type = ?", db.EventTurnStarted,
+	).Scan(&started, &guessed); err != nil {
+		t.Fatal(err)
 	}
-	prompt, source, _, readErr := loadSystemPrompt(cfg)
-	if readErr != nil {
-		t.Fatal(readErr)
+	if guessed.Valid ||
+		!strings.Contains(started, `"router_chain":[{"backend":"dummy","model_name":"dummy-a"},{"backend":"backup","model_name":"dummy-a"}]`) {
+		t.Fatalf("expected turn.started to log the chain without guessing the backend, got %s", started)
 	}
-	if source != "env" {
-		t.Fatalf("unexpected source: %s", source)
+	if err := database.QueryRow("SELECT payload FROM events WHERE event_type = ?", db.EventTurnCompleted).Scan(&completed); err != nil {
+		t.Fatal(err)
 	}
-	if !strings.Contains(prompt, "env-only-prompt") {
-		t.Fatalf("expected env prompt content, got: %s", prompt)
+	for _, want := range []string{`"backend":"backup"`, `"model_name":"backup-model"`, `"failovers":1`} {
+		if !strings.Contains(completed, want) {
+			t.Fatalf("expected %s in turn.completed, got %s", want, completed)
+		}
 	}
-	if !strings.Contains(prompt, "系统提示符文件:") {
-		t.Fatalf("expected config metadata injected, got: %s", prompt)
+}
+
+type streamSeqProvider struct {
+	nativeSeqProvider
+	deltas [][]string
+}
+
+func (s *streamSeqProvider) ChatCompletionStream(ctx context.Context, messages []ctxpkg.Message, tools []modelpkg.ToolDefinition, onDelta func(string)) (modelpkg.CompletionResponse, error) {
+	i := len(s.calls)
+	if i < len(s.deltas) {
+		for _, d := range s.deltas[i] {
+			onDelta(d)
+		}
 	}
+	return s.ChatCompletionWithTools(ctx, messages, tools)
 }
 
-func TestLoadSystemPrompt_FileReadErrorFallsBackToEnv(t *testing.T) {
-	dir := t.TempDir()
+type editCaptureCommander struct {
+	captureCommander
+	sent      []string
+	edits     []string
+	sentIDs   int64
+	failEdits int
+}
+
+func (c *editCaptureCommander) SendMessageWithID(ctx context.Context, chatID int64, text string) (int64, error) {
+	c.sent = append(c.sent, text)
+	c.sentIDs++
+	return c.sentIDs, nil
+}
+
+func (c *editCaptureCommander) EditMessageText(ctx context.Context, chatID int64, messageID int64, text string) error {
+	if c.failEdits > 0 {
+		c.failEdits--
+		return errors.New("message can't be edited")
+	}
+	c.edits = append(c.edits, text)
+	return nil
+}
+
+func TestProcessTask_StreamsIntoEditedMessage(t *testing.T) {
+	database := testWorkerDB(t)
+	commander := &editCaptureCommander{}
+	provider := &streamSeqProvider{
+		nativeSeqProvider: nativeSeqProvider{seqProvider: seqProvider{
+			resps: []modelpkg.CompletionResponse{
+				{Content: "Hello world", InputTokens: 3, OutputTokens: 2},
+			},
+		}},
+		deltas: [][]string{{"Hello", " world"}},
+	}
 	cfg := &config.WorkerConfig{
-		ConfigDir:        dir,
-		SystemPromptFile: dir, // read directory to trigger non-not-exist error.
-		SystemPromptEnv:  "env-fallback",
+		OpenAIModel:   "dummy",
+		SystemPrompt:  "sys",
+		HistoryWindow: 12,
+		StreamReplies: true,
+	}
+	task := &queueTask{ID: 7, ChatID: 1, UpdateID: 7, Text: "hi"}
+	ctxProvider := &ctxpkg.SQLiteProvider{DB: database}
+	ctxCompressor := &ctxpkg.SimpleCompressor{MaxMessages: 12}
+	ctxAssembler := &ctxpkg.StandardAssembler{}
+	policy := control.Policy{MaxTurns: 2, MaxWallTime: 120 * time.Second, MaxTokens: 1000, MaxRetries: 3}
+	agentEventID, err := db.LogEvent(database, nil, db.EventAgentStarted, map[string]any{"task_id": 7})
+	if err != nil {
+		t.Fatal(err)
+	}
+	reg := toolpkg.NewRegistry()
+	runner := toolpkg.NewRunner(reg)
+
+	if err := processTask(context.Background(), database, commander, provider, cfg, task, agentEventID, ctxProvider, ctxCompressor, ctxAssembler, policy, reg, runner); err != nil {
+		t.Fatalf("processTask failed: %v", err)
+	}
+	if len(commander.sent) != 1 || commander.sent[0] != liveReplyPlaceholder {
+		t.Fatalf("expected one placeholder message, got %v", commander.sent)
+	}
+	if commander.last != "" {
+		t.Fatalf("expected final reply delivered by edit, got SendMessage %q", commander.last)
+	}
+	if len(commander.edits) == 0 || commander.edits[len(commander.edits)-1] != "Hello world" {
+		t.Fatalf("expected final edit with full reply, got %v", commander.edits)
+	}
+
+	var payload string
+	if err := database.QueryRow("SELECT payload FROM events WHERE event_type = ?", db.EventTurnCompleted).Scan(&payload); err != nil {
+		t.Fatal(err)
+	}
+	if !strings.Contains(payload, `"input_tokens":3`) || !strings.Contains(payload, `"streamed":true`) {
+		t.Fatalf("unexpected turn.completed payload: %s", payload)
+	}
+	var reply string
+	if err := database.QueryRow("SELECT text FROM history WHERE role = 'assistant'").Scan(&reply); err != nil {
+		t.Fatal(err)
+	}
+	if reply != "Hello world" {
+		t.Fatalf("unexpected history reply: %q", reply)
+	}
+}
+
+func TestProcessTask_FailedEditPointsPlaceholderAtReply(t *testing.T) {
+	database := testWorkerDB(t)
+	commander := &editCaptureCommander{failEdits: 1}
+	provider := &streamSeqProvider{
+		nativeSeqProvider: nativeSeqProvider{seqProvider: seqProvider{
+			resps: []modelpkg.CompletionResponse{{Content: "Hello world again", InputTokens: 3, OutputTokens: 3}},
+		}},
+		deltas: [][]string{{"Hello", " world", " again"}},
+	}
+	cfg := &config.WorkerConfig{OpenAIModel: "dummy", SystemPrompt: "sys", HistoryWindow: 12, StreamReplies: true}
+	task := &queueTask{ID: 8, ChatID: 1, UpdateID: 8, Text: "hi"}
+	policy := control.Policy{MaxTurns: 2, MaxWallTime: 120 * time.Second, MaxTokens: 1000, MaxRetries: 3}
+	agentEventID, err := db.LogEvent(database, nil, db.EventAgentStarted, map[string]any{"task_id": 8})
+	if err != nil {
+		t.Fatal(err)
+	}
+	reg := toolpkg.NewRegistry()
+	if err := processTask(context.Background(), database, commander, provider, cfg, task, agentEventID,
+		&ctxpkg.SQLiteProvider{DB: database}, &ctxpkg.SimpleCompressor{MaxMessages: 12}, &ctxpkg.StandardAssembler{},
+		policy, reg, toolpkg.NewRunner(reg)); err != nil {
+		t.Fatalf("processTask failed: %v", err)
+	}
+	// After the first edit fails no further deltas are edited in, and the
+	// placeholder points at the reply sent as a regular message.
+	if len(commander.edits) != 1 || commander.edits[0] != liveReplyMoved {
+		t.Fatalf("expected only the pointer edit, got %v", commander.edits)
+	}
+	if commander.last != "Hello world again" {
+		t.Fatalf("expected the reply sent as a message, got %q", commander.last)
+	}
+}
+
+// midStreamFailProvider streams part of a reply and then fails the call.
+type midStreamFailProvider struct {
+	nativeSeqProvider
+}
+
+func (p *midStreamFailProvider) ChatCompletionStream(ctx context.Context, messages []ctxpkg.Message, tools []modelpkg.ToolDefinition, onDelta func(string)) (modelpkg.CompletionResponse, error) {
+	onDelta("partial")
+	return modelpkg.CompletionResponse{}, &modelpkg.Error{Class: modelpkg.ErrBadRequest, Provider: "openai", Message: "stream broke"}
+}
+
+func TestExecutorRun_FailureReplacesStreamedPlaceholder(t *testing.T) {
+	database := testWorkerDB(t)
+	if _, err := enqueueMessage(database, 100, 1, "hi", 0); err != nil {
+		t.Fatal(err)
+	}
+	commander := &editCaptureCommander{}
+	exec := testExecutor(database, commander, &midStreamFailProvider{}, toolpkg.NewRegistry())
+	exec.cfg.StreamReplies = true
+	task, err := claimNextTask(database, exec.policy)
+	if err != nil || task == nil {
+		t.Fatalf("expected a task, got %+v err=%v", task, err)
+	}
+	exec.run(task)
+
+	if len(commander.sent) != 1 || commander.sent[0] != liveReplyPlaceholder {
+		t.Fatalf("expected only the placeholder sent, got %v", commander.sent)
+	}
+	if commander.last != "" {
+		t.Fatalf("expected no second message, got %q", commander.last)
+	}
+	if n := len(commander.edits); n == 0 || !strings.Contains(commander.edits[n-1], "任务处理失败") {
+		t.Fatalf("expected the placeholder edited into the failure notice, got %v", commander.edits)
 	}
-	prompt, source, _, readErr := loadSystemPrompt(cfg)
-	if readErr == nil {
-		t.Fatal("expected read error")
+}
+
+func TestStreamingUnavailable(t *testing.T) {
+	if reason := streamingUnavailable(&editCaptureCommander{}, &seqProvider{}); !strings.Contains(reason, "does not stream") {
+		t.Fatalf("expected a provider without streaming to be reported, got %q", reason)
 	}
-	if source != "env" {
-		t.Fatalf("unexpected source: %s", source)
+	if reason := streamingUnavailable(&captureCommander{}, &streamSeqProvider{}); !strings.Contains(reason, "cannot edit messages") {
+		t.Fatalf("expected a commander without edits to be reported, got %q", reason)
 	}
-	if !strings.Contains(prompt, "env-fallback") {
-		t.Fatalf("expected env fallback prompt, got: %s", prompt)
+	if reason := streamingUnavailable(&editCaptureCommander{}, &streamSeqProvider{}); reason != "" {
+		t.Fatalf("expected streaming to be available, got %q", reason)
 	}
 }
 
-func TestLoadSystemPrompt_FallsBackToBuiltin(t *testing.T) {
+func TestInjectConfigMeta(t *testing.T) {
 	dir := t.TempDir()
-	cfg := &config.WorkerConfig{
-		ConfigDir:        dir,
-		SystemPromptFile: filepath.Join(dir, "AUTONOUS.md"),
-		SystemPromptEnv:  "",
+	out := injectConfigMeta("系统指令\n配置目录占位符={AUTONOUS_CONFIG_DIR}", dir)
+	if !strings.Contains(out, "配置目录占位符="+dir) || !strings.Contains(out, "系统提示符文件: "+filepath.Join(dir, "AUTONOUS.md")) {
+		t.Fatalf("expected placeholder replaced and metadata appended, got: %s", out)
+	}
+	if again := injectConfigMeta(out, dir); again != out {
+		t.Fatalf("expected metadata not appended twice, got: %s", again)
+	}
+	if out := injectConfigMeta("", dir); !strings.HasPrefix(out, "配置目录: "+dir) {
+		t.Fatalf("expected metadata alone for an empty prompt, got: %s", out)
+	}
+}
+
+func TestResolveSystemPrompt_ReloadsPerTask(t *testing.T) {
+	database := testWorkerDB(t)
+	dir := t.TempDir()
+	file := filepath.Join(dir, "AUTONOUS.md")
+	if err := os.WriteFile(file, []byte("chat {{.ChatID}}"), 0o644); err != nil {
+		t.Fatal(err)
+	}
+	cfg := &config.WorkerConfig{ConfigDir: dir, SystemPromptFile: file}
+	loader := newPromptLoader(cfg)
+
+	if got := resolveSystemPrompt(database, 0, loader, cfg, nil, 5); !strings.HasPrefix(got, "chat 5\n\n配置目录: "+dir) {
+		t.Fatalf("unexpected prompt %q", got)
+	}
+	resolveSystemPrompt(database, 0, loader, cfg, nil, 5)
+	later := time.Now().Add(time.Minute)
+	if err := os.WriteFile(file, []byte("edited {{.ChatID}}"), 0o644); err != nil {
+		t.Fatal(err)
 	}
-	prompt, source, _, readErr := loadSystemPrompt(cfg)
-	if readErr != nil {
-		t.Fatal(readErr)
+	if err := os.Chtimes(file, later, later); err != nil {
+		t.Fatal(err)
 	}
-	if source != "builtin" {
-		t.Fatalf("unexpected source: %s", source)
+	if got := resolveSystemPrompt(database, 0, loader, cfg, nil, 5); !strings.HasPrefix(got, "edited 5") {
+		t.Fatalf("expected the edited prompt without a restart, got %q", got)
 	}
-	if !strings.Contains(prompt, builtinSystemPrompt()) {
-		t.Fatalf("expected builtin prompt content, got: %s", prompt)
+	var loaded int
+	if err := database.QueryRow(`SELECT COUNT(*) FROM events WHERE event_type = 'system_prompt.loaded'`).Scan(&loaded); err != nil || loaded != 2 {
+		t.Fatalf("expected system_prompt.loaded for the first and the edited prompt only, got %d err=%v", loaded, err)
 	}
 }
 
@@ -412,7 +1400,7 @@ func TestProcessTask_ExtractsFinalAnswerFromJSON(t *testing.T) {
 	}
 	reg := toolpkg.NewRegistry()
 	runner := toolpkg.NewRunner(reg)
-	if err := processTask(database, commander, provider, cfg, task, agentEventID, ctxProvider, ctxCompressor, ctxAssembler, policy, reg, runner); err != nil {
+	if err := processTask(context.Background(), database, commander, provider, cfg, task, agentEventID, ctxProvider, ctxCompressor, ctxAssembler, policy, reg, runner); err != nil {
 		t.Fatalf("processTask failed: %v", err)
 	}
 	if commander.last != "direct final" {
@@ -471,7 +1459,7 @@ func TestProcessTask_ToolFailureThenRecover(t *testing.T) {
 	}
 	runner := toolpkg.NewRunner(reg)
 
-	if err := processTask(database, commander, provider, cfg, task, agentEventID, ctxProvider, ctxCompressor, ctxAssembler, policy, reg, runner); err != nil {
+	if err := processTask(context.Background(), database, commander, provider, cfg, task, agentEventID, ctxProvider, ctxCompressor, ctxAssembler, policy, reg, runner); err != nil {
 		t.Fatalf("processTask failed: %v", err)
 	}
 	if commander.last != "recovered" {
@@ -510,9 +1498,10 @@ func TestClassifyToolError(t *testing.T) {
 		want string
 	}{
 		{err: context.DeadlineExceeded, want: "timeout"},
-		{err: errString("path outside allowlist: /"), want: "policy"},
-		{err: errString("validation: read.limit must be > 0"), want: "validation"},
+		{err: &toolpkg.Error{Class: toolpkg.ErrPolicy, Err: errString("path outside allowlist: /")}, want: "policy"},
+		{err: &toolpkg.Error{Class: toolpkg.ErrValidation, Err: errString("read.limit must be > 0")}, want: "validation"},
 		{err: errString("ls execution failed: exit status 2"), want: "tool_exec"},
+		{err: errString("invalid timeout value"), want: "tool_exec"},
 	}
 	for _, c := range cases {
 		got := classifyToolError(c.err)
@@ -522,14 +1511,37 @@ func TestClassifyToolError(t *testing.T) {
 	}
 }
 
-func TestRedactSecrets(t *testing.T) {
-	in := "Authorization: Bearer abc123 TOKEN=xyz sk-test-secret"
-	out, redacted := redactSecrets(in)
-	if !redacted {
-		t.Fatal("expected redacted=true")
+func TestClassifyError(t *testing.T) {
+	cases := []struct {
+		err  error
+		want string
+	}{
+		{err: &modelpkg.Error{Class: modelpkg.ErrRateLimited, Provider: "openai"}, want: "provider_api"},
+		{err: fmt.Errorf("router: all model providers failed: %w", &modelpkg.Error{Class: modelpkg.ErrServer}), want: "provider_api"},
+		{err: sqlite3.Error{Code: sqlite3.ErrBusy}, want: "db"},
+		{err: &cmdpkg.Error{Source: "telegram", Err: errString("telegram getUpdates request failed: EOF")}, want: "command_source_api"},
+		{err: errString("telegram is mentioned but no commander call failed"), want: "unknown"},
+		{err: errString("failed to load model config from db"), want: "unknown"},
+	}
+	for _, c := range cases {
+		if got := classifyError(c.err); got != c.want {
+			t.Fatalf("classifyError(%v)=%s want=%s", c.err, got, c.want)
+		}
+	}
+}
+
+func TestTripsCircuit(t *testing.T) {
+	if tripsCircuit(&modelpkg.Error{Class: modelpkg.ErrBadRequest}) {
+		t.Fatal("bad_request should not trip the circuit")
+	}
+	if tripsCircuit(&modelpkg.Error{Class: modelpkg.ErrContextLengthExceeded}) {
+		t.Fatal("context_length_exceeded should not trip the circuit")
 	}
-	if strings.Contains(out, "abc123") || strings.Contains(out, "xyz") || strings.Contains(out, "sk-test-secret") {
-		t.Fatalf("secret leak after redaction: %q", out)
+	if !tripsCircuit(&modelpkg.Error{Class: modelpkg.ErrAuth}) {
+		t.Fatal("auth should trip the circuit")
+	}
+	if !tripsCircuit(errString("telegram down")) {
+		t.Fatal("untyped errors should trip the circuit")
 	}
 }
 
@@ -693,3 +1705,736 @@ func TestProcessDirectCommand_CancelSuccess(t *testing.T) {
 type errString string
 
 func (e errString) Error() string { return string(e) }
+
+// runNativeLSSession runs a "list files" style task against a fresh database
+// and workspace with a single ls tool registered.
+func runNativeLSSession(t *testing.T, commander cmdpkg.Commander, provider modelpkg.Provider, text string) error {
+	t.Helper()
+	database := testWorkerDB(t)
+	base := t.TempDir()
+	if err := os.WriteFile(filepath.Join(base, "hello.txt"), []byte("hello"), 0o644); err != nil {
+		t.Fatal(err)
+	}
+	cfg := &config.WorkerConfig{OpenAIModel: "dummy", SystemPrompt: "sys", HistoryWindow: 12}
+	task := &queueTask{ID: 11, ChatID: 1, UpdateID: 11, Text: text}
+	policy := control.Policy{MaxTurns: 2, MaxWallTime: 120 * time.Second, MaxTokens: 1000, MaxRetries: 3}
+	agentEventID, err := db.LogEvent(database, nil, db.EventAgentStarted, map[string]any{"task_id": 11})
+	if err != nil {
+		t.Fatal(err)
+	}
+	p, err := toolpkg.NewPolicy(base, "")
+	if err != nil {
+		t.Fatal(err)
+	}
+	reg := toolpkg.NewRegistry()
+	if err := reg.Register(toolpkg.NewLS(p, base, 2*time.Second, toolpkg.Limits{MaxLines: 100, MaxBytes: 4096})); err != nil {
+		t.Fatal(err)
+	}
+	return processTask(context.Background(), database, commander, provider, cfg, task, agentEventID,
+		&ctxpkg.SQLiteProvider{DB: database}, &ctxpkg.SimpleCompressor{MaxMessages: 12}, &ctxpkg.StandardAssembler{},
+		policy, reg, toolpkg.NewRunner(reg))
+}
+
+func TestProcessDirectCommand_Sessions(t *testing.T) {
+	database := testWorkerDB(t)
+	appendHistory(database, 1, "user", "old task")
+	appendHistory(database, 1, "assistant", "old answer")
+	direct := func(text string) string {
+		t.Helper()
+		handled, reply, shouldExit, err := processDirectCommand(database, &captureCommander{}, &config.WorkerConfig{}, &queueTask{ChatID: 1, Text: text}, 0)
+		if err != nil || !handled || shouldExit {
+			t.Fatalf("%s: unexpected handled=%v shouldExit=%v err=%v", text, handled, shouldExit, err)
+		}
+		return reply
+	}
+	history := func() []ctxpkg.Message {
+		t.Helper()
+		msgs, err := (&ctxpkg.SQLiteProvider{DB: database}).GetHistory(1, 10)
+		if err != nil {
+			t.Fatal(err)
+		}
+		return msgs
+	}
+
+	if reply := direct("/new"); !strings.Contains(reply, "已开始新会话 #2") {
+		t.Fatalf("unexpected /new reply: %s", reply)
+	}
+	if msgs := history(); len(msgs) != 0 {
+		t.Fatalf("expected empty history in the new session, got %+v", msgs)
+	}
+	appendHistory(database, 1, "user", "new task")
+
+	reply := direct("/sessions@autonous_bot")
+	if !strings.Contains(reply, "* #2 new task（1 条") || !strings.Contains(reply, "  #1 old task（2 条") {
+		t.Fatalf("unexpected /sessions reply: %s", reply)
+	}
+	if reply := direct("/resume 1"); !strings.Contains(reply, "已切换到会话 #1：old task") {
+		t.Fatalf("unexpected /resume reply: %s", reply)
+	}
+	if msgs := history(); len(msgs) != 2 || msgs[0].Content != "old task" {
+		t.Fatalf("expected the resumed session's history, got %+v", msgs)
+	}
+	if reply := direct("/resume 99"); !strings.Contains(reply, "会话 #99 不存在") {
+		t.Fatalf("unexpected reply for a missing session: %s", reply)
+	}
+	if reply := direct("/resume"); !strings.Contains(reply, "请提供会话编号") {
+		t.Fatalf("unexpected reply without a session id: %s", reply)
+	}
+}
+
+func TestCircuitBreakers_PersistAcrossRestartsAndStatus(t *testing.T) {
+	database := testWorkerDB(t)
+	cfg := &config.WorkerConfig{
+		ControlCircuitThreshold:   5,
+		ControlCircuitCooldownSec: 30,
+		ControlCircuitClasses:     map[string]config.CircuitClass{"db": {Threshold: 2, CooldownSeconds: 60}},
+	}
+	status := func() string {
+		t.Helper()
+		handled, reply, _, err := processDirectCommand(database, &captureCommander{}, cfg, &queueTask{ChatID: 1, Text: "/status"}, 0)
+		if err != nil || !handled {
+			t.Fatalf("unexpected handled=%v err=%v", handled, err)
+		}
+		return reply
+	}
+	if reply := status(); !strings.Contains(reply, "全部关闭") {
+		t.Fatalf("unexpected status before failures: %s", reply)
+	}
+
+	breakers := newBreakerSet(database, cfg)
+	recordCircuitFailure(database, 0, breakers, "provider_api")
+	recordCircuitFailure(database, 0, breakers, "db")
+	recordCircuitFailure(database, 0, breakers, "db")
+	if allowed, _ := breakers.Allow(time.Now()); allowed {
+		t.Fatal("expected db breaker to block work after its own threshold")
+	}
+
+	restarted := newBreakerSet(database, cfg)
+	if err := restoreBreakers(database, restarted); err != nil {
+		t.Fatal(err)
+	}
+	if restarted.State("db") != control.CircuitOpen || restarted.Snapshot("provider_api").Failures != 1 {
+		t.Fatalf("expected restored state, got db=%s", restarted.State("db"))
+	}
+	if allowed, _ := restarted.Allow(time.Now()); allowed {
+		t.Fatal("expected a restart to keep the db breaker open")
+	}
+	reply := status()
+	if !strings.Contains(reply, "- db：open，连续失败 2/2，冷却 60 秒") || !strings.Contains(reply, "- provider_api：closed，连续失败 1/5，冷却 30 秒") {
+		t.Fatalf("unexpected status: %s", reply)
+	}
+
+	closeCircuits(database, 0, restarted, restarted.Classes()...)
+	if reply := status(); !strings.Contains(reply, "全部关闭") {
+		t.Fatalf("unexpected status after recovery: %s", reply)
+	}
+
+	if err := db.RecordSpend(database, 1, "2026-05-20", 0.25, 0, 0); err != nil {
+		t.Fatal(err)
+	}
+	if err := db.RecordSpend(database, 2, "2026-05-21", 1, 0, 0); err != nil {
+		t.Fatal(err)
+	}
+	if reply := status(); !strings.Contains(reply, "累计花费：本聊天 $0.2500，全部聊天 $1.2500") {
+		t.Fatalf("unexpected spend status: %s", reply)
+	}
+}
+
+func TestProcessTask_ReplaysRecordedCassette(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "ls.json")
+	rec := cassette.Create(path)
+	live := &nativeSeqProvider{seqProvider: seqProvider{
+		resps: []modelpkg.CompletionResponse{
+			{ToolCalls: []ctxpkg.ToolCall{{ID: "call_1", Name: "ls", Arguments: json.RawMessage(`{"path":"."}`)}}, InputTokens: 1, OutputTokens: 1},
+			{Content: "native done", InputTokens: 1, OutputTokens: 1},
+		},
+	}}
+	if err := runNativeLSSession(t, rec.RecordCommander(&captureCommander{}), rec.RecordProvider(live), "list files"); err != nil {
+		t.Fatalf("recording run failed: %v", err)
+	}
+
+	tape, err := cassette.Load(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := runNativeLSSession(t, tape.ReplayCommander(), tape.ReplayProvider(), "list files"); err != nil {
+		t.Fatalf("replay run failed: %v", err)
+	}
+	if err := tape.Finish(); err != nil {
+		t.Fatalf("replay did not match recording: %v", err)
+	}
+
+	tape, err = cassette.Load(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	err = runNativeLSSession(t, tape.ReplayCommander(), tape.ReplayProvider(), "list all files")
+	var div *cassette.DivergenceError
+	if !errors.As(err, &div) || div.Call != "model call" || div.Index != 0 {
+		t.Fatalf("expected divergence on the first model call, got %v", err)
+	}
+	if modelpkg.IsRetryable(err) {
+		t.Fatal("expected divergence to fail the task without retry")
+	}
+}
+
+func TestProcessTask_RecordsTurnCost(t *testing.T) {
+	database := testWorkerDB(t)
+	commander := &captureCommander{}
+	provider := &seqProvider{resps: []modelpkg.CompletionResponse{{Content: "priced", InputTokens: 1000, OutputTokens: 500}}}
+	cfg := &config.WorkerConfig{
+		OpenAIModel:   "gpt-4o-mini",
+		SystemPrompt:  "sys",
+		HistoryWindow: 12,
+		ModelPrices:   map[string]cost.Price{"gpt-4o-mini": {InputPerMTok: 1, OutputPerMTok: 2}},
+	}
+	task := &queueTask{ID: 12, ChatID: 7, UpdateID: 12, Text: "hi"}
+	policy := control.Policy{MaxTurns: 1, MaxWallTime: 120 * time.Second, MaxTokens: 10000, MaxRetries: 3}
+	agentEventID, err := db.LogEvent(database, nil, db.EventAgentStarted, map[string]any{"task_id": 12})
+	if err != nil {
+		t.Fatal(err)
+	}
+	reg := toolpkg.NewRegistry()
+	if err := processTask(context.Background(), database, commander, provider, cfg, task, agentEventID,
+		&ctxpkg.SQLiteProvider{DB: database}, &ctxpkg.SimpleCompressor{MaxMessages: 12}, &ctxpkg.StandardAssembler{},
+		policy, reg, toolpkg.NewRunner(reg)); err != nil {
+		t.Fatalf("processTask failed: %v", err)
+	}
+
+	var turnCost float64
+	if err := database.QueryRow(
+		"SELECT json_extract(payload, '$.cost_usd') FROM events WHERE event_type = ?", db.EventTurnCompleted,
+	).Scan(&turnCost); err != nil {
+		t.Fatal(err)
+	}
+	if turnCost != 0.002 {
+		t.Fatalf("expected turn cost 0.002, got %v", turnCost)
+	}
+	spent, err := db.ChatSpend(database, 7)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if spent != 0.002 {
+		t.Fatalf("expected chat spend 0.002, got %v", spent)
+	}
+}
+
+func TestProcessTask_PersistsToolTurns(t *testing.T) {
+	database := testWorkerDB(t)
+	base := t.TempDir()
+	if err := os.WriteFile(filepath.Join(base, "hello.txt"), []byte("hello"), 0o644); err != nil {
+		t.Fatal(err)
+	}
+	provider := &nativeSeqProvider{seqProvider: seqProvider{
+		resps: []modelpkg.CompletionResponse{
+			{ToolCalls: []ctxpkg.ToolCall{{ID: "call_1", Name: "ls", Arguments: json.RawMessage(`{"path":"."}`)}}},
+			{Content: "有 hello.txt"},
+			{Content: "还是 hello.txt"},
+		},
+	}}
+	cfg := &config.WorkerConfig{OpenAIModel: "dummy", SystemPrompt: "sys", HistoryWindow: 12, HistoryToolOutputBytes: 2000}
+	policy := control.Policy{MaxTurns: 2, MaxWallTime: 120 * time.Second, MaxTokens: 1000, MaxRetries: 3}
+	p, err := toolpkg.NewPolicy(base, "")
+	if err != nil {
+		t.Fatal(err)
+	}
+	reg := toolpkg.NewRegistry()
+	if err := reg.Register(toolpkg.NewLS(p, base, 2*time.Second, toolpkg.Limits{MaxLines: 100, MaxBytes: 4096})); err != nil {
+		t.Fatal(err)
+	}
+	for i, text := range []string{"list files", "again?"} {
+		task := &queueTask{ID: int64(20 + i), ChatID: 1, UpdateID: int64(20 + i), Text: text}
+		agentEventID, err := db.LogEvent(database, nil, db.EventAgentStarted, map[string]any{"task_id": task.ID})
+		if err != nil {
+			t.Fatal(err)
+		}
+		if err := processTask(context.Background(), database, &captureCommander{}, provider, cfg, task, agentEventID,
+			&ctxpkg.SQLiteProvider{DB: database}, &ctxpkg.SimpleCompressor{MaxMessages: 12}, &ctxpkg.StandardAssembler{},
+			policy, reg, toolpkg.NewRunner(reg)); err != nil {
+			t.Fatalf("processTask %d failed: %v", i, err)
+		}
+	}
+
+	var roles []string
+	rows, err := database.Query("SELECT role, COALESCE(tool_call_id, '') FROM history WHERE chat_id = 1 ORDER BY id")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer rows.Close()
+	for rows.Next() {
+		var role, callID string
+		if err := rows.Scan(&role, &callID); err != nil {
+			t.Fatal(err)
+		}
+		roles = append(roles, role+":"+callID)
+	}
+	if got := strings.Join(roles, ","); got != "user:,assistant:,tool:call_1,assistant:,user:,assistant:" {
+		t.Fatalf("unexpected stored history %s", got)
+	}
+
+	// The second task replays the first task's tool call in native roles.
+	replayed := provider.calls[2]
+	if len(replayed) != 7 {
+		t.Fatalf("expected 2 system, 4 history and user messages, got %+v", replayed)
+	}
+	if call := replayed[3]; call.Role != "assistant" || len(call.ToolCalls) != 1 || call.ToolCalls[0].Name != "ls" {
+		t.Fatalf("expected replayed tool call, got %+v", call)
+	}
+	if result := replayed[4]; result.Role != "tool" || result.ToolCallID != "call_1" || !strings.Contains(result.Content, "hello.txt") {
+		t.Fatalf("expected replayed tool result, got %+v", result)
+	}
+}
+
+func TestProcessTask_MemoryToolAndInjection(t *testing.T) {
+	database := testWorkerDB(t)
+	provider := &nativeSeqProvider{seqProvider: seqProvider{
+		resps: []modelpkg.CompletionResponse{
+			{ToolCalls: []ctxpkg.ToolCall{{ID: "call_1", Name: "memory", Arguments: json.RawMessage(`{"op":"save","key":"deploy day","content":"Deploys happen on Fridays"}`)}}},
+			{Content: "记住了"},
+			{Content: "周五"},
+		},
+	}}
+	cfg := &config.WorkerConfig{OpenAIModel: "dummy", SystemPrompt: "sys", HistoryWindow: 12, MemoryTopK: 3}
+	policy := control.Policy{MaxTurns: 2, MaxWallTime: 120 * time.Second, MaxTokens: 1000, MaxRetries: 3}
+	reg := toolpkg.NewRegistry()
+	if err := reg.Register(memory.NewTool(database)); err != nil {
+		t.Fatal(err)
+	}
+	for i, text := range []string{"remember we deploy on Fridays", "which day do we deploy?"} {
+		task := &queueTask{ID: int64(40 + i), ChatID: 7, UpdateID: int64(40 + i), Text: text}
+		agentEventID, err := db.LogEvent(database, nil, db.EventAgentStarted, map[string]any{"task_id": task.ID})
+		if err != nil {
+			t.Fatal(err)
+		}
+		if err := processTask(context.Background(), database, &captureCommander{}, provider, cfg, task, agentEventID,
+			&ctxpkg.SQLiteProvider{DB: database}, &ctxpkg.SimpleCompressor{MaxMessages: 12}, &ctxpkg.StandardAssembler{},
+			policy, reg, toolpkg.NewRunner(reg)); err != nil {
+			t.Fatalf("processTask %d failed: %v", i, err)
+		}
+	}
+
+	mems, err := db.ListMemories(database, 7)
+	if err != nil || len(mems) != 1 || mems[0].Scope != db.MemoryScopeChat || mems[0].ChatID != 7 {
+		t.Fatalf("expected one chat memory saved, got %+v err=%v", mems, err)
+	}
+	var parentType string
+	if err := database.QueryRow(
+		`SELECT p.event_type FROM events e JOIN events p ON p.id = e.parent_id WHERE e.event_type = ?`, db.EventMemorySaved,
+	).Scan(&parentType); err != nil || parentType != db.EventToolCallStarted {
+		t.Fatalf("expected memory.saved under tool_call.started, got %q err=%v", parentType, err)
+	}
+	last := provider.calls[len(provider.calls)-1]
+	if len(last) < 3 || last[2].Role != "system" || !strings.Contains(last[2].Content, "- [chat] deploy day: Deploys happen on Fridays") {
+		t.Fatalf("expected memory injected after the tool instruction, got %+v", last)
+	}
+	var payload string
+	if err := database.QueryRow(`SELECT payload FROM events WHERE event_type = ? ORDER BY id DESC LIMIT 1`, db.EventContextAssembled).Scan(&payload); err != nil {
+		t.Fatal(err)
+	}
+	if !strings.Contains(payload, `"memory_count":1`) {
+		t.Fatalf("expected memory_count in context.assembled, got %s", payload)
+	}
+}
+
+func TestProcessTask_CapturesRedactedPrompts(t *testing.T) {
+	database := testWorkerDB(t)
+	provider := &nativeSeqProvider{seqProvider: seqProvider{
+		resps: []modelpkg.CompletionResponse{
+			{ToolCalls: []ctxpkg.ToolCall{{ID: "call_1", Name: "memory", Arguments: json.RawMessage(`{"op":"save","key":"ci","content":"GITHUB_TOKEN=ghp_abc123"}`)}}},
+			{Content: "done"},
+		},
+	}}
+	cfg := &config.WorkerConfig{OpenAIModel: "dummy", SystemPrompt: "sys", HistoryWindow: 12}
+	policy := control.Policy{MaxTurns: 3, MaxWallTime: 120 * time.Second, MaxTokens: 1000, MaxRetries: 3}
+	reg := toolpkg.NewRegistry()
+	if err := reg.Register(memory.NewTool(database)); err != nil {
+		t.Fatal(err)
+	}
+	task := &queueTask{ID: 50, ChatID: 7, UpdateID: 50, Text: "use Bearer abc.def.ghi for the api"}
+	agentEventID, err := db.LogEvent(database, nil, db.EventAgentStarted, map[string]any{"task_id": task.ID})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := processTask(context.Background(), database, &captureCommander{}, provider, cfg, task, agentEventID,
+		&ctxpkg.SQLiteProvider{DB: database}, &ctxpkg.SimpleCompressor{MaxMessages: 12}, &ctxpkg.StandardAssembler{},
+		policy, reg, toolpkg.NewRunner(reg)); err != nil {
+		t.Fatal(err)
+	}
+
+	rows, err := database.Query(`SELECT json_extract(payload, '$.prompt_blob'), json_extract(payload, '$.prompt_messages') FROM events WHERE event_type = ? ORDER BY id`, db.EventTurnStarted)
+	if err != nil {
+		t.Fatal(err)
+	}
+	var prompts [][]db.PromptMessage
+	for rows.Next() {
+		var hash string
+		var count int
+		if err := rows.Scan(&hash, &count); err != nil {
+			t.Fatal(err)
+		}
+		msgs, err := db.GetPrompt(database, hash)
+		if err != nil || len(msgs) != count {
+			t.Fatalf("prompt %s: expected %d messages, got %d err=%v", hash, count, len(msgs), err)
+		}
+		prompts = append(prompts, msgs)
+	}
+	rows.Close()
+	if len(prompts) != 2 || len(prompts[1]) != len(provider.calls[1]) {
+		t.Fatalf("expected one captured prompt per model call, got %d", len(prompts))
+	}
+	for i, m := range prompts[1] {
+		if want := provider.calls[1][i]; m.Role != want.Role || m.ToolCallID != want.ToolCallID {
+			t.Fatalf("message %d: captured %+v, sent %+v", i, m, want)
+		}
+	}
+	user := prompts[0][len(prompts[0])-1]
+	if user.Role != "user" || strings.Contains(user.Content, "abc.def.ghi") || !strings.Contains(user.Content, "REDACTED") {
+		t.Fatalf("expected the redacted user message, got %+v", user)
+	}
+	call := prompts[1][len(prompts[1])-2]
+	if len(call.ToolCalls) != 1 || strings.Contains(call.ToolCalls[0].Arguments, "ghp_abc123") {
+		t.Fatalf("expected redacted tool call arguments, got %+v", call)
+	}
+
+	var completion string
+	if err := database.QueryRow(`SELECT json_extract(payload, '$.completion_blob') FROM events WHERE event_type = ? ORDER BY id LIMIT 1`, db.EventTurnCompleted).Scan(&completion); err != nil {
+		t.Fatal(err)
+	}
+	reply, err := db.GetPromptMessage(database, completion)
+	if err != nil || !reflect.DeepEqual(reply, call) {
+		t.Fatalf("expected the first completion to be the tool call message %+v, got %+v err=%v", call, reply, err)
+	}
+}
+
+func TestProcessTask_ContextStageChain(t *testing.T) {
+	cfg := &config.WorkerConfig{OpenAIModel: "gpt-4o-mini", SystemPrompt: "sys", HistoryWindow: 12, ContextTokenBudget: 6000, SummaryThreshold: 6, SummaryKeep: 2}
+	if got := contextStages(cfg); !slices.Equal(got, []string{"summarize", "token_budget"}) {
+		t.Fatalf("unexpected default stages %v", got)
+	}
+	cfg.ContextTokenBudget, cfg.SummaryThreshold = 0, 0
+	if got := contextStages(cfg); !slices.Equal(got, []string{"window"}) {
+		t.Fatalf("unexpected default stages without budget or summaries %v", got)
+	}
+
+	database := testWorkerDB(t)
+	appendHistory(database, 7, "user", "部署失败了")
+	appendHistory(database, 7, "user", "部署失败了")
+	appendHistory(database, 7, "assistant", "请贴一下日志")
+	cfg.ContextStages = []string{"dedupe", "window"}
+	chain, err := newContextChain(cfg, database, 2)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, ok := summarizerOf(chain); ok {
+		t.Fatal("a chain without summarize must not summarize")
+	}
+	provider := &nativeSeqProvider{seqProvider: seqProvider{resps: []modelpkg.CompletionResponse{{Content: "ok"}}}}
+	task := &queueTask{ID: 16, ChatID: 7, UpdateID: 16, Text: "日志如下"}
+	policy := control.Policy{MaxTurns: 1, MaxWallTime: 120 * time.Second, MaxTokens: 10000, MaxRetries: 3}
+	agentEventID, err := db.LogEvent(database, nil, db.EventAgentStarted, map[string]any{"task_id": task.ID})
+	if err != nil {
+		t.Fatal(err)
+	}
+	reg := toolpkg.NewRegistry()
+	if err := processTask(context.Background(), database, &captureCommander{}, provider, cfg, task, agentEventID,
+		&ctxpkg.SQLiteProvider{DB: database}, chain, &ctxpkg.StandardAssembler{},
+		policy, reg, toolpkg.NewRunner(reg)); err != nil {
+		t.Fatal(err)
+	}
+	var users int
+	for _, msg := range provider.calls[0] {
+		if msg.Content == "部署失败了" {
+			users++
+		}
+	}
+	if users != 1 {
+		t.Fatalf("expected the repeated message once, got %d in %+v", users, provider.calls[0])
+	}
+
+	var payload struct {
+		DroppedCount int              `json:"dropped_count"`
+		Stages       []map[string]any `json:"stages"`
+	}
+	var raw string
+	if err := database.QueryRow(`SELECT payload FROM events WHERE event_type = ? AND parent_id = ?`, db.EventContextAssembled, agentEventID).Scan(&raw); err != nil {
+		t.Fatal(err)
+	}
+	if err := json.Unmarshal([]byte(raw), &payload); err != nil {
+		t.Fatal(err)
+	}
+	if payload.DroppedCount != 1 || len(payload.Stages) != 2 {
+		t.Fatalf("unexpected context.assembled %s", raw)
+	}
+	dedupe, window := payload.Stages[0], payload.Stages[1]
+	if dedupe["name"] != "dedupe" || dedupe["in_count"] != 3.0 || dedupe["out_count"] != 2.0 || dedupe["dropped_count"] != 1.0 {
+		t.Fatalf("unexpected dedupe stage %v", dedupe)
+	}
+	if window["name"] != "window" || window["out_count"] != 2.0 || window["dropped_count"] != nil {
+		t.Fatalf("unexpected window stage %v", window)
+	}
+
+	cfg.SummaryThreshold = 6
+	cfg.ContextStages = []string{"dedupe", "token_budget", "summarize"}
+	if chain, err = newContextChain(cfg, database, 12); err != nil {
+		t.Fatal(err)
+	}
+	if _, ok := summarizerOf(chain); !ok {
+		t.Fatal("expected the summarize stage to summarize wherever it is listed")
+	}
+}
+
+func TestProcessTask_SemanticRetrieval(t *testing.T) {
+	database := testWorkerDB(t)
+	appendHistory(database, 7, "user", "数据库迁移方案定为先备份再迁移")
+	appendHistory(database, 7, "assistant", "好的")
+	for _, text := range []string{"今天天气不错", "明天要开会", "会议室在三楼", "收到"} {
+		appendHistory(database, 7, "user", text)
+	}
+	indexer := &vector.Indexer{DB: database, Embedder: dummy.NewEmbedder(256)}
+	ctxProvider := &vector.Provider{Next: &ctxpkg.SQLiteProvider{DB: database}, Indexer: indexer, TopK: 1, MinScore: 0.2}
+	provider := &nativeSeqProvider{seqProvider: seqProvider{resps: []modelpkg.CompletionResponse{{Content: "先备份"}}}}
+	cfg := &config.WorkerConfig{OpenAIModel: "gpt-4o-mini", SystemPrompt: "sys", HistoryWindow: 4}
+	task := &queueTask{ID: 15, ChatID: 7, UpdateID: 15, Text: "数据库迁移怎么做来着"}
+	policy := control.Policy{MaxTurns: 1, MaxWallTime: 120 * time.Second, MaxTokens: 10000, MaxRetries: 3}
+	agentEventID, err := db.LogEvent(database, nil, db.EventAgentStarted, map[string]any{"task_id": 15})
+	if err != nil {
+		t.Fatal(err)
+	}
+	reg := toolpkg.NewRegistry()
+	if err := processTask(context.Background(), database, &captureCommander{}, provider, cfg, task, agentEventID,
+		ctxProvider, &ctxpkg.SimpleCompressor{MaxMessages: 5}, &ctxpkg.StandardAssembler{},
+		policy, reg, toolpkg.NewRunner(reg)); err != nil {
+		t.Fatalf("processTask failed: %v", err)
+	}
+
+	var found bool
+	for _, m := range provider.calls[0] {
+		if m.Role == "system" && strings.HasPrefix(m.Content, ctxpkg.RetrievedPrefix) && strings.Contains(m.Content, "先备份再迁移") {
+			found = true
+		}
+	}
+	if !found {
+		t.Fatalf("expected the older migration message in a retrieved block, got %+v", provider.calls[0])
+	}
+	var retrieved int
+	if err := database.QueryRow(
+		`SELECT json_extract(payload, '$.retrieved_count') FROM events WHERE event_type = ?`, db.EventContextAssembled,
+	).Scan(&retrieved); err != nil || retrieved != 1 {
+		t.Fatalf("expected retrieved_count 1, got %d err=%v", retrieved, err)
+	}
+	pending, err := db.PendingHistoryEmbeddings(database, indexer.Embedder.Model(), 10)
+	if err != nil || len(pending) != 0 {
+		t.Fatalf("expected the new turn embedded after the task, got %+v err=%v", pending, err)
+	}
+}
+
+func TestProcessTask_TokenBudgetTrimsHistory(t *testing.T) {
+	database := testWorkerDB(t)
+	for i := 0; i < 6; i++ {
+		appendHistory(database, 7, "user", strings.Repeat("很长的历史消息内容。", 80))
+		appendHistory(database, 7, "assistant", "好的")
+	}
+	provider := &nativeSeqProvider{seqProvider: seqProvider{resps: []modelpkg.CompletionResponse{{Content: "ok"}}}}
+	cfg := &config.WorkerConfig{OpenAIModel: "gpt-4o-mini", SystemPrompt: "sys", HistoryWindow: 12}
+	task := &queueTask{ID: 13, ChatID: 7, UpdateID: 13, Text: "hi"}
+	policy := control.Policy{MaxTurns: 1, MaxWallTime: 120 * time.Second, MaxTokens: 100000, MaxRetries: 3}
+	agentEventID, err := db.LogEvent(database, nil, db.EventAgentStarted, map[string]any{"task_id": 13})
+	if err != nil {
+		t.Fatal(err)
+	}
+	compressor := &ctxpkg.TokenBudgetCompressor{Tokenizer: tokenizer.ForModel(cfg.OpenAIModel), BudgetTokens: 1500}
+	reg := toolpkg.NewRegistry()
+	if err := processTask(context.Background(), database, &captureCommander{}, provider, cfg, task, agentEventID,
+		&ctxpkg.SQLiteProvider{DB: database}, compressor, &ctxpkg.StandardAssembler{},
+		policy, reg, toolpkg.NewRunner(reg)); err != nil {
+		t.Fatalf("processTask failed: %v", err)
+	}
+
+	var dropped, truncated, historyTokens, historyBudget int
+	var encoding string
+	if err := database.QueryRow(
+		`SELECT json_extract(payload, '$.dropped_count'), json_extract(payload, '$.truncated_count'),
+			json_extract(payload, '$.history_tokens'), json_extract(payload, '$.history_budget_tokens'),
+			json_extract(payload, '$.tokenizer')
+		FROM events WHERE event_type = ?`, db.EventContextAssembled,
+	).Scan(&dropped, &truncated, &historyTokens, &historyBudget, &encoding); err != nil {
+		t.Fatal(err)
+	}
+	if dropped == 0 || historyTokens > historyBudget || encoding != tokenizer.O200K {
+		t.Fatalf("expected trimmed history within budget, got dropped=%d truncated=%d history=%d budget=%d tokenizer=%s",
+			dropped, truncated, historyTokens, historyBudget, encoding)
+	}
+	sent := ctxpkg.CountTokens(tokenizer.ForModel(cfg.OpenAIModel), provider.calls[0])
+	if sent > compressor.BudgetTokens {
+		t.Fatalf("expected prompt within %d tokens, sent %d", compressor.BudgetTokens, sent)
+	}
+}
+
+func TestProcessTask_SummarizesOldHistory(t *testing.T) {
+	database := testWorkerDB(t)
+	for i := 0; i < 4; i++ {
+		appendHistory(database, 7, "user", fmt.Sprintf("问题 %d", i))
+		appendHistory(database, 7, "assistant", fmt.Sprintf("回答 %d", i))
+	}
+	provider := &nativeSeqProvider{seqProvider: seqProvider{resps: []modelpkg.CompletionResponse{
+		{Content: "用户决定使用 SQLite。", InputTokens: 300, OutputTokens: 40},
+		{Content: "ok", InputTokens: 100, OutputTokens: 5},
+	}}}
+	cfg := &config.WorkerConfig{OpenAIModel: "gpt-4o-mini", SystemPrompt: "sys", HistoryWindow: 12}
+	task := &queueTask{ID: 14, ChatID: 7, UpdateID: 14, Text: "继续"}
+	policy := control.Policy{MaxTurns: 1, MaxWallTime: 120 * time.Second, MaxTokens: 10000, MaxRetries: 3}
+	agentEventID, err := db.LogEvent(database, nil, db.EventAgentStarted, map[string]any{"task_id": 14})
+	if err != nil {
+		t.Fatal(err)
+	}
+	compressor := summary.New(database, 6, 2, &ctxpkg.SimpleCompressor{MaxMessages: 12})
+	reg := toolpkg.NewRegistry()
+	if err := processTask(context.Background(), database, &captureCommander{}, provider, cfg, task, agentEventID,
+		&ctxpkg.SQLiteProvider{DB: database}, compressor, &ctxpkg.StandardAssembler{},
+		policy, reg, toolpkg.NewRunner(reg)); err != nil {
+		t.Fatalf("processTask failed: %v", err)
+	}
+
+	var folded, toID int
+	if err := database.QueryRow(
+		`SELECT json_extract(payload, '$.folded_count'), json_extract(payload, '$.to_history_id')
+		 FROM events WHERE event_type = ? AND parent_id = ?`, db.EventSummaryCompleted, agentEventID,
+	).Scan(&folded, &toID); err != nil {
+		t.Fatal(err)
+	}
+	if folded != 6 || toID != 6 {
+		t.Fatalf("expected rows 1..6 folded, got folded=%d to=%d", folded, toID)
+	}
+	// The answering turn sees the summary instead of the folded messages.
+	if len(provider.calls) != 1 {
+		t.Fatalf("expected one tool-capable answering call, got %d", len(provider.calls))
+	}
+	prompt := provider.calls[0]
+	var sawSummary bool
+	for _, msg := range prompt {
+		if msg.Content == summary.SummaryPrefix+"用户决定使用 SQLite。" {
+			sawSummary = true
+		}
+		if msg.Content == "问题 0" {
+			t.Fatal("expected folded history to be left out of the prompt")
+		}
+	}
+	if !sawSummary {
+		t.Fatalf("expected summary in prompt, got %+v", prompt)
+	}
+	var spentTokens int
+	if err := database.QueryRow("SELECT input_tokens FROM spend WHERE chat_id = 7").Scan(&spentTokens); err != nil {
+		t.Fatal(err)
+	}
+	if spentTokens != 400 {
+		t.Fatalf("expected summary tokens in spend, got %d", spentTokens)
+	}
+
+	// Summary tokens count toward the task's token limit.
+	for i := 0; i < 2; i++ {
+		appendHistory(database, 7, "user", "更多")
+		appendHistory(database, 7, "assistant", "好")
+	}
+	provider = &nativeSeqProvider{seqProvider: seqProvider{resps: []modelpkg.CompletionResponse{
+		{Content: "更新后的摘要", InputTokens: 500, OutputTokens: 50},
+	}}}
+	policy.MaxTokens = 400
+	task = &queueTask{ID: 15, ChatID: 7, UpdateID: 15, Text: "再继续"}
+	err = processTask(context.Background(), database, &captureCommander{}, provider, cfg, task, agentEventID,
+		&ctxpkg.SQLiteProvider{DB: database}, compressor, &ctxpkg.StandardAssembler{},
+		policy, reg, toolpkg.NewRunner(reg))
+	var limitErr *control.LimitError
+	if !errors.As(err, &limitErr) || limitErr.Type != control.LimitTokens || len(provider.calls) != 0 {
+		t.Fatalf("expected token limit from the summary call alone, got %v (calls=%d)", err, len(provider.calls))
+	}
+}
+
+func TestProcessTask_SpendBudgetStopsBeforeNextTurn(t *testing.T) {
+	database := testWorkerDB(t)
+	base := t.TempDir()
+	provider := &nativeSeqProvider{seqProvider: seqProvider{resps: []modelpkg.CompletionResponse{
+		{ToolCalls: []ctxpkg.ToolCall{{ID: "call_1", Name: "ls", Arguments: json.RawMessage(`{"path":"."}`)}}, InputTokens: 1000, OutputTokens: 500},
+		{Content: "never sent", InputTokens: 1, OutputTokens: 1},
+	}}}
+	cfg := &config.WorkerConfig{
+		OpenAIModel:   "gpt-4o-mini",
+		SystemPrompt:  "sys",
+		HistoryWindow: 12,
+		ModelPrices:   map[string]cost.Price{"gpt-4o-mini": {InputPerMTok: 1, OutputPerMTok: 2}},
+	}
+	task := &queueTask{ID: 16, ChatID: 7, UpdateID: 16, Text: "list files"}
+	policy := control.Policy{MaxTurns: 5, MaxWallTime: 120 * time.Second, MaxTokens: 100000, MaxRetries: 3, MaxDailyCostUSD: 0.001}
+	agentEventID, err := db.LogEvent(database, nil, db.EventAgentStarted, map[string]any{"task_id": 16})
+	if err != nil {
+		t.Fatal(err)
+	}
+	p, err := toolpkg.NewPolicy(base, "")
+	if err != nil {
+		t.Fatal(err)
+	}
+	reg := toolpkg.NewRegistry()
+	if err := reg.Register(toolpkg.NewLS(p, base, 2*time.Second, toolpkg.Limits{MaxLines: 100, MaxBytes: 4096})); err != nil {
+		t.Fatal(err)
+	}
+	err = processTask(context.Background(), database, &captureCommander{}, provider, cfg, task, agentEventID,
+		&ctxpkg.SQLiteProvider{DB: database}, &ctxpkg.SimpleCompressor{MaxMessages: 12}, &ctxpkg.StandardAssembler{},
+		policy, reg, toolpkg.NewRunner(reg))
+	var limitErr *control.LimitError
+	if !errors.As(err, &limitErr) || limitErr.Type != control.LimitCost || len(provider.calls) != 1 {
+		t.Fatalf("expected max_cost before the second model call, got %v (calls=%d)", err, len(provider.calls))
+	}
+	var limitType, period string
+	if err := database.QueryRow(
+		"SELECT json_extract(payload, '$.limit_type'), json_extract(payload, '$.period') FROM events WHERE event_type = ? AND parent_id = ?",
+		db.EventControlLimitReached, agentEventID,
+	).Scan(&limitType, &period); err != nil {
+		t.Fatal(err)
+	}
+	if limitType != "max_cost" || period != "daily" {
+		t.Fatalf("unexpected limit event: type=%s period=%s", limitType, period)
+	}
+}
+
+func TestCheckSpendBudget(t *testing.T) {
+	database := testWorkerDB(t)
+	now := time.Date(2026, 5, 20, 12, 0, 0, 0, time.UTC)
+	if err := db.RecordSpend(database, 1, "2026-05-20", 0.6, 0, 0); err != nil {
+		t.Fatal(err)
+	}
+	if err := db.RecordSpend(database, 2, "2026-05-03", 4, 0, 0); err != nil {
+		t.Fatal(err)
+	}
+
+	limitErr, err := checkSpendBudget(database, control.Policy{MaxDailyCostUSD: 1, MaxMonthlyCostUSD: 10}, now)
+	if err != nil || limitErr != nil {
+		t.Fatalf("expected spend within budget, got %v err=%v", limitErr, err)
+	}
+	limitErr, err = checkSpendBudget(database, control.Policy{MaxDailyCostUSD: 0.5}, now)
+	if err != nil || limitErr == nil || limitErr.Type != control.LimitCost || limitErr.Period != control.PeriodDaily {
+		t.Fatalf("expected daily max_cost limit, got %v err=%v", limitErr, err)
+	}
+	if reply := budgetExceededReply(limitErr); !strings.Contains(reply, "每日") || !strings.Contains(reply, "$0.6000") {
+		t.Fatalf("unexpected reply: %s", reply)
+	}
+	limitErr, err = checkSpendBudget(database, control.Policy{MaxMonthlyCostUSD: 4.5}, now)
+	if err != nil || limitErr == nil || limitErr.Period != control.PeriodMonthly {
+		t.Fatalf("expected monthly max_cost limit, got %v err=%v", limitErr, err)
+	}
+
+	agentEventID, err := db.LogEvent(database, nil, db.EventAgentStarted, map[string]any{"task_id": 13})
+	if err != nil {
+		t.Fatal(err)
+	}
+	recordLimitEvent(database, agentEventID, 13, limitErr)
+	var limitType, period string
+	var thresholdUSD float64
+	if err := database.QueryRow(
+		"SELECT json_extract(payload, '$.limit_type'), json_extract(payload, '$.period'), json_extract(payload, '$.threshold_usd') FROM events WHERE event_type = ?",
+		db.EventControlLimitReached,
+	).Scan(&limitType, &period, &thresholdUSD); err != nil {
+		t.Fatal(err)
+	}
+	if limitType != "max_cost" || period != "monthly" || thresholdUSD != 4.5 {
+		t.Fatalf("unexpected limit event: type=%s period=%s threshold_usd=%v", limitType, period, thresholdUSD)
+	}
+}
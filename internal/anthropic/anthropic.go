@@ -0,0 +1,247 @@
+package anthropic
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"fmt"
+	"io"
+	"net/http"
+	"strings"
+	"time"
+
+	ctxpkg "github.com/stupiduntilnot/autonous/internal/context"
+	modelpkg "github.com/stupiduntilnot/autonous/internal/model"
+)
+
+const apiVersion = "2023-06-01"
+
+// Client is a minimal Anthropic Messages API client.
+type Client struct {
+	apiKey     string
+	url        string
+	model      string
+	maxTokens  int
+	httpClient *http.Client
+}
+
+// NewClient creates an Anthropic client. maxTokens caps each completion and
+// defaults to 4096 when not positive.
+func NewClient(apiKey, url, model string, maxTokens int, timeout time.Duration) *Client {
+	if maxTokens <= 0 {
+		maxTokens = 4096
+	}
+	return &Client{
+		apiKey:    apiKey,
+		url:       url,
+		model:     model,
+		maxTokens: maxTokens,
+		httpClient: &http.Client{
+			Timeout: timeout,
+		},
+	}
+}
+
+// block is one content block of a Messages API message.
+type block struct {
+	Type      string          `json:"type"`
+	Text      string          `json:"text,omitempty"`
+	ID        string          `json:"id,omitempty"`
+	Name      string          `json:"name,omitempty"`
+	Input     json.RawMessage `json:"input,omitempty"`
+	ToolUseID string          `json:"tool_use_id,omitempty"`
+	Content   string          `json:"content,omitempty"`
+}
+
+type message struct {
+	Role    string  `json:"role"`
+	Content []block `json:"content"`
+}
+
+type toolSpec struct {
+	Name        string          `json:"name"`
+	Description string          `json:"description,omitempty"`
+	InputSchema json.RawMessage `json:"input_schema"`
+}
+
+type toolChoice struct {
+	Type string `json:"type"`
+}
+
+type messagesRequest struct {
+	Model       string      `json:"model"`
+	MaxTokens   int         `json:"max_tokens"`
+	System      string      `json:"system,omitempty"`
+	Messages    []message   `json:"messages"`
+	Temperature float32     `json:"temperature,omitempty"`
+	Tools       []toolSpec  `json:"tools,omitempty"`
+	ToolChoice  *toolChoice `json:"tool_choice,omitempty"`
+}
+
+type messagesResponse struct {
+	Content []block `json:"content"`
+	Usage   *usage  `json:"usage"`
+}
+
+type usage struct {
+	InputTokens  int `json:"input_tokens"`
+	OutputTokens int `json:"output_tokens"`
+}
+
+// ChatCompletion sends a Messages API request and returns a CompletionResponse.
+func (c *Client) ChatCompletion(ctx context.Context, messages []ctxpkg.Message) (modelpkg.CompletionResponse, error) {
+	return c.ChatCompletionWithTools(ctx, messages, nil)
+}
+
+// ChatCompletionWithTools sends a Messages API request declaring tools.
+// tool_use blocks in the response are returned in CompletionResponse.ToolCalls.
+func (c *Client) ChatCompletionWithTools(ctx context.Context, messages []ctxpkg.Message, tools []modelpkg.ToolDefinition) (modelpkg.CompletionResponse, error) {
+	system, converted := convertMessages(messages)
+	reqBody := messagesRequest{
+		Model:       c.model,
+		MaxTokens:   c.maxTokens,
+		System:      system,
+		Messages:    converted,
+		Temperature: 0.2,
+	}
+	if len(tools) > 0 {
+		reqBody.Tools = toToolSpecs(tools)
+		reqBody.ToolChoice = &toolChoice{Type: "auto"}
+	}
+	payload, err := json.Marshal(reqBody)
+	if err != nil {
+		return modelpkg.CompletionResponse{}, &modelpkg.Error{Class: modelpkg.ErrBadRequest, Provider: "anthropic", Message: "failed to marshal request", Err: err}
+	}
+
+	req, err := http.NewRequestWithContext(ctx, http.MethodPost, c.url, bytes.NewReader(payload))
+	if err != nil {
+		return modelpkg.CompletionResponse{}, &modelpkg.Error{Class: modelpkg.ErrBadRequest, Provider: "anthropic", Message: "failed to create request", Err: err}
+	}
+	req.Header.Set("Content-Type", "application/json")
+	req.Header.Set("x-api-key", c.apiKey)
+	req.Header.Set("anthropic-version", apiVersion)
+
+	resp, err := c.httpClient.Do(req)
+	if err != nil {
+		return modelpkg.CompletionResponse{}, modelpkg.TransportError("anthropic", err)
+	}
+	defer resp.Body.Close()
+
+	body, err := io.ReadAll(resp.Body)
+	if err != nil {
+		return modelpkg.CompletionResponse{}, modelpkg.TransportError("anthropic", fmt.Errorf("failed reading response: %w", err))
+	}
+
+	if resp.StatusCode < 200 || resp.StatusCode >= 300 {
+		return modelpkg.CompletionResponse{}, modelpkg.HTTPError("anthropic", resp.StatusCode, resp.Header, truncate(string(body), 400))
+	}
+
+	var parsed messagesResponse
+	if err := json.Unmarshal(body, &parsed); err != nil {
+		return modelpkg.CompletionResponse{}, &modelpkg.Error{Class: modelpkg.ErrServer, Provider: "anthropic", Message: "failed to parse response: " + truncate(string(body), 400)}
+	}
+
+	result := modelpkg.CompletionResponse{}
+	if parsed.Usage != nil {
+		result.InputTokens = parsed.Usage.InputTokens
+		result.OutputTokens = parsed.Usage.OutputTokens
+	}
+
+	var text []string
+	for _, b := range parsed.Content {
+		switch b.Type {
+		case "text":
+			if s := strings.TrimSpace(b.Text); s != "" {
+				text = append(text, s)
+			}
+		case "tool_use":
+			args := b.Input
+			if len(bytes.TrimSpace(args)) == 0 {
+				args = json.RawMessage("{}")
+			}
+			result.ToolCalls = append(result.ToolCalls, ctxpkg.ToolCall{ID: b.ID, Name: b.Name, Arguments: args})
+		}
+	}
+	result.Content = strings.Join(text, "\n\n")
+	if result.Content == "" && len(result.ToolCalls) == 0 {
+		result.Content = "(empty model response)"
+	}
+	return result, nil
+}
+
+// convertMessages maps context messages onto the Messages API shape: system
+// messages are joined into the top-level system field, tool results become
+// user tool_result blocks, and consecutive same-role turns are merged so the
+// conversation strictly alternates starting with a user turn.
+func convertMessages(messages []ctxpkg.Message) (string, []message) {
+	var systemParts []string
+	var out []message
+	appendBlocks := func(role string, blocks []block) {
+		if len(blocks) == 0 {
+			return
+		}
+		if len(out) > 0 && out[len(out)-1].Role == role {
+			out[len(out)-1].Content = append(out[len(out)-1].Content, blocks...)
+			return
+		}
+		out = append(out, message{Role: role, Content: blocks})
+	}
+
+	for _, m := range messages {
+		switch m.Role {
+		case "system":
+			if s := strings.TrimSpace(m.Content); s != "" {
+				systemParts = append(systemParts, s)
+			}
+		case "tool":
+			content := m.Content
+			if strings.TrimSpace(content) == "" {
+				content = "(no output)"
+			}
+			appendBlocks("user", []block{{Type: "tool_result", ToolUseID: m.ToolCallID, Content: content}})
+		case "assistant":
+			var blocks []block
+			if strings.TrimSpace(m.Content) != "" {
+				blocks = append(blocks, block{Type: "text", Text: m.Content})
+			}
+			for _, tc := range m.ToolCalls {
+				input := tc.Arguments
+				if len(bytes.TrimSpace(input)) == 0 {
+					input = json.RawMessage("{}")
+				}
+				blocks = append(blocks, block{Type: "tool_use", ID: tc.ID, Name: tc.Name, Input: input})
+			}
+			appendBlocks("assistant", blocks)
+		default:
+			if strings.TrimSpace(m.Content) != "" {
+				appendBlocks("user", []block{{Type: "text", Text: m.Content}})
+			}
+		}
+	}
+
+	if len(out) > 0 && out[0].Role != "user" {
+		lead := message{Role: "user", Content: []block{{Type: "text", Text: "(earlier conversation omitted)"}}}
+		out = append([]message{lead}, out...)
+	}
+	return strings.Join(systemParts, "\n\n"), out
+}
+
+func toToolSpecs(tools []modelpkg.ToolDefinition) []toolSpec {
+	specs := make([]toolSpec, 0, len(tools))
+	for _, t := range tools {
+		schema := t.Parameters
+		if len(schema) == 0 {
+			schema = json.RawMessage(`{"type":"object","properties":{}}`)
+		}
+		specs = append(specs, toolSpec{Name: t.Name, Description: t.Description, InputSchema: schema})
+	}
+	return specs
+}
+
+func truncate(s string, maxChars int) string {
+	runes := []rune(s)
+	if len(runes) <= maxChars {
+		return s
+	}
+	return string(runes[:maxChars])
+}
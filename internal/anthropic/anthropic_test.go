@@ -0,0 +1,198 @@
+package anthropic
+
+import (
+	"context"
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+	"time"
+
+	ctxpkg "github.com/stupiduntilnot/autonous/internal/context"
+	modelpkg "github.com/stupiduntilnot/autonous/internal/model"
+)
+
+func TestChatCompletion_WithUsage(t *testing.T) {
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.Header.Get("x-api-key") != "test-key" {
+			t.Errorf("unexpected api key header: %q", r.Header.Get("x-api-key"))
+		}
+		if r.Header.Get("anthropic-version") == "" {
+			t.Error("expected anthropic-version header")
+		}
+		resp := map[string]any{
+			"content": []map[string]any{
+				{"type": "text", "text": "Hello!"},
+			},
+			"usage": map[string]any{
+				"input_tokens":  42,
+				"output_tokens": 7,
+			},
+		}
+		w.Header().Set("Content-Type", "application/json")
+		json.NewEncoder(w).Encode(resp)
+	}))
+	defer server.Close()
+
+	client := NewClient("test-key", server.URL, "test-model", 1024, 5*time.Second)
+	result, err := client.ChatCompletion(context.Background(), []ctxpkg.Message{{Role: "user", Content: "hi"}})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if result.Content != "Hello!" {
+		t.Errorf("expected content 'Hello!', got %q", result.Content)
+	}
+	if result.InputTokens != 42 {
+		t.Errorf("expected 42 input tokens, got %d", result.InputTokens)
+	}
+	if result.OutputTokens != 7 {
+		t.Errorf("expected 7 output tokens, got %d", result.OutputTokens)
+	}
+}
+
+func TestChatCompletion_SystemAndAlternation(t *testing.T) {
+	var captured messagesRequest
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if err := json.NewDecoder(r.Body).Decode(&captured); err != nil {
+			t.Errorf("decode request: %v", err)
+		}
+		w.Header().Set("Content-Type", "application/json")
+		json.NewEncoder(w).Encode(map[string]any{
+			"content": []map[string]any{{"type": "text", "text": "ok"}},
+		})
+	}))
+	defer server.Close()
+
+	client := NewClient("test-key", server.URL, "test-model", 1024, 5*time.Second)
+	_, err := client.ChatCompletion(context.Background(), []ctxpkg.Message{
+		{Role: "system", Content: "You are a bot."},
+		{Role: "system", Content: "Tool instruction."},
+		{Role: "assistant", Content: "earlier answer"},
+		{Role: "user", Content: "first"},
+		{Role: "user", Content: "second"},
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if captured.System != "You are a bot.\n\nTool instruction." {
+		t.Errorf("unexpected system field: %q", captured.System)
+	}
+	if captured.MaxTokens != 1024 {
+		t.Errorf("expected max_tokens 1024, got %d", captured.MaxTokens)
+	}
+	if len(captured.Messages) != 3 {
+		t.Fatalf("expected 3 alternating messages, got %d: %+v", len(captured.Messages), captured.Messages)
+	}
+	wantRoles := []string{"user", "assistant", "user"}
+	for i, m := range captured.Messages {
+		if m.Role != wantRoles[i] {
+			t.Errorf("message %d: expected role %s, got %s", i, wantRoles[i], m.Role)
+		}
+	}
+	if len(captured.Messages[2].Content) != 2 {
+		t.Errorf("expected consecutive user turns merged, got %+v", captured.Messages[2])
+	}
+}
+
+func TestChatCompletionWithTools_ToolUseRoundTrip(t *testing.T) {
+	var captured messagesRequest
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if err := json.NewDecoder(r.Body).Decode(&captured); err != nil {
+			t.Errorf("decode request: %v", err)
+		}
+		w.Header().Set("Content-Type", "application/json")
+		json.NewEncoder(w).Encode(map[string]any{
+			"content": []map[string]any{
+				{"type": "text", "text": "Let me look."},
+				{"type": "tool_use", "id": "toolu_2", "name": "read", "input": map[string]any{"path": "a.txt", "limit": 10}},
+			},
+			"usage": map[string]any{"input_tokens": 5, "output_tokens": 3},
+		})
+	}))
+	defer server.Close()
+
+	client := NewClient("test-key", server.URL, "test-model", 1024, 5*time.Second)
+	tools := []modelpkg.ToolDefinition{
+		{Name: "ls", Description: "list", Parameters: json.RawMessage(`{"type":"object"}`)},
+	}
+	result, err := client.ChatCompletionWithTools(context.Background(), []ctxpkg.Message{
+		{Role: "user", Content: "list"},
+		{Role: "assistant", ToolCalls: []ctxpkg.ToolCall{{ID: "toolu_1", Name: "ls", Arguments: json.RawMessage(`{"path":"."}`)}}},
+		{Role: "tool", ToolCallID: "toolu_1", Content: "a.txt"},
+	}, tools)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if len(captured.Tools) != 1 || captured.Tools[0].Name != "ls" {
+		t.Fatalf("unexpected tools in request: %+v", captured.Tools)
+	}
+	if captured.ToolChoice == nil || captured.ToolChoice.Type != "auto" {
+		t.Errorf("expected tool_choice auto, got %+v", captured.ToolChoice)
+	}
+	if len(captured.Messages) != 3 {
+		t.Fatalf("expected 3 messages, got %d", len(captured.Messages))
+	}
+	use := captured.Messages[1].Content[0]
+	if use.Type != "tool_use" || use.ID != "toolu_1" || use.Name != "ls" {
+		t.Errorf("unexpected tool_use block: %+v", use)
+	}
+	res := captured.Messages[2]
+	if res.Role != "user" || res.Content[0].Type != "tool_result" || res.Content[0].ToolUseID != "toolu_1" {
+		t.Errorf("unexpected tool_result message: %+v", res)
+	}
+
+	if result.Content != "Let me look." {
+		t.Errorf("unexpected content: %q", result.Content)
+	}
+	if len(result.ToolCalls) != 1 {
+		t.Fatalf("expected 1 tool call, got %d", len(result.ToolCalls))
+	}
+	tc := result.ToolCalls[0]
+	if tc.ID != "toolu_2" || tc.Name != "read" {
+		t.Errorf("unexpected tool call: %+v", tc)
+	}
+	var args map[string]any
+	if err := json.Unmarshal(tc.Arguments, &args); err != nil || args["path"] != "a.txt" {
+		t.Errorf("unexpected tool arguments: %s", tc.Arguments)
+	}
+}
+
+func TestChatCompletion_EmptyContent(t *testing.T) {
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("Content-Type", "application/json")
+		json.NewEncoder(w).Encode(map[string]any{
+			"content": []map[string]any{},
+			"usage":   map[string]any{"input_tokens": 10, "output_tokens": 0},
+		})
+	}))
+	defer server.Close()
+
+	client := NewClient("test-key", server.URL, "test-model", 0, 5*time.Second)
+	result, err := client.ChatCompletion(context.Background(), []ctxpkg.Message{{Role: "user", Content: "hi"}})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if result.Content != "(empty model response)" {
+		t.Errorf("expected empty model response fallback, got %q", result.Content)
+	}
+	if result.InputTokens != 10 {
+		t.Errorf("expected 10 input tokens, got %d", result.InputTokens)
+	}
+}
+
+func TestChatCompletion_HTTPError(t *testing.T) {
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.WriteHeader(http.StatusTooManyRequests)
+		w.Write([]byte(`{"type":"error","error":{"type":"rate_limit_error"}}`))
+	}))
+	defer server.Close()
+
+	client := NewClient("test-key", server.URL, "test-model", 1024, 5*time.Second)
+	_, err := client.ChatCompletion(context.Background(), []ctxpkg.Message{{Role: "user", Content: "hi"}})
+	if err == nil {
+		t.Fatal("expected error for 429 response")
+	}
+}
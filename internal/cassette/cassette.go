@@ -0,0 +1,366 @@
+package cassette
+
+import (
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"os"
+	"path/filepath"
+	"slices"
+	"sync"
+
+	cmdpkg "github.com/stupiduntilnot/autonous/internal/commander"
+	ctxpkg "github.com/stupiduntilnot/autonous/internal/context"
+	modelpkg "github.com/stupiduntilnot/autonous/internal/model"
+	"github.com/stupiduntilnot/autonous/internal/redact"
+)
+
+const version = 2
+
+// Capabilities recorded alongside the interactions so a replay exposes the
+// same optional interfaces as the recorded provider and commander.
+const (
+	capTools  = "tools"
+	capStream = "stream"
+	capEdit   = "edit"
+)
+
+// Model interaction kinds.
+const (
+	kindChat   = "chat"
+	kindTools  = "tools"
+	kindStream = "stream"
+)
+
+// Commander interaction kinds.
+const (
+	kindGetUpdates        = "get_updates"
+	kindSendMessage       = "send_message"
+	kindSendMessageWithID = "send_message_with_id"
+	kindEditMessageText   = "edit_message_text"
+)
+
+// Cassette is a JSON recording of model and commander interactions.
+//
+// A recording cassette is rewritten after every interaction so a crash keeps
+// everything captured so far. A replay cassette serves the interactions back
+// in order: model requests must match the recorded request and sends must
+// carry the recorded chat and text, otherwise the call fails with a
+// DivergenceError. Requests are matched without their leading system
+// messages, which carry the date, git head, repository map and memories and
+// so change between runs of the same conversation; their hash is recorded
+// separately and a replay that sends a different system prompt gets a
+// warning instead. Text is stored with credentials masked by redact.Secrets,
+// and requests are hashed and matched in that masked form.
+type Cassette struct {
+	Version      int                    `json:"version"`
+	Capabilities []string               `json:"capabilities,omitempty"`
+	Model        []ModelInteraction     `json:"model"`
+	Commander    []CommanderInteraction `json:"commander"`
+
+	path string
+
+	mu        sync.Mutex
+	nextModel int
+	nextPoll  int
+	nextSend  int
+	edits     map[int64]string
+	warnings  []string
+}
+
+// ModelInteraction is one recorded model call.
+type ModelInteraction struct {
+	Kind        string    `json:"kind"`
+	RequestHash string    `json:"request_hash"`
+	SystemHash  string    `json:"system_hash,omitempty"`
+	Messages    []Message `json:"messages"`
+	Tools       []string  `json:"tools,omitempty"`
+	Deltas      []string  `json:"deltas,omitempty"`
+	Response    *Response `json:"response,omitempty"`
+	Error       *Error    `json:"error,omitempty"`
+}
+
+// Message is the recorded form of a context message.
+type Message struct {
+	Role       string            `json:"role"`
+	Content    string            `json:"content"`
+	ToolCalls  []ctxpkg.ToolCall `json:"tool_calls,omitempty"`
+	ToolCallID string            `json:"tool_call_id,omitempty"`
+}
+
+// Response is the recorded form of a completion response.
+type Response struct {
+	Content      string            `json:"content"`
+	ToolCalls    []ctxpkg.ToolCall `json:"tool_calls,omitempty"`
+	InputTokens  int               `json:"input_tokens"`
+	OutputTokens int               `json:"output_tokens"`
+	Route        *Route            `json:"route,omitempty"`
+}
+
+// Route is the recorded form of a model route.
+type Route struct {
+	Backend   string `json:"backend"`
+	Model     string `json:"model"`
+	Failovers int    `json:"failovers"`
+}
+
+// Error is a recorded failure. Class is empty for errors that were not typed
+// provider errors.
+type Error struct {
+	Class        string `json:"class,omitempty"`
+	Provider     string `json:"provider,omitempty"`
+	StatusCode   int    `json:"status_code,omitempty"`
+	RetryAfterMs int64  `json:"retry_after_ms,omitempty"`
+	Message      string `json:"message"`
+	Cause        string `json:"cause,omitempty"`
+}
+
+// CommanderInteraction is one recorded commander call. Polls that returned
+// nothing are not recorded.
+type CommanderInteraction struct {
+	Kind      string          `json:"kind"`
+	Updates   []cmdpkg.Update `json:"updates,omitempty"`
+	ChatID    int64           `json:"chat_id,omitempty"`
+	MessageID int64           `json:"message_id,omitempty"`
+	Text      string          `json:"text,omitempty"`
+	Error     string          `json:"error,omitempty"`
+}
+
+// DivergenceError reports a replayed call that does not match the cassette.
+type DivergenceError struct {
+	Call   string
+	Index  int
+	Reason string
+}
+
+func (e *DivergenceError) Error() string {
+	return fmt.Sprintf("cassette: %s %d diverged: %s", e.Call, e.Index, e.Reason)
+}
+
+// Create returns an empty cassette that records to path.
+func Create(path string) *Cassette {
+	return &Cassette{Version: version, path: path}
+}
+
+// Load reads a cassette for replay.
+func Load(path string) (*Cassette, error) {
+	raw, err := os.ReadFile(path)
+	if err != nil {
+		return nil, fmt.Errorf("read cassette: %w", err)
+	}
+	c := &Cassette{path: path}
+	if err := json.Unmarshal(raw, c); err != nil {
+		return nil, fmt.Errorf("parse cassette %s: %w", path, err)
+	}
+	if c.Version != version {
+		return nil, fmt.Errorf("cassette %s has unsupported version %d", path, c.Version)
+	}
+	return c, nil
+}
+
+// Finish reports recorded interactions a replay did not consume and streamed
+// messages whose final text differs from the recording.
+func (c *Cassette) Finish() error {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	var errs []error
+	if c.nextModel < len(c.Model) {
+		errs = append(errs, fmt.Errorf("cassette: %d of %d model calls not replayed", len(c.Model)-c.nextModel, len(c.Model)))
+	}
+	if i, ok := c.findCommander(c.nextPoll, isPoll); ok {
+		errs = append(errs, fmt.Errorf("cassette: commander poll %d not replayed", i))
+	}
+	if i, ok := c.findCommander(c.nextSend, isSend); ok {
+		errs = append(errs, fmt.Errorf("cassette: commander send %d not replayed", i))
+	}
+	for id, want := range c.recordedFinalEdits() {
+		if got := c.edits[id]; got != want {
+			errs = append(errs, fmt.Errorf("cassette: message %d final text diverged: recorded %q, got %q", id, clip(want), clip(got)))
+		}
+	}
+	return errors.Join(errs...)
+}
+
+// Warnings returns the differences a replay tolerated, such as a changed
+// system prompt.
+func (c *Cassette) Warnings() []string {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	return slices.Clone(c.warnings)
+}
+
+// PollsReplayed reports whether a replay has served every recorded poll, so
+// its commander has no updates left to deliver.
+func (c *Cassette) PollsReplayed() bool {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	_, ok := c.findCommander(c.nextPoll, isPoll)
+	return !ok
+}
+
+func (c *Cassette) addCapability(name string) {
+	if !slices.Contains(c.Capabilities, name) {
+		c.Capabilities = append(c.Capabilities, name)
+	}
+}
+
+func (c *Cassette) hasCapability(name string) bool {
+	return slices.Contains(c.Capabilities, name)
+}
+
+// save rewrites the cassette file. Callers hold c.mu.
+func (c *Cassette) save() error {
+	raw, err := json.MarshalIndent(c, "", "  ")
+	if err != nil {
+		return fmt.Errorf("encode cassette: %w", err)
+	}
+	if dir := filepath.Dir(c.path); dir != "" {
+		if err := os.MkdirAll(dir, 0o755); err != nil {
+			return fmt.Errorf("create cassette dir: %w", err)
+		}
+	}
+	tmp := c.path + ".tmp"
+	if err := os.WriteFile(tmp, append(raw, '\n'), 0o644); err != nil {
+		return fmt.Errorf("write cassette: %w", err)
+	}
+	if err := os.Rename(tmp, c.path); err != nil {
+		return fmt.Errorf("write cassette: %w", err)
+	}
+	return nil
+}
+
+func (c *Cassette) findCommander(from int, match func(kind string) bool) (int, bool) {
+	for i := from; i < len(c.Commander); i++ {
+		if match(c.Commander[i].Kind) {
+			return i, true
+		}
+	}
+	return 0, false
+}
+
+// recordedFinalEdits returns the last recorded text of every edited message.
+func (c *Cassette) recordedFinalEdits() map[int64]string {
+	out := map[int64]string{}
+	for _, it := range c.Commander {
+		if it.Kind == kindEditMessageText && it.Error == "" {
+			out[it.MessageID] = it.Text
+		}
+	}
+	return out
+}
+
+func isPoll(kind string) bool {
+	return kind == kindGetUpdates
+}
+
+// isSend matches the commander calls replayed strictly in order. Edits are
+// excluded because how many are sent depends on stream timing; only the final
+// text of each message is checked by Finish.
+func isSend(kind string) bool {
+	return kind == kindSendMessage || kind == kindSendMessageWithID
+}
+
+// toMessages converts messages to their recorded, redacted form.
+func toMessages(messages []ctxpkg.Message) []Message {
+	out := make([]Message, 0, len(messages))
+	for _, m := range messages {
+		out = append(out, Message{Role: m.Role, Content: redactText(m.Content), ToolCalls: redactCalls(m.ToolCalls), ToolCallID: m.ToolCallID})
+	}
+	return out
+}
+
+func redactText(text string) string {
+	out, _ := redact.Secrets(text)
+	return out
+}
+
+// redactCalls masks credentials in tool call arguments. Arguments that are no
+// longer valid JSON once masked are recorded as a JSON string.
+func redactCalls(calls []ctxpkg.ToolCall) []ctxpkg.ToolCall {
+	if len(calls) == 0 {
+		return nil
+	}
+	out := make([]ctxpkg.ToolCall, len(calls))
+	for i, call := range calls {
+		args, redacted := redact.Secrets(string(call.Arguments))
+		call.Arguments = json.RawMessage(args)
+		if redacted && !json.Valid(call.Arguments) {
+			call.Arguments, _ = json.Marshal(args)
+		}
+		out[i] = call
+	}
+	return out
+}
+
+func toolNames(tools []modelpkg.ToolDefinition) []string {
+	if len(tools) == 0 {
+		return nil
+	}
+	out := make([]string, 0, len(tools))
+	for _, t := range tools {
+		out = append(out, t.Name)
+	}
+	return out
+}
+
+// matchKey returns the part of a request a replay must reproduce: every
+// message after the leading system messages.
+func matchKey(messages []Message) []Message {
+	return messages[len(systemPrefix(messages)):]
+}
+
+// systemPrefix returns the leading system messages of a request.
+func systemPrefix(messages []Message) []Message {
+	for i, m := range messages {
+		if m.Role != "system" {
+			return messages[:i]
+		}
+	}
+	return messages
+}
+
+// requestHash identifies a model request by its messages and tool names.
+func requestHash(messages []Message, tools []string) string {
+	raw, _ := json.Marshal(struct {
+		Messages []Message `json:"messages"`
+		Tools    []string  `json:"tools,omitempty"`
+	}{messages, tools})
+	sum := sha256.Sum256(raw)
+	return hex.EncodeToString(sum[:])
+}
+
+// describeMismatch explains how a replayed request differs from the recording.
+// Both are match keys; skipped is the number of leading system messages the
+// replayed request had, so messages are numbered as in the full request.
+func describeMismatch(recorded, got []Message, skipped int, recordedTools, gotTools []string) string {
+	for i := 0; i < len(recorded) && i < len(got); i++ {
+		r, g := recorded[i], got[i]
+		n := i + skipped
+		if r.Role != g.Role {
+			return fmt.Sprintf("message %d role: recorded %s, got %s", n, r.Role, g.Role)
+		}
+		if r.Content != g.Content {
+			return fmt.Sprintf("message %d (%s) content: recorded %q, got %q", n, r.Role, clip(r.Content), clip(g.Content))
+		}
+		rc, _ := json.Marshal(r)
+		gc, _ := json.Marshal(g)
+		if string(rc) != string(gc) {
+			return fmt.Sprintf("message %d (%s) tool calls differ", n, r.Role)
+		}
+	}
+	if len(recorded) != len(got) {
+		return fmt.Sprintf("recorded %d messages after the system prompt, got %d", len(recorded), len(got))
+	}
+	return fmt.Sprintf("tools: recorded %v, got %v", recordedTools, gotTools)
+}
+
+func clip(s string) string {
+	const max = 80
+	runes := []rune(s)
+	if len(runes) <= max {
+		return s
+	}
+	return string(runes[:max]) + "..."
+}
@@ -0,0 +1,310 @@
+package cassette
+
+import (
+	"context"
+	"errors"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+
+	cmdpkg "github.com/stupiduntilnot/autonous/internal/commander"
+	ctxpkg "github.com/stupiduntilnot/autonous/internal/context"
+	"github.com/stupiduntilnot/autonous/internal/dummy"
+	modelpkg "github.com/stupiduntilnot/autonous/internal/model"
+)
+
+type fakeStreamer struct {
+	calls int
+}
+
+func (f *fakeStreamer) ChatCompletion(ctx context.Context, messages []ctxpkg.Message) (modelpkg.CompletionResponse, error) {
+	return f.ChatCompletionWithTools(ctx, messages, nil)
+}
+
+func (f *fakeStreamer) ChatCompletionWithTools(ctx context.Context, messages []ctxpkg.Message, tools []modelpkg.ToolDefinition) (modelpkg.CompletionResponse, error) {
+	f.calls++
+	if f.calls == 1 {
+		return modelpkg.CompletionResponse{}, &modelpkg.Error{Class: modelpkg.ErrRateLimited, Provider: "openai", StatusCode: 429, RetryAfter: 2 * time.Second}
+	}
+	return modelpkg.CompletionResponse{
+		ToolCalls:    []ctxpkg.ToolCall{{ID: "c1", Name: "ls", Arguments: []byte(`{"path":"."}`)}},
+		InputTokens:  10,
+		OutputTokens: 3,
+	}, nil
+}
+
+func (f *fakeStreamer) ChatCompletionStream(ctx context.Context, messages []ctxpkg.Message, tools []modelpkg.ToolDefinition, onDelta func(string)) (modelpkg.CompletionResponse, error) {
+	onDelta("hel")
+	onDelta("lo")
+	return modelpkg.CompletionResponse{Content: "hello", InputTokens: 12, OutputTokens: 2}, nil
+}
+
+type fakeEditor struct {
+	updates []cmdpkg.Update
+	sent    []string
+	edits   []string
+}
+
+func (f *fakeEditor) GetUpdates(offset int64, timeout int) ([]cmdpkg.Update, error) {
+	updates := f.updates
+	f.updates = nil
+	return updates, nil
+}
+
+func (f *fakeEditor) SendMessage(ctx context.Context, chatID int64, text string) error {
+	f.sent = append(f.sent, text)
+	return nil
+}
+
+func (f *fakeEditor) SendMessageWithID(ctx context.Context, chatID int64, text string) (int64, error) {
+	f.sent = append(f.sent, text)
+	return 77, nil
+}
+
+func (f *fakeEditor) EditMessageText(ctx context.Context, chatID int64, messageID int64, text string) error {
+	f.edits = append(f.edits, text)
+	return nil
+}
+
+var (
+	firstRequest  = []ctxpkg.Message{{Role: "system", Content: "sys"}, {Role: "user", Content: "list files"}}
+	secondRequest = append(append([]ctxpkg.Message{}, firstRequest...),
+		ctxpkg.Message{Role: "assistant", ToolCalls: []ctxpkg.ToolCall{{ID: "c1", Name: "ls", Arguments: []byte(`{"path":"."}`)}}},
+		ctxpkg.Message{Role: "tool", ToolCallID: "c1", Content: "a.go"},
+	)
+	tools = []modelpkg.ToolDefinition{{Name: "ls"}}
+)
+
+// recordSession drives a rate-limited call, a tool call and a streamed answer
+// delivered through an edited message.
+func recordSession(t *testing.T, p modelpkg.Provider, cmd cmdpkg.Commander) {
+	t.Helper()
+	ctx := context.Background()
+	tc := p.(modelpkg.ToolCaller)
+	if _, err := tc.ChatCompletionWithTools(ctx, firstRequest, tools); err == nil {
+		t.Fatal("expected recorded rate limit")
+	}
+	if _, err := tc.ChatCompletionWithTools(ctx, firstRequest, tools); err != nil {
+		t.Fatal(err)
+	}
+	editor := cmd.(cmdpkg.MessageEditor)
+	id, err := editor.SendMessageWithID(ctx, 1, "…")
+	if err != nil {
+		t.Fatal(err)
+	}
+	var streamed strings.Builder
+	resp, err := p.(modelpkg.Streamer).ChatCompletionStream(ctx, secondRequest, tools, func(d string) {
+		streamed.WriteString(d)
+		_ = editor.EditMessageText(ctx, 1, id, streamed.String())
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := editor.EditMessageText(ctx, 1, id, resp.Content+"!"); err != nil {
+		t.Fatal(err)
+	}
+	if err := cmd.SendMessage(ctx, 1, "done"); err != nil {
+		t.Fatal(err)
+	}
+}
+
+func TestRecordThenReplay(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "session.json")
+	rec := Create(path)
+	recordSession(t, rec.RecordProvider(&fakeStreamer{}), rec.RecordCommander(&fakeEditor{}))
+
+	tape, err := Load(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	p := tape.ReplayProvider()
+	if _, ok := p.(modelpkg.Streamer); !ok {
+		t.Fatal("expected replay provider to stream like the recorded one")
+	}
+	tc := p.(modelpkg.ToolCaller)
+	_, err = tc.ChatCompletionWithTools(context.Background(), firstRequest, tools)
+	perr, ok := modelpkg.AsError(err)
+	if !ok || perr.Class != modelpkg.ErrRateLimited || perr.RetryAfter != 2*time.Second || perr.StatusCode != 429 {
+		t.Fatalf("expected recorded rate limit error, got %v", err)
+	}
+	resp, err := tc.ChatCompletionWithTools(context.Background(), firstRequest, tools)
+	if err != nil || len(resp.ToolCalls) != 1 || resp.ToolCalls[0].Name != "ls" || resp.InputTokens != 10 {
+		t.Fatalf("unexpected replayed tool call: %+v err=%v", resp, err)
+	}
+
+	cmd := tape.ReplayCommander()
+	editor := cmd.(cmdpkg.MessageEditor)
+	id, err := editor.SendMessageWithID(context.Background(), 1, "…")
+	if err != nil || id != 77 {
+		t.Fatalf("expected recorded message id, got %d err=%v", id, err)
+	}
+	var deltas []string
+	resp, err = p.(modelpkg.Streamer).ChatCompletionStream(context.Background(), secondRequest, tools, func(d string) {
+		deltas = append(deltas, d)
+	})
+	if err != nil || resp.Content != "hello" || strings.Join(deltas, "|") != "hel|lo" {
+		t.Fatalf("unexpected replayed stream: %+v deltas=%v err=%v", resp, deltas, err)
+	}
+	if err := tape.Finish(); err == nil {
+		t.Fatal("expected unreplayed send and final edit to be reported")
+	}
+	if err := editor.EditMessageText(context.Background(), 1, id, "hello!"); err != nil {
+		t.Fatal(err)
+	}
+	if err := cmd.SendMessage(context.Background(), 1, "done"); err != nil {
+		t.Fatal(err)
+	}
+	if err := tape.Finish(); err != nil {
+		t.Fatalf("expected full replay, got %v", err)
+	}
+}
+
+func TestPollsReplayed(t *testing.T) {
+	tape := &Cassette{Version: version, Commander: []CommanderInteraction{
+		{Kind: kindGetUpdates, Updates: []cmdpkg.Update{{UpdateID: 1}}},
+		{Kind: kindSendMessage, ChatID: 1, Text: "hello"},
+	}}
+	if tape.PollsReplayed() {
+		t.Fatal("expected a recorded poll left")
+	}
+	cmd := tape.ReplayCommander()
+	if updates, err := cmd.GetUpdates(0, 0); err != nil || len(updates) != 1 {
+		t.Fatalf("expected the recorded update, got %+v err=%v", updates, err)
+	}
+	if !tape.PollsReplayed() {
+		t.Fatal("expected every poll replayed")
+	}
+	if err := tape.Finish(); err == nil || !strings.Contains(err.Error(), "send 1 not replayed") {
+		t.Fatalf("expected the unsent reply reported, got %v", err)
+	}
+}
+
+func TestReplayCommander_ReturnsRecordedErrorsAsCommanderErrors(t *testing.T) {
+	tape := &Cassette{Version: version, Commander: []CommanderInteraction{
+		{Kind: kindGetUpdates, Error: "telegram getUpdates request failed: EOF"},
+	}}
+	_, err := tape.ReplayCommander().GetUpdates(0, 0)
+	if _, ok := cmdpkg.AsError(err); !ok || err.Error() != "telegram getUpdates request failed: EOF" {
+		t.Fatalf("expected the recorded commander error, got %T %v", err, err)
+	}
+}
+
+func TestReplayFailsOnDivergence(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "session.json")
+	rec := Create(path)
+	recordSession(t, rec.RecordProvider(&fakeStreamer{}), rec.RecordCommander(&fakeEditor{}))
+	tape, err := Load(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	changed := []ctxpkg.Message{{Role: "system", Content: "sys"}, {Role: "user", Content: "delete files"}}
+	_, err = tape.ReplayProvider().(modelpkg.ToolCaller).ChatCompletionWithTools(context.Background(), changed, tools)
+	var div *DivergenceError
+	if !errors.As(err, &div) || div.Call != "model call" || div.Index != 0 {
+		t.Fatalf("expected divergence at model call 0, got %v", err)
+	}
+	if !strings.Contains(err.Error(), `message 1 (user) content: recorded "list files", got "delete files"`) {
+		t.Fatalf("expected divergence to name the changed message, got %v", err)
+	}
+	if modelpkg.IsRetryable(err) {
+		t.Fatal("expected divergence not to be retried")
+	}
+	// The system prompt changes between runs and is not part of the match,
+	// but a change is reported.
+	today := []ctxpkg.Message{{Role: "system", Content: "sys, today"}, {Role: "system", Content: "memories"}, {Role: "user", Content: "list files"}}
+	if _, err := tape.ReplayProvider().(modelpkg.ToolCaller).ChatCompletionWithTools(context.Background(), today, tools); !modelpkg.IsRetryable(err) {
+		t.Fatalf("expected the recorded rate limit despite a new system prompt, got %v", err)
+	}
+	if w := tape.Warnings(); len(w) != 1 || !strings.Contains(w[0], "model call 0: system prompt differs") {
+		t.Fatalf("expected a system prompt warning, got %q", w)
+	}
+	if _, err := tape.ReplayProvider().ChatCompletion(context.Background(), firstRequest); !errors.As(err, &div) {
+		t.Fatalf("expected kind mismatch divergence, got %v", err)
+	}
+
+	if err := tape.ReplayCommander().SendMessage(context.Background(), 1, "other"); !errors.As(err, &div) {
+		t.Fatalf("expected send divergence, got %v", err)
+	}
+}
+
+func TestRecord_RedactsSecrets(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "secrets.json")
+	rec := Create(path)
+	text := "deploy with API_KEY=hunter2"
+	live := &fakeEditor{updates: []cmdpkg.Update{{UpdateID: 1, Message: &cmdpkg.Message{Chat: cmdpkg.Chat{ID: 1}, Text: &text}}}}
+	cmd := rec.RecordCommander(live)
+	updates, err := cmd.GetUpdates(0, 0)
+	if err != nil || *updates[0].Message.Text != text {
+		t.Fatalf("expected the live update untouched, got %v err=%v", updates, err)
+	}
+	request := []ctxpkg.Message{
+		{Role: "system", Content: "sys"},
+		{Role: "user", Content: text},
+		{Role: "assistant", ToolCalls: []ctxpkg.ToolCall{{ID: "c1", Name: "bash", Arguments: []byte(`{"command":"curl -H 'Authorization: Bearer abc123'"}`)}}},
+		{Role: "tool", ToolCallID: "c1", Content: "TOKEN=xyz789"},
+	}
+	if _, err := rec.RecordProvider(&fakeStreamer{calls: 1}).(modelpkg.ToolCaller).ChatCompletionWithTools(context.Background(), request, tools); err != nil {
+		t.Fatal(err)
+	}
+	if err := cmd.SendMessage(context.Background(), 1, "used sk-abcdefghijkl"); err != nil {
+		t.Fatal(err)
+	}
+	raw, err := os.ReadFile(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	for _, secret := range []string{"hunter2", "abc123", "xyz789", "sk-abcdefghijkl"} {
+		if strings.Contains(string(raw), secret) {
+			t.Fatalf("cassette leaks %q: %s", secret, raw)
+		}
+	}
+
+	// A replay of the same live data matches the masked recording.
+	tape, err := Load(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, err := tape.ReplayProvider().(modelpkg.ToolCaller).ChatCompletionWithTools(context.Background(), request, tools); err != nil {
+		t.Fatalf("expected the unmasked request to match, got %v", err)
+	}
+	if err := tape.ReplayCommander().SendMessage(context.Background(), 1, "used sk-abcdefghijkl"); err != nil {
+		t.Fatalf("expected the unmasked send to match, got %v", err)
+	}
+	if w := tape.Warnings(); len(w) != 0 {
+		t.Fatalf("expected no warnings, got %q", w)
+	}
+}
+
+func TestRecordProvider_KeepsPlainProviderPlain(t *testing.T) {
+	rec := Create(filepath.Join(t.TempDir(), "plain.json"))
+	inner, err := dummy.NewProvider("dummy", "msg:hi")
+	if err != nil {
+		t.Fatal(err)
+	}
+	p := rec.RecordProvider(inner)
+	if _, ok := p.(modelpkg.ToolCaller); ok {
+		t.Fatal("expected recorder not to add tool support")
+	}
+	if _, err := p.ChatCompletion(context.Background(), firstRequest); err != nil {
+		t.Fatal(err)
+	}
+
+	tape, err := Load(rec.path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	replay := tape.ReplayProvider()
+	if _, ok := replay.(modelpkg.ToolCaller); ok {
+		t.Fatal("expected replay not to add tool support")
+	}
+	resp, err := replay.ChatCompletion(context.Background(), firstRequest)
+	if err != nil || resp.Content != "hi" {
+		t.Fatalf("unexpected replay: %+v err=%v", resp, err)
+	}
+	if _, err := replay.ChatCompletion(context.Background(), firstRequest); err == nil {
+		t.Fatal("expected error once the cassette is exhausted")
+	}
+}
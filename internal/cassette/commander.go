@@ -0,0 +1,203 @@
+package cassette
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"log"
+
+	cmdpkg "github.com/stupiduntilnot/autonous/internal/commander"
+)
+
+// recordingCommander forwards calls to a live commander and records them.
+type recordingCommander struct {
+	c     *Cassette
+	inner cmdpkg.Commander
+}
+
+// recordingEditorCommander is returned when the live commander can edit sent
+// messages.
+type recordingEditorCommander struct {
+	*recordingCommander
+}
+
+// RecordCommander wraps cmd so every poll that returns updates and every send
+// is appended to the cassette. The result implements commander.MessageEditor
+// only when cmd does.
+func (c *Cassette) RecordCommander(cmd cmdpkg.Commander) cmdpkg.Commander {
+	r := &recordingCommander{c: c, inner: cmd}
+	if _, ok := cmd.(cmdpkg.MessageEditor); !ok {
+		return r
+	}
+	c.mu.Lock()
+	c.addCapability(capEdit)
+	c.mu.Unlock()
+	return &recordingEditorCommander{r}
+}
+
+func (r *recordingCommander) GetUpdates(offset int64, timeout int) ([]cmdpkg.Update, error) {
+	updates, err := r.inner.GetUpdates(offset, timeout)
+	if len(updates) > 0 || err != nil {
+		r.c.recordCommander(CommanderInteraction{Kind: kindGetUpdates, Updates: updates}, err)
+	}
+	return updates, err
+}
+
+func (r *recordingCommander) SendMessage(ctx context.Context, chatID int64, text string) error {
+	err := r.inner.SendMessage(ctx, chatID, text)
+	r.c.recordCommander(CommanderInteraction{Kind: kindSendMessage, ChatID: chatID, Text: text}, err)
+	return err
+}
+
+func (r *recordingEditorCommander) SendMessageWithID(ctx context.Context, chatID int64, text string) (int64, error) {
+	id, err := r.inner.(cmdpkg.MessageEditor).SendMessageWithID(ctx, chatID, text)
+	r.c.recordCommander(CommanderInteraction{Kind: kindSendMessageWithID, ChatID: chatID, MessageID: id, Text: text}, err)
+	return id, err
+}
+
+func (r *recordingEditorCommander) EditMessageText(ctx context.Context, chatID int64, messageID int64, text string) error {
+	err := r.inner.(cmdpkg.MessageEditor).EditMessageText(ctx, chatID, messageID, text)
+	r.c.recordCommander(CommanderInteraction{Kind: kindEditMessageText, ChatID: chatID, MessageID: messageID, Text: text}, err)
+	return err
+}
+
+func (c *Cassette) recordCommander(it CommanderInteraction, err error) {
+	it.Text = redactText(it.Text)
+	it.Updates = redactUpdates(it.Updates)
+	if err != nil {
+		it.Error = redactText(err.Error())
+	}
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	c.Commander = append(c.Commander, it)
+	if err := c.save(); err != nil {
+		log.Printf("[cassette] %v", err)
+	}
+}
+
+// redactUpdates returns updates with their message texts masked, leaving the
+// caller's updates untouched.
+func redactUpdates(updates []cmdpkg.Update) []cmdpkg.Update {
+	if len(updates) == 0 {
+		return nil
+	}
+	out := make([]cmdpkg.Update, len(updates))
+	for i, u := range updates {
+		if u.Message != nil && u.Message.Text != nil {
+			m := *u.Message
+			text := redactText(*m.Text)
+			m.Text = &text
+			u.Message = &m
+		}
+		out[i] = u
+	}
+	return out
+}
+
+// replayedError recreates the recorded failure as a commander error with the
+// recorded message.
+func (it CommanderInteraction) replayedError() error {
+	return &cmdpkg.Error{Source: "replay", Err: errors.New(it.Error)}
+}
+
+// replayCommander serves recorded commander calls.
+type replayCommander struct {
+	c *Cassette
+}
+
+type replayEditorCommander struct {
+	*replayCommander
+}
+
+// ReplayCommander returns a commander that serves the cassette's polls in
+// order, then reports no updates. Sends must match the recorded chat and text
+// in order or they fail with a DivergenceError. Edits are accepted for any
+// replayed message; Finish compares each message's final text.
+func (c *Cassette) ReplayCommander() cmdpkg.Commander {
+	r := &replayCommander{c: c}
+	if c.hasCapability(capEdit) {
+		return &replayEditorCommander{r}
+	}
+	return r
+}
+
+func (r *replayCommander) GetUpdates(offset int64, timeout int) ([]cmdpkg.Update, error) {
+	c := r.c
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	i, ok := c.findCommander(c.nextPoll, isPoll)
+	if !ok {
+		c.nextPoll = len(c.Commander)
+		return nil, nil
+	}
+	c.nextPoll = i + 1
+	it := c.Commander[i]
+	if it.Error != "" {
+		return nil, it.replayedError()
+	}
+	return it.Updates, nil
+}
+
+func (r *replayCommander) SendMessage(ctx context.Context, chatID int64, text string) error {
+	it, err := r.c.replaySend(kindSendMessage, chatID, text)
+	if err != nil {
+		return err
+	}
+	if it.Error != "" {
+		return it.replayedError()
+	}
+	return nil
+}
+
+func (r *replayEditorCommander) SendMessageWithID(ctx context.Context, chatID int64, text string) (int64, error) {
+	it, err := r.c.replaySend(kindSendMessageWithID, chatID, text)
+	if err != nil {
+		return 0, err
+	}
+	if it.Error != "" {
+		return 0, it.replayedError()
+	}
+	return it.MessageID, nil
+}
+
+func (r *replayEditorCommander) EditMessageText(ctx context.Context, chatID int64, messageID int64, text string) error {
+	c := r.c
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	sent := false
+	for _, it := range c.Commander[:c.nextSend] {
+		if it.Kind == kindSendMessageWithID && it.ChatID == chatID && it.MessageID == messageID {
+			sent = true
+			break
+		}
+	}
+	if !sent {
+		return &DivergenceError{Call: "commander edit of message", Index: int(messageID), Reason: "not sent by this replay"}
+	}
+	if c.edits == nil {
+		c.edits = map[int64]string{}
+	}
+	c.edits[messageID] = redactText(text)
+	return nil
+}
+
+func (c *Cassette) replaySend(kind string, chatID int64, text string) (CommanderInteraction, error) {
+	text = redactText(text)
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	i, ok := c.findCommander(c.nextSend, isSend)
+	if !ok {
+		return CommanderInteraction{}, &DivergenceError{Call: "commander send", Index: len(c.Commander), Reason: "no recorded send left"}
+	}
+	it := c.Commander[i]
+	switch {
+	case it.Kind != kind:
+		return CommanderInteraction{}, &DivergenceError{Call: "commander send", Index: i, Reason: "recorded " + it.Kind + ", got " + kind}
+	case it.ChatID != chatID:
+		return CommanderInteraction{}, &DivergenceError{Call: "commander send", Index: i, Reason: fmt.Sprintf("recorded chat %d, got %d", it.ChatID, chatID)}
+	case it.Text != text:
+		return CommanderInteraction{}, &DivergenceError{Call: "commander send", Index: i, Reason: fmt.Sprintf("recorded %q, got %q", clip(it.Text), clip(text))}
+	}
+	c.nextSend = i + 1
+	return it, nil
+}
@@ -0,0 +1,247 @@
+package cassette
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"log"
+	"time"
+
+	ctxpkg "github.com/stupiduntilnot/autonous/internal/context"
+	modelpkg "github.com/stupiduntilnot/autonous/internal/model"
+)
+
+// recordingProvider forwards calls to a live provider and records them.
+type recordingProvider struct {
+	c     *Cassette
+	inner modelpkg.Provider
+}
+
+// recordingToolProvider is returned when the live provider supports native
+// tool calls.
+type recordingToolProvider struct {
+	*recordingProvider
+}
+
+// recordingStreamProvider is returned when the live provider also streams.
+type recordingStreamProvider struct {
+	*recordingToolProvider
+}
+
+// RecordProvider wraps p so every call is appended to the cassette. The
+// result implements model.ToolCaller and model.Streamer only when p does.
+func (c *Cassette) RecordProvider(p modelpkg.Provider) modelpkg.Provider {
+	r := &recordingProvider{c: c, inner: p}
+	if _, ok := p.(modelpkg.ToolCaller); !ok {
+		return r
+	}
+	c.mu.Lock()
+	c.addCapability(capTools)
+	_, streams := p.(modelpkg.Streamer)
+	if streams {
+		c.addCapability(capStream)
+	}
+	c.mu.Unlock()
+	if streams {
+		return &recordingStreamProvider{&recordingToolProvider{r}}
+	}
+	return &recordingToolProvider{r}
+}
+
+func (r *recordingProvider) ChatCompletion(ctx context.Context, messages []ctxpkg.Message) (modelpkg.CompletionResponse, error) {
+	resp, err := r.inner.ChatCompletion(ctx, messages)
+	r.c.recordModel(kindChat, messages, nil, nil, resp, err)
+	return resp, err
+}
+
+func (r *recordingToolProvider) ChatCompletionWithTools(ctx context.Context, messages []ctxpkg.Message, tools []modelpkg.ToolDefinition) (modelpkg.CompletionResponse, error) {
+	resp, err := r.inner.(modelpkg.ToolCaller).ChatCompletionWithTools(ctx, messages, tools)
+	r.c.recordModel(kindTools, messages, tools, nil, resp, err)
+	return resp, err
+}
+
+func (r *recordingStreamProvider) ChatCompletionStream(ctx context.Context, messages []ctxpkg.Message, tools []modelpkg.ToolDefinition, onDelta func(delta string)) (modelpkg.CompletionResponse, error) {
+	var deltas []string
+	resp, err := r.inner.(modelpkg.Streamer).ChatCompletionStream(ctx, messages, tools, func(delta string) {
+		deltas = append(deltas, delta)
+		onDelta(delta)
+	})
+	r.c.recordModel(kindStream, messages, tools, deltas, resp, err)
+	return resp, err
+}
+
+func (c *Cassette) recordModel(kind string, messages []ctxpkg.Message, tools []modelpkg.ToolDefinition, deltas []string, resp modelpkg.CompletionResponse, err error) {
+	msgs := toMessages(messages)
+	names := toolNames(tools)
+	it := ModelInteraction{
+		Kind:        kind,
+		RequestHash: requestHash(matchKey(msgs), names),
+		SystemHash:  requestHash(systemPrefix(msgs), nil),
+		Messages:    msgs,
+		Tools:       names,
+	}
+	for _, d := range deltas {
+		it.Deltas = append(it.Deltas, redactText(d))
+	}
+	if err != nil {
+		it.Error = recordError(err)
+	} else {
+		it.Response = &Response{
+			Content:      redactText(resp.Content),
+			ToolCalls:    redactCalls(resp.ToolCalls),
+			InputTokens:  resp.InputTokens,
+			OutputTokens: resp.OutputTokens,
+		}
+		if resp.Route != nil {
+			it.Response.Route = &Route{Backend: resp.Route.Backend, Model: resp.Route.Model, Failovers: resp.Route.Failovers}
+		}
+	}
+
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	c.Model = append(c.Model, it)
+	if err := c.save(); err != nil {
+		log.Printf("[cassette] %v", err)
+	}
+}
+
+func recordError(err error) *Error {
+	perr, ok := modelpkg.AsError(err)
+	if !ok {
+		return &Error{Message: redactText(err.Error())}
+	}
+	e := &Error{
+		Class:        string(perr.Class),
+		Provider:     perr.Provider,
+		StatusCode:   perr.StatusCode,
+		RetryAfterMs: perr.RetryAfter.Milliseconds(),
+		Message:      redactText(perr.Message),
+	}
+	if perr.Err != nil {
+		e.Cause = redactText(perr.Err.Error())
+	}
+	return e
+}
+
+func (e *Error) toError() error {
+	if e.Class == "" {
+		return errors.New(e.Message)
+	}
+	perr := &modelpkg.Error{
+		Class:      modelpkg.ErrorClass(e.Class),
+		Provider:   e.Provider,
+		StatusCode: e.StatusCode,
+		RetryAfter: time.Duration(e.RetryAfterMs) * time.Millisecond,
+		Message:    e.Message,
+	}
+	if e.Cause != "" {
+		perr.Err = errors.New(e.Cause)
+	}
+	return perr
+}
+
+// replayProvider serves recorded model calls.
+type replayProvider struct {
+	c *Cassette
+}
+
+type replayToolProvider struct {
+	*replayProvider
+}
+
+type replayStreamProvider struct {
+	*replayToolProvider
+}
+
+// ReplayProvider returns a provider that serves the cassette's model calls in
+// order. It implements the same optional interfaces as the recorded provider.
+// A request that does not match the recording fails with a non-retryable
+// model error wrapping a DivergenceError.
+func (c *Cassette) ReplayProvider() modelpkg.Provider {
+	r := &replayProvider{c: c}
+	if !c.hasCapability(capTools) {
+		return r
+	}
+	if c.hasCapability(capStream) {
+		return &replayStreamProvider{&replayToolProvider{r}}
+	}
+	return &replayToolProvider{r}
+}
+
+func (r *replayProvider) ChatCompletion(ctx context.Context, messages []ctxpkg.Message) (modelpkg.CompletionResponse, error) {
+	it, err := r.c.replayModel(kindChat, messages, nil)
+	if err != nil {
+		return modelpkg.CompletionResponse{}, err
+	}
+	return it.result()
+}
+
+func (r *replayToolProvider) ChatCompletionWithTools(ctx context.Context, messages []ctxpkg.Message, tools []modelpkg.ToolDefinition) (modelpkg.CompletionResponse, error) {
+	it, err := r.c.replayModel(kindTools, messages, tools)
+	if err != nil {
+		return modelpkg.CompletionResponse{}, err
+	}
+	return it.result()
+}
+
+func (r *replayStreamProvider) ChatCompletionStream(ctx context.Context, messages []ctxpkg.Message, tools []modelpkg.ToolDefinition, onDelta func(delta string)) (modelpkg.CompletionResponse, error) {
+	it, err := r.c.replayModel(kindStream, messages, tools)
+	if err != nil {
+		return modelpkg.CompletionResponse{}, err
+	}
+	for _, d := range it.Deltas {
+		onDelta(d)
+	}
+	return it.result()
+}
+
+func (c *Cassette) replayModel(kind string, messages []ctxpkg.Message, tools []modelpkg.ToolDefinition) (ModelInteraction, error) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	i := c.nextModel
+	if i >= len(c.Model) {
+		return ModelInteraction{}, diverged(&DivergenceError{Call: "model call", Index: i, Reason: "no recorded call left"})
+	}
+	it := c.Model[i]
+	if it.Kind != kind {
+		return ModelInteraction{}, diverged(&DivergenceError{Call: "model call", Index: i, Reason: "recorded " + it.Kind + " call, got " + kind})
+	}
+	msgs := toMessages(messages)
+	got := matchKey(msgs)
+	names := toolNames(tools)
+	if it.RequestHash != requestHash(got, names) {
+		reason := describeMismatch(matchKey(it.Messages), got, len(msgs)-len(got), it.Tools, names)
+		return ModelInteraction{}, diverged(&DivergenceError{Call: "model call", Index: i, Reason: reason})
+	}
+	if system := systemPrefix(msgs); it.SystemHash != requestHash(system, nil) {
+		c.warnings = append(c.warnings, fmt.Sprintf("model call %d: system prompt differs from the recording (%d messages recorded, %d sent)",
+			i, len(systemPrefix(it.Messages)), len(system)))
+	}
+	c.nextModel++
+	return it, nil
+}
+
+func (it ModelInteraction) result() (modelpkg.CompletionResponse, error) {
+	if it.Error != nil {
+		return modelpkg.CompletionResponse{}, it.Error.toError()
+	}
+	if it.Response == nil {
+		return modelpkg.CompletionResponse{}, nil
+	}
+	resp := modelpkg.CompletionResponse{
+		Content:      it.Response.Content,
+		ToolCalls:    it.Response.ToolCalls,
+		InputTokens:  it.Response.InputTokens,
+		OutputTokens: it.Response.OutputTokens,
+	}
+	if rt := it.Response.Route; rt != nil {
+		resp.Route = &modelpkg.Route{Backend: rt.Backend, Model: rt.Model, Failovers: rt.Failovers}
+	}
+	return resp, nil
+}
+
+// diverged wraps a divergence as a bad_request model error so the worker
+// fails the task immediately instead of retrying it.
+func diverged(err *DivergenceError) error {
+	return &modelpkg.Error{Class: modelpkg.ErrBadRequest, Provider: "replay", Err: err}
+}
@@ -1,9 +1,47 @@
 package commander
 
+import (
+	"context"
+	"errors"
+)
+
 // Commander is the instruction source abstraction used by worker.
 type Commander interface {
 	GetUpdates(offset int64, timeout int) ([]Update, error)
-	SendMessage(chatID int64, text string) error
+	SendMessage(ctx context.Context, chatID int64, text string) error
+}
+
+// Error is a failed call to the instruction source. Commanders return it so
+// that callers can tell command-source failures from other errors. Its
+// message is that of the wrapped error.
+type Error struct {
+	// Source names the commander, such as "telegram".
+	Source string
+	Err    error
+}
+
+func (e *Error) Error() string {
+	return e.Err.Error()
+}
+
+func (e *Error) Unwrap() error {
+	return e.Err
+}
+
+// AsError returns the commander error in err's chain, if any.
+func AsError(err error) (*Error, bool) {
+	var cerr *Error
+	if errors.As(err, &cerr) {
+		return cerr, true
+	}
+	return nil, false
+}
+
+// MessageEditor is implemented by commanders that can update a sent message
+// in place, which the worker uses to show streamed replies as they arrive.
+type MessageEditor interface {
+	SendMessageWithID(ctx context.Context, chatID int64, text string) (int64, error)
+	EditMessageText(ctx context.Context, chatID int64, messageID int64, text string) error
 }
 
 // Update represents an incoming command/update.
@@ -4,8 +4,11 @@ import (
 	"fmt"
 	"os"
 	"path/filepath"
+	"slices"
 	"strconv"
 	"strings"
+
+	"github.com/stupiduntilnot/autonous/internal/cost"
 )
 
 // SupervisorConfig holds configuration for the supervisor process.
@@ -47,12 +50,34 @@ type WorkerConfig struct {
 	PendingWindowSeconds      int64
 	PendingMaxMessages        int
 	HistoryWindow             int
+	ContextTokenBudget        int
+	ContextTokenBudgets       map[string]int
+	ContextStages             []string
+	ContextMaxMessageTokens   int
+	SummaryThreshold          int
+	SummaryKeep               int
+	HistoryToolOutputBytes    int
+	RetrievalTopK             int
+	EmbeddingsProvider        string
+	OpenAIEmbeddingsURL       string
+	OpenAIEmbeddingsModel     string
+	SemanticTopK              int
+	SemanticFileTopK          int
+	SemanticMinScore          float64
+	RepoMapTokens             int
+	MemoryTopK                int
 	WorkerInstanceID          string
 	ParentProcessID           int64
 	SuicideEvery              uint64
+	WorkerConcurrency         int
+	TaskLeaseSeconds          int
 	OpenAIAPIKey              string
 	OpenAIChatCompURL         string
 	OpenAIModel               string
+	AnthropicAPIKey           string
+	AnthropicMessagesURL      string
+	AnthropicModel            string
+	AnthropicMaxTokens        int
 	SystemPrompt              string
 	SystemPromptEnv           string
 	ConfigDir                 string
@@ -60,13 +85,29 @@ type WorkerConfig struct {
 	DBPath                    string
 	WorkspaceDir              string
 	ModelProvider             string
+	ModelRouterChain          []string
+	RouterBreakerThreshold    int
+	RouterBreakerCooldownSec  int
 	Commander                 string
 	DummyProviderScript       string
 	DummyCommanderScript      string
 	DummySendScript           string
+	CassetteMode              string
+	CassettePath              string
+	StreamReplies             bool
+	StreamEditIntervalMs      int
 	ControlMaxTurns           int
 	ControlMaxWallTimeSeconds int
 	ControlMaxRetries         int
+	ControlCircuitThreshold   int
+	ControlCircuitCooldownSec int
+	ControlCircuitClasses     map[string]CircuitClass
+	ControlRatePerMinute      int
+	ControlRateBurst          int
+	ControlRateChats          map[int64]ChatRate
+	ModelPrices               map[string]cost.Price
+	BudgetDailyUSD            float64
+	BudgetMonthlyUSD          float64
 	ToolTimeoutSeconds        int
 	ToolMaxOutputLines        int
 	ToolMaxOutputBytes        int
@@ -82,14 +123,65 @@ type WorkerConfig struct {
 func LoadWorkerConfig() (WorkerConfig, error) {
 	modelProvider := envOrDefault("AUTONOUS_MODEL_PROVIDER", "openai")
 	commander := envOrDefault("AUTONOUS_COMMANDER", "telegram")
+	cassetteMode := envOrDefault("AUTONOUS_CASSETTE_MODE", "off")
+	// A replay serves every model call and update from the cassette, so no
+	// credentials are needed.
+	replay := cassetteMode == "replay"
+	var routerChain []string
+	if modelProvider == "router" {
+		chain, err := parseRouterChain(envOrDefault("AUTONOUS_MODEL_ROUTER_CHAIN", "openai,anthropic"))
+		if err != nil {
+			return WorkerConfig{}, err
+		}
+		routerChain = chain
+	}
+	uses := func(name string) bool {
+		if modelProvider == "router" {
+			return slices.Contains(routerChain, name)
+		}
+		return modelProvider == name
+	}
 
 	telegramToken := os.Getenv("TELEGRAM_BOT_TOKEN")
-	if commander == "telegram" && telegramToken == "" {
+	if commander == "telegram" && telegramToken == "" && !replay {
 		return WorkerConfig{}, fmt.Errorf("TELEGRAM_BOT_TOKEN is required in environment when AUTONOUS_COMMANDER=telegram")
 	}
 	openaiKey := os.Getenv("OPENAI_API_KEY")
-	if modelProvider == "openai" && openaiKey == "" {
-		return WorkerConfig{}, fmt.Errorf("OPENAI_API_KEY is required in environment when AUTONOUS_MODEL_PROVIDER=openai")
+	if uses("openai") && openaiKey == "" && !replay {
+		return WorkerConfig{}, fmt.Errorf("OPENAI_API_KEY is required in environment when AUTONOUS_MODEL_PROVIDER=openai or the router chain includes openai")
+	}
+	embeddingsProvider := os.Getenv("AUTONOUS_EMBEDDINGS_PROVIDER")
+	if embeddingsProvider == "openai" && openaiKey == "" {
+		return WorkerConfig{}, fmt.Errorf("OPENAI_API_KEY is required in environment when AUTONOUS_EMBEDDINGS_PROVIDER=openai")
+	}
+	anthropicKey := os.Getenv("ANTHROPIC_API_KEY")
+	if uses("anthropic") && anthropicKey == "" && !replay {
+		return WorkerConfig{}, fmt.Errorf("ANTHROPIC_API_KEY is required in environment when AUTONOUS_MODEL_PROVIDER=anthropic or the router chain includes anthropic")
+	}
+
+	modelPrices, err := cost.ParseOverrides(os.Getenv("AUTONOUS_MODEL_PRICES"))
+	if err != nil {
+		return WorkerConfig{}, fmt.Errorf("AUTONOUS_MODEL_PRICES: %w", err)
+	}
+
+	contextBudgets, err := parseContextBudgets(os.Getenv("AUTONOUS_CONTEXT_TOKEN_BUDGETS"))
+	if err != nil {
+		return WorkerConfig{}, fmt.Errorf("AUTONOUS_CONTEXT_TOKEN_BUDGETS: %w", err)
+	}
+
+	contextStages, err := parseContextStages(os.Getenv("AUTONOUS_CONTEXT_STAGES"))
+	if err != nil {
+		return WorkerConfig{}, err
+	}
+
+	circuitClasses, err := parseCircuitClasses(os.Getenv("AUTONOUS_CONTROL_CIRCUIT_CLASSES"))
+	if err != nil {
+		return WorkerConfig{}, fmt.Errorf("AUTONOUS_CONTROL_CIRCUIT_CLASSES: %w", err)
+	}
+
+	rateChats, err := parseRateChats(os.Getenv("AUTONOUS_CONTROL_RATE_CHATS"))
+	if err != nil {
+		return WorkerConfig{}, fmt.Errorf("AUTONOUS_CONTROL_RATE_CHATS: %w", err)
 	}
 
 	workerInstanceID := envOrDefault("WORKER_INSTANCE_ID", "W000000")
@@ -113,25 +205,63 @@ func LoadWorkerConfig() (WorkerConfig, error) {
 		PendingWindowSeconds:      int64(envIntOrDefault("TG_PENDING_WINDOW_SECONDS", 600)),
 		PendingMaxMessages:        envIntOrDefault("TG_PENDING_MAX_MESSAGES", 50),
 		HistoryWindow:             envIntOrDefault("TG_HISTORY_WINDOW", 12),
+		ContextTokenBudget:        envIntOrDefault("AUTONOUS_CONTEXT_TOKEN_BUDGET", 0),
+		ContextTokenBudgets:       contextBudgets,
+		ContextStages:             contextStages,
+		ContextMaxMessageTokens:   envIntOrDefault("AUTONOUS_CONTEXT_MAX_MESSAGE_TOKENS", 1000),
+		SummaryThreshold:          envIntOrDefault("AUTONOUS_SUMMARY_THRESHOLD", 0),
+		SummaryKeep:               envIntOrDefault("AUTONOUS_SUMMARY_KEEP", 4),
+		HistoryToolOutputBytes:    envIntOrDefault("AUTONOUS_HISTORY_TOOL_OUTPUT_BYTES", 2000),
+		RetrievalTopK:             envIntOrDefault("AUTONOUS_RETRIEVAL_TOP_K", 0),
+		EmbeddingsProvider:        embeddingsProvider,
+		OpenAIEmbeddingsURL:       envOrDefault("OPENAI_EMBEDDINGS_URL", "https://api.openai.com/v1/embeddings"),
+		OpenAIEmbeddingsModel:     envOrDefault("OPENAI_EMBEDDINGS_MODEL", "text-embedding-3-small"),
+		SemanticTopK:              envIntOrDefault("AUTONOUS_SEMANTIC_TOP_K", 4),
+		SemanticFileTopK:          envIntOrDefault("AUTONOUS_SEMANTIC_FILE_TOP_K", 0),
+		SemanticMinScore:          envFloatOrDefault("AUTONOUS_SEMANTIC_MIN_SCORE", 0.3),
+		RepoMapTokens:             envIntOrDefault("AUTONOUS_REPO_MAP_TOKENS", 0),
+		MemoryTopK:                envIntOrDefault("AUTONOUS_MEMORY_TOP_K", 0),
 		WorkerInstanceID:          workerInstanceID,
 		ParentProcessID:           parentProcessID,
 		SuicideEvery:              uint64(envIntOrDefault("WORKER_SUICIDE_EVERY", 0)),
+		WorkerConcurrency:         envIntOrDefault("AUTONOUS_WORKER_CONCURRENCY", 1),
+		TaskLeaseSeconds:          envIntOrDefault("AUTONOUS_TASK_LEASE_SECONDS", 60),
 		OpenAIAPIKey:              openaiKey,
 		OpenAIChatCompURL:         envOrDefault("OPENAI_CHAT_COMPLETIONS_URL", "https://api.openai.com/v1/chat/completions"),
 		OpenAIModel:               envOrDefault("OPENAI_MODEL", "gpt-4o-mini"),
+		AnthropicAPIKey:           anthropicKey,
+		AnthropicMessagesURL:      envOrDefault("ANTHROPIC_MESSAGES_URL", "https://api.anthropic.com/v1/messages"),
+		AnthropicModel:            envOrDefault("ANTHROPIC_MODEL", "claude-sonnet-4-5"),
+		AnthropicMaxTokens:        envIntOrDefault("ANTHROPIC_MAX_TOKENS", 4096),
 		SystemPromptEnv:           os.Getenv("WORKER_SYSTEM_PROMPT"),
 		ConfigDir:                 configDir,
 		SystemPromptFile:          systemPromptFile,
 		DBPath:                    envOrDefault("AUTONOUS_DB_PATH", "/state/agent.db"),
 		WorkspaceDir:              envOrDefault("WORKSPACE_DIR", "/workspace"),
 		ModelProvider:             modelProvider,
+		ModelRouterChain:          routerChain,
+		RouterBreakerThreshold:    envIntOrDefault("AUTONOUS_MODEL_ROUTER_BREAKER_THRESHOLD", 3),
+		RouterBreakerCooldownSec:  envIntOrDefault("AUTONOUS_MODEL_ROUTER_BREAKER_COOLDOWN_SECONDS", 60),
 		Commander:                 commander,
 		DummyProviderScript:       envOrDefault("AUTONOUS_DUMMY_PROVIDER_SCRIPT", "ok"),
 		DummyCommanderScript:      envOrDefault("AUTONOUS_DUMMY_COMMANDER_SCRIPT", "ok"),
 		DummySendScript:           envOrDefault("AUTONOUS_DUMMY_COMMANDER_SEND_SCRIPT", "ok"),
+		CassetteMode:              cassetteMode,
+		CassettePath:              os.Getenv("AUTONOUS_CASSETTE_PATH"),
+		StreamReplies:             envBoolOrDefault("AUTONOUS_STREAM_REPLIES", false),
+		StreamEditIntervalMs:      envIntOrDefault("AUTONOUS_STREAM_EDIT_INTERVAL_MS", 1500),
 		ControlMaxTurns:           envIntOrDefault("AUTONOUS_CONTROL_MAX_TURNS", 1),
 		ControlMaxWallTimeSeconds: envIntOrDefault("AUTONOUS_CONTROL_MAX_WALL_TIME_SECONDS", 120),
 		ControlMaxRetries:         envIntOrDefault("AUTONOUS_CONTROL_MAX_RETRIES", 3),
+		ControlCircuitThreshold:   envIntOrDefault("AUTONOUS_CONTROL_CIRCUIT_THRESHOLD", 5),
+		ControlCircuitCooldownSec: envIntOrDefault("AUTONOUS_CONTROL_CIRCUIT_COOLDOWN_SECONDS", 30),
+		ControlCircuitClasses:     circuitClasses,
+		ControlRatePerMinute:      envIntOrDefault("AUTONOUS_CONTROL_RATE_PER_MINUTE", 0),
+		ControlRateBurst:          envIntOrDefault("AUTONOUS_CONTROL_RATE_BURST", 10),
+		ControlRateChats:          rateChats,
+		ModelPrices:               modelPrices,
+		BudgetDailyUSD:            envFloatOrDefault("AUTONOUS_BUDGET_DAILY_USD", 0),
+		BudgetMonthlyUSD:          envFloatOrDefault("AUTONOUS_BUDGET_MONTHLY_USD", 0),
 		ToolTimeoutSeconds:        envIntOrDefault("AUTONOUS_TOOL_TIMEOUT_SECONDS", 30),
 		ToolMaxOutputLines:        envIntOrDefault("AUTONOUS_TOOL_MAX_OUTPUT_LINES", 2000),
 		ToolMaxOutputBytes:        envIntOrDefault("AUTONOUS_TOOL_MAX_OUTPUT_BYTES", 51200),
@@ -148,6 +278,207 @@ func LoadWorkerConfig() (WorkerConfig, error) {
 	return cfg, nil
 }
 
+// ModelName returns the model name of the configured provider. For the
+// router it is the model of the head of the chain.
+func (c *WorkerConfig) ModelName() string {
+	if c.ModelProvider == "router" && len(c.ModelRouterChain) > 0 {
+		return c.ModelNameFor(c.ModelRouterChain[0])
+	}
+	return c.ModelNameFor(c.ModelProvider)
+}
+
+// ModelNameFor returns the model name used by the named provider.
+func (c *WorkerConfig) ModelNameFor(provider string) string {
+	if provider == "anthropic" {
+		return c.AnthropicModel
+	}
+	return c.OpenAIModel
+}
+
+// ContextTokenBudgetFor returns the prompt token budget for model: an exact
+// or longest "prefix-" match in ContextTokenBudgets, else ContextTokenBudget.
+// Zero disables token-level trimming.
+func (c *WorkerConfig) ContextTokenBudgetFor(model string) int {
+	name := strings.ToLower(strings.TrimSpace(model))
+	if budget, ok := c.ContextTokenBudgets[name]; ok {
+		return budget
+	}
+	best := ""
+	for prefix := range c.ContextTokenBudgets {
+		if len(prefix) > len(best) && strings.HasPrefix(name, prefix+"-") {
+			best = prefix
+		}
+	}
+	if best != "" {
+		return c.ContextTokenBudgets[best]
+	}
+	return c.ContextTokenBudget
+}
+
+// parseContextBudgets parses "model=tokens,..." into lower-cased model names.
+func parseContextBudgets(raw string) (map[string]int, error) {
+	out := map[string]int{}
+	for _, entry := range strings.Split(raw, ",") {
+		entry = strings.TrimSpace(entry)
+		if entry == "" {
+			continue
+		}
+		name, tokens, ok := strings.Cut(entry, "=")
+		name = strings.TrimSpace(name)
+		if !ok || name == "" {
+			return nil, fmt.Errorf("invalid context budget %q: want model=tokens", entry)
+		}
+		n, err := strconv.Atoi(strings.TrimSpace(tokens))
+		if err != nil || n < 0 {
+			return nil, fmt.Errorf("invalid context budget %q: tokens must be an integer >= 0", entry)
+		}
+		out[strings.ToLower(name)] = n
+	}
+	return out, nil
+}
+
+// CircuitErrorClasses are the error classes the worker's circuit breakers
+// track.
+var CircuitErrorClasses = []string{"provider_api", "command_source_api", "db", "unknown"}
+
+// CircuitClass is the breaker policy of one error class.
+type CircuitClass struct {
+	Threshold       int
+	CooldownSeconds int
+}
+
+// CircuitFor returns the breaker policy of errClass: its override, else the
+// default threshold and cooldown.
+func (c *WorkerConfig) CircuitFor(errClass string) CircuitClass {
+	if p, ok := c.ControlCircuitClasses[errClass]; ok {
+		return p
+	}
+	return CircuitClass{Threshold: c.ControlCircuitThreshold, CooldownSeconds: c.ControlCircuitCooldownSec}
+}
+
+// parseCircuitClasses parses "class=threshold:cooldown_seconds,...".
+func parseCircuitClasses(raw string) (map[string]CircuitClass, error) {
+	out := map[string]CircuitClass{}
+	for _, entry := range strings.Split(raw, ",") {
+		entry = strings.TrimSpace(entry)
+		if entry == "" {
+			continue
+		}
+		name, policy, ok := strings.Cut(entry, "=")
+		name = strings.TrimSpace(name)
+		threshold, cooldown, ok2 := strings.Cut(policy, ":")
+		if !ok || !ok2 || name == "" {
+			return nil, fmt.Errorf("invalid circuit class %q: want class=threshold:cooldown_seconds", entry)
+		}
+		if !slices.Contains(CircuitErrorClasses, name) {
+			return nil, fmt.Errorf("unknown error class %q (known: %s)", name, strings.Join(CircuitErrorClasses, ", "))
+		}
+		t, err := strconv.Atoi(strings.TrimSpace(threshold))
+		if err != nil || t <= 0 {
+			return nil, fmt.Errorf("invalid circuit class %q: threshold must be an integer > 0", entry)
+		}
+		c, err := strconv.Atoi(strings.TrimSpace(cooldown))
+		if err != nil || c <= 0 {
+			return nil, fmt.Errorf("invalid circuit class %q: cooldown_seconds must be an integer > 0", entry)
+		}
+		out[name] = CircuitClass{Threshold: t, CooldownSeconds: c}
+	}
+	return out, nil
+}
+
+// ChatRate is the inbox rate limit of one chat: PerMinute messages a minute
+// with bursts of up to Burst. Zero PerMinute means unlimited.
+type ChatRate struct {
+	PerMinute int
+	Burst     int
+}
+
+// RateFor returns the rate limit of chatID: its override, else the default.
+func (c *WorkerConfig) RateFor(chatID int64) ChatRate {
+	if r, ok := c.ControlRateChats[chatID]; ok {
+		return r
+	}
+	return ChatRate{PerMinute: c.ControlRatePerMinute, Burst: c.ControlRateBurst}
+}
+
+// parseRateChats parses "chat_id=per_minute:burst,...".
+func parseRateChats(raw string) (map[int64]ChatRate, error) {
+	out := map[int64]ChatRate{}
+	for _, entry := range strings.Split(raw, ",") {
+		entry = strings.TrimSpace(entry)
+		if entry == "" {
+			continue
+		}
+		chat, rate, ok := strings.Cut(entry, "=")
+		perMinute, burst, ok2 := strings.Cut(rate, ":")
+		if !ok || !ok2 {
+			return nil, fmt.Errorf("invalid chat rate %q: want chat_id=per_minute:burst", entry)
+		}
+		chatID, err := strconv.ParseInt(strings.TrimSpace(chat), 10, 64)
+		if err != nil {
+			return nil, fmt.Errorf("invalid chat rate %q: chat_id must be an integer", entry)
+		}
+		p, err := strconv.Atoi(strings.TrimSpace(perMinute))
+		if err != nil || p < 0 {
+			return nil, fmt.Errorf("invalid chat rate %q: per_minute must be an integer >= 0", entry)
+		}
+		b, err := strconv.Atoi(strings.TrimSpace(burst))
+		if err != nil || b <= 0 {
+			return nil, fmt.Errorf("invalid chat rate %q: burst must be an integer > 0", entry)
+		}
+		out[chatID] = ChatRate{PerMinute: p, Burst: b}
+	}
+	return out, nil
+}
+
+// parseRouterChain splits the comma-separated router chain, rejecting
+// unknown, nested or duplicate providers.
+func parseRouterChain(raw string) ([]string, error) {
+	var out []string
+	for _, p := range strings.Split(raw, ",") {
+		name := strings.TrimSpace(p)
+		if name == "" {
+			continue
+		}
+		switch name {
+		case "openai", "anthropic", "dummy":
+		default:
+			return nil, fmt.Errorf("AUTONOUS_MODEL_ROUTER_CHAIN has unsupported provider: %s", name)
+		}
+		if slices.Contains(out, name) {
+			return nil, fmt.Errorf("AUTONOUS_MODEL_ROUTER_CHAIN has duplicate provider: %s", name)
+		}
+		out = append(out, name)
+	}
+	if len(out) == 0 {
+		return nil, fmt.Errorf("AUTONOUS_MODEL_ROUTER_CHAIN cannot be empty")
+	}
+	return out, nil
+}
+
+// ContextStageNames are the stages AUTONOUS_CONTEXT_STAGES can chain.
+var ContextStageNames = []string{"window", "dedupe", "truncate_long", "token_budget", "summarize"}
+
+// parseContextStages parses a comma-separated stage chain. Empty means the
+// worker derives the chain from the other context settings.
+func parseContextStages(raw string) ([]string, error) {
+	var out []string
+	for _, p := range strings.Split(raw, ",") {
+		name := strings.TrimSpace(p)
+		if name == "" {
+			continue
+		}
+		if !slices.Contains(ContextStageNames, name) {
+			return nil, fmt.Errorf("AUTONOUS_CONTEXT_STAGES has unsupported stage: %s", name)
+		}
+		if slices.Contains(out, name) {
+			return nil, fmt.Errorf("AUTONOUS_CONTEXT_STAGES has duplicate stage: %s", name)
+		}
+		out = append(out, name)
+	}
+	return out, nil
+}
+
 func resolveConfigDir() (string, bool, error) {
 	if v := strings.TrimSpace(os.Getenv("AUTONOUS_CONFIG_DIR")); v != "" {
 		abs, err := filepath.Abs(v)
@@ -185,6 +516,18 @@ func envIntOrDefault(key string, fallback int) int {
 	return n
 }
 
+func envFloatOrDefault(key string, fallback float64) float64 {
+	v := os.Getenv(key)
+	if v == "" {
+		return fallback
+	}
+	f, err := strconv.ParseFloat(v, 64)
+	if err != nil {
+		return fallback
+	}
+	return f
+}
+
 func envBoolOrDefault(key string, fallback bool) bool {
 	v := os.Getenv(key)
 	if v == "" {
@@ -203,6 +546,101 @@ func validateWorkerConfig(cfg *WorkerConfig) error {
 	if cfg.ControlMaxRetries < 0 {
 		return fmt.Errorf("AUTONOUS_CONTROL_MAX_RETRIES must be >= 0")
 	}
+	if cfg.ControlCircuitThreshold <= 0 {
+		return fmt.Errorf("AUTONOUS_CONTROL_CIRCUIT_THRESHOLD must be > 0")
+	}
+	if cfg.ControlCircuitCooldownSec <= 0 {
+		return fmt.Errorf("AUTONOUS_CONTROL_CIRCUIT_COOLDOWN_SECONDS must be > 0")
+	}
+	if cfg.ControlRatePerMinute < 0 {
+		return fmt.Errorf("AUTONOUS_CONTROL_RATE_PER_MINUTE must be >= 0")
+	}
+	if cfg.ControlRateBurst <= 0 {
+		return fmt.Errorf("AUTONOUS_CONTROL_RATE_BURST must be > 0")
+	}
+	if cfg.ContextTokenBudget < 0 {
+		return fmt.Errorf("AUTONOUS_CONTEXT_TOKEN_BUDGET must be >= 0")
+	}
+	if cfg.ContextMaxMessageTokens <= 0 {
+		return fmt.Errorf("AUTONOUS_CONTEXT_MAX_MESSAGE_TOKENS must be > 0")
+	}
+	if slices.Contains(cfg.ContextStages, "summarize") && cfg.SummaryThreshold <= 0 {
+		return fmt.Errorf("AUTONOUS_CONTEXT_STAGES includes summarize but AUTONOUS_SUMMARY_THRESHOLD is 0")
+	}
+	if cfg.SummaryThreshold < 0 {
+		return fmt.Errorf("AUTONOUS_SUMMARY_THRESHOLD must be >= 0")
+	}
+	if cfg.SummaryThreshold > 0 {
+		// Messages beyond the history window are never loaded, so they would
+		// age out before they could be summarized.
+		if cfg.SummaryThreshold > cfg.HistoryWindow {
+			return fmt.Errorf("AUTONOUS_SUMMARY_THRESHOLD must be <= TG_HISTORY_WINDOW")
+		}
+		if cfg.SummaryKeep < 0 || cfg.SummaryKeep >= cfg.SummaryThreshold {
+			return fmt.Errorf("AUTONOUS_SUMMARY_KEEP must be >= 0 and < AUTONOUS_SUMMARY_THRESHOLD")
+		}
+	}
+	if cfg.HistoryToolOutputBytes < 0 {
+		return fmt.Errorf("AUTONOUS_HISTORY_TOOL_OUTPUT_BYTES must be >= 0")
+	}
+	if cfg.RetrievalTopK < 0 {
+		return fmt.Errorf("AUTONOUS_RETRIEVAL_TOP_K must be >= 0")
+	}
+	switch cfg.EmbeddingsProvider {
+	case "", "openai", "dummy":
+	default:
+		return fmt.Errorf("AUTONOUS_EMBEDDINGS_PROVIDER must be empty, openai or dummy: %s", cfg.EmbeddingsProvider)
+	}
+	if cfg.SemanticTopK < 0 || cfg.SemanticFileTopK < 0 {
+		return fmt.Errorf("AUTONOUS_SEMANTIC_TOP_K and AUTONOUS_SEMANTIC_FILE_TOP_K must be >= 0")
+	}
+	if cfg.SemanticMinScore < -1 || cfg.SemanticMinScore > 1 {
+		return fmt.Errorf("AUTONOUS_SEMANTIC_MIN_SCORE must be between -1 and 1")
+	}
+	if cfg.RepoMapTokens < 0 {
+		return fmt.Errorf("AUTONOUS_REPO_MAP_TOKENS must be >= 0")
+	}
+	if cfg.MemoryTopK < 0 {
+		return fmt.Errorf("AUTONOUS_MEMORY_TOP_K must be >= 0")
+	}
+	if cfg.BudgetDailyUSD < 0 {
+		return fmt.Errorf("AUTONOUS_BUDGET_DAILY_USD must be >= 0")
+	}
+	if cfg.BudgetMonthlyUSD < 0 {
+		return fmt.Errorf("AUTONOUS_BUDGET_MONTHLY_USD must be >= 0")
+	}
+	if cfg.ModelProvider == "router" {
+		if cfg.RouterBreakerThreshold <= 0 {
+			return fmt.Errorf("AUTONOUS_MODEL_ROUTER_BREAKER_THRESHOLD must be > 0")
+		}
+		if cfg.RouterBreakerCooldownSec <= 0 {
+			return fmt.Errorf("AUTONOUS_MODEL_ROUTER_BREAKER_COOLDOWN_SECONDS must be > 0")
+		}
+	}
+	if (cfg.ModelProvider == "anthropic" || slices.Contains(cfg.ModelRouterChain, "anthropic")) && cfg.AnthropicMaxTokens <= 0 {
+		return fmt.Errorf("ANTHROPIC_MAX_TOKENS must be > 0")
+	}
+	switch cfg.CassetteMode {
+	case "off":
+	case "record", "replay":
+		if strings.TrimSpace(cfg.CassettePath) == "" {
+			return fmt.Errorf("AUTONOUS_CASSETTE_PATH is required when AUTONOUS_CASSETTE_MODE=%s", cfg.CassetteMode)
+		}
+	default:
+		return fmt.Errorf("AUTONOUS_CASSETTE_MODE must be off, record or replay: %s", cfg.CassetteMode)
+	}
+	if cfg.WorkerConcurrency <= 0 {
+		return fmt.Errorf("AUTONOUS_WORKER_CONCURRENCY must be > 0")
+	}
+	if cfg.CassetteMode != "off" && cfg.WorkerConcurrency != 1 {
+		return fmt.Errorf("AUTONOUS_WORKER_CONCURRENCY must be 1 when AUTONOUS_CASSETTE_MODE=%s", cfg.CassetteMode)
+	}
+	if cfg.TaskLeaseSeconds <= 0 {
+		return fmt.Errorf("AUTONOUS_TASK_LEASE_SECONDS must be > 0")
+	}
+	if cfg.StreamEditIntervalMs <= 0 {
+		return fmt.Errorf("AUTONOUS_STREAM_EDIT_INTERVAL_MS must be > 0")
+	}
 	if cfg.ToolTimeoutSeconds <= 0 {
 		return fmt.Errorf("AUTONOUS_TOOL_TIMEOUT_SECONDS must be > 0")
 	}
@@ -3,6 +3,7 @@ package config
 import (
 	"os"
 	"path/filepath"
+	"slices"
 	"strings"
 	"testing"
 )
@@ -171,3 +172,452 @@ func TestLoadWorkerConfig_DoesNotCreateDefaultConfigDir(t *testing.T) {
 		t.Fatalf("unexpected config dir: %s", cfg.ConfigDir)
 	}
 }
+
+func TestLoadWorkerConfig_AnthropicRequiresKey(t *testing.T) {
+	setupWorkerEnv(t)
+	t.Setenv("AUTONOUS_MODEL_PROVIDER", "anthropic")
+	t.Setenv("ANTHROPIC_API_KEY", "")
+	_, err := LoadWorkerConfig()
+	if err == nil {
+		t.Fatal("expected missing anthropic key error")
+	}
+	if !strings.Contains(err.Error(), "ANTHROPIC_API_KEY") {
+		t.Fatalf("unexpected err: %v", err)
+	}
+}
+
+func TestLoadWorkerConfig_AnthropicModelName(t *testing.T) {
+	setupWorkerEnv(t)
+	t.Setenv("AUTONOUS_MODEL_PROVIDER", "anthropic")
+	t.Setenv("ANTHROPIC_API_KEY", "test-key")
+	t.Setenv("ANTHROPIC_MODEL", "claude-test")
+	cfg, err := LoadWorkerConfig()
+	if err != nil {
+		t.Fatalf("unexpected err: %v", err)
+	}
+	if cfg.ModelName() != "claude-test" {
+		t.Fatalf("unexpected model name: %s", cfg.ModelName())
+	}
+}
+
+func TestLoadWorkerConfig_RouterChain(t *testing.T) {
+	setupWorkerEnv(t)
+	t.Setenv("AUTONOUS_MODEL_PROVIDER", "router")
+	t.Setenv("AUTONOUS_MODEL_ROUTER_CHAIN", " anthropic , openai ")
+	t.Setenv("ANTHROPIC_API_KEY", "test-key")
+	t.Setenv("ANTHROPIC_MODEL", "claude-test")
+	cfg, err := LoadWorkerConfig()
+	if err != nil {
+		t.Fatalf("unexpected err: %v", err)
+	}
+	if len(cfg.ModelRouterChain) != 2 || cfg.ModelRouterChain[0] != "anthropic" || cfg.ModelRouterChain[1] != "openai" {
+		t.Fatalf("unexpected chain: %v", cfg.ModelRouterChain)
+	}
+	if cfg.ModelName() != "claude-test" {
+		t.Fatalf("expected head-of-chain model name, got %s", cfg.ModelName())
+	}
+}
+
+func TestLoadWorkerConfig_RouterChainValidation(t *testing.T) {
+	cases := map[string]string{
+		"unknown":   "openai,mistral",
+		"duplicate": "openai,openai",
+		"nested":    "router",
+		"empty":     " , ",
+	}
+	for name, chain := range cases {
+		t.Run(name, func(t *testing.T) {
+			setupWorkerEnv(t)
+			t.Setenv("AUTONOUS_MODEL_PROVIDER", "router")
+			t.Setenv("AUTONOUS_MODEL_ROUTER_CHAIN", chain)
+			if _, err := LoadWorkerConfig(); err == nil || !strings.Contains(err.Error(), "AUTONOUS_MODEL_ROUTER_CHAIN") {
+				t.Fatalf("expected chain validation error, got %v", err)
+			}
+		})
+	}
+}
+
+func TestLoadWorkerConfig_RouterRequiresChainKeys(t *testing.T) {
+	setupWorkerEnv(t)
+	t.Setenv("AUTONOUS_MODEL_PROVIDER", "router")
+	t.Setenv("AUTONOUS_MODEL_ROUTER_CHAIN", "openai,anthropic")
+	t.Setenv("ANTHROPIC_API_KEY", "")
+	_, err := LoadWorkerConfig()
+	if err == nil || !strings.Contains(err.Error(), "ANTHROPIC_API_KEY") {
+		t.Fatalf("expected missing anthropic key error, got %v", err)
+	}
+}
+
+func TestLoadWorkerConfig_CassetteMode(t *testing.T) {
+	setupWorkerEnv(t)
+	t.Setenv("AUTONOUS_CASSETTE_MODE", "record")
+	if _, err := LoadWorkerConfig(); err == nil || !strings.Contains(err.Error(), "AUTONOUS_CASSETTE_PATH") {
+		t.Fatalf("expected missing cassette path error, got %v", err)
+	}
+	t.Setenv("AUTONOUS_CASSETTE_MODE", "rewind")
+	t.Setenv("AUTONOUS_CASSETTE_PATH", "/tmp/session.json")
+	if _, err := LoadWorkerConfig(); err == nil || !strings.Contains(err.Error(), "AUTONOUS_CASSETTE_MODE") {
+		t.Fatalf("expected invalid cassette mode error, got %v", err)
+	}
+}
+
+func TestLoadWorkerConfig_ReplayNeedsNoCredentials(t *testing.T) {
+	setupWorkerEnv(t)
+	t.Setenv("TELEGRAM_BOT_TOKEN", "")
+	t.Setenv("OPENAI_API_KEY", "")
+	t.Setenv("AUTONOUS_CASSETTE_MODE", "replay")
+	t.Setenv("AUTONOUS_CASSETTE_PATH", "/tmp/session.json")
+	cfg, err := LoadWorkerConfig()
+	if err != nil {
+		t.Fatalf("unexpected err: %v", err)
+	}
+	if cfg.CassetteMode != "replay" || cfg.CassettePath != "/tmp/session.json" {
+		t.Fatalf("unexpected cassette config: %s %s", cfg.CassetteMode, cfg.CassettePath)
+	}
+}
+
+func TestLoadWorkerConfig_PricesAndBudgets(t *testing.T) {
+	setupWorkerEnv(t)
+	t.Setenv("AUTONOUS_MODEL_PRICES", "gpt-4o-mini=0.2:0.8")
+	t.Setenv("AUTONOUS_BUDGET_DAILY_USD", "1.5")
+	t.Setenv("AUTONOUS_BUDGET_MONTHLY_USD", "20")
+	cfg, err := LoadWorkerConfig()
+	if err != nil {
+		t.Fatalf("unexpected err: %v", err)
+	}
+	if p := cfg.ModelPrices["gpt-4o-mini"]; p.InputPerMTok != 0.2 || p.OutputPerMTok != 0.8 {
+		t.Fatalf("unexpected price override: %+v", cfg.ModelPrices)
+	}
+	if cfg.BudgetDailyUSD != 1.5 || cfg.BudgetMonthlyUSD != 20 {
+		t.Fatalf("unexpected budgets: daily=%v monthly=%v", cfg.BudgetDailyUSD, cfg.BudgetMonthlyUSD)
+	}
+
+	t.Setenv("AUTONOUS_BUDGET_DAILY_USD", "-1")
+	if _, err := LoadWorkerConfig(); err == nil || !strings.Contains(err.Error(), "AUTONOUS_BUDGET_DAILY_USD") {
+		t.Fatalf("expected negative budget error, got %v", err)
+	}
+	t.Setenv("AUTONOUS_BUDGET_DAILY_USD", "")
+	t.Setenv("AUTONOUS_MODEL_PRICES", "gpt-4o-mini=cheap")
+	if _, err := LoadWorkerConfig(); err == nil || !strings.Contains(err.Error(), "AUTONOUS_MODEL_PRICES") {
+		t.Fatalf("expected price parse error, got %v", err)
+	}
+}
+
+func TestLoadWorkerConfig_ContextTokenBudgets(t *testing.T) {
+	setupWorkerEnv(t)
+	if cfg, err := LoadWorkerConfig(); err != nil || cfg.ContextTokenBudgetFor("gpt-4o-mini") != 0 {
+		t.Fatalf("expected no token budget by default, got %d err=%v", cfg.ContextTokenBudget, err)
+	}
+	t.Setenv("AUTONOUS_CONTEXT_TOKEN_BUDGET", "4000")
+	t.Setenv("AUTONOUS_CONTEXT_TOKEN_BUDGETS", "GPT-4o=20000, gpt-4o-mini=10000, gpt-5=0")
+	cfg, err := LoadWorkerConfig()
+	if err != nil {
+		t.Fatalf("unexpected err: %v", err)
+	}
+	cases := map[string]int{
+		"gpt-4o":                 20000,
+		"gpt-4o-2024-08-06":      20000,
+		"gpt-4o-mini-2024-07-18": 10000,
+		"gpt-5":                  0,
+		"claude-sonnet-4-5":      4000,
+	}
+	for model, want := range cases {
+		if got := cfg.ContextTokenBudgetFor(model); got != want {
+			t.Fatalf("%s: got budget %d, want %d", model, got, want)
+		}
+	}
+
+	t.Setenv("AUTONOUS_CONTEXT_TOKEN_BUDGETS", "gpt-4o=lots")
+	if _, err := LoadWorkerConfig(); err == nil || !strings.Contains(err.Error(), "AUTONOUS_CONTEXT_TOKEN_BUDGETS") {
+		t.Fatalf("expected budget parse error, got %v", err)
+	}
+	t.Setenv("AUTONOUS_CONTEXT_TOKEN_BUDGETS", "")
+	t.Setenv("AUTONOUS_CONTEXT_TOKEN_BUDGET", "-1")
+	if _, err := LoadWorkerConfig(); err == nil || !strings.Contains(err.Error(), "AUTONOUS_CONTEXT_TOKEN_BUDGET") {
+		t.Fatalf("expected negative budget error, got %v", err)
+	}
+}
+
+func TestLoadWorkerConfig_Summary(t *testing.T) {
+	setupWorkerEnv(t)
+	cfg, err := LoadWorkerConfig()
+	if err != nil {
+		t.Fatalf("unexpected err: %v", err)
+	}
+	if cfg.SummaryThreshold != 0 || cfg.SummaryKeep != 4 {
+		t.Fatalf("expected summaries off by default, got threshold=%d keep=%d", cfg.SummaryThreshold, cfg.SummaryKeep)
+	}
+
+	t.Setenv("AUTONOUS_SUMMARY_THRESHOLD", "10")
+	if _, err := LoadWorkerConfig(); err != nil {
+		t.Fatalf("unexpected err: %v", err)
+	}
+	t.Setenv("AUTONOUS_SUMMARY_THRESHOLD", "20")
+	if _, err := LoadWorkerConfig(); err == nil || !strings.Contains(err.Error(), "TG_HISTORY_WINDOW") {
+		t.Fatalf("expected threshold above the history window to fail, got %v", err)
+	}
+	t.Setenv("AUTONOUS_SUMMARY_THRESHOLD", "4")
+	if _, err := LoadWorkerConfig(); err == nil || !strings.Contains(err.Error(), "AUTONOUS_SUMMARY_KEEP") {
+		t.Fatalf("expected keep >= threshold to fail, got %v", err)
+	}
+}
+
+func TestLoadWorkerConfig_HistoryToolOutputBytes(t *testing.T) {
+	setupWorkerEnv(t)
+	cfg, err := LoadWorkerConfig()
+	if err != nil {
+		t.Fatalf("unexpected err: %v", err)
+	}
+	if cfg.HistoryToolOutputBytes != 2000 {
+		t.Fatalf("expected default 2000, got %d", cfg.HistoryToolOutputBytes)
+	}
+	t.Setenv("AUTONOUS_HISTORY_TOOL_OUTPUT_BYTES", "0")
+	if cfg, err := LoadWorkerConfig(); err != nil || cfg.HistoryToolOutputBytes != 0 {
+		t.Fatalf("expected 0 to disable persisted tool turns, got %d err=%v", cfg.HistoryToolOutputBytes, err)
+	}
+	t.Setenv("AUTONOUS_HISTORY_TOOL_OUTPUT_BYTES", "-1")
+	if _, err := LoadWorkerConfig(); err == nil || !strings.Contains(err.Error(), "AUTONOUS_HISTORY_TOOL_OUTPUT_BYTES") {
+		t.Fatalf("expected negative size error, got %v", err)
+	}
+}
+
+func TestLoadWorkerConfig_RetrievalTopK(t *testing.T) {
+	setupWorkerEnv(t)
+	cfg, err := LoadWorkerConfig()
+	if err != nil {
+		t.Fatalf("unexpected err: %v", err)
+	}
+	if cfg.RetrievalTopK != 0 {
+		t.Fatalf("expected retrieval off by default, got %d", cfg.RetrievalTopK)
+	}
+	t.Setenv("AUTONOUS_RETRIEVAL_TOP_K", "-1")
+	if _, err := LoadWorkerConfig(); err == nil || !strings.Contains(err.Error(), "AUTONOUS_RETRIEVAL_TOP_K") {
+		t.Fatalf("expected negative top-k error, got %v", err)
+	}
+}
+
+func TestLoadWorkerConfig_Embeddings(t *testing.T) {
+	setupWorkerEnv(t)
+	cfg, err := LoadWorkerConfig()
+	if err != nil {
+		t.Fatalf("unexpected err: %v", err)
+	}
+	if cfg.EmbeddingsProvider != "" || cfg.SemanticTopK != 4 || cfg.SemanticFileTopK != 0 || cfg.SemanticMinScore != 0.3 {
+		t.Fatalf("unexpected embedding defaults %+v", cfg)
+	}
+	if cfg.OpenAIEmbeddingsModel != "text-embedding-3-small" {
+		t.Fatalf("unexpected embeddings model %q", cfg.OpenAIEmbeddingsModel)
+	}
+
+	t.Setenv("AUTONOUS_EMBEDDINGS_PROVIDER", "dummy")
+	if _, err := LoadWorkerConfig(); err != nil {
+		t.Fatalf("unexpected err: %v", err)
+	}
+	t.Setenv("AUTONOUS_EMBEDDINGS_PROVIDER", "cohere")
+	if _, err := LoadWorkerConfig(); err == nil || !strings.Contains(err.Error(), "AUTONOUS_EMBEDDINGS_PROVIDER") {
+		t.Fatalf("expected unknown embeddings provider error, got %v", err)
+	}
+	t.Setenv("AUTONOUS_EMBEDDINGS_PROVIDER", "dummy")
+	t.Setenv("AUTONOUS_SEMANTIC_MIN_SCORE", "1.5")
+	if _, err := LoadWorkerConfig(); err == nil || !strings.Contains(err.Error(), "AUTONOUS_SEMANTIC_MIN_SCORE") {
+		t.Fatalf("expected min score range error, got %v", err)
+	}
+}
+
+func TestLoadWorkerConfig_RepoMapTokens(t *testing.T) {
+	setupWorkerEnv(t)
+	cfg, err := LoadWorkerConfig()
+	if err != nil {
+		t.Fatalf("unexpected err: %v", err)
+	}
+	if cfg.RepoMapTokens != 0 {
+		t.Fatalf("expected the repo map off by default, got %d", cfg.RepoMapTokens)
+	}
+	t.Setenv("AUTONOUS_REPO_MAP_TOKENS", "-1")
+	if _, err := LoadWorkerConfig(); err == nil || !strings.Contains(err.Error(), "AUTONOUS_REPO_MAP_TOKENS") {
+		t.Fatalf("expected negative repo map budget error, got %v", err)
+	}
+}
+
+func TestLoadWorkerConfig_MemoryTopK(t *testing.T) {
+	setupWorkerEnv(t)
+	cfg, err := LoadWorkerConfig()
+	if err != nil {
+		t.Fatalf("unexpected err: %v", err)
+	}
+	if cfg.MemoryTopK != 0 {
+		t.Fatalf("expected no memories injected by default, got %d", cfg.MemoryTopK)
+	}
+	t.Setenv("AUTONOUS_MEMORY_TOP_K", "-1")
+	if _, err := LoadWorkerConfig(); err == nil || !strings.Contains(err.Error(), "AUTONOUS_MEMORY_TOP_K") {
+		t.Fatalf("expected negative memory top-k error, got %v", err)
+	}
+}
+
+func TestLoadWorkerConfig_ContextStages(t *testing.T) {
+	setupWorkerEnv(t)
+	cfg, err := LoadWorkerConfig()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if cfg.ContextStages != nil || cfg.ContextMaxMessageTokens != 1000 {
+		t.Fatalf("expected no explicit chain and a 1000 token cap by default, got %v %d", cfg.ContextStages, cfg.ContextMaxMessageTokens)
+	}
+	t.Setenv("AUTONOUS_CONTEXT_STAGES", " dedupe, truncate_long ,token_budget")
+	if cfg, err = LoadWorkerConfig(); err != nil || !slices.Equal(cfg.ContextStages, []string{"dedupe", "truncate_long", "token_budget"}) {
+		t.Fatalf("unexpected stages %v err=%v", cfg.ContextStages, err)
+	}
+	for value, want := range map[string]string{
+		"dedupe,bogus":        "unsupported stage: bogus",
+		"window,window":       "duplicate stage: window",
+		"dedupe,summarize":    "AUTONOUS_SUMMARY_THRESHOLD is 0",
+		"token_budget,dedupe": "",
+	} {
+		t.Setenv("AUTONOUS_CONTEXT_STAGES", value)
+		_, err := LoadWorkerConfig()
+		if want == "" {
+			if err != nil {
+				t.Fatalf("%s: unexpected err %v", value, err)
+			}
+			continue
+		}
+		if err == nil || !strings.Contains(err.Error(), want) {
+			t.Fatalf("%s: expected %q, got %v", value, want, err)
+		}
+	}
+	t.Setenv("AUTONOUS_CONTEXT_STAGES", "")
+	t.Setenv("AUTONOUS_CONTEXT_MAX_MESSAGE_TOKENS", "0")
+	if _, err := LoadWorkerConfig(); err == nil || !strings.Contains(err.Error(), "AUTONOUS_CONTEXT_MAX_MESSAGE_TOKENS") {
+		t.Fatalf("expected max message tokens error, got %v", err)
+	}
+}
+
+func TestLoadWorkerConfig_CircuitClasses(t *testing.T) {
+	setupWorkerEnv(t)
+	cfg, err := LoadWorkerConfig()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if got := cfg.CircuitFor("provider_api"); got != (CircuitClass{Threshold: 5, CooldownSeconds: 30}) {
+		t.Fatalf("expected the 5/30s default, got %+v", got)
+	}
+	t.Setenv("AUTONOUS_CONTROL_CIRCUIT_THRESHOLD", "4")
+	t.Setenv("AUTONOUS_CONTROL_CIRCUIT_CLASSES", "provider_api=3:120, db=10:5")
+	if cfg, err = LoadWorkerConfig(); err != nil {
+		t.Fatal(err)
+	}
+	if got := cfg.CircuitFor("provider_api"); got != (CircuitClass{Threshold: 3, CooldownSeconds: 120}) {
+		t.Fatalf("unexpected provider_api policy %+v", got)
+	}
+	if got := cfg.CircuitFor("command_source_api"); got != (CircuitClass{Threshold: 4, CooldownSeconds: 30}) {
+		t.Fatalf("expected the default policy for a class without override, got %+v", got)
+	}
+	for value, want := range map[string]string{
+		"provider=3:10":     "unknown error class",
+		"provider_api=3":    "want class=threshold:cooldown_seconds",
+		"provider_api=0:10": "threshold must be",
+		"db=2:x":            "cooldown_seconds must be",
+	} {
+		t.Setenv("AUTONOUS_CONTROL_CIRCUIT_CLASSES", value)
+		if _, err := LoadWorkerConfig(); err == nil || !strings.Contains(err.Error(), want) {
+			t.Fatalf("%s: expected %q, got %v", value, want, err)
+		}
+	}
+	t.Setenv("AUTONOUS_CONTROL_CIRCUIT_CLASSES", "")
+	t.Setenv("AUTONOUS_CONTROL_CIRCUIT_COOLDOWN_SECONDS", "0")
+	if _, err := LoadWorkerConfig(); err == nil || !strings.Contains(err.Error(), "AUTONOUS_CONTROL_CIRCUIT_COOLDOWN_SECONDS") {
+		t.Fatalf("expected cooldown error, got %v", err)
+	}
+}
+
+func TestLoadWorkerConfig_ChatRates(t *testing.T) {
+	setupWorkerEnv(t)
+	cfg, err := LoadWorkerConfig()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if got := cfg.RateFor(42); got != (ChatRate{PerMinute: 0, Burst: 10}) {
+		t.Fatalf("expected no rate limit by default, got %+v", got)
+	}
+	t.Setenv("AUTONOUS_CONTROL_RATE_PER_MINUTE", "6")
+	t.Setenv("AUTONOUS_CONTROL_RATE_CHATS", "42=0:1, -100123=60:20")
+	if cfg, err = LoadWorkerConfig(); err != nil {
+		t.Fatal(err)
+	}
+	if got := cfg.RateFor(42); got != (ChatRate{PerMinute: 0, Burst: 1}) {
+		t.Fatalf("unexpected override for chat 42: %+v", got)
+	}
+	if got := cfg.RateFor(-100123); got != (ChatRate{PerMinute: 60, Burst: 20}) {
+		t.Fatalf("unexpected override for a group chat: %+v", got)
+	}
+	if got := cfg.RateFor(7); got != (ChatRate{PerMinute: 6, Burst: 10}) {
+		t.Fatalf("expected the default for a chat without override, got %+v", got)
+	}
+	for value, want := range map[string]string{
+		"alice=1:1": "chat_id must be an integer",
+		"42=5":      "want chat_id=per_minute:burst",
+		"42=-1:1":   "per_minute must be",
+		"42=5:0":    "burst must be",
+	} {
+		t.Setenv("AUTONOUS_CONTROL_RATE_CHATS", value)
+		if _, err := LoadWorkerConfig(); err == nil || !strings.Contains(err.Error(), want) {
+			t.Fatalf("%s: expected %q, got %v", value, want, err)
+		}
+	}
+	t.Setenv("AUTONOUS_CONTROL_RATE_CHATS", "")
+	t.Setenv("AUTONOUS_CONTROL_RATE_BURST", "0")
+	if _, err := LoadWorkerConfig(); err == nil || !strings.Contains(err.Error(), "AUTONOUS_CONTROL_RATE_BURST") {
+		t.Fatalf("expected burst error, got %v", err)
+	}
+}
+
+func TestLoadWorkerConfig_WorkerConcurrency(t *testing.T) {
+	setupWorkerEnv(t)
+	cfg, err := LoadWorkerConfig()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if cfg.WorkerConcurrency != 1 {
+		t.Fatalf("expected a single executor by default, got %d", cfg.WorkerConcurrency)
+	}
+	t.Setenv("AUTONOUS_WORKER_CONCURRENCY", "4")
+	if cfg, err = LoadWorkerConfig(); err != nil || cfg.WorkerConcurrency != 4 {
+		t.Fatalf("expected 4 executors, got %d err=%v", cfg.WorkerConcurrency, err)
+	}
+	t.Setenv("AUTONOUS_CASSETTE_MODE", "record")
+	t.Setenv("AUTONOUS_CASSETTE_PATH", "/tmp/session.json")
+	if _, err := LoadWorkerConfig(); err == nil || !strings.Contains(err.Error(), "must be 1 when AUTONOUS_CASSETTE_MODE=record") {
+		t.Fatalf("expected cassette concurrency error, got %v", err)
+	}
+	t.Setenv("AUTONOUS_CASSETTE_MODE", "off")
+	t.Setenv("AUTONOUS_WORKER_CONCURRENCY", "0")
+	if _, err := LoadWorkerConfig(); err == nil || !strings.Contains(err.Error(), "AUTONOUS_WORKER_CONCURRENCY must be > 0") {
+		t.Fatalf("expected concurrency error, got %v", err)
+	}
+}
+
+func TestLoadWorkerConfig_StreamReplies(t *testing.T) {
+	setupWorkerEnv(t)
+	if cfg, err := LoadWorkerConfig(); err != nil || cfg.StreamReplies {
+		t.Fatalf("expected streaming off by default, got %v err=%v", cfg.StreamReplies, err)
+	}
+	t.Setenv("AUTONOUS_STREAM_REPLIES", "true")
+	if cfg, err := LoadWorkerConfig(); err != nil || !cfg.StreamReplies {
+		t.Fatalf("expected streaming enabled, got %v err=%v", cfg.StreamReplies, err)
+	}
+}
+
+func TestLoadWorkerConfig_TaskLeaseSeconds(t *testing.T) {
+	setupWorkerEnv(t)
+	cfg, err := LoadWorkerConfig()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if cfg.TaskLeaseSeconds != 60 {
+		t.Fatalf("expected a 60s lease by default, got %d", cfg.TaskLeaseSeconds)
+	}
+	t.Setenv("AUTONOUS_TASK_LEASE_SECONDS", "0")
+	if _, err := LoadWorkerConfig(); err == nil || !strings.Contains(err.Error(), "AUTONOUS_TASK_LEASE_SECONDS must be > 0") {
+		t.Fatalf("expected lease error, got %v", err)
+	}
+}
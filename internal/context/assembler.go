@@ -1,14 +1,62 @@
 package context
 
+import "strings"
+
+// RetrievedPrefix starts the system message that carries retrieved older
+// messages, so the model does not mistake them for the recent conversation.
+const RetrievedPrefix = "Earlier messages from this chat, retrieved because they may be relevant to the new message:\n"
+
 // StandardAssembler combines system prompt, history, and user message
 // into a single ordered message list.
-type StandardAssembler struct{}
+type StandardAssembler struct {
+	// FlattenToolCalls rewrites stored tool turns as plain text, for
+	// providers without native tool calling.
+	FlattenToolCalls bool
+	// Injectors add system messages after the system prompt.
+	Injectors []SystemInjector
+}
 
-// Assemble builds the final message list: system + history + user.
+// Assemble builds the final message list: system + injected + history +
+// user. Stored tool turns are repaired so every call has its result directly
+// after it, and retrieved messages are gathered into one marked system
+// message.
 func (a *StandardAssembler) Assemble(system string, history []Message, userMsg string) []Message {
-	messages := make([]Message, 0, 1+len(history)+1)
+	history = RepairToolTurns(markRetrieved(history))
+	if a.FlattenToolCalls {
+		history = FlattenToolTurns(history)
+	}
+	messages := make([]Message, 0, 1+len(a.Injectors)+len(history)+1)
 	messages = append(messages, Message{Role: "system", Content: system})
+	for _, inj := range a.Injectors {
+		if content := inj.SystemMessage(userMsg); content != "" {
+			messages = append(messages, Message{Role: "system", Content: content})
+		}
+	}
 	messages = append(messages, history...)
 	messages = append(messages, Message{Role: "user", Content: userMsg})
 	return messages
 }
+
+// markRetrieved replaces the Retrieved messages in history with a single
+// system message at the position of the first one.
+func markRetrieved(history []Message) []Message {
+	var b strings.Builder
+	at := -1
+	out := make([]Message, 0, len(history))
+	for _, msg := range history {
+		if !msg.Retrieved {
+			out = append(out, msg)
+			continue
+		}
+		if at < 0 {
+			at = len(out)
+			out = append(out, Message{})
+			b.WriteString(RetrievedPrefix)
+		}
+		b.WriteString("[" + msg.Role + "] " + msg.Content + "\n")
+	}
+	if at >= 0 {
+		out[at] = Message{Role: "system", Content: strings.TrimSuffix(b.String(), "\n")}
+	}
+	return out
+}
@@ -42,3 +42,56 @@ func TestStandardAssembler_EmptyHistory(t *testing.T) {
 		t.Errorf("unexpected user message: %+v", result[1])
 	}
 }
+
+func TestStandardAssembler_FlattensToolCalls(t *testing.T) {
+	history := []Message{
+		{Role: "assistant", ToolCalls: []ToolCall{{ID: "a", Name: "ls", Arguments: []byte(`{}`)}}},
+		{Role: "tool", ToolCallID: "a", Content: "x.go"},
+	}
+	native := (&StandardAssembler{}).Assemble("sys", history, "next")
+	if len(native) != 4 || native[2].Role != "tool" {
+		t.Fatalf("expected native tool turns kept, got %+v", native)
+	}
+	flat := (&StandardAssembler{FlattenToolCalls: true}).Assemble("sys", history, "next")
+	if len(flat) != 4 || flat[1].Role != "assistant" || len(flat[1].ToolCalls) != 0 || flat[2].Role != "user" {
+		t.Fatalf("expected flattened tool turns, got %+v", flat)
+	}
+}
+
+func TestStandardAssembler_MarksRetrieved(t *testing.T) {
+	history := []Message{
+		{Role: "system", Content: "summary"},
+		{Role: "user", Content: "use postgres", Retrieved: true},
+		{Role: "assistant", Content: "noted", Retrieved: true},
+		{Role: "user", Content: "recent"},
+	}
+	result := (&StandardAssembler{}).Assemble("sys", history, "new")
+	if len(result) != 5 {
+		t.Fatalf("expected retrieved messages merged into one, got %+v", result)
+	}
+	want := RetrievedPrefix + "[user] use postgres\n[assistant] noted"
+	if result[2].Role != "system" || result[2].Content != want {
+		t.Fatalf("unexpected retrieved block %+v", result[2])
+	}
+	if result[3].Content != "recent" {
+		t.Fatalf("expected recent history after the retrieved block, got %+v", result[3])
+	}
+}
+
+type staticInjector string
+
+func (s staticInjector) SystemMessage(string) string { return string(s) }
+
+func TestStandardAssembler_Injectors(t *testing.T) {
+	a := &StandardAssembler{Injectors: []SystemInjector{staticInjector("map"), staticInjector("")}}
+	result := a.Assemble("sys", []Message{{Role: "user", Content: "prev"}}, "now")
+	if len(result) != 4 {
+		t.Fatalf("expected 4 messages, got %+v", result)
+	}
+	if result[1].Role != "system" || result[1].Content != "map" {
+		t.Fatalf("expected injected system message after the prompt, got %+v", result[1])
+	}
+	if result[2].Content != "prev" || result[3].Content != "now" {
+		t.Fatalf("unexpected history or user message: %+v", result)
+	}
+}
@@ -0,0 +1,155 @@
+package context
+
+import "github.com/stupiduntilnot/autonous/internal/tokenizer"
+
+// TruncationMarker ends the content of a message cut to fit the budget.
+const TruncationMarker = "\n…[truncated]"
+
+// minTruncatedTokens is the smallest room worth filling with a truncated
+// message; below it the message is dropped instead.
+const minTruncatedTokens = 32
+
+// TokenBudgetCompressor trims history so the whole prompt fits BudgetTokens.
+// History messages larger than MaxMessageTokens are first cut with a marker.
+// If history still does not fit, tool results are elided oldest first, keeping
+// the calls that produced them. The newest messages are then kept whole while
+// they fit, the next one is truncated if enough room remains, and everything
+// older is dropped. Leading system messages, such as a conversation summary,
+// are never dropped.
+type TokenBudgetCompressor struct {
+	Tokenizer tokenizer.Tokenizer
+	// BudgetTokens is the total input budget. Zero disables trimming.
+	BudgetTokens int
+	// MaxMessageTokens caps a single history message. Zero means half of
+	// the room left for history.
+	MaxMessageTokens int
+}
+
+// Compress trims messages as if nothing else shared the budget.
+func (c *TokenBudgetCompressor) Compress(messages []Message) []Message {
+	out, _ := c.CompressWithin(messages, 0)
+	return out
+}
+
+// CompressWithin trims messages to the budget left after reservedTokens.
+func (c *TokenBudgetCompressor) CompressWithin(messages []Message, reservedTokens int) ([]Message, CompressionReport) {
+	report := CompressionReport{BudgetTokens: c.BudgetTokens}
+	if c.BudgetTokens <= 0 {
+		report.KeptTokens = CountTokens(c.Tokenizer, messages)
+		return messages, report
+	}
+	available := max(c.BudgetTokens-reservedTokens, 0)
+	report.HistoryBudgetTokens = available
+	perMessage := c.MaxMessageTokens
+	if perMessage <= 0 {
+		perMessage = available / 2
+	}
+
+	original := make([]int, len(messages))
+	capped := make([]Message, len(messages))
+	for i, msg := range messages {
+		original[i] = MessageTokens(c.Tokenizer, msg)
+		capped[i] = msg
+		if original[i] > perMessage {
+			if cut, ok := c.truncate(msg, perMessage); ok {
+				capped[i] = cut
+			}
+		}
+	}
+
+	total := 0
+	for _, msg := range capped {
+		total += MessageTokens(c.Tokenizer, msg)
+	}
+	elided := make([]bool, len(capped))
+	for i := 0; i < len(capped) && total > available; i++ {
+		if capped[i].Role != "tool" || capped[i].Content == ElidedToolOutput {
+			continue
+		}
+		before := MessageTokens(c.Tokenizer, capped[i])
+		capped[i].Content = ElidedToolOutput
+		total -= before - MessageTokens(c.Tokenizer, capped[i])
+		elided[i] = true
+	}
+
+	pinned, used := 0, 0
+	for pinned < len(capped) && capped[pinned].Role == "system" {
+		used += MessageTokens(c.Tokenizer, capped[pinned])
+		pinned++
+	}
+	start := len(capped)
+	for i := len(capped) - 1; i >= pinned; i-- {
+		tokens := MessageTokens(c.Tokenizer, capped[i])
+		if used+tokens <= available {
+			used += tokens
+			start = i
+			continue
+		}
+		if room := available - used; room >= minTruncatedTokens {
+			if cut, ok := c.truncate(capped[i], room); ok {
+				capped[i] = cut
+				used += MessageTokens(c.Tokenizer, cut)
+				start = i
+			}
+		}
+		break
+	}
+	// Tool results are meaningless, and rejected by providers, without the
+	// assistant message that requested them.
+	for start < len(capped) && capped[start].Role == "tool" {
+		used -= MessageTokens(c.Tokenizer, capped[start])
+		start++
+	}
+
+	for i := range messages {
+		if i >= pinned && i < start {
+			report.DroppedMessages++
+			report.DroppedTokens += original[i]
+			continue
+		}
+		if elided[i] {
+			report.ElidedMessages++
+			report.ElidedTokens += original[i] - MessageTokens(c.Tokenizer, capped[i])
+			continue
+		}
+		if capped[i].Content != messages[i].Content {
+			report.TruncatedMessages++
+			report.TruncatedTokens += original[i] - MessageTokens(c.Tokenizer, capped[i])
+		}
+	}
+	report.KeptTokens = used
+	return append(capped[:pinned:pinned], capped[start:]...), report
+}
+
+func (c *TokenBudgetCompressor) truncate(msg Message, limit int) (Message, bool) {
+	return truncateMessage(c.Tokenizer, msg, limit)
+}
+
+// truncateMessage cuts msg's content so the message costs at most limit
+// tokens. It fails for messages whose tool calls alone exceed the limit or
+// that carry no content to cut.
+func truncateMessage(tok tokenizer.Tokenizer, msg Message, limit int) (Message, bool) {
+	runes := []rune(msg.Content)
+	if len(runes) == 0 {
+		return msg, false
+	}
+	fits := func(n int) bool {
+		cut := msg
+		cut.Content = string(runes[:n]) + TruncationMarker
+		return MessageTokens(tok, cut) <= limit
+	}
+	if !fits(0) {
+		return msg, false
+	}
+	lo, hi := 0, len(runes)
+	for lo < hi {
+		mid := (lo + hi + 1) / 2
+		if fits(mid) {
+			lo = mid
+		} else {
+			hi = mid - 1
+		}
+	}
+	msg.Content = string(runes[:lo]) + TruncationMarker
+	return msg, true
+}
@@ -0,0 +1,125 @@
+package context
+
+import (
+	"strings"
+	"testing"
+)
+
+func words(n int) string {
+	return strings.TrimSpace(strings.Repeat("w ", n))
+}
+
+func TestTokenBudgetCompressor_DropsOldestToFit(t *testing.T) {
+	c := &TokenBudgetCompressor{Tokenizer: wordTokenizer{}, BudgetTokens: 20}
+	msgs := []Message{
+		{Role: "user", Content: "one two three"},
+		{Role: "assistant", Content: "four five six"},
+		{Role: "user", Content: "seven eight nine"},
+		{Role: "assistant", Content: "ten eleven twelve"},
+	}
+	got, report := c.CompressWithin(msgs, 5)
+	if len(got) != 2 || got[0].Content != "seven eight nine" {
+		t.Fatalf("expected the two newest messages, got %+v", got)
+	}
+	want := CompressionReport{BudgetTokens: 20, HistoryBudgetTokens: 15, KeptTokens: 12, DroppedMessages: 2, DroppedTokens: 12}
+	if report != want {
+		t.Fatalf("unexpected report %+v, want %+v", report, want)
+	}
+}
+
+func TestTokenBudgetCompressor_TruncatesOversizedMessage(t *testing.T) {
+	c := &TokenBudgetCompressor{Tokenizer: wordTokenizer{}, BudgetTokens: 1000, MaxMessageTokens: 10}
+	msgs := []Message{{Role: "user", Content: words(50)}, {Role: "assistant", Content: "hi"}}
+	got, report := c.CompressWithin(msgs, 0)
+	if len(got) != 2 || !strings.HasSuffix(got[0].Content, TruncationMarker) {
+		t.Fatalf("expected oversized message to be truncated with a marker, got %+v", got)
+	}
+	if n := MessageTokens(wordTokenizer{}, got[0]); n != 10 {
+		t.Fatalf("expected truncated message to use the 10 token cap, got %d", n)
+	}
+	if report.TruncatedMessages != 1 || report.TruncatedTokens != 53-10 || report.DroppedMessages != 0 {
+		t.Fatalf("unexpected report %+v", report)
+	}
+}
+
+func TestTokenBudgetCompressor_TruncatesOldestKeptMessage(t *testing.T) {
+	c := &TokenBudgetCompressor{Tokenizer: wordTokenizer{}, BudgetTokens: 100, MaxMessageTokens: 1000}
+	msgs := []Message{
+		{Role: "user", Content: words(5)},
+		{Role: "assistant", Content: words(100)},
+		{Role: "user", Content: words(10)},
+	}
+	got, report := c.CompressWithin(msgs, 0)
+	if len(got) != 2 || !strings.HasSuffix(got[0].Content, TruncationMarker) || got[1].Content != words(10) {
+		t.Fatalf("expected truncated older message plus newest, got %+v", got)
+	}
+	if report.KeptTokens != 100 || report.DroppedMessages != 1 || report.TruncatedMessages != 1 {
+		t.Fatalf("unexpected report %+v", report)
+	}
+}
+
+func TestTokenBudgetCompressor_DropsOrphanedToolResults(t *testing.T) {
+	c := &TokenBudgetCompressor{Tokenizer: wordTokenizer{}, BudgetTokens: 12, MaxMessageTokens: 1000}
+	msgs := []Message{
+		{Role: "assistant", ToolCalls: []ToolCall{{ID: "c1", Name: "ls", Arguments: []byte(words(40))}}},
+		{Role: "tool", ToolCallID: "c1", Content: "a.go"},
+		{Role: "assistant", Content: "found a.go"},
+	}
+	got, report := c.CompressWithin(msgs, 0)
+	if len(got) != 1 || got[0].Content != "found a.go" {
+		t.Fatalf("expected only the final answer, got %+v", got)
+	}
+	if report.DroppedMessages != 2 || report.KeptTokens != 5 {
+		t.Fatalf("unexpected report %+v", report)
+	}
+}
+
+func TestTokenBudgetCompressor_ZeroBudgetKeepsEverything(t *testing.T) {
+	c := &TokenBudgetCompressor{Tokenizer: wordTokenizer{}}
+	msgs := []Message{{Role: "user", Content: words(500)}}
+	if got := c.Compress(msgs); len(got) != 1 || got[0].Content != msgs[0].Content {
+		t.Fatalf("expected no trimming without a budget, got %+v", got)
+	}
+}
+
+func TestTokenBudgetCompressor_KeepsLeadingSystemMessages(t *testing.T) {
+	c := &TokenBudgetCompressor{Tokenizer: wordTokenizer{}, BudgetTokens: 14}
+	msgs := []Message{
+		{Role: "system", Content: "summary of earlier talk"},
+		{Role: "user", Content: "one two three"},
+		{Role: "assistant", Content: "four five six"},
+	}
+	got, report := c.CompressWithin(msgs, 0)
+	if len(got) != 2 || got[0].Role != "system" || got[1].Content != "four five six" {
+		t.Fatalf("expected summary plus newest message, got %+v", got)
+	}
+	if report.DroppedMessages != 1 || report.KeptTokens != 13 {
+		t.Fatalf("unexpected report %+v", report)
+	}
+}
+
+func TestTokenBudgetCompressor_ElidesOldestToolOutputFirst(t *testing.T) {
+	c := &TokenBudgetCompressor{Tokenizer: wordTokenizer{}, BudgetTokens: 40, MaxMessageTokens: 1000}
+	call := func(id string) Message {
+		return Message{Role: "assistant", ToolCalls: []ToolCall{{ID: id, Name: "ls", Arguments: []byte(`{}`)}}}
+	}
+	msgs := []Message{
+		{Role: "user", Content: "q"},
+		call("c1"),
+		{Role: "tool", ToolCallID: "c1", Content: words(30)},
+		call("c2"),
+		{Role: "tool", ToolCallID: "c2", Content: words(10)},
+		{Role: "assistant", Content: words(3)},
+	}
+	got, report := c.CompressWithin(msgs, 0)
+	if len(got) != len(msgs) || got[2].Content != ElidedToolOutput || got[4].Content != words(10) {
+		t.Fatalf("expected only the oldest tool output elided, got %+v", got)
+	}
+	if len(got[1].ToolCalls) != 1 {
+		t.Fatalf("expected the tool call to be kept, got %+v", got[1])
+	}
+	want := CompressionReport{BudgetTokens: 40, HistoryBudgetTokens: 40, KeptTokens: 39, ElidedMessages: 1, ElidedTokens: 27}
+	if report != want {
+		t.Fatalf("unexpected report %+v, want %+v", report, want)
+	}
+}
@@ -0,0 +1,137 @@
+package context
+
+import (
+	"fmt"
+	"sort"
+	"strings"
+
+	"github.com/stupiduntilnot/autonous/internal/tokenizer"
+)
+
+// NamedStage is one step of a Chain.
+type NamedStage struct {
+	Name string
+	Compressor
+}
+
+// StageReport describes what one stage of a Chain did. Report holds the
+// stage's own counts when it is a BudgetCompressor.
+type StageReport struct {
+	Name      string
+	InCount   int
+	OutCount  int
+	InTokens  int
+	OutTokens int
+	Report    CompressionReport
+}
+
+// Chain runs its stages in order, each compressing the output of the one
+// before. It is a BudgetCompressor whose report adds up the stages' reports;
+// stages that are plain Compressors count as having dropped whatever they
+// removed.
+type Chain struct {
+	Tokenizer tokenizer.Tokenizer
+	Stages    []NamedStage
+}
+
+// Compress runs the chain as if nothing else shared the budget.
+func (c *Chain) Compress(messages []Message) []Message {
+	out, _, _ := c.CompressStages(messages, 0)
+	return out
+}
+
+// CompressWithin runs the chain with reservedTokens passed to every stage.
+func (c *Chain) CompressWithin(messages []Message, reservedTokens int) ([]Message, CompressionReport) {
+	out, report, _ := c.CompressStages(messages, reservedTokens)
+	return out, report
+}
+
+// CompressStages is CompressWithin that also reports every stage.
+func (c *Chain) CompressStages(messages []Message, reservedTokens int) ([]Message, CompressionReport, []StageReport) {
+	var total CompressionReport
+	stages := make([]StageReport, 0, len(c.Stages))
+	for _, st := range c.Stages {
+		sr := StageReport{Name: st.Name, InCount: len(messages), InTokens: CountTokens(c.Tokenizer, messages)}
+		if bc, ok := st.Compressor.(BudgetCompressor); ok {
+			messages, sr.Report = bc.CompressWithin(messages, reservedTokens)
+		} else {
+			messages = st.Compress(messages)
+		}
+		sr.OutCount, sr.OutTokens = len(messages), CountTokens(c.Tokenizer, messages)
+		if _, ok := st.Compressor.(BudgetCompressor); !ok && sr.OutCount < sr.InCount {
+			sr.Report.DroppedMessages = sr.InCount - sr.OutCount
+			sr.Report.DroppedTokens = max(sr.InTokens-sr.OutTokens, 0)
+		}
+		if sr.Report.BudgetTokens > 0 {
+			total.BudgetTokens = sr.Report.BudgetTokens
+			total.HistoryBudgetTokens = sr.Report.HistoryBudgetTokens
+		}
+		total.DroppedMessages += sr.Report.DroppedMessages
+		total.DroppedTokens += sr.Report.DroppedTokens
+		total.TruncatedMessages += sr.Report.TruncatedMessages
+		total.TruncatedTokens += sr.Report.TruncatedTokens
+		total.ElidedMessages += sr.Report.ElidedMessages
+		total.ElidedTokens += sr.Report.ElidedTokens
+		stages = append(stages, sr)
+	}
+	total.KeptTokens = CountTokens(c.Tokenizer, messages)
+	return messages, total, stages
+}
+
+// StageFactory builds a fresh stage.
+type StageFactory func() (Compressor, error)
+
+// StageRegistry maps stage names to the factories that build them, so a
+// chain can be described by a list of names in configuration.
+type StageRegistry struct {
+	factories map[string]StageFactory
+}
+
+func NewStageRegistry() *StageRegistry {
+	return &StageRegistry{factories: map[string]StageFactory{}}
+}
+
+func (r *StageRegistry) Register(name string, f StageFactory) error {
+	name = strings.TrimSpace(name)
+	if name == "" {
+		return fmt.Errorf("stage name is empty")
+	}
+	if f == nil {
+		return fmt.Errorf("stage factory is nil: %s", name)
+	}
+	if _, exists := r.factories[name]; exists {
+		return fmt.Errorf("stage already registered: %s", name)
+	}
+	r.factories[name] = f
+	return nil
+}
+
+// Names returns the registered stage names, sorted.
+func (r *StageRegistry) Names() []string {
+	names := make([]string, 0, len(r.factories))
+	for name := range r.factories {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	return names
+}
+
+// Chain builds a Chain of the named stages in the given order.
+func (r *StageRegistry) Chain(tok tokenizer.Tokenizer, names []string) (*Chain, error) {
+	if len(names) == 0 {
+		return nil, fmt.Errorf("context chain has no stages")
+	}
+	chain := &Chain{Tokenizer: tok}
+	for _, name := range names {
+		f, ok := r.factories[name]
+		if !ok {
+			return nil, fmt.Errorf("unknown context stage %q (known: %s)", name, strings.Join(r.Names(), ", "))
+		}
+		stage, err := f()
+		if err != nil {
+			return nil, fmt.Errorf("context stage %s: %w", name, err)
+		}
+		chain.Stages = append(chain.Stages, NamedStage{Name: name, Compressor: stage})
+	}
+	return chain, nil
+}
@@ -0,0 +1,92 @@
+package context
+
+import (
+	"strings"
+	"testing"
+)
+
+func TestDeduper_DropsRepeatsAndRetrievedDuplicates(t *testing.T) {
+	d := &Deduper{Tokenizer: wordTokenizer{}}
+	msgs := []Message{
+		{Role: "user", Content: "deploy plan", Retrieved: true},
+		{Role: "user", Content: "old question", Retrieved: true},
+		{Role: "user", Content: "deploy plan"},
+		{Role: "user", Content: "deploy plan"},
+		{Role: "assistant", Content: "ok"},
+		{Role: "tool", ToolCallID: "c1", Content: "ok"},
+		{Role: "tool", ToolCallID: "c2", Content: "ok"},
+	}
+	got, report := d.CompressWithin(msgs, 0)
+	if len(got) != 5 || got[0].Content != "old question" || got[1].Content != "deploy plan" || got[1].Retrieved {
+		t.Fatalf("unexpected messages %+v", got)
+	}
+	if report.DroppedMessages != 2 || report.DroppedTokens != 10 {
+		t.Fatalf("unexpected report %+v", report)
+	}
+}
+
+func TestLongMessageTruncator(t *testing.T) {
+	tr := &LongMessageTruncator{Tokenizer: wordTokenizer{}, MaxTokens: 10}
+	got, report := tr.CompressWithin([]Message{{Role: "user", Content: words(50)}, {Role: "assistant", Content: "hi"}}, 0)
+	if !strings.HasSuffix(got[0].Content, TruncationMarker) || MessageTokens(wordTokenizer{}, got[0]) > 10 || got[1].Content != "hi" {
+		t.Fatalf("unexpected messages %+v", got)
+	}
+	if report.TruncatedMessages != 1 || report.TruncatedTokens != 53-MessageTokens(wordTokenizer{}, got[0]) {
+		t.Fatalf("unexpected report %+v", report)
+	}
+}
+
+func TestStageRegistry_ChainReportsEveryStage(t *testing.T) {
+	r := NewStageRegistry()
+	for name, f := range map[string]StageFactory{
+		"dedupe": func() (Compressor, error) { return &Deduper{Tokenizer: wordTokenizer{}}, nil },
+		"window": func() (Compressor, error) { return &SimpleCompressor{MaxMessages: 3}, nil },
+		"token_budget": func() (Compressor, error) {
+			return &TokenBudgetCompressor{Tokenizer: wordTokenizer{}, BudgetTokens: 12}, nil
+		},
+	} {
+		if err := r.Register(name, f); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if err := r.Register("window", func() (Compressor, error) { return nil, nil }); err == nil {
+		t.Fatal("expected duplicate registration to fail")
+	}
+	if _, err := r.Chain(wordTokenizer{}, []string{"dedupe", "bogus"}); err == nil || !strings.Contains(err.Error(), "known: dedupe, token_budget, window") {
+		t.Fatalf("expected unknown stage error listing known stages, got %v", err)
+	}
+
+	chain, err := r.Chain(wordTokenizer{}, []string{"dedupe", "window", "token_budget"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	msgs := []Message{
+		{Role: "user", Content: "a"},
+		{Role: "assistant", Content: "b"},
+		{Role: "user", Content: "c"},
+		{Role: "user", Content: "c"},
+		{Role: "assistant", Content: "d"},
+		{Role: "user", Content: "e"},
+	}
+	got, report, stages := chain.CompressStages(msgs, 4)
+	if len(got) != 2 || got[0].Content != "d" || got[1].Content != "e" {
+		t.Fatalf("unexpected messages %+v", got)
+	}
+	want := []StageReport{
+		{Name: "dedupe", InCount: 6, OutCount: 5, InTokens: 24, OutTokens: 20, Report: CompressionReport{KeptTokens: 20, DroppedMessages: 1, DroppedTokens: 4}},
+		{Name: "window", InCount: 5, OutCount: 3, InTokens: 20, OutTokens: 12, Report: CompressionReport{DroppedMessages: 2, DroppedTokens: 8}},
+		{Name: "token_budget", InCount: 3, OutCount: 2, InTokens: 12, OutTokens: 8, Report: CompressionReport{BudgetTokens: 12, HistoryBudgetTokens: 8, KeptTokens: 8, DroppedMessages: 1, DroppedTokens: 4}},
+	}
+	if len(stages) != len(want) {
+		t.Fatalf("expected %d stage reports, got %+v", len(want), stages)
+	}
+	for i := range want {
+		if stages[i] != want[i] {
+			t.Fatalf("stage %d: got %+v, want %+v", i, stages[i], want[i])
+		}
+	}
+	total := CompressionReport{BudgetTokens: 12, HistoryBudgetTokens: 8, KeptTokens: 8, DroppedMessages: 4, DroppedTokens: 16}
+	if report != total {
+		t.Fatalf("unexpected total %+v, want %+v", report, total)
+	}
+}
@@ -1,16 +1,53 @@
 package context
 
+import "context"
+
 // Provider retrieves conversation history from a persistent store.
 type Provider interface {
 	GetHistory(chatID int64, limit int) ([]Message, error)
 }
 
+// QueryProvider is a Provider that also returns older messages relevant to
+// the incoming user text, marked Retrieved and placed before the recent
+// window.
+type QueryProvider interface {
+	Provider
+	GetHistoryFor(ctx context.Context, chatID int64, limit int, query string) ([]Message, error)
+}
+
 // Compressor reduces a list of messages to fit within constraints.
 type Compressor interface {
 	Compress(messages []Message) []Message
 }
 
+// SystemInjector contributes an extra system message for the incoming user
+// message, such as a repository map. It returns "" to contribute nothing.
+type SystemInjector interface {
+	SystemMessage(userMsg string) string
+}
+
 // Assembler combines system prompt, history, and user message into a final message list.
 type Assembler interface {
 	Assemble(system string, history []Message, userMsg string) []Message
 }
+
+// BudgetCompressor is a Compressor that fits history into a token budget
+// shared with the rest of the prompt. reservedTokens is what the system
+// prompt, tool instruction and user message already use.
+type BudgetCompressor interface {
+	Compressor
+	CompressWithin(messages []Message, reservedTokens int) ([]Message, CompressionReport)
+}
+
+// CompressionReport describes what a BudgetCompressor removed.
+type CompressionReport struct {
+	BudgetTokens        int
+	HistoryBudgetTokens int
+	KeptTokens          int
+	DroppedMessages     int
+	DroppedTokens       int
+	TruncatedMessages   int
+	TruncatedTokens     int
+	ElidedMessages      int
+	ElidedTokens        int
+}
@@ -1,7 +1,27 @@
 package context
 
+import "encoding/json"
+
 // Message is a model-agnostic chat message used across the context pipeline.
+//
+// Assistant messages may carry ToolCalls requested by the model; the matching
+// results are sent back as Role "tool" messages with ToolCallID set.
+//
+// HistoryID is the id of the history row a message was loaded from, zero for
+// messages built for the current task. Retrieved marks older messages found
+// by relevance rather than recency. Providers send neither.
 type Message struct {
-	Role    string
-	Content string
+	Role       string
+	Content    string
+	ToolCalls  []ToolCall
+	ToolCallID string
+	HistoryID  int64
+	Retrieved  bool
+}
+
+// ToolCall is a provider-neutral tool invocation requested by the model.
+type ToolCall struct {
+	ID        string          `json:"id,omitempty"`
+	Name      string          `json:"name"`
+	Arguments json.RawMessage `json:"arguments"`
 }
@@ -1,18 +1,26 @@
 package context
 
-import "database/sql"
+import (
+	"database/sql"
+	"encoding/json"
+)
 
 // SQLiteProvider reads conversation history from a SQLite database.
 type SQLiteProvider struct {
 	DB *sql.DB
 }
 
-// GetHistory returns the most recent `limit` messages for the given chat,
-// ordered chronologically (oldest first).
+// GetHistory returns the most recent `limit` messages of the chat's active
+// session, ordered chronologically (oldest first). A chat without sessions
+// reads the history written before sessions existed. Assistant tool calls and tool
+// results are returned in their own roles; callers repair or flatten them
+// for the provider in use.
 func (p *SQLiteProvider) GetHistory(chatID int64, limit int) ([]Message, error) {
 	rows, err := p.DB.Query(
-		"SELECT role, text FROM history WHERE chat_id = ? ORDER BY id DESC LIMIT ?",
-		chatID, limit,
+		`SELECT id, role, text, tool_calls, tool_call_id FROM history
+		  WHERE chat_id = ? AND session_id IS (SELECT session_id FROM active_sessions WHERE chat_id = ?)
+		  ORDER BY id DESC LIMIT ?`,
+		chatID, chatID, limit,
 	)
 	if err != nil {
 		return nil, err
@@ -21,15 +29,26 @@ func (p *SQLiteProvider) GetHistory(chatID int64, limit int) ([]Message, error)
 
 	var results []Message
 	for rows.Next() {
+		var id int64
 		var role, text string
-		if err := rows.Scan(&role, &text); err != nil {
+		var toolCalls, toolCallID sql.NullString
+		if err := rows.Scan(&id, &role, &text, &toolCalls, &toolCallID); err != nil {
 			continue
 		}
-		mapped := "user"
-		if role == "assistant" {
-			mapped = "assistant"
+		msg := Message{Role: "user", Content: text, HistoryID: id}
+		switch role {
+		case "assistant":
+			msg.Role = "assistant"
+			if toolCalls.String != "" {
+				if err := json.Unmarshal([]byte(toolCalls.String), &msg.ToolCalls); err != nil {
+					msg.ToolCalls = nil
+				}
+			}
+		case "tool":
+			msg.Role = "tool"
+			msg.ToolCallID = toolCallID.String
 		}
-		results = append(results, Message{Role: mapped, Content: text})
+		results = append(results, msg)
 	}
 
 	// Reverse to chronological order.
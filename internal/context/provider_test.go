@@ -17,7 +17,14 @@ func setupTestDB(t *testing.T) *sql.DB {
 		id INTEGER PRIMARY KEY AUTOINCREMENT,
 		chat_id INTEGER NOT NULL,
 		role TEXT NOT NULL,
-		text TEXT NOT NULL
+		text TEXT NOT NULL,
+		tool_calls TEXT,
+		tool_call_id TEXT,
+		session_id INTEGER
+	);
+	CREATE TABLE active_sessions (
+		chat_id INTEGER PRIMARY KEY,
+		session_id INTEGER NOT NULL
 	)`)
 	if err != nil {
 		t.Fatal(err)
@@ -61,6 +68,9 @@ func TestSQLiteProvider_GetHistory(t *testing.T) {
 	if msgs[2].Content != "how are you" {
 		t.Errorf("expected third message 'how are you', got %q", msgs[2].Content)
 	}
+	if msgs[0].HistoryID != 1 || msgs[2].HistoryID != 3 {
+		t.Errorf("expected history ids 1..3, got %d and %d", msgs[0].HistoryID, msgs[2].HistoryID)
+	}
 }
 
 func TestSQLiteProvider_GetHistory_Limit(t *testing.T) {
@@ -104,3 +114,60 @@ func TestSQLiteProvider_GetHistory_Empty(t *testing.T) {
 		t.Fatalf("expected 0 messages, got %d", len(msgs))
 	}
 }
+
+func TestSQLiteProvider_GetHistory_ToolTurns(t *testing.T) {
+	db := setupTestDB(t)
+	defer db.Close()
+
+	insertHistory(t, db, 1, "user", "list files")
+	if _, err := db.Exec(`INSERT INTO history (chat_id, role, text, tool_calls) VALUES (1, 'assistant', '', ?)`,
+		`[{"id":"call_1","name":"ls","arguments":{"path":"."}}]`); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := db.Exec(`INSERT INTO history (chat_id, role, text, tool_call_id) VALUES (1, 'tool', 'a.go', 'call_1')`); err != nil {
+		t.Fatal(err)
+	}
+	insertHistory(t, db, 1, "assistant", "a.go")
+
+	msgs, err := (&SQLiteProvider{DB: db}).GetHistory(1, 10)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(msgs) != 4 {
+		t.Fatalf("expected 4 messages, got %d", len(msgs))
+	}
+	call := msgs[1]
+	if call.Role != "assistant" || len(call.ToolCalls) != 1 || call.ToolCalls[0].ID != "call_1" || string(call.ToolCalls[0].Arguments) != `{"path":"."}` {
+		t.Errorf("unexpected tool call message: %+v", call)
+	}
+	if msgs[2].Role != "tool" || msgs[2].ToolCallID != "call_1" || msgs[2].Content != "a.go" {
+		t.Errorf("unexpected tool result message: %+v", msgs[2])
+	}
+}
+
+func TestSQLiteProvider_GetHistory_ActiveSession(t *testing.T) {
+	db := setupTestDB(t)
+	defer db.Close()
+
+	for _, row := range []struct {
+		session any
+		text    string
+	}{{nil, "before sessions"}, {1, "first session"}, {2, "second session"}} {
+		if _, err := db.Exec("INSERT INTO history (chat_id, session_id, role, text) VALUES (1, ?, 'user', ?)", row.session, row.text); err != nil {
+			t.Fatal(err)
+		}
+	}
+	p := &SQLiteProvider{DB: db}
+
+	msgs, err := p.GetHistory(1, 10)
+	if err != nil || len(msgs) != 1 || msgs[0].Content != "before sessions" {
+		t.Fatalf("expected only sessionless history without an active session, got %+v err=%v", msgs, err)
+	}
+	if _, err := db.Exec("INSERT INTO active_sessions (chat_id, session_id) VALUES (1, 1)"); err != nil {
+		t.Fatal(err)
+	}
+	msgs, err = p.GetHistory(1, 10)
+	if err != nil || len(msgs) != 1 || msgs[0].Content != "first session" {
+		t.Fatalf("expected the active session's history, got %+v err=%v", msgs, err)
+	}
+}
@@ -0,0 +1,114 @@
+package context
+
+import (
+	"context"
+	"database/sql"
+	"sort"
+	"strings"
+	"unicode"
+)
+
+// maxQueryTerms bounds the FTS query built from one user message.
+const maxQueryTerms = 64
+
+// FTSProvider returns the recent history window plus up to TopK older
+// messages that match the incoming user text in the history_fts index.
+type FTSProvider struct {
+	DB   *sql.DB
+	TopK int
+}
+
+// GetHistory returns the recent window only.
+func (p *FTSProvider) GetHistory(chatID int64, limit int) ([]Message, error) {
+	return (&SQLiteProvider{DB: p.DB}).GetHistory(chatID, limit)
+}
+
+// GetHistoryFor returns the recent window preceded by the TopK best matches
+// for query among older user and assistant messages of the chat's active
+// session, oldest first. Other sessions are never searched.
+func (p *FTSProvider) GetHistoryFor(ctx context.Context, chatID int64, limit int, query string) ([]Message, error) {
+	recent, err := p.GetHistory(chatID, limit)
+	if err != nil || len(recent) == 0 || p.TopK <= 0 {
+		return recent, err
+	}
+	match := FTSQuery(query)
+	if match == "" {
+		return recent, nil
+	}
+	rows, err := p.DB.QueryContext(ctx,
+		`SELECT h.id, h.role, h.text FROM history_fts
+		 JOIN history h ON h.id = history_fts.rowid
+		 WHERE history_fts MATCH ? AND h.chat_id = ? AND h.id < ?
+		   AND h.session_id IS (SELECT session_id FROM active_sessions WHERE chat_id = ?)
+		   AND h.role IN ('user', 'assistant') AND h.text != '' AND h.tool_calls IS NULL
+		 ORDER BY bm25(history_fts) LIMIT ?`,
+		match, chatID, recent[0].HistoryID, chatID, p.TopK,
+	)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	var retrieved []Message
+	for rows.Next() {
+		msg := Message{Retrieved: true}
+		if err := rows.Scan(&msg.HistoryID, &msg.Role, &msg.Content); err != nil {
+			return nil, err
+		}
+		retrieved = append(retrieved, msg)
+	}
+	if err := rows.Err(); err != nil {
+		return nil, err
+	}
+	sort.Slice(retrieved, func(i, j int) bool { return retrieved[i].HistoryID < retrieved[j].HistoryID })
+	return append(retrieved, recent...), nil
+}
+
+// FTSQuery turns user text into an FTS5 query for the trigram index: words
+// of three or more characters are matched whole, and runs of CJK characters,
+// which have no spaces to split on, contribute every three-character window.
+// Terms are ORed so bm25 ranks rows by how many they contain. It returns ""
+// when the text has nothing searchable.
+func FTSQuery(text string) string {
+	var terms []string
+	seen := map[string]bool{}
+	add := func(term string) {
+		term = strings.ToLower(term)
+		if len(terms) < maxQueryTerms && !seen[term] {
+			seen[term] = true
+			terms = append(terms, `"`+strings.ReplaceAll(term, `"`, `""`)+`"`)
+		}
+	}
+	flush := func(run []rune, cjk bool) {
+		switch {
+		case len(run) < 3:
+		case cjk:
+			for i := 0; i+3 <= len(run); i++ {
+				add(string(run[i : i+3]))
+			}
+		default:
+			add(string(run))
+		}
+	}
+
+	var run []rune
+	runCJK := false
+	for _, r := range text {
+		cjk := isCJK(r)
+		word := cjk || unicode.IsLetter(r) || unicode.IsDigit(r) || r == '_'
+		if !word || (len(run) > 0 && cjk != runCJK) {
+			flush(run, runCJK)
+			run = run[:0]
+		}
+		if word {
+			run = append(run, r)
+			runCJK = cjk
+		}
+	}
+	flush(run, runCJK)
+	return strings.Join(terms, " OR ")
+}
+
+func isCJK(r rune) bool {
+	return unicode.In(r, unicode.Han, unicode.Hiragana, unicode.Katakana, unicode.Hangul)
+}
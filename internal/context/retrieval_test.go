@@ -0,0 +1,94 @@
+package context
+
+import (
+	"context"
+	"database/sql"
+	"fmt"
+	"testing"
+
+	"github.com/stupiduntilnot/autonous/internal/db"
+)
+
+func TestFTSQuery(t *testing.T) {
+	cases := map[string]string{
+		"":                         "",
+		"hi ok":                    "",
+		`Use the "Redis" cache`:    `"use" OR "the" OR "redis" OR "cache"`,
+		"数据库迁移":                    `"数据库" OR "据库迁" OR "库迁移"`,
+		"上次说的 sqlite 方案":           `"上次说" OR "次说的" OR "sqlite"`,
+		"the THE the":              `"the"`,
+		"snake_case_name, v2.1.0!": `"snake_case_name"`,
+	}
+	for in, want := range cases {
+		if got := FTSQuery(in); got != want {
+			t.Errorf("FTSQuery(%q) = %s, want %s", in, got, want)
+		}
+	}
+}
+
+func ftsDB(t *testing.T) *sql.DB {
+	t.Helper()
+	database, err := db.OpenDB(t.TempDir() + "/fts.db")
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { _ = database.Close() })
+	if err := db.InitSchema(database); err != nil {
+		t.Fatal(err)
+	}
+	if enabled, err := db.HistoryFTSEnabled(database); err != nil || !enabled {
+		t.Skip("go-sqlite3 built without the sqlite_fts5 tag")
+	}
+	return database
+}
+
+func TestFTSProvider_GetHistoryFor(t *testing.T) {
+	database := ftsDB(t)
+	insertHistory(t, database, 1, "user", "我们决定用 PostgreSQL 做主数据库")
+	insertHistory(t, database, 1, "assistant", "好的，记下了 PostgreSQL")
+	insertHistory(t, database, 2, "user", "PostgreSQL in another chat")
+	for i := 0; i < 6; i++ {
+		insertHistory(t, database, 1, "user", fmt.Sprintf("闲聊 %d", i))
+	}
+
+	p := &FTSProvider{DB: database, TopK: 1}
+	msgs, err := p.GetHistoryFor(context.Background(), 1, 4, "之前定的 postgresql 配置呢")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(msgs) != 5 {
+		t.Fatalf("expected 1 retrieved plus 4 recent messages, got %+v", msgs)
+	}
+	if !msgs[0].Retrieved || msgs[0].HistoryID > 2 {
+		t.Fatalf("expected an older matching message first, got %+v", msgs[0])
+	}
+	for _, m := range msgs[1:] {
+		if m.Retrieved {
+			t.Fatalf("expected recent messages unmarked, got %+v", m)
+		}
+	}
+
+	// Matches already inside the recent window are not repeated.
+	msgs, err = p.GetHistoryFor(context.Background(), 1, 20, "postgresql")
+	if err != nil || len(msgs) != 8 {
+		t.Fatalf("expected the full window without duplicates, got %d err=%v", len(msgs), err)
+	}
+	msgs, err = p.GetHistoryFor(context.Background(), 1, 4, "ok")
+	if err != nil || len(msgs) != 4 {
+		t.Fatalf("expected no retrieval for an unsearchable query, got %d err=%v", len(msgs), err)
+	}
+
+	// A new session recalls nothing from the ones before it.
+	if _, err := db.NewSession(database, 1); err != nil {
+		t.Fatal(err)
+	}
+	for i := 0; i < 6; i++ {
+		if err := db.AppendHistory(database, 1, "user", fmt.Sprintf("新话题 %d", i), nil, nil); err != nil {
+			t.Fatal(err)
+		}
+	}
+	msgs, err = p.GetHistoryFor(context.Background(), 1, 4, "postgresql")
+	if err != nil || len(msgs) != 4 || msgs[0].Retrieved {
+		t.Fatalf("expected only the new session's recent window, got %+v err=%v", msgs, err)
+	}
+}
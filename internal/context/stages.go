@@ -0,0 +1,78 @@
+package context
+
+import "github.com/stupiduntilnot/autonous/internal/tokenizer"
+
+// Deduper drops repeated messages: a message with the same role and content
+// as the one kept before it, such as a user message resent after a failed
+// task, and a retrieved message that duplicates one already in history.
+// Messages that carry or answer tool calls are always kept.
+type Deduper struct {
+	Tokenizer tokenizer.Tokenizer
+}
+
+// Compress drops duplicates.
+func (d *Deduper) Compress(messages []Message) []Message {
+	out, _ := d.CompressWithin(messages, 0)
+	return out
+}
+
+// CompressWithin drops duplicates and reports them as dropped.
+func (d *Deduper) CompressWithin(messages []Message, _ int) ([]Message, CompressionReport) {
+	var report CompressionReport
+	type key struct{ role, content string }
+	recent := map[key]bool{}
+	for _, msg := range messages {
+		if !msg.Retrieved {
+			recent[key{msg.Role, msg.Content}] = true
+		}
+	}
+	out := make([]Message, 0, len(messages))
+	for _, msg := range messages {
+		plain := len(msg.ToolCalls) == 0 && msg.ToolCallID == ""
+		repeat := len(out) > 0 && out[len(out)-1].Role == msg.Role && out[len(out)-1].Content == msg.Content
+		if plain && (repeat || (msg.Retrieved && recent[key{msg.Role, msg.Content}])) {
+			report.DroppedMessages++
+			report.DroppedTokens += MessageTokens(d.Tokenizer, msg)
+			continue
+		}
+		out = append(out, msg)
+	}
+	report.KeptTokens = CountTokens(d.Tokenizer, out)
+	return out, report
+}
+
+// LongMessageTruncator cuts every message larger than MaxTokens down to it,
+// ending the content with TruncationMarker. Zero disables it.
+type LongMessageTruncator struct {
+	Tokenizer tokenizer.Tokenizer
+	MaxTokens int
+}
+
+// Compress truncates long messages.
+func (t *LongMessageTruncator) Compress(messages []Message) []Message {
+	out, _ := t.CompressWithin(messages, 0)
+	return out
+}
+
+// CompressWithin truncates long messages and reports them as truncated.
+func (t *LongMessageTruncator) CompressWithin(messages []Message, _ int) ([]Message, CompressionReport) {
+	var report CompressionReport
+	out := make([]Message, len(messages))
+	for i, msg := range messages {
+		out[i] = msg
+		if t.MaxTokens <= 0 {
+			continue
+		}
+		tokens := MessageTokens(t.Tokenizer, msg)
+		if tokens <= t.MaxTokens {
+			continue
+		}
+		if cut, ok := truncateMessage(t.Tokenizer, msg, t.MaxTokens); ok {
+			out[i] = cut
+			report.TruncatedMessages++
+			report.TruncatedTokens += tokens - MessageTokens(t.Tokenizer, cut)
+		}
+	}
+	report.KeptTokens = CountTokens(t.Tokenizer, out)
+	return out, report
+}
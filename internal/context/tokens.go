@@ -0,0 +1,26 @@
+package context
+
+import "github.com/stupiduntilnot/autonous/internal/tokenizer"
+
+// messageOverhead approximates the tokens OpenAI's chat format spends framing
+// each message (role and separators).
+const messageOverhead = 3
+
+// MessageTokens returns the tokens msg costs in a prompt: its content, any
+// tool call names and arguments, and the per-message framing.
+func MessageTokens(tok tokenizer.Tokenizer, msg Message) int {
+	n := messageOverhead + tok.Count(msg.Content)
+	for _, call := range msg.ToolCalls {
+		n += tok.Count(call.Name) + tok.Count(string(call.Arguments))
+	}
+	return n
+}
+
+// CountTokens returns the summed MessageTokens of messages.
+func CountTokens(tok tokenizer.Tokenizer, messages []Message) int {
+	total := 0
+	for _, msg := range messages {
+		total += MessageTokens(tok, msg)
+	}
+	return total
+}
@@ -0,0 +1,28 @@
+package context
+
+import (
+	"strings"
+	"testing"
+)
+
+// wordTokenizer counts whitespace-separated words.
+type wordTokenizer struct{}
+
+func (wordTokenizer) Name() string             { return "words" }
+func (wordTokenizer) Encode(text string) []int { return make([]int, len(strings.Fields(text))) }
+func (wordTokenizer) Count(text string) int    { return len(strings.Fields(text)) }
+
+func TestCountTokens_IncludesToolCallsAndFraming(t *testing.T) {
+	msgs := []Message{
+		{Role: "user", Content: "list the files"},
+		{Role: "assistant", ToolCalls: []ToolCall{{Name: "ls", Arguments: []byte(`{"path": "."}`)}}},
+		{Role: "tool", ToolCallID: "c1", Content: "a.go b.go"},
+	}
+	want := (3 + 3) + (3 + 1 + 2) + (3 + 2)
+	if got := CountTokens(wordTokenizer{}, msgs); got != want {
+		t.Fatalf("expected %d tokens, got %d", want, got)
+	}
+	if got := CountTokens(wordTokenizer{}, nil); got != 0 {
+		t.Fatalf("expected 0 tokens for no messages, got %d", got)
+	}
+}
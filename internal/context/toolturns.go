@@ -0,0 +1,124 @@
+package context
+
+import (
+	"fmt"
+	"strings"
+	"unicode/utf8"
+)
+
+// ElidedToolOutput replaces the content of a tool result a compressor chose
+// to leave out. The result message itself stays so the call it answers is
+// still well formed.
+const ElidedToolOutput = "[tool output elided]"
+
+// MissingToolOutput answers a stored tool call whose result was not kept.
+const MissingToolOutput = "[no tool output recorded]"
+
+// CapToolOutput shortens s to at most maxBytes, keeping its head and tail
+// around a marker stating how much was cut. maxBytes <= 0 leaves s as is.
+func CapToolOutput(s string, maxBytes int) string {
+	if maxBytes <= 0 || len(s) <= maxBytes {
+		return s
+	}
+	marker := fmt.Sprintf("\n…[%d bytes omitted]…\n", len(s)-maxBytes)
+	keep := maxBytes - len(marker)
+	if keep <= 0 {
+		return validPrefix(s, maxBytes)
+	}
+	head := validPrefix(s, keep*2/3)
+	tail := validSuffix(s, keep-len(head))
+	return head + marker + tail
+}
+
+func validPrefix(s string, n int) string {
+	for n > 0 && n < len(s) && !utf8.RuneStart(s[n]) {
+		n--
+	}
+	return s[:n]
+}
+
+func validSuffix(s string, n int) string {
+	start := len(s) - n
+	for start < len(s) && !utf8.RuneStart(s[start]) {
+		start++
+	}
+	return s[start:]
+}
+
+// RepairToolTurns makes stored history valid for providers with native tool
+// calling: tool results must directly follow the assistant message that
+// requested them, and every requested call needs a result. Results whose
+// call is not in view (for example cut off by the history window) are
+// dropped and missing results are filled with MissingToolOutput.
+func RepairToolTurns(messages []Message) []Message {
+	out := make([]Message, 0, len(messages))
+	var pending []string
+	answered := map[string]bool{}
+	flush := func() {
+		for _, id := range pending {
+			if !answered[id] {
+				out = append(out, Message{Role: "tool", ToolCallID: id, Content: MissingToolOutput})
+			}
+		}
+		pending, answered = nil, map[string]bool{}
+	}
+	for _, msg := range messages {
+		if msg.Role == "tool" {
+			if !containsString(pending, msg.ToolCallID) || answered[msg.ToolCallID] {
+				continue
+			}
+			answered[msg.ToolCallID] = true
+			out = append(out, msg)
+			continue
+		}
+		flush()
+		out = append(out, msg)
+		for _, call := range msg.ToolCalls {
+			pending = append(pending, call.ID)
+		}
+	}
+	flush()
+	return out
+}
+
+func containsString(list []string, s string) bool {
+	for _, v := range list {
+		if v == s {
+			return true
+		}
+	}
+	return false
+}
+
+// FlattenToolTurns rewrites tool calls and results as plain assistant and
+// user text for providers without native tool calling.
+func FlattenToolTurns(messages []Message) []Message {
+	out := make([]Message, 0, len(messages))
+	names := map[string]string{}
+	for _, msg := range messages {
+		switch {
+		case len(msg.ToolCalls) > 0:
+			var b strings.Builder
+			b.WriteString(msg.Content)
+			for _, call := range msg.ToolCalls {
+				names[call.ID] = call.Name
+				if b.Len() > 0 {
+					b.WriteString("\n")
+				}
+				fmt.Fprintf(&b, "[called tool %s with %s]", call.Name, string(call.Arguments))
+			}
+			out = append(out, Message{Role: "assistant", Content: b.String(), HistoryID: msg.HistoryID})
+		case msg.Role == "tool":
+			content := fmt.Sprintf("[result of tool %s]\n%s", names[msg.ToolCallID], msg.Content)
+			// Consecutive results of one assistant message share a user turn.
+			if n := len(out); n > 0 && out[n-1].Role == "user" && strings.HasPrefix(out[n-1].Content, "[result of tool ") {
+				out[n-1].Content += "\n" + content
+				continue
+			}
+			out = append(out, Message{Role: "user", Content: content, HistoryID: msg.HistoryID})
+		default:
+			out = append(out, msg)
+		}
+	}
+	return out
+}
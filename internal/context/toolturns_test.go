@@ -0,0 +1,70 @@
+package context
+
+import (
+	"strings"
+	"testing"
+	"unicode/utf8"
+)
+
+func TestCapToolOutput(t *testing.T) {
+	if got := CapToolOutput("short", 100); got != "short" {
+		t.Fatalf("expected short output unchanged, got %q", got)
+	}
+	long := strings.Repeat("头", 200) + strings.Repeat("尾", 200)
+	got := CapToolOutput(long, 300)
+	if len(got) > 300 || !utf8.ValidString(got) {
+		t.Fatalf("expected valid UTF-8 within 300 bytes, got %d bytes", len(got))
+	}
+	if !strings.HasPrefix(got, "头") || !strings.HasSuffix(got, "尾") || !strings.Contains(got, "bytes omitted") {
+		t.Fatalf("expected head, marker and tail, got %q", got)
+	}
+	if got := CapToolOutput(long, 0); got != long {
+		t.Fatal("expected 0 to disable capping")
+	}
+}
+
+func TestRepairToolTurns(t *testing.T) {
+	msgs := []Message{
+		{Role: "tool", ToolCallID: "gone", Content: "orphan"},
+		{Role: "user", Content: "q"},
+		{Role: "assistant", ToolCalls: []ToolCall{{ID: "a", Name: "ls"}, {ID: "b", Name: "read"}}},
+		{Role: "tool", ToolCallID: "b", Content: "b out"},
+		{Role: "assistant", Content: "done"},
+	}
+	got := RepairToolTurns(msgs)
+	var parts []string
+	for _, m := range got {
+		parts = append(parts, m.Role+":"+m.ToolCallID+":"+m.Content)
+	}
+	want := "user::q,assistant::,tool:b:b out,tool:a:" + MissingToolOutput + ",assistant::done"
+	if strings.Join(parts, ",") != want {
+		t.Fatalf("unexpected repair\n got %s\nwant %s", strings.Join(parts, ","), want)
+	}
+}
+
+func TestFlattenToolTurns(t *testing.T) {
+	msgs := []Message{
+		{Role: "assistant", Content: "checking", ToolCalls: []ToolCall{
+			{ID: "a", Name: "ls", Arguments: []byte(`{"path":"."}`)},
+			{ID: "b", Name: "read", Arguments: []byte(`{"path":"x"}`)},
+		}},
+		{Role: "tool", ToolCallID: "a", Content: "x"},
+		{Role: "tool", ToolCallID: "b", Content: "hello"},
+		{Role: "assistant", Content: "x says hello"},
+	}
+	got := FlattenToolTurns(msgs)
+	if len(got) != 3 {
+		t.Fatalf("expected call, merged results and reply, got %+v", got)
+	}
+	for _, m := range got {
+		if len(m.ToolCalls) > 0 || m.Role == "tool" {
+			t.Fatalf("expected plain messages only, got %+v", m)
+		}
+	}
+	if !strings.Contains(got[0].Content, `[called tool ls with {"path":"."}]`) {
+		t.Fatalf("unexpected flattened call %q", got[0].Content)
+	}
+	if got[1].Role != "user" || !strings.Contains(got[1].Content, "[result of tool read]\nhello") {
+		t.Fatalf("unexpected flattened results %+v", got[1])
+	}
+}
@@ -1,6 +1,10 @@
 package control
 
-import "time"
+import (
+	"sort"
+	"sync"
+	"time"
+)
 
 type CircuitState string
 
@@ -81,3 +85,215 @@ func (c *CircuitBreaker) RecordFailure(errClass string, now time.Time) {
 func (c *CircuitBreaker) OpenedClass() string {
 	return c.openedClass
 }
+
+func (c *CircuitBreaker) OpenedAt() time.Time {
+	return c.openedAt
+}
+
+// Failures returns the failures of errClass counted toward the threshold.
+func (c *CircuitBreaker) Failures(errClass string) int {
+	return c.failures[errClass]
+}
+
+// Restore puts the breaker back into a previously saved state: failures
+// consecutive failures of errClass and, unless closed, opened at openedAt.
+func (c *CircuitBreaker) Restore(state CircuitState, errClass string, failures int, openedAt time.Time) {
+	c.state = state
+	c.failures = map[string]int{}
+	if failures > 0 {
+		c.failures[errClass] = failures
+	}
+	c.openedClass, c.openedAt = "", time.Time{}
+	if state != CircuitClosed {
+		c.openedClass, c.openedAt = errClass, openedAt
+	}
+}
+
+// BreakerPolicy is the threshold and cooldown of one error class's breaker.
+type BreakerPolicy struct {
+	Threshold int
+	Cooldown  time.Duration
+}
+
+// BreakerSnapshot is the saved state of one breaker.
+type BreakerSnapshot struct {
+	State    CircuitState
+	Failures int
+	OpenedAt time.Time
+}
+
+// BreakerSet keeps a CircuitBreaker per error class, each tripping on its
+// own policy. New work is allowed only while no breaker is open. Its methods
+// are safe for concurrent use.
+type BreakerSet struct {
+	Default  BreakerPolicy
+	Policies map[string]BreakerPolicy
+	// OnChange, if set, is called with the set locked whenever a breaker's
+	// state or failure count changes, so saved state is never stale.
+	OnChange func(errClass string, snap BreakerSnapshot)
+
+	mu       sync.Mutex
+	breakers map[string]*CircuitBreaker
+}
+
+// NewBreakerSet returns a set whose classes use policies, falling back to
+// def for classes without one.
+func NewBreakerSet(def BreakerPolicy, policies map[string]BreakerPolicy) *BreakerSet {
+	return &BreakerSet{Default: def, Policies: policies, breakers: map[string]*CircuitBreaker{}}
+}
+
+// Policy returns the policy of errClass.
+func (s *BreakerSet) Policy(errClass string) BreakerPolicy {
+	if p, ok := s.Policies[errClass]; ok {
+		return p
+	}
+	return s.Default
+}
+
+func (s *BreakerSet) breaker(errClass string) *CircuitBreaker {
+	b, ok := s.breakers[errClass]
+	if !ok {
+		p := s.Policy(errClass)
+		b = NewCircuitBreaker(p.Threshold, p.Cooldown)
+		s.breakers[errClass] = b
+	}
+	return b
+}
+
+func (s *BreakerSet) changed(errClass string) {
+	if s.OnChange != nil {
+		s.OnChange(errClass, s.snapshot(errClass))
+	}
+}
+
+func (s *BreakerSet) snapshot(errClass string) BreakerSnapshot {
+	b, ok := s.breakers[errClass]
+	if !ok {
+		return BreakerSnapshot{State: CircuitClosed}
+	}
+	snap := BreakerSnapshot{State: b.State(), Failures: b.Failures(errClass)}
+	if snap.State != CircuitClosed {
+		snap.OpenedAt = b.OpenedAt()
+	}
+	return snap
+}
+
+func classOrUnknown(errClass string) string {
+	if errClass == "" {
+		return "unknown"
+	}
+	return errClass
+}
+
+// State returns the state of errClass's breaker, closed when it has none.
+func (s *BreakerSet) State(errClass string) CircuitState {
+	return s.Snapshot(errClass).State
+}
+
+// Snapshot returns the state of errClass's breaker.
+func (s *BreakerSet) Snapshot(errClass string) BreakerSnapshot {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	return s.snapshot(classOrUnknown(errClass))
+}
+
+// Restore puts errClass's breaker back into a saved state without calling
+// OnChange.
+func (s *BreakerSet) Restore(errClass string, snap BreakerSnapshot) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	errClass = classOrUnknown(errClass)
+	s.breaker(errClass).Restore(snap.State, errClass, snap.Failures, snap.OpenedAt)
+}
+
+// RecordFailure counts a failure of errClass and reports whether it opened
+// the class's breaker.
+func (s *BreakerSet) RecordFailure(errClass string, now time.Time) (opened bool) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	errClass = classOrUnknown(errClass)
+	b := s.breaker(errClass)
+	prev := b.State()
+	b.RecordFailure(errClass, now)
+	s.changed(errClass)
+	return prev != CircuitOpen && b.State() == CircuitOpen
+}
+
+// RecordSuccess closes errClass's breaker and clears its failures. It
+// returns the state the breaker was in and whether anything changed.
+func (s *BreakerSet) RecordSuccess(errClass string) (prev CircuitState, changed bool) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	errClass = classOrUnknown(errClass)
+	b, ok := s.breakers[errClass]
+	if !ok || (b.State() == CircuitClosed && b.Failures(errClass) == 0) {
+		return CircuitClosed, false
+	}
+	prev = b.State()
+	b.RecordSuccess()
+	s.changed(errClass)
+	return prev, true
+}
+
+// Classes returns the classes that have a breaker, sorted.
+func (s *BreakerSet) Classes() []string {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	return s.classes()
+}
+
+func (s *BreakerSet) classes() []string {
+	out := make([]string, 0, len(s.breakers))
+	for class := range s.breakers {
+		out = append(out, class)
+	}
+	sort.Strings(out)
+	return out
+}
+
+// Allow reports whether new work is allowed at now. Open breakers whose
+// cooldown elapsed move to half-open and are returned in halfOpened.
+func (s *BreakerSet) Allow(now time.Time) (allowed bool, halfOpened []string) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	allowed = true
+	for _, class := range s.classes() {
+		b := s.breakers[class]
+		prev := b.State()
+		if !b.Allow(now) {
+			allowed = false
+			continue
+		}
+		if prev == CircuitOpen && b.State() == CircuitHalfOpen {
+			halfOpened = append(halfOpened, class)
+			s.changed(class)
+		}
+	}
+	return allowed, halfOpened
+}
+
+// HalfOpen reports whether a breaker is half-open, waiting for a single
+// probe to close or reopen it.
+func (s *BreakerSet) HalfOpen() bool {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	for _, b := range s.breakers {
+		if b.State() == CircuitHalfOpen {
+			return true
+		}
+	}
+	return false
+}
+
+// Blocked reports whether an open breaker currently holds back new work,
+// without moving any breaker to half-open.
+func (s *BreakerSet) Blocked(now time.Time) bool {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	for _, b := range s.breakers {
+		if b.State() == CircuitOpen && now.Sub(b.OpenedAt()) < b.Cooldown {
+			return true
+		}
+	}
+	return false
+}
@@ -1,6 +1,7 @@
 package control
 
 import (
+	"sync"
 	"testing"
 	"time"
 )
@@ -38,3 +39,89 @@ func TestCircuitBreaker_StateTransitions(t *testing.T) {
 		t.Fatalf("expected closed after probe success, got %s", c.State())
 	}
 }
+
+func TestBreakerSet_PerClassPolicies(t *testing.T) {
+	s := NewBreakerSet(BreakerPolicy{Threshold: 3, Cooldown: time.Minute}, map[string]BreakerPolicy{
+		"db": {Threshold: 1, Cooldown: 10 * time.Second},
+	})
+	saved := map[string]BreakerSnapshot{}
+	s.OnChange = func(class string, snap BreakerSnapshot) { saved[class] = snap }
+	now := time.Now()
+	s.RecordFailure("provider_api", now)
+	if opened := s.RecordFailure("provider_api", now); opened {
+		t.Fatal("expected provider_api below the default threshold")
+	}
+	if allowed, _ := s.Allow(now); !allowed {
+		t.Fatal("expected work allowed below the default threshold")
+	}
+	if opened := s.RecordFailure("db", now); !opened {
+		t.Fatal("expected db to open after its own threshold")
+	}
+	if s.State("db") != CircuitOpen || s.Snapshot("provider_api").Failures != 2 || s.State("never_failed") != CircuitClosed {
+		t.Fatalf("expected only db open, got db=%s provider_api=%+v", s.State("db"), s.Snapshot("provider_api"))
+	}
+	if saved["db"].State != CircuitOpen || !saved["db"].OpenedAt.Equal(now) || saved["provider_api"].Failures != 2 {
+		t.Fatalf("expected every change passed to OnChange, got %+v", saved)
+	}
+	if allowed, _ := s.Allow(now.Add(5 * time.Second)); allowed || !s.Blocked(now.Add(5*time.Second)) {
+		t.Fatal("expected work blocked while db is open")
+	}
+	if s.Blocked(now.Add(10 * time.Second)) {
+		t.Fatal("expected Blocked to stop once the cooldown ended")
+	}
+	allowed, halfOpened := s.Allow(now.Add(10 * time.Second))
+	if !allowed || len(halfOpened) != 1 || halfOpened[0] != "db" || saved["db"].State != CircuitHalfOpen {
+		t.Fatalf("expected db half-open after its own cooldown, got allowed=%v half=%v", allowed, halfOpened)
+	}
+	if !s.HalfOpen() {
+		t.Fatal("expected HalfOpen while db waits for its probe")
+	}
+	if got := s.Classes(); len(got) != 2 || got[0] != "db" || got[1] != "provider_api" {
+		t.Fatalf("unexpected classes %v", got)
+	}
+	if prev, changed := s.RecordSuccess("db"); !changed || prev != CircuitHalfOpen || saved["db"].State != CircuitClosed {
+		t.Fatalf("expected db closed, got prev=%s changed=%v", prev, changed)
+	}
+	if s.HalfOpen() {
+		t.Fatal("expected HalfOpen to end once the probe closed db")
+	}
+	if _, changed := s.RecordSuccess("db"); changed {
+		t.Fatal("expected no change for a breaker already closed without failures")
+	}
+}
+
+func TestBreakerSet_ConcurrentUse(t *testing.T) {
+	s := NewBreakerSet(BreakerPolicy{Threshold: 1000, Cooldown: time.Minute}, nil)
+	var wg sync.WaitGroup
+	for i := 0; i < 8; i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			for j := 0; j < 100; j++ {
+				s.RecordFailure("db", time.Now())
+				s.Allow(time.Now())
+			}
+		}()
+	}
+	wg.Wait()
+	if got := s.Snapshot("db").Failures; got != 800 {
+		t.Fatalf("expected 800 failures, got %d", got)
+	}
+}
+
+func TestCircuitBreaker_Restore(t *testing.T) {
+	c := NewCircuitBreaker(2, time.Minute)
+	openedAt := time.Now().Add(-30 * time.Second)
+	c.Restore(CircuitOpen, "provider_api", 2, openedAt)
+	if c.Allow(time.Now()) || c.OpenedClass() != "provider_api" || !c.OpenedAt().Equal(openedAt) {
+		t.Fatal("expected a restored open breaker to keep blocking until its cooldown ends")
+	}
+	if !c.Allow(openedAt.Add(time.Minute)) || c.State() != CircuitHalfOpen {
+		t.Fatalf("expected half-open after the cooldown, got %s", c.State())
+	}
+	c.Restore(CircuitClosed, "db", 1, time.Time{})
+	c.RecordFailure("db", time.Now())
+	if c.State() != CircuitOpen {
+		t.Fatal("expected the restored failure count to count toward the threshold")
+	}
+}
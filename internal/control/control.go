@@ -2,6 +2,7 @@ package control
 
 import (
 	"fmt"
+	"math"
 	"time"
 )
 
@@ -11,6 +12,10 @@ type Policy struct {
 	MaxWallTime time.Duration
 	MaxTokens   int
 	MaxRetries  int
+	// MaxDailyCostUSD and MaxMonthlyCostUSD cap model spend across all chats
+	// per UTC day and month. Zero means unlimited.
+	MaxDailyCostUSD   float64
+	MaxMonthlyCostUSD float64
 }
 
 // DefaultPolicy returns the default milestone-3 policy.
@@ -30,16 +35,28 @@ const (
 	LimitTurns    LimitType = "max_turns"
 	LimitWallTime LimitType = "max_wall_time_seconds"
 	LimitTokens   LimitType = "max_tokens"
+	LimitCost     LimitType = "max_cost"
 )
 
-// LimitError indicates a run limit was reached.
+// Cost budget periods reported as LimitError.Period.
+const (
+	PeriodDaily   = "daily"
+	PeriodMonthly = "monthly"
+)
+
+// LimitError indicates a run limit was reached. For max_cost, Value and
+// Threshold are in micro-USD and Period names the budget.
 type LimitError struct {
 	Type      LimitType
 	Value     int64
 	Threshold int64
+	Period    string
 }
 
 func (e *LimitError) Error() string {
+	if e.Period != "" {
+		return fmt.Sprintf("limit reached type=%s period=%s value=%d threshold=%d", e.Type, e.Period, e.Value, e.Threshold)
+	}
 	return fmt.Sprintf("limit reached type=%s value=%d threshold=%d", e.Type, e.Value, e.Threshold)
 }
 
@@ -82,14 +99,41 @@ func CheckTokenLimit(p Policy, usedTokens int) error {
 	return nil
 }
 
-// RetryBackoffSeconds computes exponential backoff with a fixed cap.
-func RetryBackoffSeconds(attempt int) int {
-	if attempt <= 0 {
-		return 0
+// CheckCostBudget validates spend so far today and this month against the
+// policy's budgets. A spend equal to the budget is already over it, since the
+// next task would exceed it.
+func CheckCostBudget(p Policy, dailyUSD, monthlyUSD float64) error {
+	if p.MaxDailyCostUSD > 0 && dailyUSD >= p.MaxDailyCostUSD {
+		return &LimitError{Type: LimitCost, Period: PeriodDaily, Value: microUSD(dailyUSD), Threshold: microUSD(p.MaxDailyCostUSD)}
+	}
+	if p.MaxMonthlyCostUSD > 0 && monthlyUSD >= p.MaxMonthlyCostUSD {
+		return &LimitError{Type: LimitCost, Period: PeriodMonthly, Value: microUSD(monthlyUSD), Threshold: microUSD(p.MaxMonthlyCostUSD)}
+	}
+	return nil
+}
+
+func microUSD(usd float64) int64 {
+	return int64(math.Round(usd * 1e6))
+}
+
+// MaxRetryAfter bounds how long a server-provided Retry-After may delay a retry.
+const MaxRetryAfter = time.Hour
+
+// RetryBackoffSeconds computes exponential backoff with a fixed cap. A
+// server-provided retryAfter wins when it asks for a longer wait.
+func RetryBackoffSeconds(attempt int, retryAfter time.Duration) int {
+	seconds := 0
+	if attempt > 0 {
+		seconds = 1 << min(attempt-1, 5)
+		if seconds > 30 {
+			seconds = 30
+		}
+	}
+	if retryAfter > MaxRetryAfter {
+		retryAfter = MaxRetryAfter
 	}
-	seconds := 1 << (attempt - 1)
-	if seconds > 30 {
-		return 30
+	if hinted := int(math.Ceil(retryAfter.Seconds())); hinted > seconds {
+		return hinted
 	}
 	return seconds
 }
@@ -36,20 +36,44 @@ func TestCheckTokenLimit(t *testing.T) {
 	}
 }
 
+func TestCheckCostBudget(t *testing.T) {
+	p := Policy{MaxDailyCostUSD: 1, MaxMonthlyCostUSD: 10}
+	if err := CheckCostBudget(p, 0.99, 9.5); err != nil {
+		t.Fatalf("unexpected err: %v", err)
+	}
+	err := CheckCostBudget(p, 1.25, 2)
+	limitErr, ok := err.(*LimitError)
+	if !ok || limitErr.Type != LimitCost || limitErr.Period != PeriodDaily || limitErr.Value != 1_250_000 || limitErr.Threshold != 1_000_000 {
+		t.Fatalf("expected daily cost limit, got %v", err)
+	}
+	err = CheckCostBudget(p, 0.5, 10)
+	if limitErr, ok := err.(*LimitError); !ok || limitErr.Period != PeriodMonthly {
+		t.Fatalf("expected monthly cost limit, got %v", err)
+	}
+	if err := CheckCostBudget(Policy{}, 1e6, 1e6); err != nil {
+		t.Fatalf("expected zero budgets to be unlimited, got %v", err)
+	}
+}
+
 func TestRetryBackoffSeconds(t *testing.T) {
 	cases := []struct {
-		attempt int
-		want    int
+		attempt    int
+		retryAfter time.Duration
+		want       int
 	}{
-		{1, 1},
-		{2, 2},
-		{3, 4},
-		{6, 30},
+		{1, 0, 1},
+		{2, 0, 2},
+		{3, 0, 4},
+		{6, 0, 30},
+		{1, 2500 * time.Millisecond, 3},
+		{6, 5 * time.Second, 30},
+		{0, 7 * time.Second, 7},
+		{1, 48 * time.Hour, int(MaxRetryAfter.Seconds())},
 	}
 	for _, c := range cases {
-		got := RetryBackoffSeconds(c.attempt)
+		got := RetryBackoffSeconds(c.attempt, c.retryAfter)
 		if got != c.want {
-			t.Fatalf("attempt=%d got=%d want=%d", c.attempt, got, c.want)
+			t.Fatalf("attempt=%d retry_after=%s got=%d want=%d", c.attempt, c.retryAfter, got, c.want)
 		}
 	}
 }
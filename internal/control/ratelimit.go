@@ -0,0 +1,65 @@
+package control
+
+import (
+	"math"
+	"time"
+)
+
+// RateLimit is a token bucket: PerMinute tokens are added each minute, up to
+// Burst. Zero PerMinute means unlimited.
+type RateLimit struct {
+	PerMinute int
+	Burst     int
+}
+
+type tokenBucket struct {
+	tokens float64
+	last   time.Time
+}
+
+// RateLimiter keeps a token bucket per chat. A chat uses its override when
+// it has one and Default otherwise.
+type RateLimiter struct {
+	Default   RateLimit
+	Overrides map[int64]RateLimit
+
+	buckets map[int64]*tokenBucket
+}
+
+// NewRateLimiter returns a limiter whose buckets start full.
+func NewRateLimiter(def RateLimit, overrides map[int64]RateLimit) *RateLimiter {
+	return &RateLimiter{Default: def, Overrides: overrides, buckets: map[int64]*tokenBucket{}}
+}
+
+// Limit returns the rate limit of chatID.
+func (l *RateLimiter) Limit(chatID int64) RateLimit {
+	if r, ok := l.Overrides[chatID]; ok {
+		return r
+	}
+	return l.Default
+}
+
+// Allow takes a token from chatID's bucket at now. When the bucket is empty
+// it reports false and how long until the next token.
+func (l *RateLimiter) Allow(chatID int64, now time.Time) (bool, time.Duration) {
+	r := l.Limit(chatID)
+	if r.PerMinute <= 0 {
+		return true, 0
+	}
+	burst := float64(max(r.Burst, 1))
+	b, ok := l.buckets[chatID]
+	if !ok {
+		b = &tokenBucket{tokens: burst, last: now}
+		l.buckets[chatID] = b
+	}
+	if elapsed := now.Sub(b.last); elapsed > 0 {
+		b.tokens = math.Min(burst, b.tokens+elapsed.Minutes()*float64(r.PerMinute))
+		b.last = now
+	}
+	if b.tokens >= 1 {
+		b.tokens--
+		return true, 0
+	}
+	wait := time.Duration((1 - b.tokens) / float64(r.PerMinute) * float64(time.Minute))
+	return false, wait
+}
@@ -0,0 +1,36 @@
+package control
+
+import (
+	"testing"
+	"time"
+)
+
+func TestRateLimiter_TokenBucketPerChat(t *testing.T) {
+	l := NewRateLimiter(RateLimit{PerMinute: 6, Burst: 2}, map[int64]RateLimit{
+		7: {PerMinute: 0},
+	})
+	now := time.Unix(1000, 0)
+	for i := 0; i < 2; i++ {
+		if ok, _ := l.Allow(1, now); !ok {
+			t.Fatalf("expected burst message %d allowed", i)
+		}
+	}
+	ok, wait := l.Allow(1, now)
+	if ok || wait != 10*time.Second {
+		t.Fatalf("expected throttled with 10s wait, got ok=%v wait=%s", ok, wait)
+	}
+	if ok, _ := l.Allow(2, now); !ok {
+		t.Fatal("expected another chat to have its own bucket")
+	}
+	if ok, _ := l.Allow(1, now.Add(10*time.Second)); !ok {
+		t.Fatal("expected a token after 10s at 6/min")
+	}
+	if ok, _ := l.Allow(1, now.Add(15*time.Second)); ok {
+		t.Fatal("expected the refilled token to be used up")
+	}
+	for i := 0; i < 100; i++ {
+		if ok, _ := l.Allow(7, now); !ok {
+			t.Fatal("expected the override to make chat 7 unlimited")
+		}
+	}
+}
@@ -0,0 +1,126 @@
+package cost
+
+import (
+	"fmt"
+	"strconv"
+	"strings"
+)
+
+// Price is the USD list price per million input and output tokens.
+type Price struct {
+	InputPerMTok  float64
+	OutputPerMTok float64
+}
+
+// Cost returns the USD cost of a call with the given token counts.
+func (p Price) Cost(inputTokens, outputTokens int) float64 {
+	return (float64(inputTokens)*p.InputPerMTok + float64(outputTokens)*p.OutputPerMTok) / 1e6
+}
+
+// DefaultPrices holds list prices for the models the worker is usually run
+// with. Overrides from configuration take precedence.
+var DefaultPrices = map[string]Price{
+	"gpt-4o-mini":       {InputPerMTok: 0.15, OutputPerMTok: 0.60},
+	"gpt-4o":            {InputPerMTok: 2.50, OutputPerMTok: 10.00},
+	"gpt-4.1":           {InputPerMTok: 2.00, OutputPerMTok: 8.00},
+	"gpt-4.1-mini":      {InputPerMTok: 0.40, OutputPerMTok: 1.60},
+	"gpt-4.1-nano":      {InputPerMTok: 0.10, OutputPerMTok: 0.40},
+	"gpt-5":             {InputPerMTok: 1.25, OutputPerMTok: 10.00},
+	"gpt-5-mini":        {InputPerMTok: 0.25, OutputPerMTok: 2.00},
+	"gpt-5-nano":        {InputPerMTok: 0.05, OutputPerMTok: 0.40},
+	"claude-opus-4-1":   {InputPerMTok: 15.00, OutputPerMTok: 75.00},
+	"claude-sonnet-4-5": {InputPerMTok: 3.00, OutputPerMTok: 15.00},
+	"claude-sonnet-4":   {InputPerMTok: 3.00, OutputPerMTok: 15.00},
+	"claude-haiku-4-5":  {InputPerMTok: 1.00, OutputPerMTok: 5.00},
+	"claude-3-5-haiku":  {InputPerMTok: 0.80, OutputPerMTok: 4.00},
+	"dummy":             {},
+}
+
+// Table resolves model names to prices.
+type Table struct {
+	prices map[string]Price
+}
+
+// NewTable returns DefaultPrices with overrides applied.
+func NewTable(overrides map[string]Price) *Table {
+	prices := make(map[string]Price, len(DefaultPrices)+len(overrides))
+	for name, p := range DefaultPrices {
+		prices[name] = p
+	}
+	for name, p := range overrides {
+		prices[strings.ToLower(name)] = p
+	}
+	return &Table{prices: prices}
+}
+
+// Lookup returns the price of model. Names without an exact entry resolve to
+// the longest listed prefix followed by "-", so dated snapshots such as
+// gpt-4o-mini-2024-07-18 are priced as their family.
+func (t *Table) Lookup(model string) (Price, bool) {
+	name := strings.ToLower(strings.TrimSpace(model))
+	if p, ok := t.prices[name]; ok {
+		return p, true
+	}
+	best := ""
+	for prefix := range t.prices {
+		if len(prefix) > len(best) && strings.HasPrefix(name, prefix+"-") {
+			best = prefix
+		}
+	}
+	if best == "" {
+		return Price{}, false
+	}
+	return t.prices[best], true
+}
+
+// Cost returns the USD cost of a call to model. Unknown models cost 0 and
+// report false.
+func (t *Table) Cost(model string, inputTokens, outputTokens int) (float64, bool) {
+	p, ok := t.Lookup(model)
+	if !ok {
+		return 0, false
+	}
+	return p.Cost(inputTokens, outputTokens), true
+}
+
+// ParseOverrides parses "model=input:output,..." where input and output are
+// USD per million tokens.
+func ParseOverrides(raw string) (map[string]Price, error) {
+	out := map[string]Price{}
+	for _, entry := range strings.Split(raw, ",") {
+		entry = strings.TrimSpace(entry)
+		if entry == "" {
+			continue
+		}
+		name, prices, ok := strings.Cut(entry, "=")
+		name = strings.TrimSpace(name)
+		if !ok || name == "" {
+			return nil, fmt.Errorf("invalid model price %q: want model=input:output", entry)
+		}
+		in, outPrice, ok := strings.Cut(prices, ":")
+		if !ok {
+			return nil, fmt.Errorf("invalid model price %q: want model=input:output", entry)
+		}
+		inUSD, err := parseUSD(in)
+		if err != nil {
+			return nil, fmt.Errorf("invalid input price for %s: %w", name, err)
+		}
+		outUSD, err := parseUSD(outPrice)
+		if err != nil {
+			return nil, fmt.Errorf("invalid output price for %s: %w", name, err)
+		}
+		out[strings.ToLower(name)] = Price{InputPerMTok: inUSD, OutputPerMTok: outUSD}
+	}
+	return out, nil
+}
+
+func parseUSD(raw string) (float64, error) {
+	v, err := strconv.ParseFloat(strings.TrimSpace(raw), 64)
+	if err != nil {
+		return 0, err
+	}
+	if v < 0 {
+		return 0, fmt.Errorf("price must be >= 0")
+	}
+	return v, nil
+}
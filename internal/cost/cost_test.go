@@ -0,0 +1,54 @@
+package cost
+
+import (
+	"math"
+	"testing"
+)
+
+func TestTable_LookupPrefersExactThenLongestPrefix(t *testing.T) {
+	table := NewTable(nil)
+	cases := map[string]Price{
+		"gpt-4o-mini":            DefaultPrices["gpt-4o-mini"],
+		"gpt-4o-mini-2024-07-18": DefaultPrices["gpt-4o-mini"],
+		"gpt-4o-2024-08-06":      DefaultPrices["gpt-4o"],
+		"Claude-Sonnet-4-5":      DefaultPrices["claude-sonnet-4-5"],
+	}
+	for model, want := range cases {
+		got, ok := table.Lookup(model)
+		if !ok || got != want {
+			t.Fatalf("%s: got %+v ok=%v, want %+v", model, got, ok, want)
+		}
+	}
+	if _, ok := table.Lookup("gpt-4omni"); ok {
+		t.Fatal("expected prefix match to require a dash boundary")
+	}
+	if _, ok := table.Lookup("mistral-large"); ok {
+		t.Fatal("expected unknown model")
+	}
+}
+
+func TestTable_Cost(t *testing.T) {
+	table := NewTable(map[string]Price{"GPT-4O-MINI": {InputPerMTok: 1, OutputPerMTok: 2}})
+	usd, ok := table.Cost("gpt-4o-mini", 1_000_000, 500_000)
+	if !ok || math.Abs(usd-2.0) > 1e-9 {
+		t.Fatalf("expected override cost 2.0, got %v ok=%v", usd, ok)
+	}
+	if usd, ok := table.Cost("unknown", 10, 10); ok || usd != 0 {
+		t.Fatalf("expected unknown model to cost 0, got %v ok=%v", usd, ok)
+	}
+}
+
+func TestParseOverrides(t *testing.T) {
+	got, err := ParseOverrides(" my-model = 0.5:1.5 , other=0:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if got["my-model"] != (Price{InputPerMTok: 0.5, OutputPerMTok: 1.5}) || got["other"] != (Price{}) {
+		t.Fatalf("unexpected overrides: %+v", got)
+	}
+	for _, bad := range []string{"model", "model=1", "model=a:1", "model=1:-1", "=1:1"} {
+		if _, err := ParseOverrides(bad); err == nil {
+			t.Fatalf("expected error for %q", bad)
+		}
+	}
+}
@@ -0,0 +1,129 @@
+package db
+
+import (
+	"crypto/sha256"
+	"database/sql"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"fmt"
+)
+
+// ErrBlobNotFound is returned when no blob has the requested hash.
+var ErrBlobNotFound = errors.New("blob not found")
+
+// PromptMessage is one message of a captured model prompt, or the model's
+// reply to one. Tool call arguments are kept as text so that redacted
+// arguments need not stay valid JSON.
+type PromptMessage struct {
+	Role       string           `json:"role"`
+	Content    string           `json:"content"`
+	ToolCallID string           `json:"tool_call_id,omitempty"`
+	ToolCalls  []PromptToolCall `json:"tool_calls,omitempty"`
+}
+
+// PromptToolCall is a tool call requested in a PromptMessage.
+type PromptToolCall struct {
+	ID        string `json:"id,omitempty"`
+	Name      string `json:"name"`
+	Arguments string `json:"arguments"`
+}
+
+// promptManifest is the blob of a prompt: the hashes of its messages, each
+// stored as a blob of its own so that the system prompt and history shared
+// by consecutive turns are stored once.
+type promptManifest struct {
+	Messages []string `json:"messages"`
+}
+
+// PutBlob stores data under the hex sha256 of its content, unless a blob
+// with that hash exists, and returns the hash. exec is a *sql.DB or *sql.Tx.
+func PutBlob(exec sqlExecer, data []byte) (string, error) {
+	sum := sha256.Sum256(data)
+	hash := hex.EncodeToString(sum[:])
+	_, err := exec.Exec(`INSERT OR IGNORE INTO blobs (hash, data, size_bytes) VALUES (?, ?, ?)`, hash, data, len(data))
+	return hash, err
+}
+
+// GetBlob returns the content of the blob with the given hash or
+// ErrBlobNotFound.
+func GetBlob(database *sql.DB, hash string) ([]byte, error) {
+	var data []byte
+	err := database.QueryRow(`SELECT data FROM blobs WHERE hash = ?`, hash).Scan(&data)
+	if errors.Is(err, sql.ErrNoRows) {
+		return nil, ErrBlobNotFound
+	}
+	return data, err
+}
+
+// PutPrompt stores messages and returns the hash of the prompt, which
+// GetPrompt turns back into the same messages.
+func PutPrompt(database *sql.DB, messages []PromptMessage) (string, error) {
+	tx, err := database.Begin()
+	if err != nil {
+		return "", err
+	}
+	defer tx.Rollback()
+	manifest := promptManifest{Messages: make([]string, 0, len(messages))}
+	for _, m := range messages {
+		hash, err := putJSONBlob(tx, m)
+		if err != nil {
+			return "", err
+		}
+		manifest.Messages = append(manifest.Messages, hash)
+	}
+	hash, err := putJSONBlob(tx, manifest)
+	if err != nil {
+		return "", err
+	}
+	return hash, tx.Commit()
+}
+
+// PutPromptMessage stores a single message, such as a model reply, and
+// returns its hash for GetPromptMessage.
+func PutPromptMessage(database *sql.DB, m PromptMessage) (string, error) {
+	return putJSONBlob(database, m)
+}
+
+// GetPrompt returns the messages of a prompt stored with PutPrompt.
+func GetPrompt(database *sql.DB, hash string) ([]PromptMessage, error) {
+	var manifest promptManifest
+	if err := getJSONBlob(database, hash, &manifest); err != nil {
+		return nil, err
+	}
+	out := make([]PromptMessage, 0, len(manifest.Messages))
+	for _, h := range manifest.Messages {
+		m, err := GetPromptMessage(database, h)
+		if err != nil {
+			return nil, err
+		}
+		out = append(out, m)
+	}
+	return out, nil
+}
+
+// GetPromptMessage returns a message stored with PutPromptMessage.
+func GetPromptMessage(database *sql.DB, hash string) (PromptMessage, error) {
+	var m PromptMessage
+	err := getJSONBlob(database, hash, &m)
+	return m, err
+}
+
+func putJSONBlob(exec sqlExecer, v any) (string, error) {
+	data, err := json.Marshal(v)
+	if err != nil {
+		return "", err
+	}
+	return PutBlob(exec, data)
+}
+
+func getJSONBlob(database *sql.DB, hash string, v any) error {
+	data, err := GetBlob(database, hash)
+	if err != nil {
+		return err
+	}
+	if err := json.Unmarshal(data, v); err != nil {
+		return fmt.Errorf("decode blob %s: %w", hash, err)
+	}
+	return nil
+}
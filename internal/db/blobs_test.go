@@ -0,0 +1,77 @@
+package db
+
+import (
+	"errors"
+	"reflect"
+	"testing"
+)
+
+func TestPutBlob_Deduplicates(t *testing.T) {
+	db := testDB(t)
+	first, err := PutBlob(db, []byte("same"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	second, err := PutBlob(db, []byte("same"))
+	if err != nil || second != first {
+		t.Fatalf("expected hash %s again, got %s err=%v", first, second, err)
+	}
+	var n int
+	if err := db.QueryRow(`SELECT COUNT(*) FROM blobs`).Scan(&n); err != nil || n != 1 {
+		t.Fatalf("expected one blob, got %d err=%v", n, err)
+	}
+	data, err := GetBlob(db, first)
+	if err != nil || string(data) != "same" {
+		t.Fatalf("unexpected blob %q err=%v", data, err)
+	}
+	if _, err := GetBlob(db, "missing"); !errors.Is(err, ErrBlobNotFound) {
+		t.Fatalf("expected ErrBlobNotFound, got %v", err)
+	}
+}
+
+func TestPutPrompt_RoundTripSharesMessages(t *testing.T) {
+	db := testDB(t)
+	turn1 := []PromptMessage{
+		{Role: "system", Content: "be brief"},
+		{Role: "user", Content: "list files"},
+	}
+	turn2 := append(append([]PromptMessage(nil), turn1...),
+		PromptMessage{Role: "assistant", ToolCalls: []PromptToolCall{{ID: "c1", Name: "bash", Arguments: `{"cmd":"ls"}`}}},
+		PromptMessage{Role: "tool", ToolCallID: "c1", Content: "a.go"},
+	)
+	h1, err := PutPrompt(db, turn1)
+	if err != nil {
+		t.Fatal(err)
+	}
+	h2, err := PutPrompt(db, turn2)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if h1 == h2 {
+		t.Fatal("different prompts must have different hashes")
+	}
+	got, err := GetPrompt(db, h2)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !reflect.DeepEqual(got, turn2) {
+		t.Fatalf("round trip mismatch:\n got %+v\nwant %+v", got, turn2)
+	}
+	// Four distinct messages plus two manifests.
+	var n int
+	if err := db.QueryRow(`SELECT COUNT(*) FROM blobs`).Scan(&n); err != nil || n != 6 {
+		t.Fatalf("expected 6 blobs, got %d err=%v", n, err)
+	}
+
+	reply := PromptMessage{Role: "assistant", ToolCalls: turn2[2].ToolCalls}
+	h, err := PutPromptMessage(db, reply)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if got, err := GetPromptMessage(db, h); err != nil || !reflect.DeepEqual(got, reply) {
+		t.Fatalf("unexpected reply %+v err=%v", got, err)
+	}
+	if err := db.QueryRow(`SELECT COUNT(*) FROM blobs`).Scan(&n); err != nil || n != 6 {
+		t.Fatalf("a reply repeated in the next prompt must not be stored twice, got %d blobs", n)
+	}
+}
@@ -0,0 +1,44 @@
+package db
+
+import "database/sql"
+
+// BreakerState is the saved state of the circuit breaker of one error
+// class. OpenedAt is 0 while the breaker is closed.
+type BreakerState struct {
+	Class     string
+	State     string
+	Failures  int
+	OpenedAt  int64
+	UpdatedAt int64
+}
+
+// SaveBreakerState stores the state of s.Class's breaker, replacing the
+// previous one; exec is a *sql.DB or *sql.Tx.
+func SaveBreakerState(exec sqlExecer, s BreakerState) error {
+	_, err := exec.Exec(
+		`INSERT INTO circuit_breakers (error_class, state, failures, opened_at) VALUES (?, ?, ?, ?)
+		 ON CONFLICT(error_class) DO UPDATE SET
+		   state = excluded.state, failures = excluded.failures,
+		   opened_at = excluded.opened_at, updated_at = unixepoch()`,
+		s.Class, s.State, s.Failures, s.OpenedAt,
+	)
+	return err
+}
+
+// ListBreakerStates returns the saved breaker states ordered by class.
+func ListBreakerStates(database *sql.DB) ([]BreakerState, error) {
+	rows, err := database.Query(`SELECT error_class, state, failures, opened_at, updated_at FROM circuit_breakers ORDER BY error_class`)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+	var out []BreakerState
+	for rows.Next() {
+		var s BreakerState
+		if err := rows.Scan(&s.Class, &s.State, &s.Failures, &s.OpenedAt, &s.UpdatedAt); err != nil {
+			return nil, err
+		}
+		out = append(out, s)
+	}
+	return out, rows.Err()
+}
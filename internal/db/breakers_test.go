@@ -0,0 +1,26 @@
+package db
+
+import "testing"
+
+func TestSaveBreakerState_Upserts(t *testing.T) {
+	db := testDB(t)
+	if err := SaveBreakerState(db, BreakerState{Class: "provider_api", State: "closed", Failures: 2}); err != nil {
+		t.Fatal(err)
+	}
+	if err := SaveBreakerState(db, BreakerState{Class: "db", State: "closed", Failures: 1}); err != nil {
+		t.Fatal(err)
+	}
+	if err := SaveBreakerState(db, BreakerState{Class: "provider_api", State: "open", Failures: 5, OpenedAt: 1700000000}); err != nil {
+		t.Fatal(err)
+	}
+	got, err := ListBreakerStates(db)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(got) != 2 || got[0].Class != "db" || got[1].Class != "provider_api" {
+		t.Fatalf("expected one row per class ordered by class, got %+v", got)
+	}
+	if p := got[1]; p.State != "open" || p.Failures != 5 || p.OpenedAt != 1700000000 || p.UpdatedAt == 0 {
+		t.Fatalf("expected the latest provider_api state, got %+v", p)
+	}
+}
@@ -6,6 +6,7 @@ import (
 	"fmt"
 	"os"
 	"path/filepath"
+	"strings"
 
 	_ "github.com/mattn/go-sqlite3"
 )
@@ -29,6 +30,8 @@ const (
 	EventAgentStarted        = "agent.started"
 	EventAgentCompleted      = "agent.completed"
 	EventAgentFailed         = "agent.failed"
+	EventAgentCancelled      = "agent.cancelled"
+	EventTaskLeaseExpired    = "task.lease_expired"
 	EventTurnStarted         = "turn.started"
 	EventTurnCompleted       = "turn.completed"
 	EventToolCallStarted     = "tool_call.started"
@@ -37,12 +40,20 @@ const (
 	EventReplySent           = "reply.sent"
 	EventContextAssembled    = "context.assembled"
 	EventControlLimitReached = "control.limit_reached"
+	EventControlRateLimited  = "control.rate_limited"
 	EventRetryScheduled      = "retry.scheduled"
 	EventRetryExhausted      = "retry.exhausted"
 	EventCircuitOpened       = "circuit.opened"
 	EventCircuitHalfOpen     = "circuit.half_open"
 	EventCircuitClosed       = "circuit.closed"
 	EventProgressStalled     = "progress.stalled"
+	EventSummaryStarted      = "summary.started"
+	EventSummaryCompleted    = "summary.completed"
+	EventSummaryFailed       = "summary.failed"
+	EventSessionStarted      = "session.started"
+	EventSessionResumed      = "session.resumed"
+	EventMemorySaved         = "memory.saved"
+	EventMemoryDeleted       = "memory.deleted"
 )
 
 // OpenDB opens (or creates) a SQLite database at the given path, ensuring
@@ -54,7 +65,10 @@ func OpenDB(path string) (*sql.DB, error) {
 		}
 	}
 
-	db, err := sql.Open("sqlite3", path+"?_journal_mode=WAL&_busy_timeout=5000")
+	// Transactions begin immediate: they all write, and a deferred one that
+	// reads first fails with "database is locked" instead of waiting when
+	// another connection writes before it does.
+	db, err := sql.Open("sqlite3", path+"?_journal_mode=WAL&_busy_timeout=5000&_txlock=immediate")
 	if err != nil {
 		return nil, fmt.Errorf("failed to open db at %s: %w", path, err)
 	}
@@ -67,7 +81,8 @@ func OpenDB(path string) (*sql.DB, error) {
 	return db, nil
 }
 
-// InitSchema creates all tables: events, inbox, history, artifacts.
+// InitSchema creates all tables: events, inbox, history, artifacts, spend,
+// summaries, embeddings, sessions, memories, circuit_breakers and blobs.
 func InitSchema(db *sql.DB) error {
 	_, err := db.Exec(`
 		CREATE TABLE IF NOT EXISTS events (
@@ -124,7 +139,188 @@ func InitSchema(db *sql.DB) error {
 		);
 		CREATE INDEX IF NOT EXISTS idx_artifacts_status_updated_at ON artifacts(status, updated_at);
 		CREATE INDEX IF NOT EXISTS idx_artifacts_base_tx_id ON artifacts(base_tx_id);
+
+		CREATE TABLE IF NOT EXISTS spend (
+			chat_id INTEGER NOT NULL,
+			day TEXT NOT NULL,
+			cost_usd REAL NOT NULL DEFAULT 0,
+			input_tokens INTEGER NOT NULL DEFAULT 0,
+			output_tokens INTEGER NOT NULL DEFAULT 0,
+			turns INTEGER NOT NULL DEFAULT 0,
+			PRIMARY KEY (chat_id, day)
+		);
+		CREATE INDEX IF NOT EXISTS idx_spend_day ON spend(day);
+
+		CREATE TABLE IF NOT EXISTS summaries (
+			id INTEGER PRIMARY KEY AUTOINCREMENT,
+			chat_id INTEGER NOT NULL,
+			from_history_id INTEGER NOT NULL,
+			to_history_id INTEGER NOT NULL,
+			summary TEXT NOT NULL,
+			message_count INTEGER NOT NULL,
+			input_tokens INTEGER NOT NULL DEFAULT 0,
+			output_tokens INTEGER NOT NULL DEFAULT 0,
+			created_at INTEGER NOT NULL DEFAULT (unixepoch())
+		);
+		CREATE INDEX IF NOT EXISTS idx_summaries_chat_to ON summaries(chat_id, to_history_id);
+
+		CREATE TABLE IF NOT EXISTS embeddings (
+			id INTEGER PRIMARY KEY AUTOINCREMENT,
+			model TEXT NOT NULL,
+			source TEXT NOT NULL,
+			history_id INTEGER NOT NULL DEFAULT 0,
+			chat_id INTEGER NOT NULL DEFAULT 0,
+			path TEXT NOT NULL DEFAULT '',
+			start_line INTEGER NOT NULL DEFAULT 0,
+			end_line INTEGER NOT NULL DEFAULT 0,
+			content TEXT NOT NULL DEFAULT '',
+			content_hash TEXT NOT NULL DEFAULT '',
+			vector BLOB NOT NULL,
+			created_at INTEGER NOT NULL DEFAULT (unixepoch()),
+			UNIQUE (model, source, history_id, path, start_line)
+		);
+		CREATE INDEX IF NOT EXISTS idx_embeddings_model_source_chat ON embeddings(model, source, chat_id);
+
+		CREATE TABLE IF NOT EXISTS sessions (
+			id INTEGER PRIMARY KEY AUTOINCREMENT,
+			chat_id INTEGER NOT NULL,
+			title TEXT NOT NULL DEFAULT '',
+			created_at INTEGER NOT NULL DEFAULT (unixepoch()),
+			updated_at INTEGER NOT NULL DEFAULT (unixepoch())
+		);
+		CREATE INDEX IF NOT EXISTS idx_sessions_chat_updated_at ON sessions(chat_id, updated_at);
+
+		CREATE TABLE IF NOT EXISTS active_sessions (
+			chat_id INTEGER PRIMARY KEY,
+			session_id INTEGER NOT NULL
+		);
+
+		CREATE TABLE IF NOT EXISTS memories (
+			id INTEGER PRIMARY KEY AUTOINCREMENT,
+			scope TEXT NOT NULL,
+			chat_id INTEGER NOT NULL DEFAULT 0,
+			key TEXT NOT NULL,
+			content TEXT NOT NULL,
+			created_at INTEGER NOT NULL DEFAULT (unixepoch()),
+			updated_at INTEGER NOT NULL DEFAULT (unixepoch()),
+			UNIQUE (scope, chat_id, key)
+		);
+
+		CREATE TABLE IF NOT EXISTS circuit_breakers (
+			error_class TEXT PRIMARY KEY,
+			state TEXT NOT NULL,
+			failures INTEGER NOT NULL DEFAULT 0,
+			opened_at INTEGER NOT NULL DEFAULT 0,
+			updated_at INTEGER NOT NULL DEFAULT (unixepoch())
+		);
+
+		CREATE TABLE IF NOT EXISTS blobs (
+			hash TEXT PRIMARY KEY,
+			data BLOB NOT NULL,
+			size_bytes INTEGER NOT NULL,
+			created_at INTEGER NOT NULL DEFAULT (unixepoch())
+		);
 	`)
+	if err != nil {
+		return err
+	}
+	for _, c := range []struct{ table, column, decl string }{
+		{"inbox", "retry_after_seconds", "INTEGER NOT NULL DEFAULT 0"},
+		// Order in which tasks were claimed, for round-robin across chats.
+		{"inbox", "claim_seq", "INTEGER NOT NULL DEFAULT 0"},
+		// Assistant tool calls (JSON) and the call a tool result answers.
+		{"history", "tool_calls", "TEXT"},
+		{"history", "tool_call_id", "TEXT"},
+		// Rows written before sessions existed have no session until the
+		// chat's first session adopts them.
+		{"history", "session_id", "INTEGER"},
+		{"summaries", "session_id", "INTEGER"},
+	} {
+		if err := addColumnIfMissing(db, c.table, c.column, c.decl); err != nil {
+			return err
+		}
+	}
+	for _, idx := range []string{
+		`CREATE INDEX IF NOT EXISTS idx_history_chat_session ON history(chat_id, session_id, id)`,
+		`CREATE INDEX IF NOT EXISTS idx_inbox_chat_claim ON inbox(chat_id, claim_seq)`,
+		`CREATE INDEX IF NOT EXISTS idx_inbox_claim_seq ON inbox(claim_seq)`,
+	} {
+		if _, err := db.Exec(idx); err != nil {
+			return err
+		}
+	}
+	return initHistoryFTS(db)
+}
+
+// initHistoryFTS creates the history_fts full-text index over history.text,
+// kept in sync by triggers, and backfills it from existing rows. The trigram
+// tokenizer matches substrings, which also works for unsegmented Chinese.
+// Builds of go-sqlite3 without the sqlite_fts5 tag lack FTS5; the index is
+// then skipped and HistoryFTSEnabled reports false.
+func initHistoryFTS(db *sql.DB) error {
+	enabled, err := HistoryFTSEnabled(db)
+	if err != nil || enabled {
+		return err
+	}
+	_, err = db.Exec(`CREATE VIRTUAL TABLE history_fts USING fts5(text, content='history', content_rowid='id', tokenize='trigram')`)
+	if err != nil {
+		if strings.Contains(err.Error(), "no such module: fts5") {
+			return nil
+		}
+		return err
+	}
+	_, err = db.Exec(`
+		CREATE TRIGGER IF NOT EXISTS history_fts_insert AFTER INSERT ON history BEGIN
+			INSERT INTO history_fts(rowid, text) VALUES (new.id, new.text);
+		END;
+		CREATE TRIGGER IF NOT EXISTS history_fts_delete AFTER DELETE ON history BEGIN
+			INSERT INTO history_fts(history_fts, rowid, text) VALUES ('delete', old.id, old.text);
+		END;
+		CREATE TRIGGER IF NOT EXISTS history_fts_update AFTER UPDATE OF text ON history BEGIN
+			INSERT INTO history_fts(history_fts, rowid, text) VALUES ('delete', old.id, old.text);
+			INSERT INTO history_fts(rowid, text) VALUES (new.id, new.text);
+		END;
+		INSERT INTO history_fts(history_fts) VALUES ('rebuild');
+	`)
+	return err
+}
+
+// HistoryFTSEnabled reports whether the history_fts index exists.
+func HistoryFTSEnabled(db *sql.DB) (bool, error) {
+	var n int
+	err := db.QueryRow(`SELECT COUNT(*) FROM sqlite_master WHERE type = 'table' AND name = 'history_fts'`).Scan(&n)
+	return n > 0, err
+}
+
+// addColumnIfMissing adds a column to an existing table so databases created
+// by older workers pick up schema additions.
+func addColumnIfMissing(db *sql.DB, table, column, decl string) error {
+	rows, err := db.Query(fmt.Sprintf("PRAGMA table_info(%s)", table))
+	if err != nil {
+		return err
+	}
+	defer rows.Close()
+	for rows.Next() {
+		var (
+			cid       int
+			name      string
+			colType   string
+			notNull   int
+			dfltValue sql.NullString
+			pk        int
+		)
+		if err := rows.Scan(&cid, &name, &colType, &notNull, &dfltValue, &pk); err != nil {
+			return err
+		}
+		if name == column {
+			return nil
+		}
+	}
+	if err := rows.Err(); err != nil {
+		return err
+	}
+	rows.Close()
+	_, err = db.Exec(fmt.Sprintf("ALTER TABLE %s ADD COLUMN %s %s", table, column, decl))
 	return err
 }
 
@@ -24,7 +24,7 @@ func TestInitSchema(t *testing.T) {
 
 	// Verify all tables exist by querying sqlite_master.
 	tables := map[string]bool{}
-	rows, err := db.Query(`SELECT name FROM sqlite_master WHERE type='table' AND name IN ('events','inbox','history','artifacts')`)
+	rows, err := db.Query(`SELECT name FROM sqlite_master WHERE type='table' AND name IN ('events','inbox','history','artifacts','spend')`)
 	if err != nil {
 		t.Fatal(err)
 	}
@@ -37,13 +37,35 @@ func TestInitSchema(t *testing.T) {
 		tables[name] = true
 	}
 
-	for _, want := range []string{"events", "inbox", "history", "artifacts"} {
+	for _, want := range []string{"events", "inbox", "history", "artifacts", "spend"} {
 		if !tables[want] {
 			t.Errorf("table %q not created", want)
 		}
 	}
 }
 
+func TestInitSchema_AddsColumnsToExistingTables(t *testing.T) {
+	db := testDB(t)
+	if _, err := db.Exec(`ALTER TABLE inbox DROP COLUMN retry_after_seconds`); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := db.Exec(`ALTER TABLE history DROP COLUMN tool_calls`); err != nil {
+		t.Fatal(err)
+	}
+	if err := InitSchema(db); err != nil {
+		t.Fatalf("re-running InitSchema failed: %v", err)
+	}
+	if err := InitSchema(db); err != nil {
+		t.Fatalf("InitSchema should be idempotent: %v", err)
+	}
+	if _, err := db.Exec(`UPDATE inbox SET retry_after_seconds = 1`); err != nil {
+		t.Fatalf("expected retry_after_seconds column restored: %v", err)
+	}
+	if _, err := db.Exec(`UPDATE history SET tool_calls = '[]'`); err != nil {
+		t.Fatalf("expected tool_calls column restored: %v", err)
+	}
+}
+
 func TestLogEvent_Basic(t *testing.T) {
 	db := testDB(t)
 
@@ -238,3 +260,34 @@ func TestLogEvent_NilPayload(t *testing.T) {
 		t.Errorf("expected NULL payload, got %q", payload.String)
 	}
 }
+
+func TestInitSchema_HistoryFTS(t *testing.T) {
+	db := testDB(t)
+	enabled, err := HistoryFTSEnabled(db)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !enabled {
+		t.Skip("go-sqlite3 built without the sqlite_fts5 tag")
+	}
+	if _, err := db.Exec(`INSERT INTO history (chat_id, role, text) VALUES (1, 'user', 'migrate the database')`); err != nil {
+		t.Fatal(err)
+	}
+	// Rows written before the index existed are backfilled.
+	if _, err := db.Exec(`DROP TABLE history_fts`); err != nil {
+		t.Fatal(err)
+	}
+	if err := InitSchema(db); err != nil {
+		t.Fatal(err)
+	}
+	var n int
+	if err := db.QueryRow(`SELECT COUNT(*) FROM history_fts WHERE history_fts MATCH '"database"'`).Scan(&n); err != nil || n != 1 {
+		t.Fatalf("expected backfilled row to match, got %d err=%v", n, err)
+	}
+	if _, err := db.Exec(`DELETE FROM history`); err != nil {
+		t.Fatal(err)
+	}
+	if err := db.QueryRow(`SELECT COUNT(*) FROM history_fts WHERE history_fts MATCH '"database"'`).Scan(&n); err != nil || n != 0 {
+		t.Fatalf("expected deleted row removed from the index, got %d err=%v", n, err)
+	}
+}
@@ -0,0 +1,182 @@
+package db
+
+import (
+	"database/sql"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"math"
+)
+
+// Embedding sources.
+const (
+	EmbeddingSourceHistory = "history"
+	EmbeddingSourceFile    = "file"
+)
+
+// Embedding is a stored vector. History embeddings point at their history
+// row; file embeddings cover lines StartLine..EndLine of Path and keep the
+// chunk text in Content. ContentHash identifies the file version a file
+// chunk was cut from.
+type Embedding struct {
+	ID          int64
+	Model       string
+	Source      string
+	HistoryID   int64
+	ChatID      int64
+	Path        string
+	StartLine   int
+	EndLine     int
+	Content     string
+	ContentHash string
+	Vector      []float32
+}
+
+// EmbeddingFilter selects embeddings of one model and source. ChatID and
+// BeforeHistoryID apply to history embeddings when non-zero; ActiveSession
+// further limits them to the active session of ChatID.
+type EmbeddingFilter struct {
+	Model           string
+	Source          string
+	ChatID          int64
+	BeforeHistoryID int64
+	ActiveSession   bool
+}
+
+// PendingHistory is a history row without an embedding for some model.
+type PendingHistory struct {
+	ID     int64
+	ChatID int64
+	Text   string
+}
+
+// InsertEmbeddings stores items in one transaction, replacing existing
+// vectors for the same model and target.
+func InsertEmbeddings(database *sql.DB, items []Embedding) error {
+	tx, err := database.Begin()
+	if err != nil {
+		return err
+	}
+	defer tx.Rollback()
+	for _, e := range items {
+		if _, err := tx.Exec(
+			`INSERT OR REPLACE INTO embeddings (model, source, history_id, chat_id, path, start_line, end_line, content, content_hash, vector)
+			 VALUES (?, ?, ?, ?, ?, ?, ?, ?, ?, ?)`,
+			e.Model, e.Source, e.HistoryID, e.ChatID, e.Path, e.StartLine, e.EndLine, e.Content, e.ContentHash, EncodeVector(e.Vector),
+		); err != nil {
+			return err
+		}
+	}
+	return tx.Commit()
+}
+
+// PendingHistoryEmbeddings returns up to limit user and assistant history
+// rows, oldest first, that have no embedding for model yet.
+func PendingHistoryEmbeddings(database *sql.DB, model string, limit int) ([]PendingHistory, error) {
+	rows, err := database.Query(
+		`SELECT h.id, h.chat_id, h.text FROM history h
+		 WHERE h.role IN ('user', 'assistant') AND h.text != '' AND h.tool_calls IS NULL
+		   AND NOT EXISTS (SELECT 1 FROM embeddings e WHERE e.model = ? AND e.source = ? AND e.history_id = h.id)
+		 ORDER BY h.id LIMIT ?`,
+		model, EmbeddingSourceHistory, limit,
+	)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+	var out []PendingHistory
+	for rows.Next() {
+		var p PendingHistory
+		if err := rows.Scan(&p.ID, &p.ChatID, &p.Text); err != nil {
+			return nil, err
+		}
+		out = append(out, p)
+	}
+	return out, rows.Err()
+}
+
+// FileEmbeddingHashes returns the content hash stored for each embedded path.
+func FileEmbeddingHashes(database *sql.DB, model string) (map[string]string, error) {
+	rows, err := database.Query(
+		`SELECT path, MAX(content_hash) FROM embeddings WHERE model = ? AND source = ? GROUP BY path`,
+		model, EmbeddingSourceFile,
+	)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+	out := map[string]string{}
+	for rows.Next() {
+		var path, hash string
+		if err := rows.Scan(&path, &hash); err != nil {
+			return nil, err
+		}
+		out[path] = hash
+	}
+	return out, rows.Err()
+}
+
+// DeleteFileEmbeddings removes every chunk of path for model.
+func DeleteFileEmbeddings(database *sql.DB, model, path string) error {
+	_, err := database.Exec(`DELETE FROM embeddings WHERE model = ? AND source = ? AND path = ?`, model, EmbeddingSourceFile, path)
+	return err
+}
+
+// ScanEmbeddings calls fn for every embedding matching filter.
+func ScanEmbeddings(database *sql.DB, filter EmbeddingFilter, fn func(Embedding) error) error {
+	query := `SELECT id, model, source, history_id, chat_id, path, start_line, end_line, content, content_hash, vector
+		FROM embeddings WHERE model = ? AND source = ?`
+	args := []any{filter.Model, filter.Source}
+	if filter.ChatID != 0 {
+		query += ` AND chat_id = ?`
+		args = append(args, filter.ChatID)
+	}
+	if filter.BeforeHistoryID != 0 {
+		query += ` AND history_id < ?`
+		args = append(args, filter.BeforeHistoryID)
+	}
+	if filter.ActiveSession {
+		query += ` AND history_id IN (SELECT id FROM history WHERE chat_id = ? AND session_id IS ` + activeSessionExpr + `)`
+		args = append(args, filter.ChatID, filter.ChatID)
+	}
+	rows, err := database.Query(query, args...)
+	if err != nil {
+		return err
+	}
+	defer rows.Close()
+	for rows.Next() {
+		var e Embedding
+		var blob []byte
+		if err := rows.Scan(&e.ID, &e.Model, &e.Source, &e.HistoryID, &e.ChatID, &e.Path, &e.StartLine, &e.EndLine, &e.Content, &e.ContentHash, &blob); err != nil {
+			return err
+		}
+		if e.Vector, err = DecodeVector(blob); err != nil {
+			return fmt.Errorf("embedding %d: %w", e.ID, err)
+		}
+		if err := fn(e); err != nil {
+			return err
+		}
+	}
+	return rows.Err()
+}
+
+// EncodeVector packs v as little-endian float32s.
+func EncodeVector(v []float32) []byte {
+	out := make([]byte, 4*len(v))
+	for i, f := range v {
+		binary.LittleEndian.PutUint32(out[4*i:], math.Float32bits(f))
+	}
+	return out
+}
+
+// DecodeVector unpacks a vector written by EncodeVector.
+func DecodeVector(b []byte) ([]float32, error) {
+	if len(b)%4 != 0 {
+		return nil, errors.New("vector blob length is not a multiple of 4")
+	}
+	out := make([]float32, len(b)/4)
+	for i := range out {
+		out[i] = math.Float32frombits(binary.LittleEndian.Uint32(b[4*i:]))
+	}
+	return out, nil
+}
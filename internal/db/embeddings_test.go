@@ -0,0 +1,61 @@
+package db
+
+import "testing"
+
+func TestEmbeddings_RoundTripAndFilters(t *testing.T) {
+	db := testDB(t)
+	for _, row := range []struct {
+		chatID int64
+		role   string
+		text   string
+	}{{1, "user", "first"}, {1, "assistant", "second"}, {2, "user", "other chat"}, {1, "tool", "tool output"}} {
+		if _, err := db.Exec(`INSERT INTO history (chat_id, role, text) VALUES (?, ?, ?)`, row.chatID, row.role, row.text); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	pending, err := PendingHistoryEmbeddings(db, "m", 10)
+	if err != nil || len(pending) != 3 {
+		t.Fatalf("expected 3 pending user/assistant rows, got %+v err=%v", pending, err)
+	}
+	if err := InsertEmbeddings(db, []Embedding{
+		{Model: "m", Source: EmbeddingSourceHistory, HistoryID: 1, ChatID: 1, Vector: []float32{1, 0.5}},
+		{Model: "m", Source: EmbeddingSourceHistory, HistoryID: 2, ChatID: 1, Vector: []float32{-1, 2}},
+		{Model: "m", Source: EmbeddingSourceFile, Path: "a.go", StartLine: 1, EndLine: 40, Content: "package a", ContentHash: "h1", Vector: []float32{0, 1}},
+	}); err != nil {
+		t.Fatal(err)
+	}
+	pending, err = PendingHistoryEmbeddings(db, "m", 10)
+	if err != nil || len(pending) != 1 || pending[0].ChatID != 2 {
+		t.Fatalf("expected only the other chat's row pending, got %+v err=%v", pending, err)
+	}
+	if pending, _ := PendingHistoryEmbeddings(db, "other-model", 10); len(pending) != 3 {
+		t.Fatalf("expected rows pending for another model, got %d", len(pending))
+	}
+
+	var got []Embedding
+	err = ScanEmbeddings(db, EmbeddingFilter{Model: "m", Source: EmbeddingSourceHistory, ChatID: 1, BeforeHistoryID: 2}, func(e Embedding) error {
+		got = append(got, e)
+		return nil
+	})
+	if err != nil || len(got) != 1 || got[0].HistoryID != 1 || got[0].Vector[1] != 0.5 {
+		t.Fatalf("unexpected scan result %+v err=%v", got, err)
+	}
+
+	hashes, err := FileEmbeddingHashes(db, "m")
+	if err != nil || hashes["a.go"] != "h1" {
+		t.Fatalf("unexpected file hashes %v err=%v", hashes, err)
+	}
+	if err := DeleteFileEmbeddings(db, "m", "a.go"); err != nil {
+		t.Fatal(err)
+	}
+	if hashes, _ := FileEmbeddingHashes(db, "m"); len(hashes) != 0 {
+		t.Fatalf("expected file chunks deleted, got %v", hashes)
+	}
+}
+
+func TestDecodeVector_RejectsBadLength(t *testing.T) {
+	if _, err := DecodeVector([]byte{1, 2, 3}); err == nil {
+		t.Fatal("expected error for truncated blob")
+	}
+}
@@ -0,0 +1,149 @@
+package db
+
+import (
+	"database/sql"
+	"errors"
+	"fmt"
+	"strings"
+)
+
+// Memory scopes. Global memories are visible to every chat; chat memories
+// only to the chat that saved them.
+const (
+	MemoryScopeGlobal = "global"
+	MemoryScopeChat   = "chat"
+)
+
+// Memory is one fact the agent chose to remember, identified by its scope,
+// chat and key. ChatID is 0 for global memories.
+type Memory struct {
+	ID        int64
+	Scope     string
+	ChatID    int64
+	Key       string
+	Content   string
+	CreatedAt int64
+	UpdatedAt int64
+}
+
+// SaveMemoryWithEvent inserts m, or replaces the content of the memory with
+// the same scope, chat and key, and records memory.saved under parentID in
+// the same transaction. It sets m's ID and timestamps and reports whether
+// the memory is new.
+func SaveMemoryWithEvent(database *sql.DB, parentID *int64, m *Memory) (bool, error) {
+	if err := normalizeMemory(m); err != nil {
+		return false, err
+	}
+	tx, err := database.Begin()
+	if err != nil {
+		return false, err
+	}
+	defer tx.Rollback()
+	var existing int64
+	err = tx.QueryRow(`SELECT id FROM memories WHERE scope = ? AND chat_id = ? AND key = ?`, m.Scope, m.ChatID, m.Key).Scan(&existing)
+	if err != nil && !errors.Is(err, sql.ErrNoRows) {
+		return false, err
+	}
+	created := existing == 0
+	if created {
+		res, err := tx.Exec(`INSERT INTO memories (scope, chat_id, key, content) VALUES (?, ?, ?, ?)`, m.Scope, m.ChatID, m.Key, m.Content)
+		if err != nil {
+			return false, err
+		}
+		if existing, err = res.LastInsertId(); err != nil {
+			return false, err
+		}
+	} else if _, err := tx.Exec(`UPDATE memories SET content = ?, updated_at = unixepoch() WHERE id = ?`, m.Content, existing); err != nil {
+		return false, err
+	}
+	if err := tx.QueryRow(`SELECT id, created_at, updated_at FROM memories WHERE id = ?`, existing).Scan(&m.ID, &m.CreatedAt, &m.UpdatedAt); err != nil {
+		return false, err
+	}
+	if _, err := LogEventTx(tx, parentID, EventMemorySaved, map[string]any{
+		"memory_id": m.ID,
+		"scope":     m.Scope,
+		"chat_id":   m.ChatID,
+		"key":       m.Key,
+		"content":   m.Content,
+		"created":   created,
+	}); err != nil {
+		return false, err
+	}
+	return created, tx.Commit()
+}
+
+// DeleteMemoryWithEvent deletes the memory with the given scope, chat and
+// key and records memory.deleted under parentID. It reports false when there
+// was no such memory.
+func DeleteMemoryWithEvent(database *sql.DB, parentID *int64, scope string, chatID int64, key string) (bool, error) {
+	m := &Memory{Scope: scope, ChatID: chatID, Key: key}
+	if err := normalizeMemory(m); err != nil {
+		return false, err
+	}
+	tx, err := database.Begin()
+	if err != nil {
+		return false, err
+	}
+	defer tx.Rollback()
+	err = tx.QueryRow(`SELECT id, content FROM memories WHERE scope = ? AND chat_id = ? AND key = ?`, m.Scope, m.ChatID, m.Key).Scan(&m.ID, &m.Content)
+	if errors.Is(err, sql.ErrNoRows) {
+		return false, nil
+	}
+	if err != nil {
+		return false, err
+	}
+	if _, err := tx.Exec(`DELETE FROM memories WHERE id = ?`, m.ID); err != nil {
+		return false, err
+	}
+	if _, err := LogEventTx(tx, parentID, EventMemoryDeleted, map[string]any{
+		"memory_id": m.ID,
+		"scope":     m.Scope,
+		"chat_id":   m.ChatID,
+		"key":       m.Key,
+		"content":   m.Content,
+	}); err != nil {
+		return false, err
+	}
+	return true, tx.Commit()
+}
+
+// ListMemories returns the global memories and those of the chat, most
+// recently updated first.
+func ListMemories(database *sql.DB, chatID int64) ([]Memory, error) {
+	rows, err := database.Query(
+		`SELECT id, scope, chat_id, key, content, created_at, updated_at FROM memories
+		  WHERE scope = ? OR (scope = ? AND chat_id = ?)
+		  ORDER BY updated_at DESC, id DESC`,
+		MemoryScopeGlobal, MemoryScopeChat, chatID,
+	)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+	var out []Memory
+	for rows.Next() {
+		var m Memory
+		if err := rows.Scan(&m.ID, &m.Scope, &m.ChatID, &m.Key, &m.Content, &m.CreatedAt, &m.UpdatedAt); err != nil {
+			return nil, err
+		}
+		out = append(out, m)
+	}
+	return out, rows.Err()
+}
+
+// normalizeMemory trims the key, checks the scope and zeroes the chat of
+// global memories.
+func normalizeMemory(m *Memory) error {
+	m.Key = strings.TrimSpace(m.Key)
+	if m.Key == "" {
+		return fmt.Errorf("memory key cannot be empty")
+	}
+	switch m.Scope {
+	case MemoryScopeGlobal:
+		m.ChatID = 0
+	case MemoryScopeChat:
+	default:
+		return fmt.Errorf("invalid memory scope: %q", m.Scope)
+	}
+	return nil
+}
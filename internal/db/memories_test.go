@@ -0,0 +1,67 @@
+package db
+
+import "testing"
+
+func TestSaveMemoryWithEvent_UpsertsByScopeChatAndKey(t *testing.T) {
+	db := testDB(t)
+	parent, err := LogEvent(db, nil, EventToolCallStarted, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	m := &Memory{Scope: MemoryScopeChat, ChatID: 1, Key: " editor ", Content: "vim"}
+	created, err := SaveMemoryWithEvent(db, &parent, m)
+	if err != nil || !created || m.ID == 0 || m.Key != "editor" {
+		t.Fatalf("expected a new memory, got %+v created=%v err=%v", m, created, err)
+	}
+	again := &Memory{Scope: MemoryScopeChat, ChatID: 1, Key: "editor", Content: "helix"}
+	created, err = SaveMemoryWithEvent(db, &parent, again)
+	if err != nil || created || again.ID != m.ID {
+		t.Fatalf("expected the same memory updated, got %+v created=%v err=%v", again, created, err)
+	}
+	if _, err := SaveMemoryWithEvent(db, nil, &Memory{Scope: MemoryScopeGlobal, ChatID: 9, Key: "editor", Content: "emacs"}); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := SaveMemoryWithEvent(db, nil, &Memory{Scope: MemoryScopeChat, ChatID: 2, Key: "editor", Content: "nano"}); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := SaveMemoryWithEvent(db, nil, &Memory{Scope: "team", Key: "x", Content: "y"}); err == nil {
+		t.Fatal("expected invalid scope rejected")
+	}
+
+	mems, err := ListMemories(db, 1)
+	if err != nil || len(mems) != 2 {
+		t.Fatalf("expected chat 1 and global memories, got %+v err=%v", mems, err)
+	}
+	for _, got := range mems {
+		if got.Scope == MemoryScopeGlobal && got.ChatID != 0 {
+			t.Fatalf("expected global memory stored without a chat, got %+v", got)
+		}
+		if got.Scope == MemoryScopeChat && got.Content != "helix" {
+			t.Fatalf("expected updated content, got %+v", got)
+		}
+	}
+	var events int
+	if err := db.QueryRow(`SELECT COUNT(*) FROM events WHERE event_type = ? AND parent_id = ?`, EventMemorySaved, parent).Scan(&events); err != nil || events != 2 {
+		t.Fatalf("expected 2 memory.saved events under the parent, got %d err=%v", events, err)
+	}
+}
+
+func TestDeleteMemoryWithEvent(t *testing.T) {
+	db := testDB(t)
+	if _, err := SaveMemoryWithEvent(db, nil, &Memory{Scope: MemoryScopeChat, ChatID: 1, Key: "k", Content: "v"}); err != nil {
+		t.Fatal(err)
+	}
+	if deleted, err := DeleteMemoryWithEvent(db, nil, MemoryScopeChat, 2, "k"); err != nil || deleted {
+		t.Fatalf("expected another chat's memory untouched, got deleted=%v err=%v", deleted, err)
+	}
+	if deleted, err := DeleteMemoryWithEvent(db, nil, MemoryScopeChat, 1, "k"); err != nil || !deleted {
+		t.Fatalf("expected memory deleted, got deleted=%v err=%v", deleted, err)
+	}
+	var payload string
+	if err := db.QueryRow(`SELECT payload FROM events WHERE event_type = ?`, EventMemoryDeleted).Scan(&payload); err != nil {
+		t.Fatal(err)
+	}
+	if payload != `{"chat_id":1,"content":"v","key":"k","memory_id":1,"scope":"chat"}` {
+		t.Fatalf("unexpected memory.deleted payload %s", payload)
+	}
+}
@@ -0,0 +1,231 @@
+package db
+
+import (
+	"database/sql"
+	"errors"
+	"strings"
+	"unicode/utf8"
+)
+
+// ErrSessionNotFound is returned when a session does not exist in the chat.
+var ErrSessionNotFound = errors.New("session not found")
+
+// activeSessionExpr selects the active session of the chat bound to the
+// next parameter. It is NULL while the chat has no session, so history and
+// summaries written before the first session stay together and are adopted
+// by it.
+const activeSessionExpr = `(SELECT session_id FROM active_sessions WHERE chat_id = ?)`
+
+// sessionTitleRunes caps titles taken from a session's first user message.
+const sessionTitleRunes = 40
+
+// Session is one conversation thread of a chat. Each chat has exactly one
+// active session once it has any; history is read from and written to it.
+type Session struct {
+	ID           int64
+	ChatID       int64
+	Title        string
+	MessageCount int
+	CreatedAt    int64
+	UpdatedAt    int64
+	Active       bool
+}
+
+// AppendHistory stores one message in the chat's active session; exec is a
+// *sql.DB or *sql.Tx. A user message also titles a session that has no title
+// yet.
+func AppendHistory(exec sqlExecer, chatID int64, role, text string, toolCalls, toolCallID any) error {
+	if _, err := exec.Exec(
+		`INSERT INTO history (chat_id, session_id, role, text, tool_calls, tool_call_id)
+		 VALUES (?, `+activeSessionExpr+`, ?, ?, ?, ?)`,
+		chatID, chatID, role, text, toolCalls, toolCallID,
+	); err != nil {
+		return err
+	}
+	title := ""
+	if role == "user" {
+		title = SessionTitle(text)
+	}
+	_, err := exec.Exec(
+		`UPDATE sessions
+		    SET updated_at = unixepoch(), title = CASE WHEN title = '' THEN ? ELSE title END
+		  WHERE id = `+activeSessionExpr,
+		title, chatID,
+	)
+	return err
+}
+
+// SessionTitle derives a title from the first line of a message.
+func SessionTitle(text string) string {
+	line, _, _ := strings.Cut(strings.TrimSpace(text), "\n")
+	line = strings.Join(strings.Fields(line), " ")
+	if utf8.RuneCountInString(line) <= sessionTitleRunes {
+		return line
+	}
+	return string([]rune(line)[:sessionTitleRunes]) + "…"
+}
+
+// ActiveSession returns the chat's active session, creating the first one
+// when the chat has none. The first session adopts history and summaries
+// written before sessions existed.
+func ActiveSession(database *sql.DB, chatID int64) (*Session, error) {
+	tx, err := database.Begin()
+	if err != nil {
+		return nil, err
+	}
+	defer tx.Rollback()
+	id, err := activeSessionID(tx, chatID)
+	if err != nil {
+		return nil, err
+	}
+	if id == 0 {
+		if id, err = startSession(tx, chatID); err != nil {
+			return nil, err
+		}
+	}
+	if err := tx.Commit(); err != nil {
+		return nil, err
+	}
+	return GetSession(database, chatID, id)
+}
+
+// NewSession starts an empty session and makes it the chat's active one.
+func NewSession(database *sql.DB, chatID int64) (*Session, error) {
+	tx, err := database.Begin()
+	if err != nil {
+		return nil, err
+	}
+	defer tx.Rollback()
+	current, err := activeSessionID(tx, chatID)
+	if err != nil {
+		return nil, err
+	}
+	if current == 0 {
+		// Keep history from before sessions in a session of its own.
+		var legacy int
+		if err := tx.QueryRow(`SELECT COUNT(*) FROM history WHERE chat_id = ? AND session_id IS NULL`, chatID).Scan(&legacy); err != nil {
+			return nil, err
+		}
+		if legacy > 0 {
+			if _, err := startSession(tx, chatID); err != nil {
+				return nil, err
+			}
+		}
+	}
+	id, err := startSession(tx, chatID)
+	if err != nil {
+		return nil, err
+	}
+	if err := tx.Commit(); err != nil {
+		return nil, err
+	}
+	return GetSession(database, chatID, id)
+}
+
+// ResumeSession makes an existing session of the chat the active one.
+func ResumeSession(database *sql.DB, chatID, sessionID int64) (*Session, error) {
+	s, err := GetSession(database, chatID, sessionID)
+	if err != nil {
+		return nil, err
+	}
+	if _, err := database.Exec(
+		`INSERT INTO active_sessions (chat_id, session_id) VALUES (?, ?)
+		 ON CONFLICT(chat_id) DO UPDATE SET session_id = excluded.session_id`,
+		chatID, sessionID,
+	); err != nil {
+		return nil, err
+	}
+	s.Active = true
+	return s, nil
+}
+
+// GetSession returns one session of the chat or ErrSessionNotFound.
+func GetSession(database *sql.DB, chatID, sessionID int64) (*Session, error) {
+	sessions, err := querySessions(database, `WHERE s.chat_id = ? AND s.id = ?`, chatID, chatID, sessionID)
+	if err != nil {
+		return nil, err
+	}
+	if len(sessions) == 0 {
+		return nil, ErrSessionNotFound
+	}
+	return &sessions[0], nil
+}
+
+// ListSessions returns the chat's most recently updated sessions first.
+func ListSessions(database *sql.DB, chatID int64, limit int) ([]Session, error) {
+	return querySessions(database, `WHERE s.chat_id = ? ORDER BY s.updated_at DESC, s.id DESC LIMIT ?`, chatID, chatID, limit)
+}
+
+func querySessions(database *sql.DB, where string, chatID int64, args ...any) ([]Session, error) {
+	rows, err := database.Query(
+		`SELECT s.id, s.chat_id, s.title, s.created_at, s.updated_at,
+		        (SELECT COUNT(*) FROM history h WHERE h.chat_id = s.chat_id AND h.session_id = s.id),
+		        s.id IS `+activeSessionExpr+`
+		   FROM sessions s `+where,
+		append([]any{chatID}, args...)...,
+	)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+	var out []Session
+	for rows.Next() {
+		var s Session
+		if err := rows.Scan(&s.ID, &s.ChatID, &s.Title, &s.CreatedAt, &s.UpdatedAt, &s.MessageCount, &s.Active); err != nil {
+			return nil, err
+		}
+		out = append(out, s)
+	}
+	return out, rows.Err()
+}
+
+func activeSessionID(tx *sql.Tx, chatID int64) (int64, error) {
+	var id int64
+	err := tx.QueryRow(`SELECT session_id FROM active_sessions WHERE chat_id = ?`, chatID).Scan(&id)
+	if errors.Is(err, sql.ErrNoRows) {
+		return 0, nil
+	}
+	return id, err
+}
+
+// startSession creates a session and activates it. When the chat had no
+// session, rows written without one move into the new session, which takes
+// its title from the first of them.
+func startSession(tx *sql.Tx, chatID int64) (int64, error) {
+	res, err := tx.Exec(`INSERT INTO sessions (chat_id) VALUES (?)`, chatID)
+	if err != nil {
+		return 0, err
+	}
+	id, err := res.LastInsertId()
+	if err != nil {
+		return 0, err
+	}
+	var first sql.NullString
+	if err := tx.QueryRow(
+		`SELECT text FROM history WHERE chat_id = ? AND session_id IS NULL AND role = 'user' ORDER BY id LIMIT 1`,
+		chatID,
+	).Scan(&first); err != nil && !errors.Is(err, sql.ErrNoRows) {
+		return 0, err
+	}
+	for _, stmt := range []string{
+		`UPDATE history SET session_id = ? WHERE chat_id = ? AND session_id IS NULL`,
+		`UPDATE summaries SET session_id = ? WHERE chat_id = ? AND session_id IS NULL`,
+	} {
+		if _, err := tx.Exec(stmt, id, chatID); err != nil {
+			return 0, err
+		}
+	}
+	if first.Valid {
+		if _, err := tx.Exec(`UPDATE sessions SET title = ? WHERE id = ?`, SessionTitle(first.String), id); err != nil {
+			return 0, err
+		}
+	}
+	if _, err := tx.Exec(
+		`INSERT INTO active_sessions (chat_id, session_id) VALUES (?, ?)
+		 ON CONFLICT(chat_id) DO UPDATE SET session_id = excluded.session_id`,
+		chatID, id,
+	); err != nil {
+		return 0, err
+	}
+	return id, nil
+}
@@ -0,0 +1,91 @@
+package db
+
+import (
+	"errors"
+	"strings"
+	"testing"
+)
+
+func TestActiveSession_AdoptsEarlierHistory(t *testing.T) {
+	db := testDB(t)
+	if _, err := db.Exec("INSERT INTO history (chat_id, role, text) VALUES (1, 'user', 'fix the login bug'), (1, 'assistant', 'done'), (2, 'user', 'other chat')"); err != nil {
+		t.Fatal(err)
+	}
+	if err := InsertSummary(db, &Summary{ChatID: 1, FromHistoryID: 1, ToHistoryID: 2, Text: "s", MessageCount: 2}); err != nil {
+		t.Fatal(err)
+	}
+
+	s, err := ActiveSession(db, 1)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !s.Active || s.Title != "fix the login bug" || s.MessageCount != 2 {
+		t.Fatalf("expected first session to adopt chat 1 history, got %+v", s)
+	}
+	again, err := ActiveSession(db, 1)
+	if err != nil || again.ID != s.ID {
+		t.Fatalf("expected the same active session, got %+v err=%v", again, err)
+	}
+	if got, err := LatestSummary(db, 1); err != nil || got == nil {
+		t.Fatalf("expected summary adopted by the session, got %+v err=%v", got, err)
+	}
+}
+
+func TestNewSession_AndResume(t *testing.T) {
+	db := testDB(t)
+	if err := AppendHistory(db, 1, "user", "before sessions", nil, nil); err != nil {
+		t.Fatal(err)
+	}
+	if err := InsertSummary(db, &Summary{ChatID: 1, FromHistoryID: 1, ToHistoryID: 1, Text: "old", MessageCount: 1}); err != nil {
+		t.Fatal(err)
+	}
+
+	fresh, err := NewSession(db, 1)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if fresh.MessageCount != 0 || fresh.Title != "" || !fresh.Active {
+		t.Fatalf("expected an empty active session, got %+v", fresh)
+	}
+	if got, _ := LatestSummary(db, 1); got != nil {
+		t.Fatalf("expected no summary in the new session, got %+v", got)
+	}
+	if err := AppendHistory(db, 1, "user", "  deploy\nthe new build  ", nil, nil); err != nil {
+		t.Fatal(err)
+	}
+	if err := AppendHistory(db, 1, "user", "second message", nil, nil); err != nil {
+		t.Fatal(err)
+	}
+
+	list, err := ListSessions(db, 1, 10)
+	if err != nil || len(list) != 2 {
+		t.Fatalf("expected 2 sessions, got %+v err=%v", list, err)
+	}
+	if list[0].ID != fresh.ID || list[0].Title != "deploy" || list[0].MessageCount != 2 || !list[0].Active {
+		t.Fatalf("unexpected newest session %+v", list[0])
+	}
+	if list[1].Title != "before sessions" || list[1].Active {
+		t.Fatalf("unexpected earlier session %+v", list[1])
+	}
+
+	resumed, err := ResumeSession(db, 1, list[1].ID)
+	if err != nil || !resumed.Active {
+		t.Fatalf("expected resumed session active, got %+v err=%v", resumed, err)
+	}
+	if got, _ := LatestSummary(db, 1); got == nil || got.Text != "old" {
+		t.Fatalf("expected the resumed session's summary, got %+v", got)
+	}
+	if _, err := ResumeSession(db, 2, fresh.ID); !errors.Is(err, ErrSessionNotFound) {
+		t.Fatalf("expected another chat's session to be not found, got %v", err)
+	}
+}
+
+func TestSessionTitle(t *testing.T) {
+	if got := SessionTitle("  hello   world \nmore"); got != "hello world" {
+		t.Fatalf("unexpected title %q", got)
+	}
+	long := strings.Repeat("字", 50)
+	if got := SessionTitle(long); got != strings.Repeat("字", 40)+"…" {
+		t.Fatalf("expected title capped at 40 runes, got %q", got)
+	}
+}
@@ -0,0 +1,56 @@
+package db
+
+import (
+	"database/sql"
+	"time"
+)
+
+// SpendDay returns the UTC day key spend is aggregated under.
+func SpendDay(t time.Time) string {
+	return t.UTC().Format(time.DateOnly)
+}
+
+// MonthStartDay returns the day key of the first day of t's UTC month.
+func MonthStartDay(t time.Time) string {
+	return t.UTC().Format("2006-01") + "-01"
+}
+
+// RecordSpend adds one model call's cost and token usage to a chat's spend
+// for the given day.
+func RecordSpend(database *sql.DB, chatID int64, day string, costUSD float64, inputTokens, outputTokens int) error {
+	_, err := database.Exec(
+		`INSERT INTO spend (chat_id, day, cost_usd, input_tokens, output_tokens, turns)
+		 VALUES (?, ?, ?, ?, ?, 1)
+		 ON CONFLICT(chat_id, day) DO UPDATE SET
+		   cost_usd = cost_usd + excluded.cost_usd,
+		   input_tokens = input_tokens + excluded.input_tokens,
+		   output_tokens = output_tokens + excluded.output_tokens,
+		   turns = turns + 1`,
+		chatID, day, costUSD, inputTokens, outputTokens,
+	)
+	return err
+}
+
+// SpendBetween returns the spend of all chats on days in [fromDay, toDay].
+func SpendBetween(database *sql.DB, fromDay, toDay string) (float64, error) {
+	var total float64
+	err := database.QueryRow(
+		`SELECT COALESCE(SUM(cost_usd), 0) FROM spend WHERE day >= ? AND day <= ?`,
+		fromDay, toDay,
+	).Scan(&total)
+	return total, err
+}
+
+// ChatSpend returns a chat's spend across all days.
+func ChatSpend(database *sql.DB, chatID int64) (float64, error) {
+	var total float64
+	err := database.QueryRow(`SELECT COALESCE(SUM(cost_usd), 0) FROM spend WHERE chat_id = ?`, chatID).Scan(&total)
+	return total, err
+}
+
+// TotalSpend returns the spend of all chats across all days.
+func TotalSpend(database *sql.DB) (float64, error) {
+	var total float64
+	err := database.QueryRow(`SELECT COALESCE(SUM(cost_usd), 0) FROM spend`).Scan(&total)
+	return total, err
+}
@@ -0,0 +1,54 @@
+package db
+
+import (
+	"math"
+	"testing"
+	"time"
+)
+
+func TestRecordSpendAggregates(t *testing.T) {
+	db := testDB(t)
+	must := func(err error) {
+		t.Helper()
+		if err != nil {
+			t.Fatal(err)
+		}
+	}
+	must(RecordSpend(db, 1, "2026-03-01", 0.25, 100, 10))
+	must(RecordSpend(db, 1, "2026-03-01", 0.5, 200, 20))
+	must(RecordSpend(db, 2, "2026-03-01", 1, 300, 30))
+	must(RecordSpend(db, 1, "2026-03-02", 2, 400, 40))
+	must(RecordSpend(db, 1, "2026-02-28", 4, 500, 50))
+
+	var turns, inputTokens int
+	must(db.QueryRow(`SELECT turns, input_tokens FROM spend WHERE chat_id = 1 AND day = '2026-03-01'`).Scan(&turns, &inputTokens))
+	if turns != 2 || inputTokens != 300 {
+		t.Fatalf("expected calls folded into one row, got turns=%d input_tokens=%d", turns, inputTokens)
+	}
+
+	check := func(name string, got float64, err error, want float64) {
+		t.Helper()
+		must(err)
+		if math.Abs(got-want) > 1e-9 {
+			t.Fatalf("%s: got %v, want %v", name, got, want)
+		}
+	}
+	day, err := SpendBetween(db, "2026-03-01", "2026-03-01")
+	check("day", day, err, 1.75)
+	month, err := SpendBetween(db, "2026-03-01", "2026-03-31")
+	check("month", month, err, 3.75)
+	chat, err := ChatSpend(db, 1)
+	check("chat", chat, err, 6.75)
+	total, err := TotalSpend(db)
+	check("total", total, err, 7.75)
+}
+
+func TestSpendDayKeysAreUTC(t *testing.T) {
+	at := time.Date(2026, 3, 31, 23, 30, 0, 0, time.FixedZone("UTC-2", -2*3600))
+	if got := SpendDay(at); got != "2026-04-01" {
+		t.Fatalf("unexpected day: %s", got)
+	}
+	if got := MonthStartDay(at); got != "2026-04-01" {
+		t.Fatalf("unexpected month start: %s", got)
+	}
+}
@@ -0,0 +1,55 @@
+package db
+
+import (
+	"database/sql"
+	"errors"
+)
+
+// Summary is a rolling summary of a chat's history rows FromHistoryID through
+// ToHistoryID inclusive. Each new summary folds in the previous one, so the
+// latest summary of a chat covers everything up to its ToHistoryID.
+// Summaries belong to the chat's session that is active when they are
+// written.
+type Summary struct {
+	ID            int64
+	ChatID        int64
+	FromHistoryID int64
+	ToHistoryID   int64
+	Text          string
+	MessageCount  int
+	InputTokens   int
+	OutputTokens  int
+}
+
+// InsertSummary stores s and sets its ID.
+func InsertSummary(database *sql.DB, s *Summary) error {
+	res, err := database.Exec(
+		`INSERT INTO summaries (chat_id, session_id, from_history_id, to_history_id, summary, message_count, input_tokens, output_tokens)
+		 VALUES (?, `+activeSessionExpr+`, ?, ?, ?, ?, ?, ?)`,
+		s.ChatID, s.ChatID, s.FromHistoryID, s.ToHistoryID, s.Text, s.MessageCount, s.InputTokens, s.OutputTokens,
+	)
+	if err != nil {
+		return err
+	}
+	s.ID, err = res.LastInsertId()
+	return err
+}
+
+// LatestSummary returns the summary of the chat's active session covering
+// the most history, or nil when the session has none.
+func LatestSummary(database *sql.DB, chatID int64) (*Summary, error) {
+	s := &Summary{}
+	err := database.QueryRow(
+		`SELECT id, chat_id, from_history_id, to_history_id, summary, message_count, input_tokens, output_tokens
+		 FROM summaries WHERE chat_id = ? AND session_id IS `+activeSessionExpr+`
+		 ORDER BY to_history_id DESC, id DESC LIMIT 1`,
+		chatID, chatID,
+	).Scan(&s.ID, &s.ChatID, &s.FromHistoryID, &s.ToHistoryID, &s.Text, &s.MessageCount, &s.InputTokens, &s.OutputTokens)
+	if errors.Is(err, sql.ErrNoRows) {
+		return nil, nil
+	}
+	if err != nil {
+		return nil, err
+	}
+	return s, nil
+}
@@ -0,0 +1,31 @@
+package db
+
+import "testing"
+
+func TestLatestSummary(t *testing.T) {
+	db := testDB(t)
+	got, err := LatestSummary(db, 1)
+	if err != nil || got != nil {
+		t.Fatalf("expected no summary, got %+v err=%v", got, err)
+	}
+
+	first := &Summary{ChatID: 1, FromHistoryID: 1, ToHistoryID: 6, Text: "first", MessageCount: 6, InputTokens: 100, OutputTokens: 20}
+	if err := InsertSummary(db, first); err != nil || first.ID == 0 {
+		t.Fatalf("insert failed: id=%d err=%v", first.ID, err)
+	}
+	second := &Summary{ChatID: 1, FromHistoryID: 1, ToHistoryID: 12, Text: "second", MessageCount: 12}
+	if err := InsertSummary(db, second); err != nil {
+		t.Fatal(err)
+	}
+	if err := InsertSummary(db, &Summary{ChatID: 2, FromHistoryID: 20, ToHistoryID: 30, Text: "other chat", MessageCount: 4}); err != nil {
+		t.Fatal(err)
+	}
+
+	got, err = LatestSummary(db, 1)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if got == nil || *got != *second {
+		t.Fatalf("expected latest summary %+v, got %+v", second, got)
+	}
+}
@@ -1,6 +1,7 @@
 package dummy
 
 import (
+	"context"
 	"encoding/base64"
 	"fmt"
 	"strconv"
@@ -109,7 +110,7 @@ func (c *Commander) GetUpdates(offset int64, timeout int) ([]cmdpkg.Update, erro
 	case "ok":
 		return nil, nil
 	case "err":
-		return nil, fmt.Errorf("dummy commander error class=%s", emptyAs(a.arg, "command_source_api"))
+		return nil, &cmdpkg.Error{Source: "dummy", Err: fmt.Errorf("dummy commander error class=%s", emptyAs(a.arg, "command_source_api"))}
 	case "sleep":
 		ms, _ := strconv.Atoi(a.arg)
 		if ms > 0 {
@@ -133,7 +134,7 @@ func (c *Commander) GetUpdates(offset int64, timeout int) ([]cmdpkg.Update, erro
 	case "msgb64":
 		raw, err := base64.StdEncoding.DecodeString(a.arg)
 		if err != nil {
-			return nil, fmt.Errorf("dummy commander msgb64 decode failed: %w", err)
+			return nil, &cmdpkg.Error{Source: "dummy", Err: fmt.Errorf("dummy commander msgb64 decode failed: %w", err)}
 		}
 		msg := string(raw)
 		c.updateID++
@@ -152,7 +153,7 @@ func (c *Commander) GetUpdates(offset int64, timeout int) ([]cmdpkg.Update, erro
 	}
 }
 
-func (c *Commander) SendMessage(chatID int64, text string) error {
+func (c *Commander) SendMessage(ctx context.Context, chatID int64, text string) error {
 	c.mu.Lock()
 	defer c.mu.Unlock()
 	a := c.send.next()
@@ -160,11 +161,15 @@ func (c *Commander) SendMessage(chatID int64, text string) error {
 	case "ok":
 		return nil
 	case "err":
-		return fmt.Errorf("dummy commander send error class=%s", emptyAs(a.arg, "command_source_api"))
+		return &cmdpkg.Error{Source: "dummy", Err: fmt.Errorf("dummy commander send error class=%s", emptyAs(a.arg, "command_source_api"))}
 	case "sleep":
 		ms, _ := strconv.Atoi(a.arg)
 		if ms > 0 {
-			time.Sleep(time.Duration(ms) * time.Millisecond)
+			select {
+			case <-time.After(time.Duration(ms) * time.Millisecond):
+			case <-ctx.Done():
+				return &cmdpkg.Error{Source: "dummy", Err: fmt.Errorf("dummy commander send interrupted: %w", ctx.Err())}
+			}
 		}
 		return nil
 	default:
@@ -186,7 +191,7 @@ func NewProvider(model, script string) (*Provider, error) {
 	return &Provider{model: model, script: runner}, nil
 }
 
-func (p *Provider) ChatCompletion(messages []ctxpkg.Message) (modelpkg.CompletionResponse, error) {
+func (p *Provider) ChatCompletion(ctx context.Context, messages []ctxpkg.Message) (modelpkg.CompletionResponse, error) {
 	p.mu.Lock()
 	defer p.mu.Unlock()
 
@@ -199,11 +204,15 @@ func (p *Provider) ChatCompletion(messages []ctxpkg.Message) (modelpkg.Completio
 			OutputTokens: 1,
 		}, nil
 	case "err":
-		return modelpkg.CompletionResponse{}, fmt.Errorf("dummy provider error class=%s", emptyAs(a.arg, "provider_api"))
+		return modelpkg.CompletionResponse{}, providerError(a.arg)
 	case "sleep":
 		ms, _ := strconv.Atoi(a.arg)
 		if ms > 0 {
-			time.Sleep(time.Duration(ms) * time.Millisecond)
+			select {
+			case <-time.After(time.Duration(ms) * time.Millisecond):
+			case <-ctx.Done():
+				return modelpkg.CompletionResponse{}, modelpkg.TransportError("dummy", ctx.Err())
+			}
 		}
 		return modelpkg.CompletionResponse{
 			Content:      "dummy-after-sleep",
@@ -219,7 +228,7 @@ func (p *Provider) ChatCompletion(messages []ctxpkg.Message) (modelpkg.Completio
 	case "msgb64":
 		raw, err := base64.StdEncoding.DecodeString(a.arg)
 		if err != nil {
-			return modelpkg.CompletionResponse{}, fmt.Errorf("dummy provider msgb64 decode failed: %w", err)
+			return modelpkg.CompletionResponse{}, &modelpkg.Error{Class: modelpkg.ErrBadRequest, Provider: "dummy", Message: "msgb64 decode failed", Err: err}
 		}
 		return modelpkg.CompletionResponse{
 			Content:      string(raw),
@@ -235,6 +244,25 @@ func (p *Provider) ChatCompletion(messages []ctxpkg.Message) (modelpkg.Completio
 	}
 }
 
+// providerError builds the typed error for an "err:<class>[:<retry_after_seconds>]"
+// action. Classes that are not model error classes (such as the legacy
+// provider_api) map to a retryable server error.
+func providerError(arg string) error {
+	class, retryAfter, _ := strings.Cut(emptyAs(arg, "provider_api"), ":")
+	e := &modelpkg.Error{Class: modelpkg.ErrorClass(class), Provider: "dummy", Message: "scripted failure"}
+	switch e.Class {
+	case modelpkg.ErrRateLimited, modelpkg.ErrAuth, modelpkg.ErrContextLengthExceeded,
+		modelpkg.ErrServer, modelpkg.ErrTimeout, modelpkg.ErrBadRequest:
+	default:
+		e.Class = modelpkg.ErrServer
+		e.Message = "scripted failure class=" + class
+	}
+	if secs, err := strconv.Atoi(retryAfter); err == nil && secs > 0 {
+		e.RetryAfter = time.Duration(secs) * time.Second
+	}
+	return e
+}
+
 func emptyAs(v string, fallback string) string {
 	if strings.TrimSpace(v) == "" {
 		return fallback
@@ -1,9 +1,12 @@
 package dummy
 
 import (
+	"context"
 	"testing"
+	"time"
 
 	ctxpkg "github.com/stupiduntilnot/autonous/internal/context"
+	modelpkg "github.com/stupiduntilnot/autonous/internal/model"
 )
 
 func TestNewProvider_InvalidScript(t *testing.T) {
@@ -19,12 +22,12 @@ func TestProvider_ScriptedResponses(t *testing.T) {
 		t.Fatal(err)
 	}
 
-	_, err = p.ChatCompletion([]ctxpkg.Message{{Role: "user", Content: "hi"}})
+	_, err = p.ChatCompletion(context.Background(), []ctxpkg.Message{{Role: "user", Content: "hi"}})
 	if err == nil {
 		t.Fatal("expected first call to error")
 	}
 
-	resp, err := p.ChatCompletion([]ctxpkg.Message{{Role: "user", Content: "hi"}})
+	resp, err := p.ChatCompletion(context.Background(), []ctxpkg.Message{{Role: "user", Content: "hi"}})
 	if err != nil {
 		t.Fatal(err)
 	}
@@ -33,6 +36,50 @@ func TestProvider_ScriptedResponses(t *testing.T) {
 	}
 }
 
+func TestProvider_TypedErrors(t *testing.T) {
+	p, err := NewProvider("x", "err:rate_limited:5,err:auth,err:provider_api")
+	if err != nil {
+		t.Fatal(err)
+	}
+	want := []struct {
+		class      modelpkg.ErrorClass
+		retryAfter time.Duration
+	}{
+		{modelpkg.ErrRateLimited, 5 * time.Second},
+		{modelpkg.ErrAuth, 0},
+		{modelpkg.ErrServer, 0},
+	}
+	for i, w := range want {
+		_, err := p.ChatCompletion(context.Background(), nil)
+		perr, ok := modelpkg.AsError(err)
+		if !ok {
+			t.Fatalf("call %d: expected typed error, got %v", i, err)
+		}
+		if perr.Class != w.class || perr.RetryAfter != w.retryAfter {
+			t.Fatalf("call %d: got class=%s retry_after=%s", i, perr.Class, perr.RetryAfter)
+		}
+	}
+}
+
+func TestProvider_SleepHonorsContext(t *testing.T) {
+	p, err := NewProvider("x", "sleep:5000")
+	if err != nil {
+		t.Fatal(err)
+	}
+	ctx, cancel := context.WithTimeout(context.Background(), 50*time.Millisecond)
+	defer cancel()
+
+	started := time.Now()
+	_, err = p.ChatCompletion(ctx, nil)
+	if time.Since(started) > time.Second {
+		t.Fatal("expected sleep to stop at the context deadline")
+	}
+	perr, ok := modelpkg.AsError(err)
+	if !ok || perr.Class != modelpkg.ErrTimeout {
+		t.Fatalf("expected timeout error, got %v", err)
+	}
+}
+
 func TestCommander_MsgAction(t *testing.T) {
 	c, err := NewCommander("msg:test-msg", "ok")
 	if err != nil {
@@ -55,7 +102,7 @@ func TestProvider_MsgB64Action(t *testing.T) {
 	if err != nil {
 		t.Fatal(err)
 	}
-	resp, err := p.ChatCompletion([]ctxpkg.Message{{Role: "user", Content: "hi"}})
+	resp, err := p.ChatCompletion(context.Background(), []ctxpkg.Message{{Role: "user", Content: "hi"}})
 	if err != nil {
 		t.Fatal(err)
 	}
@@ -63,3 +110,28 @@ func TestProvider_MsgB64Action(t *testing.T) {
 		t.Fatalf("expected hello, got %q", resp.Content)
 	}
 }
+
+func TestEmbedder_DeterministicAndSimilar(t *testing.T) {
+	e := NewEmbedder(64)
+	resp, err := e.Embed(context.Background(), []string{"数据库迁移方案", "数据库迁移", "deploy the frontend", "数据库迁移方案"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	dot := func(a, b []float32) float32 {
+		var s float32
+		for i := range a {
+			s += a[i] * b[i]
+		}
+		return s
+	}
+	v := resp.Vectors
+	if len(v) != 4 || len(v[0]) != 64 || e.Model() != "dummy-hash-64" {
+		t.Fatalf("unexpected vectors %d x %d model=%s", len(v), len(v[0]), e.Model())
+	}
+	if dot(v[0], v[3]) < 0.999 {
+		t.Fatal("expected identical texts to embed identically")
+	}
+	if dot(v[0], v[1]) <= dot(v[0], v[2]) {
+		t.Fatalf("expected related texts closer: related=%f unrelated=%f", dot(v[0], v[1]), dot(v[0], v[2]))
+	}
+}
@@ -0,0 +1,98 @@
+package dummy
+
+import (
+	"context"
+	"hash/fnv"
+	"math"
+	"strconv"
+	"strings"
+	"unicode"
+
+	modelpkg "github.com/stupiduntilnot/autonous/internal/model"
+)
+
+// Embedder is a deterministic offline embedder for tests and dummy runs. It
+// hashes lowercase words and CJK character bigrams into a fixed number of
+// dimensions, so texts sharing vocabulary get similar vectors.
+type Embedder struct {
+	dims int
+}
+
+// NewEmbedder returns an embedder producing dims-dimensional vectors.
+func NewEmbedder(dims int) *Embedder {
+	if dims <= 0 {
+		dims = 64
+	}
+	return &Embedder{dims: dims}
+}
+
+// Model names the vector space, including its size.
+func (e *Embedder) Model() string {
+	return "dummy-hash-" + strconv.Itoa(e.dims)
+}
+
+// Embed returns one unit vector per text; InputTokens counts the hashed
+// features.
+func (e *Embedder) Embed(ctx context.Context, texts []string) (modelpkg.EmbeddingResponse, error) {
+	if err := ctx.Err(); err != nil {
+		return modelpkg.EmbeddingResponse{}, err
+	}
+	resp := modelpkg.EmbeddingResponse{Vectors: make([][]float32, len(texts))}
+	for i, text := range texts {
+		vec := make([]float32, e.dims)
+		features := embeddingFeatures(text)
+		for _, f := range features {
+			h := fnv.New32a()
+			h.Write([]byte(f))
+			sum := h.Sum32()
+			sign := float32(1)
+			if sum&(1<<31) != 0 {
+				sign = -1
+			}
+			vec[int(sum%uint32(e.dims))] += sign
+		}
+		var norm float64
+		for _, v := range vec {
+			norm += float64(v) * float64(v)
+		}
+		if norm > 0 {
+			scale := float32(1 / math.Sqrt(norm))
+			for j := range vec {
+				vec[j] *= scale
+			}
+		}
+		resp.Vectors[i] = vec
+		resp.InputTokens += len(features)
+	}
+	return resp, nil
+}
+
+func embeddingFeatures(text string) []string {
+	var features []string
+	var word []rune
+	var prevCJK rune
+	flushWord := func() {
+		if len(word) > 0 {
+			features = append(features, string(word))
+			word = word[:0]
+		}
+	}
+	for _, r := range strings.ToLower(text) {
+		switch {
+		case unicode.Is(unicode.Han, r):
+			flushWord()
+			if prevCJK != 0 {
+				features = append(features, string([]rune{prevCJK, r}))
+			}
+			prevCJK = r
+			continue
+		case unicode.IsLetter(r) || unicode.IsDigit(r):
+			word = append(word, r)
+		default:
+			flushWord()
+		}
+		prevCJK = 0
+	}
+	flushWord()
+	return features
+}
@@ -0,0 +1,108 @@
+// Package memory is the agent's long-term memory: short facts saved through
+// the memory tool in the memories table, global or per chat, and the most
+// relevant of them rendered into every assembled context.
+package memory
+
+import (
+	"fmt"
+	"sort"
+	"strings"
+	"unicode"
+
+	"github.com/stupiduntilnot/autonous/internal/db"
+)
+
+// Header starts the system message listing memories.
+const Header = "Long-term memories (saved with the memory tool; global ones apply to every chat):"
+
+// Rank orders memories by how many terms of query their key and content
+// contain, most recently updated first among equals, and returns the first
+// n. Memories matching no term are still kept when there is room, so recent
+// standing facts reach the model even for unrelated messages.
+func Rank(memories []db.Memory, query string, n int) []db.Memory {
+	if n <= 0 || len(memories) == 0 {
+		return nil
+	}
+	qt := terms(query)
+	scores := make(map[int64]int, len(memories))
+	for _, m := range memories {
+		text := strings.ToLower(m.Key + " " + m.Content)
+		for _, t := range qt {
+			if strings.Contains(text, t) {
+				scores[m.ID]++
+			}
+		}
+	}
+	out := append([]db.Memory(nil), memories...)
+	sort.SliceStable(out, func(i, j int) bool {
+		if scores[out[i].ID] != scores[out[j].ID] {
+			return scores[out[i].ID] > scores[out[j].ID]
+		}
+		if out[i].UpdatedAt != out[j].UpdatedAt {
+			return out[i].UpdatedAt > out[j].UpdatedAt
+		}
+		return out[i].ID > out[j].ID
+	})
+	return out[:min(n, len(out))]
+}
+
+// Render returns the system message listing memories, or "" when there are
+// none.
+func Render(memories []db.Memory) string {
+	if len(memories) == 0 {
+		return ""
+	}
+	var b strings.Builder
+	b.WriteString(Header)
+	for _, m := range memories {
+		fmt.Fprintf(&b, "\n- [%s] %s: %s", m.Scope, m.Key, m.Content)
+	}
+	return b.String()
+}
+
+// terms splits query into lowercase words of at least two characters, and
+// runs of CJK characters into overlapping bigrams, since Chinese has no
+// spaces to split on.
+func terms(query string) []string {
+	seen := map[string]bool{}
+	var out []string
+	add := func(t string) {
+		if !seen[t] {
+			seen[t] = true
+			out = append(out, t)
+		}
+	}
+	for _, w := range strings.FieldsFunc(strings.ToLower(query), func(r rune) bool {
+		return !unicode.IsLetter(r) && !unicode.IsDigit(r)
+	}) {
+		var ascii []rune
+		var cjk []rune
+		flush := func() {
+			if len(ascii) >= 2 {
+				add(string(ascii))
+			}
+			if len(cjk) == 1 {
+				add(string(cjk))
+			}
+			for i := 0; i+1 < len(cjk); i++ {
+				add(string(cjk[i : i+2]))
+			}
+			ascii, cjk = ascii[:0], cjk[:0]
+		}
+		for _, r := range w {
+			if unicode.Is(unicode.Han, r) {
+				if len(ascii) > 0 {
+					flush()
+				}
+				cjk = append(cjk, r)
+				continue
+			}
+			if len(cjk) > 0 {
+				flush()
+			}
+			ascii = append(ascii, r)
+		}
+		flush()
+	}
+	return out
+}
@@ -0,0 +1,115 @@
+package memory
+
+import (
+	"context"
+	"database/sql"
+	"encoding/json"
+	"strings"
+	"testing"
+
+	"github.com/stupiduntilnot/autonous/internal/db"
+	toolpkg "github.com/stupiduntilnot/autonous/internal/tool"
+)
+
+func testDB(t *testing.T) *sql.DB {
+	t.Helper()
+	database, err := db.OpenDB(t.TempDir() + "/memory.db")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := db.InitSchema(database); err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { _ = database.Close() })
+	return database
+}
+
+func TestRank_PrefersMatchesThenRecency(t *testing.T) {
+	mems := []db.Memory{
+		{ID: 1, Key: "editor", Content: "vim", UpdatedAt: 30},
+		{ID: 2, Key: "部署", Content: "每周五部署", UpdatedAt: 10},
+		{ID: 3, Key: "timezone", Content: "Asia/Shanghai", UpdatedAt: 20},
+	}
+	got := Rank(mems, "什么时候部署？", 2)
+	if len(got) != 2 || got[0].ID != 2 || got[1].ID != 1 {
+		t.Fatalf("expected the deploy memory then the most recent, got %+v", got)
+	}
+	if got := Rank(mems, "", 5); len(got) != 3 || got[0].ID != 1 {
+		t.Fatalf("expected recency order without a query, got %+v", got)
+	}
+	if got := Rank(mems, "x", 0); got != nil {
+		t.Fatalf("expected nothing for n=0, got %+v", got)
+	}
+}
+
+func TestRender(t *testing.T) {
+	if Render(nil) != "" {
+		t.Fatal("expected no message without memories")
+	}
+	got := Render([]db.Memory{{Scope: "global", Key: "editor", Content: "vim"}})
+	if got != Header+"\n- [global] editor: vim" {
+		t.Fatalf("unexpected render %q", got)
+	}
+}
+
+func run(t *testing.T, tool *Tool, ctx context.Context, args string) (toolpkg.Result, error) {
+	t.Helper()
+	return tool.Execute(ctx, json.RawMessage(args))
+}
+
+func TestTool_SaveSearchDelete(t *testing.T) {
+	database := testDB(t)
+	tool := NewTool(database)
+	parent, err := db.LogEvent(database, nil, db.EventToolCallStarted, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	ctx := toolpkg.WithEventID(toolpkg.WithChatID(context.Background(), 5), parent)
+
+	if res, err := run(t, tool, ctx, `{"op":"save","key":"editor","content":"prefers vim"}`); err != nil || res.Stdout != `saved chat memory "editor"` {
+		t.Fatalf("unexpected save result %+v err=%v", res, err)
+	}
+	if res, err := run(t, tool, ctx, `{"op":"save","scope":"global","key":"owner","content":"the owner is Lin"}`); err != nil || !res.OK {
+		t.Fatalf("unexpected global save result %+v err=%v", res, err)
+	}
+	res, err := run(t, tool, ctx, `{"op":"search","query":"which editor"}`)
+	if err != nil || !strings.Contains(res.Stdout, "[chat] editor: prefers vim") || strings.Contains(res.Stdout, "owner") {
+		t.Fatalf("expected only the editor memory, got %+v err=%v", res, err)
+	}
+	other := toolpkg.WithChatID(context.Background(), 6)
+	res, err = run(t, tool, other, `{"op":"search"}`)
+	if err != nil || strings.Contains(res.Stdout, "editor") || !strings.Contains(res.Stdout, "[global] owner") {
+		t.Fatalf("expected another chat to see only global memories, got %+v err=%v", res, err)
+	}
+	if res, err := run(t, tool, ctx, `{"op":"delete","key":"editor"}`); err != nil || res.Stdout != `deleted chat memory "editor"` {
+		t.Fatalf("unexpected delete result %+v err=%v", res, err)
+	}
+	var events int
+	if err := database.QueryRow(`SELECT COUNT(*) FROM events WHERE parent_id = ? AND event_type IN (?, ?)`,
+		parent, db.EventMemorySaved, db.EventMemoryDeleted).Scan(&events); err != nil || events != 3 {
+		t.Fatalf("expected 3 memory events under the tool call, got %d err=%v", events, err)
+	}
+
+	if _, err := run(t, tool, context.Background(), `{"op":"save","key":"k","content":"v"}`); err == nil {
+		t.Fatal("expected a chat memory without a chat to fail")
+	}
+}
+
+func TestTool_Validate(t *testing.T) {
+	tool := NewTool(nil)
+	for _, args := range []string{
+		`{"op":"forget"}`,
+		`{"op":"save","key":"k"}`,
+		`{"op":"save","content":"v"}`,
+		`{"op":"delete"}`,
+		`{"op":"search","scope":"team"}`,
+		`{"op":"save","key":"k","content":"` + strings.Repeat("x", maxContentChars+1) + `"}`,
+	} {
+		if err := tool.Validate(json.RawMessage(args)); err == nil {
+			t.Fatalf("expected %s rejected", args)
+		}
+	}
+	if err := tool.Validate(json.RawMessage(`{"op":"search"}`)); err != nil {
+		t.Fatalf("unexpected err: %v", err)
+	}
+}
@@ -0,0 +1,182 @@
+package memory
+
+import (
+	"context"
+	"database/sql"
+	"encoding/json"
+	"fmt"
+	"strings"
+	"time"
+
+	"github.com/stupiduntilnot/autonous/internal/db"
+	toolpkg "github.com/stupiduntilnot/autonous/internal/tool"
+)
+
+const (
+	maxKeyChars     = 100
+	maxContentChars = 2000
+	defaultLimit    = 10
+	maxLimit        = 50
+)
+
+// ToolInput is the argument of the memory tool.
+type ToolInput struct {
+	Op      string `json:"op"`
+	Scope   string `json:"scope"`
+	Key     string `json:"key"`
+	Content string `json:"content"`
+	Query   string `json:"query"`
+	Limit   int    `json:"limit"`
+}
+
+// Tool saves, searches and deletes memories of the chat set on the call's
+// context with tool.WithChatID. Saves and deletes are recorded as
+// memory.saved and memory.deleted events under the call's tool event.
+type Tool struct {
+	DB *sql.DB
+}
+
+// NewTool returns the memory tool backed by database.
+func NewTool(database *sql.DB) *Tool {
+	return &Tool{DB: database}
+}
+
+func (t *Tool) Name() string { return "memory" }
+
+func (t *Tool) Description() string {
+	return "Long-term memory that persists across conversations. " +
+		"op=save stores content under key (replacing an existing key); " +
+		"op=search lists memories matching query, or the most recent without one; " +
+		"op=delete removes key. scope is \"chat\" (default, this chat only) or \"global\" (every chat). " +
+		"Save durable facts, preferences and decisions, not transient task state."
+}
+
+func (t *Tool) Schema() json.RawMessage {
+	return json.RawMessage(`{"type":"object","properties":{` +
+		`"op":{"type":"string","enum":["save","search","delete"]},` +
+		`"scope":{"type":"string","enum":["chat","global"]},` +
+		`"key":{"type":"string"},"content":{"type":"string"},` +
+		`"query":{"type":"string"},"limit":{"type":"integer"}},"required":["op"]}`)
+}
+
+func (t *Tool) Validate(raw json.RawMessage) error {
+	_, err := parseInput(raw)
+	return err
+}
+
+func (t *Tool) Execute(ctx context.Context, raw json.RawMessage) (toolpkg.Result, error) {
+	in, err := parseInput(raw)
+	if err != nil {
+		return toolpkg.Result{OK: false, ExitCode: 2, Stderr: err.Error()}, err
+	}
+	chatID, ok := toolpkg.ChatIDFrom(ctx)
+	if !ok && (in.Scope == db.MemoryScopeChat || in.Op == "search") {
+		err := fmt.Errorf("memory: no chat for this call")
+		return toolpkg.Result{OK: false, ExitCode: 1, Stderr: err.Error()}, err
+	}
+	var parentID *int64
+	if id, ok := toolpkg.EventIDFrom(ctx); ok {
+		parentID = &id
+	}
+
+	switch in.Op {
+	case "save":
+		m := &db.Memory{Scope: in.Scope, ChatID: chatID, Key: in.Key, Content: in.Content}
+		created, err := db.SaveMemoryWithEvent(t.DB, parentID, m)
+		if err != nil {
+			return toolpkg.Result{OK: false, ExitCode: 1, Stderr: err.Error()}, err
+		}
+		verb := "updated"
+		if created {
+			verb = "saved"
+		}
+		return toolpkg.Result{OK: true, Stdout: fmt.Sprintf("%s %s memory %q", verb, m.Scope, m.Key)}, nil
+
+	case "delete":
+		deleted, err := db.DeleteMemoryWithEvent(t.DB, parentID, in.Scope, chatID, in.Key)
+		if err != nil {
+			return toolpkg.Result{OK: false, ExitCode: 1, Stderr: err.Error()}, err
+		}
+		if !deleted {
+			return toolpkg.Result{OK: true, Stdout: fmt.Sprintf("no %s memory %q", in.Scope, in.Key)}, nil
+		}
+		return toolpkg.Result{OK: true, Stdout: fmt.Sprintf("deleted %s memory %q", in.Scope, in.Key)}, nil
+
+	default:
+		all, err := db.ListMemories(t.DB, chatID)
+		if err != nil {
+			return toolpkg.Result{OK: false, ExitCode: 1, Stderr: err.Error()}, err
+		}
+		found := all
+		if strings.TrimSpace(in.Query) != "" {
+			found = matching(all, in.Query)
+		}
+		found = found[:min(in.Limit, len(found))]
+		if len(found) == 0 {
+			return toolpkg.Result{OK: true, Stdout: "no memories found"}, nil
+		}
+		var b strings.Builder
+		for _, m := range found {
+			fmt.Fprintf(&b, "[%s] %s: %s (updated %s)\n", m.Scope, m.Key, m.Content,
+				time.Unix(m.UpdatedAt, 0).UTC().Format("2006-01-02"))
+		}
+		return toolpkg.Result{OK: true, Stdout: b.String(), Meta: map[string]any{"count": len(found)}}, nil
+	}
+}
+
+// matching returns the memories containing at least one term of query, best
+// match first.
+func matching(memories []db.Memory, query string) []db.Memory {
+	qt := terms(query)
+	var out []db.Memory
+	for _, m := range Rank(memories, query, len(memories)) {
+		text := strings.ToLower(m.Key + " " + m.Content)
+		for _, t := range qt {
+			if strings.Contains(text, t) {
+				out = append(out, m)
+				break
+			}
+		}
+	}
+	return out
+}
+
+func parseInput(raw json.RawMessage) (ToolInput, error) {
+	var in ToolInput
+	if err := json.Unmarshal(raw, &in); err != nil {
+		return in, fmt.Errorf("invalid memory input: %w", err)
+	}
+	in.Op = strings.TrimSpace(in.Op)
+	in.Key = strings.TrimSpace(in.Key)
+	if in.Scope == "" {
+		in.Scope = db.MemoryScopeChat
+	}
+	if in.Scope != db.MemoryScopeChat && in.Scope != db.MemoryScopeGlobal {
+		return in, fmt.Errorf("memory.scope must be chat or global")
+	}
+	switch in.Op {
+	case "save":
+		if strings.TrimSpace(in.Content) == "" {
+			return in, fmt.Errorf("memory.content is required for save")
+		}
+		if n := len([]rune(in.Content)); n > maxContentChars {
+			return in, fmt.Errorf("memory.content is %d characters, limit is %d", n, maxContentChars)
+		}
+		fallthrough
+	case "delete":
+		if in.Key == "" {
+			return in, fmt.Errorf("memory.key is required for %s", in.Op)
+		}
+		if n := len([]rune(in.Key)); n > maxKeyChars {
+			return in, fmt.Errorf("memory.key is %d characters, limit is %d", n, maxKeyChars)
+		}
+	case "search":
+		if in.Limit <= 0 {
+			in.Limit = defaultLimit
+		}
+		in.Limit = min(in.Limit, maxLimit)
+	default:
+		return in, fmt.Errorf("memory.op must be save, search or delete")
+	}
+	return in, nil
+}
@@ -0,0 +1,159 @@
+package model
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"net"
+	"net/http"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// ErrorClass categorizes provider failures.
+type ErrorClass string
+
+const (
+	ErrRateLimited           ErrorClass = "rate_limited"
+	ErrAuth                  ErrorClass = "auth"
+	ErrContextLengthExceeded ErrorClass = "context_length_exceeded"
+	ErrServer                ErrorClass = "server"
+	ErrTimeout               ErrorClass = "timeout"
+	ErrBadRequest            ErrorClass = "bad_request"
+)
+
+// Retryable reports whether a failure of this class may succeed if retried.
+func (c ErrorClass) Retryable() bool {
+	switch c {
+	case ErrRateLimited, ErrServer, ErrTimeout:
+		return true
+	default:
+		return false
+	}
+}
+
+// Error is the typed error returned by model providers.
+type Error struct {
+	Class      ErrorClass
+	Provider   string
+	StatusCode int
+	// RetryAfter is the server-requested delay before retrying, if any.
+	RetryAfter time.Duration
+	Message    string
+	Err        error
+}
+
+func (e *Error) Error() string {
+	var b strings.Builder
+	b.WriteString(e.Provider)
+	b.WriteString(" error class=")
+	b.WriteString(string(e.Class))
+	if e.StatusCode != 0 {
+		fmt.Fprintf(&b, " status=%d", e.StatusCode)
+	}
+	if e.RetryAfter > 0 {
+		fmt.Fprintf(&b, " retry_after=%s", e.RetryAfter)
+	}
+	if e.Message != "" {
+		b.WriteString(": ")
+		b.WriteString(e.Message)
+	}
+	if e.Err != nil {
+		b.WriteString(": ")
+		b.WriteString(e.Err.Error())
+	}
+	return b.String()
+}
+
+func (e *Error) Unwrap() error {
+	return e.Err
+}
+
+// AsError returns the typed provider error in err's chain, if any.
+func AsError(err error) (*Error, bool) {
+	var perr *Error
+	if errors.As(err, &perr) {
+		return perr, true
+	}
+	return nil, false
+}
+
+// IsRetryable reports whether err may succeed if retried. Errors that are
+// not typed provider errors are treated as retryable.
+func IsRetryable(err error) bool {
+	if perr, ok := AsError(err); ok {
+		return perr.Class.Retryable()
+	}
+	return true
+}
+
+// RetryAfter returns the server-requested retry delay carried by err, or 0.
+func RetryAfter(err error) time.Duration {
+	if perr, ok := AsError(err); ok {
+		return perr.RetryAfter
+	}
+	return 0
+}
+
+// HTTPError maps a non-success HTTP response to a typed provider error.
+func HTTPError(provider string, status int, header http.Header, body string) *Error {
+	e := &Error{Provider: provider, StatusCode: status, Message: body}
+	lower := strings.ToLower(body)
+	switch {
+	case status == http.StatusTooManyRequests:
+		e.Class = ErrRateLimited
+		e.RetryAfter = ParseRetryAfter(header, time.Now())
+	case status == http.StatusUnauthorized || status == http.StatusForbidden:
+		e.Class = ErrAuth
+	case status == http.StatusRequestTimeout || status == http.StatusGatewayTimeout:
+		e.Class = ErrTimeout
+	case status >= 500:
+		e.Class = ErrServer
+		e.RetryAfter = ParseRetryAfter(header, time.Now())
+	case strings.Contains(lower, "context_length_exceeded"),
+		strings.Contains(lower, "maximum context length"),
+		strings.Contains(lower, "prompt is too long"):
+		e.Class = ErrContextLengthExceeded
+	default:
+		e.Class = ErrBadRequest
+	}
+	return e
+}
+
+// TransportError maps a failed HTTP round trip to a typed provider error.
+func TransportError(provider string, err error) *Error {
+	class := ErrServer
+	var netErr net.Error
+	if errors.Is(err, context.DeadlineExceeded) || (errors.As(err, &netErr) && netErr.Timeout()) {
+		class = ErrTimeout
+	}
+	return &Error{Class: class, Provider: provider, Message: "request failed", Err: err}
+}
+
+// ParseRetryAfter reads the retry-after-ms or Retry-After header, accepting
+// either delay seconds or an HTTP date.
+func ParseRetryAfter(header http.Header, now time.Time) time.Duration {
+	if header == nil {
+		return 0
+	}
+	if v := strings.TrimSpace(header.Get("retry-after-ms")); v != "" {
+		if ms, err := strconv.ParseFloat(v, 64); err == nil && ms > 0 {
+			return time.Duration(ms * float64(time.Millisecond))
+		}
+	}
+	v := strings.TrimSpace(header.Get("Retry-After"))
+	if v == "" {
+		return 0
+	}
+	if secs, err := strconv.ParseFloat(v, 64); err == nil {
+		if secs <= 0 {
+			return 0
+		}
+		return time.Duration(secs * float64(time.Second))
+	}
+	if at, err := http.ParseTime(v); err == nil && at.After(now) {
+		return at.Sub(now)
+	}
+	return 0
+}
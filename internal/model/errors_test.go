@@ -0,0 +1,68 @@
+package model
+
+import (
+	"errors"
+	"fmt"
+	"net/http"
+	"testing"
+	"time"
+)
+
+func TestHTTPError_Classes(t *testing.T) {
+	cases := []struct {
+		status int
+		body   string
+		want   ErrorClass
+	}{
+		{429, "", ErrRateLimited},
+		{401, "", ErrAuth},
+		{403, "", ErrAuth},
+		{408, "", ErrTimeout},
+		{500, "", ErrServer},
+		{529, "overloaded", ErrServer},
+		{400, `{"error":{"code":"context_length_exceeded"}}`, ErrContextLengthExceeded},
+		{400, `{"error":{"message":"prompt is too long: 210000 tokens"}}`, ErrContextLengthExceeded},
+		{400, `{"error":"bad"}`, ErrBadRequest},
+		{404, "", ErrBadRequest},
+	}
+	for _, c := range cases {
+		got := HTTPError("openai", c.status, nil, c.body)
+		if got.Class != c.want {
+			t.Errorf("status=%d body=%q: got %s want %s", c.status, c.body, got.Class, c.want)
+		}
+	}
+}
+
+func TestParseRetryAfter(t *testing.T) {
+	now := time.Date(2026, 1, 2, 3, 4, 5, 0, time.UTC)
+	h := http.Header{}
+	h.Set("Retry-After", "12")
+	if got := ParseRetryAfter(h, now); got != 12*time.Second {
+		t.Fatalf("seconds: got %s", got)
+	}
+	h = http.Header{}
+	h.Set("Retry-After", now.Add(90*time.Second).Format(http.TimeFormat))
+	if got := ParseRetryAfter(h, now); got != 90*time.Second {
+		t.Fatalf("http date: got %s", got)
+	}
+	h.Set("retry-after-ms", "1500")
+	if got := ParseRetryAfter(h, now); got != 1500*time.Millisecond {
+		t.Fatalf("retry-after-ms: got %s", got)
+	}
+	if got := ParseRetryAfter(http.Header{}, now); got != 0 {
+		t.Fatalf("missing header: got %s", got)
+	}
+}
+
+func TestRetryHelpers_UnwrapChains(t *testing.T) {
+	err := fmt.Errorf("turn failed: %w", &Error{Class: ErrRateLimited, RetryAfter: 3 * time.Second})
+	if !IsRetryable(err) || RetryAfter(err) != 3*time.Second {
+		t.Fatalf("expected retryable rate limit with retry-after, got %v", err)
+	}
+	if IsRetryable(&Error{Class: ErrAuth}) {
+		t.Fatal("auth should not be retryable")
+	}
+	if !IsRetryable(errors.New("untyped")) {
+		t.Fatal("untyped errors should stay retryable")
+	}
+}
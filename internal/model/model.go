@@ -1,15 +1,65 @@
 package model
 
-import ctxpkg "github.com/stupiduntilnot/autonous/internal/context"
+import (
+	"context"
+	"encoding/json"
+
+	ctxpkg "github.com/stupiduntilnot/autonous/internal/context"
+)
 
 // CompletionResponse is the common response model for model providers.
 type CompletionResponse struct {
 	Content      string
+	ToolCalls    []ctxpkg.ToolCall
 	InputTokens  int
 	OutputTokens int
+	// Route is set by composite providers to the backend that served the call.
+	Route *Route
+}
+
+// Route identifies the concrete backend a composite provider dispatched to.
+type Route struct {
+	Backend   string
+	Model     string
+	Failovers int
 }
 
-// Provider is the model provider abstraction used by worker.
+// Provider is the model provider abstraction used by worker. Implementations
+// must abandon the request when ctx is done.
 type Provider interface {
-	ChatCompletion(messages []ctxpkg.Message) (CompletionResponse, error)
+	ChatCompletion(ctx context.Context, messages []ctxpkg.Message) (CompletionResponse, error)
+}
+
+// ToolDefinition declares a tool the model may call natively.
+type ToolDefinition struct {
+	Name        string
+	Description string
+	Parameters  json.RawMessage
+}
+
+// ToolCaller is implemented by providers with native function calling.
+// Providers without it fall back to the JSON-in-content tool protocol.
+type ToolCaller interface {
+	ChatCompletionWithTools(ctx context.Context, messages []ctxpkg.Message, tools []ToolDefinition) (CompletionResponse, error)
+}
+
+// Streamer is implemented by providers that can stream completions.
+// onDelta receives content text as it arrives; the returned response carries
+// the full content, tool calls and usage exactly as a non-streaming call would.
+type Streamer interface {
+	ChatCompletionStream(ctx context.Context, messages []ctxpkg.Message, tools []ToolDefinition, onDelta func(delta string)) (CompletionResponse, error)
+}
+
+// EmbeddingResponse carries one vector per input text, in input order.
+type EmbeddingResponse struct {
+	Vectors     [][]float32
+	InputTokens int
+}
+
+// Embedder turns texts into vectors for semantic search. Model identifies
+// the vector space, so vectors from different models are never compared.
+// Implementations must abandon the request when ctx is done.
+type Embedder interface {
+	Model() string
+	Embed(ctx context.Context, texts []string) (EmbeddingResponse, error)
 }
@@ -0,0 +1,87 @@
+package openai
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"io"
+	"net/http"
+	"time"
+
+	modelpkg "github.com/stupiduntilnot/autonous/internal/model"
+)
+
+// EmbeddingClient is a minimal client for OpenAI-compatible embeddings
+// endpoints.
+type EmbeddingClient struct {
+	apiKey     string
+	url        string
+	model      string
+	httpClient *http.Client
+}
+
+// NewEmbeddingClient creates an embeddings client.
+func NewEmbeddingClient(apiKey, url, model string, timeout time.Duration) *EmbeddingClient {
+	return &EmbeddingClient{
+		apiKey: apiKey,
+		url:    url,
+		model:  model,
+		httpClient: &http.Client{
+			Timeout: timeout,
+		},
+	}
+}
+
+type embeddingRequest struct {
+	Model string   `json:"model"`
+	Input []string `json:"input"`
+}
+
+type embeddingResponse struct {
+	Data []struct {
+		Index     int       `json:"index"`
+		Embedding []float32 `json:"embedding"`
+	} `json:"data"`
+	Usage *usage `json:"usage"`
+}
+
+// Model returns the embedding model name.
+func (c *EmbeddingClient) Model() string { return c.model }
+
+// Embed returns one vector per text, in input order.
+func (c *EmbeddingClient) Embed(ctx context.Context, texts []string) (modelpkg.EmbeddingResponse, error) {
+	if len(texts) == 0 {
+		return modelpkg.EmbeddingResponse{}, nil
+	}
+	resp, err := postJSON(ctx, c.httpClient, c.url, c.apiKey, embeddingRequest{Model: c.model, Input: texts})
+	if err != nil {
+		return modelpkg.EmbeddingResponse{}, err
+	}
+	defer resp.Body.Close()
+
+	body, err := io.ReadAll(resp.Body)
+	if err != nil {
+		return modelpkg.EmbeddingResponse{}, modelpkg.TransportError("openai", fmt.Errorf("failed reading response: %w", err))
+	}
+	var parsed embeddingResponse
+	if err := json.Unmarshal(body, &parsed); err != nil {
+		return modelpkg.EmbeddingResponse{}, &modelpkg.Error{Class: modelpkg.ErrServer, Provider: "openai", Message: "failed to parse embeddings response: " + truncate(string(body), 400)}
+	}
+
+	result := modelpkg.EmbeddingResponse{Vectors: make([][]float32, len(texts))}
+	if parsed.Usage != nil {
+		result.InputTokens = parsed.Usage.PromptTokens
+	}
+	for _, d := range parsed.Data {
+		if d.Index < 0 || d.Index >= len(texts) {
+			return modelpkg.EmbeddingResponse{}, &modelpkg.Error{Class: modelpkg.ErrServer, Provider: "openai", Message: fmt.Sprintf("embedding index %d out of range", d.Index)}
+		}
+		result.Vectors[d.Index] = d.Embedding
+	}
+	for i, v := range result.Vectors {
+		if len(v) == 0 {
+			return modelpkg.EmbeddingResponse{}, &modelpkg.Error{Class: modelpkg.ErrServer, Provider: "openai", Message: fmt.Sprintf("missing embedding for input %d", i)}
+		}
+	}
+	return result, nil
+}
@@ -2,6 +2,7 @@ package openai
 
 import (
 	"bytes"
+	"context"
 	"encoding/json"
 	"fmt"
 	"io"
@@ -38,20 +39,53 @@ type CompletionResponse = modelpkg.CompletionResponse
 
 // message is the internal JSON-serializable chat message for OpenAI API.
 type message struct {
-	Role    string `json:"role"`
-	Content string `json:"content"`
+	Role       string     `json:"role"`
+	Content    string     `json:"content"`
+	ToolCalls  []toolCall `json:"tool_calls,omitempty"`
+	ToolCallID string     `json:"tool_call_id,omitempty"`
+}
+
+type toolCall struct {
+	ID       string       `json:"id"`
+	Type     string       `json:"type"`
+	Function functionCall `json:"function"`
+}
+
+type functionCall struct {
+	Name      string `json:"name"`
+	Arguments string `json:"arguments"`
+}
+
+type toolSpec struct {
+	Type     string       `json:"type"`
+	Function functionSpec `json:"function"`
+}
+
+type functionSpec struct {
+	Name        string          `json:"name"`
+	Description string          `json:"description,omitempty"`
+	Parameters  json.RawMessage `json:"parameters"`
 }
 
 type chatRequest struct {
-	Model       string    `json:"model"`
-	Messages    []message `json:"messages"`
-	Temperature float32   `json:"temperature,omitempty"`
+	Model         string         `json:"model"`
+	Messages      []message      `json:"messages"`
+	Temperature   float32        `json:"temperature,omitempty"`
+	Tools         []toolSpec     `json:"tools,omitempty"`
+	ToolChoice    string         `json:"tool_choice,omitempty"`
+	Stream        bool           `json:"stream,omitempty"`
+	StreamOptions *streamOptions `json:"stream_options,omitempty"`
+}
+
+type streamOptions struct {
+	IncludeUsage bool `json:"include_usage"`
 }
 
 type chatResponse struct {
 	Choices []struct {
 		Message struct {
-			Content string `json:"content"`
+			Content   string     `json:"content"`
+			ToolCalls []toolCall `json:"tool_calls"`
 		} `json:"message"`
 	} `json:"choices"`
 	Usage *usage `json:"usage"`
@@ -63,49 +97,37 @@ type usage struct {
 }
 
 // ChatCompletion sends a chat completion request and returns a CompletionResponse.
-func (c *Client) ChatCompletion(messages []ctxpkg.Message) (modelpkg.CompletionResponse, error) {
-	internal := make([]message, len(messages))
-	for i, m := range messages {
-		internal[i] = message{Role: m.Role, Content: m.Content}
-	}
+func (c *Client) ChatCompletion(ctx context.Context, messages []ctxpkg.Message) (modelpkg.CompletionResponse, error) {
+	return c.ChatCompletionWithTools(ctx, messages, nil)
+}
 
+// ChatCompletionWithTools sends a chat completion request declaring tools for
+// native function calling. Tool calls from the response are returned in
+// CompletionResponse.ToolCalls.
+func (c *Client) ChatCompletionWithTools(ctx context.Context, messages []ctxpkg.Message, tools []modelpkg.ToolDefinition) (modelpkg.CompletionResponse, error) {
 	reqBody := chatRequest{
 		Model:       c.model,
-		Messages:    internal,
+		Messages:    toInternalMessages(messages),
 		Temperature: 0.2,
 	}
-	payload, err := json.Marshal(reqBody)
-	if err != nil {
-		return modelpkg.CompletionResponse{}, fmt.Errorf("failed to marshal openai request: %w", err)
+	if len(tools) > 0 {
+		reqBody.Tools = toToolSpecs(tools)
+		reqBody.ToolChoice = "auto"
 	}
-
-	req, err := http.NewRequest(http.MethodPost, c.url, bytes.NewReader(payload))
+	resp, err := c.post(ctx, reqBody)
 	if err != nil {
-		return modelpkg.CompletionResponse{}, fmt.Errorf("failed to create openai request: %w", err)
-	}
-	req.Header.Set("Content-Type", "application/json")
-	req.Header.Set("Authorization", "Bearer "+c.apiKey)
-
-	resp, err := c.httpClient.Do(req)
-	if err != nil {
-		return modelpkg.CompletionResponse{}, fmt.Errorf("openai request failed: %w", err)
+		return modelpkg.CompletionResponse{}, err
 	}
 	defer resp.Body.Close()
 
 	body, err := io.ReadAll(resp.Body)
 	if err != nil {
-		return modelpkg.CompletionResponse{}, fmt.Errorf("failed reading openai response: %w", err)
-	}
-
-	if resp.StatusCode < 200 || resp.StatusCode >= 300 {
-		truncated := truncate(string(body), 400)
-		return modelpkg.CompletionResponse{}, fmt.Errorf("openai non-success status=%d body=%s", resp.StatusCode, truncated)
+		return modelpkg.CompletionResponse{}, modelpkg.TransportError("openai", fmt.Errorf("failed reading response: %w", err))
 	}
 
 	var parsed chatResponse
 	if err := json.Unmarshal(body, &parsed); err != nil {
-		truncated := truncate(string(body), 400)
-		return modelpkg.CompletionResponse{}, fmt.Errorf("failed to parse openai response: %s", truncated)
+		return modelpkg.CompletionResponse{}, &modelpkg.Error{Class: modelpkg.ErrServer, Provider: "openai", Message: "failed to parse response: " + truncate(string(body), 400)}
 	}
 
 	result := modelpkg.CompletionResponse{}
@@ -120,8 +142,10 @@ func (c *Client) ChatCompletion(messages []ctxpkg.Message) (modelpkg.CompletionR
 		result.Content = "(empty model response)"
 		return result, nil
 	}
-	content := strings.TrimSpace(parsed.Choices[0].Message.Content)
-	if content == "" {
+	choice := parsed.Choices[0].Message
+	result.ToolCalls = fromInternalToolCalls(choice.ToolCalls)
+	content := strings.TrimSpace(choice.Content)
+	if content == "" && len(result.ToolCalls) == 0 {
 		result.Content = "(empty model response)"
 		return result, nil
 	}
@@ -129,6 +153,92 @@ func (c *Client) ChatCompletion(messages []ctxpkg.Message) (modelpkg.CompletionR
 	return result, nil
 }
 
+// post sends the request and returns the response for a 2xx status. Callers
+// must close the response body.
+func (c *Client) post(ctx context.Context, reqBody chatRequest) (*http.Response, error) {
+	return postJSON(ctx, c.httpClient, c.url, c.apiKey, reqBody)
+}
+
+// postJSON posts reqBody to url and returns the response for a 2xx status,
+// mapping failures to model errors. Callers must close the response body.
+func postJSON(ctx context.Context, httpClient *http.Client, url, apiKey string, reqBody any) (*http.Response, error) {
+	payload, err := json.Marshal(reqBody)
+	if err != nil {
+		return nil, &modelpkg.Error{Class: modelpkg.ErrBadRequest, Provider: "openai", Message: "failed to marshal request", Err: err}
+	}
+
+	req, err := http.NewRequestWithContext(ctx, http.MethodPost, url, bytes.NewReader(payload))
+	if err != nil {
+		return nil, &modelpkg.Error{Class: modelpkg.ErrBadRequest, Provider: "openai", Message: "failed to create request", Err: err}
+	}
+	req.Header.Set("Content-Type", "application/json")
+	req.Header.Set("Authorization", "Bearer "+apiKey)
+
+	resp, err := httpClient.Do(req)
+	if err != nil {
+		return nil, modelpkg.TransportError("openai", err)
+	}
+	if resp.StatusCode < 200 || resp.StatusCode >= 300 {
+		defer resp.Body.Close()
+		body, _ := io.ReadAll(resp.Body)
+		return nil, modelpkg.HTTPError("openai", resp.StatusCode, resp.Header, truncate(string(body), 400))
+	}
+	return resp, nil
+}
+
+func toInternalMessages(messages []ctxpkg.Message) []message {
+	internal := make([]message, len(messages))
+	for i, m := range messages {
+		internal[i] = message{Role: m.Role, Content: m.Content, ToolCallID: m.ToolCallID}
+		for _, tc := range m.ToolCalls {
+			args := strings.TrimSpace(string(tc.Arguments))
+			if args == "" {
+				args = "{}"
+			}
+			internal[i].ToolCalls = append(internal[i].ToolCalls, toolCall{
+				ID:       tc.ID,
+				Type:     "function",
+				Function: functionCall{Name: tc.Name, Arguments: args},
+			})
+		}
+	}
+	return internal
+}
+
+func toToolSpecs(tools []modelpkg.ToolDefinition) []toolSpec {
+	specs := make([]toolSpec, 0, len(tools))
+	for _, t := range tools {
+		params := t.Parameters
+		if len(params) == 0 {
+			params = json.RawMessage(`{"type":"object","properties":{}}`)
+		}
+		specs = append(specs, toolSpec{
+			Type:     "function",
+			Function: functionSpec{Name: t.Name, Description: t.Description, Parameters: params},
+		})
+	}
+	return specs
+}
+
+func fromInternalToolCalls(calls []toolCall) []ctxpkg.ToolCall {
+	if len(calls) == 0 {
+		return nil
+	}
+	out := make([]ctxpkg.ToolCall, 0, len(calls))
+	for _, tc := range calls {
+		args := strings.TrimSpace(tc.Function.Arguments)
+		if args == "" {
+			args = "{}"
+		}
+		out = append(out, ctxpkg.ToolCall{
+			ID:        tc.ID,
+			Name:      tc.Function.Name,
+			Arguments: json.RawMessage(args),
+		})
+	}
+	return out
+}
+
 func truncate(s string, maxChars int) string {
 	runes := []rune(s)
 	if len(runes) <= maxChars {
@@ -1,6 +1,7 @@
 package openai
 
 import (
+	"context"
 	"encoding/json"
 	"net/http"
 	"net/http/httptest"
@@ -8,6 +9,7 @@ import (
 	"time"
 
 	ctxpkg "github.com/stupiduntilnot/autonous/internal/context"
+	modelpkg "github.com/stupiduntilnot/autonous/internal/model"
 )
 
 func TestChatCompletion_WithUsage(t *testing.T) {
@@ -27,7 +29,7 @@ func TestChatCompletion_WithUsage(t *testing.T) {
 	defer server.Close()
 
 	client := NewClient("test-key", server.URL, "test-model", 5*time.Second)
-	result, err := client.ChatCompletion([]ctxpkg.Message{{Role: "user", Content: "hi"}})
+	result, err := client.ChatCompletion(context.Background(), []ctxpkg.Message{{Role: "user", Content: "hi"}})
 	if err != nil {
 		t.Fatal(err)
 	}
@@ -56,7 +58,7 @@ func TestChatCompletion_NoUsage(t *testing.T) {
 	defer server.Close()
 
 	client := NewClient("test-key", server.URL, "test-model", 5*time.Second)
-	result, err := client.ChatCompletion([]ctxpkg.Message{{Role: "user", Content: "hi"}})
+	result, err := client.ChatCompletion(context.Background(), []ctxpkg.Message{{Role: "user", Content: "hi"}})
 	if err != nil {
 		t.Fatal(err)
 	}
@@ -84,7 +86,7 @@ func TestChatCompletion_EmptyChoices(t *testing.T) {
 	defer server.Close()
 
 	client := NewClient("test-key", server.URL, "test-model", 5*time.Second)
-	result, err := client.ChatCompletion([]ctxpkg.Message{{Role: "user", Content: "hi"}})
+	result, err := client.ChatCompletion(context.Background(), []ctxpkg.Message{{Role: "user", Content: "hi"}})
 	if err != nil {
 		t.Fatal(err)
 	}
@@ -99,14 +101,192 @@ func TestChatCompletion_EmptyChoices(t *testing.T) {
 
 func TestChatCompletion_HTTPError(t *testing.T) {
 	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("Retry-After", "7")
 		w.WriteHeader(http.StatusTooManyRequests)
 		w.Write([]byte(`{"error":"rate limited"}`))
 	}))
 	defer server.Close()
 
 	client := NewClient("test-key", server.URL, "test-model", 5*time.Second)
-	_, err := client.ChatCompletion([]ctxpkg.Message{{Role: "user", Content: "hi"}})
+	_, err := client.ChatCompletion(context.Background(), []ctxpkg.Message{{Role: "user", Content: "hi"}})
 	if err == nil {
 		t.Fatal("expected error for 429 response")
 	}
+	perr, ok := modelpkg.AsError(err)
+	if !ok {
+		t.Fatalf("expected typed provider error, got %T", err)
+	}
+	if perr.Class != modelpkg.ErrRateLimited || perr.RetryAfter != 7*time.Second || perr.StatusCode != 429 {
+		t.Fatalf("unexpected error: %+v", perr)
+	}
+}
+
+func TestChatCompletion_ContextLengthError(t *testing.T) {
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.WriteHeader(http.StatusBadRequest)
+		w.Write([]byte(`{"error":{"code":"context_length_exceeded","message":"too long"}}`))
+	}))
+	defer server.Close()
+
+	client := NewClient("test-key", server.URL, "test-model", 5*time.Second)
+	_, err := client.ChatCompletion(context.Background(), []ctxpkg.Message{{Role: "user", Content: "hi"}})
+	perr, ok := modelpkg.AsError(err)
+	if !ok || perr.Class != modelpkg.ErrContextLengthExceeded {
+		t.Fatalf("expected context_length_exceeded, got %v", err)
+	}
+	if modelpkg.IsRetryable(err) {
+		t.Fatal("context_length_exceeded should not be retryable")
+	}
+}
+
+func TestChatCompletionWithTools_ParsesToolCalls(t *testing.T) {
+	var captured map[string]any
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if err := json.NewDecoder(r.Body).Decode(&captured); err != nil {
+			t.Errorf("decode request: %v", err)
+		}
+		resp := map[string]any{
+			"choices": []map[string]any{
+				{"message": map[string]any{
+					"content": nil,
+					"tool_calls": []map[string]any{
+						{
+							"id":   "call_1",
+							"type": "function",
+							"function": map[string]any{
+								"name":      "ls",
+								"arguments": `{"path":"."}`,
+							},
+						},
+					},
+				}},
+			},
+			"usage": map[string]any{"prompt_tokens": 5, "completion_tokens": 3},
+		}
+		w.Header().Set("Content-Type", "application/json")
+		json.NewEncoder(w).Encode(resp)
+	}))
+	defer server.Close()
+
+	client := NewClient("test-key", server.URL, "test-model", 5*time.Second)
+	tools := []modelpkg.ToolDefinition{
+		{Name: "ls", Description: "list", Parameters: json.RawMessage(`{"type":"object"}`)},
+	}
+	result, err := client.ChatCompletionWithTools(context.Background(), []ctxpkg.Message{{Role: "user", Content: "hi"}}, tools)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if captured["tool_choice"] != "auto" {
+		t.Errorf("expected tool_choice=auto, got %v", captured["tool_choice"])
+	}
+	reqTools, _ := captured["tools"].([]any)
+	if len(reqTools) != 1 {
+		t.Fatalf("expected 1 tool in request, got %v", captured["tools"])
+	}
+	fn, _ := reqTools[0].(map[string]any)["function"].(map[string]any)
+	if fn["name"] != "ls" {
+		t.Errorf("unexpected tool spec: %v", reqTools[0])
+	}
+
+	if result.Content != "" {
+		t.Errorf("expected empty content with tool calls, got %q", result.Content)
+	}
+	if len(result.ToolCalls) != 1 {
+		t.Fatalf("expected 1 tool call, got %d", len(result.ToolCalls))
+	}
+	tc := result.ToolCalls[0]
+	if tc.ID != "call_1" || tc.Name != "ls" || string(tc.Arguments) != `{"path":"."}` {
+		t.Errorf("unexpected tool call: %+v", tc)
+	}
+}
+
+func TestChatCompletion_SendsToolMessages(t *testing.T) {
+	var captured struct {
+		Messages []map[string]any `json:"messages"`
+		Tools    []any            `json:"tools"`
+	}
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if err := json.NewDecoder(r.Body).Decode(&captured); err != nil {
+			t.Errorf("decode request: %v", err)
+		}
+		resp := map[string]any{
+			"choices": []map[string]any{
+				{"message": map[string]any{"content": "done"}},
+			},
+		}
+		w.Header().Set("Content-Type", "application/json")
+		json.NewEncoder(w).Encode(resp)
+	}))
+	defer server.Close()
+
+	client := NewClient("test-key", server.URL, "test-model", 5*time.Second)
+	messages := []ctxpkg.Message{
+		{Role: "user", Content: "list"},
+		{Role: "assistant", ToolCalls: []ctxpkg.ToolCall{{ID: "call_1", Name: "ls", Arguments: json.RawMessage(`{"path":"."}`)}}},
+		{Role: "tool", ToolCallID: "call_1", Content: "a.txt"},
+	}
+	if _, err := client.ChatCompletion(context.Background(), messages); err != nil {
+		t.Fatal(err)
+	}
+
+	if len(captured.Tools) != 0 {
+		t.Errorf("expected no tools without definitions, got %v", captured.Tools)
+	}
+	if len(captured.Messages) != 3 {
+		t.Fatalf("expected 3 messages, got %d", len(captured.Messages))
+	}
+	calls, _ := captured.Messages[1]["tool_calls"].([]any)
+	if len(calls) != 1 {
+		t.Fatalf("expected assistant tool_calls, got %v", captured.Messages[1])
+	}
+	fn, _ := calls[0].(map[string]any)["function"].(map[string]any)
+	if fn["arguments"] != `{"path":"."}` {
+		t.Errorf("expected arguments serialized as string, got %v", fn["arguments"])
+	}
+	if captured.Messages[2]["role"] != "tool" || captured.Messages[2]["tool_call_id"] != "call_1" {
+		t.Errorf("unexpected tool message: %v", captured.Messages[2])
+	}
+}
+
+func TestEmbed_OrdersVectorsByIndex(t *testing.T) {
+	var got embeddingRequest
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.Header.Get("Authorization") != "Bearer test-key" {
+			t.Errorf("missing bearer token")
+		}
+		json.NewDecoder(r.Body).Decode(&got)
+		json.NewEncoder(w).Encode(map[string]any{
+			"data": []map[string]any{
+				{"index": 1, "embedding": []float32{0, 1}},
+				{"index": 0, "embedding": []float32{1, 0}},
+			},
+			"usage": map[string]any{"prompt_tokens": 5},
+		})
+	}))
+	defer server.Close()
+
+	client := NewEmbeddingClient("test-key", server.URL, "emb-model", 5*time.Second)
+	resp, err := client.Embed(context.Background(), []string{"a", "b"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if got.Model != "emb-model" || len(got.Input) != 2 {
+		t.Fatalf("unexpected request %+v", got)
+	}
+	if resp.Vectors[0][0] != 1 || resp.Vectors[1][1] != 1 || resp.InputTokens != 5 {
+		t.Fatalf("unexpected response %+v", resp)
+	}
+}
+
+func TestEmbed_MissingVectorIsServerError(t *testing.T) {
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		json.NewEncoder(w).Encode(map[string]any{"data": []map[string]any{{"index": 0, "embedding": []float32{1}}}})
+	}))
+	defer server.Close()
+
+	_, err := NewEmbeddingClient("k", server.URL, "m", 5*time.Second).Embed(context.Background(), []string{"a", "b"})
+	if e, ok := modelpkg.AsError(err); !ok || e.Class != modelpkg.ErrServer {
+		t.Fatalf("expected server error, got %v", err)
+	}
 }
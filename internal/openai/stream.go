@@ -0,0 +1,160 @@
+package openai
+
+import (
+	"bufio"
+	"context"
+	"encoding/json"
+	"fmt"
+	"sort"
+	"strings"
+
+	ctxpkg "github.com/stupiduntilnot/autonous/internal/context"
+	modelpkg "github.com/stupiduntilnot/autonous/internal/model"
+)
+
+type streamChunk struct {
+	Choices []struct {
+		Delta struct {
+			Content   string          `json:"content"`
+			ToolCalls []toolCallDelta `json:"tool_calls"`
+		} `json:"delta"`
+	} `json:"choices"`
+	Usage *usage `json:"usage"`
+	// Error is set when the server fails after the stream has started.
+	Error *streamError `json:"error"`
+}
+
+// streamError is the error object OpenAI sends in place of a chunk when a
+// request fails mid-stream, after the 200 response has been committed.
+type streamError struct {
+	Message string          `json:"message"`
+	Type    string          `json:"type"`
+	Code    json.RawMessage `json:"code"`
+}
+
+// toModelError classifies the error object by its type and code, which
+// carry what the HTTP status would have said before the stream began.
+func (e *streamError) toModelError(data string) *modelpkg.Error {
+	var code string
+	if json.Unmarshal(e.Code, &code) != nil {
+		code = strings.Trim(string(e.Code), `"`)
+	}
+	kind := strings.ToLower(e.Type + " " + code)
+	class := modelpkg.ErrServer
+	switch {
+	case strings.Contains(kind, "rate_limit"), strings.Contains(kind, "insufficient_quota"):
+		class = modelpkg.ErrRateLimited
+	case strings.Contains(kind, "context_length_exceeded"):
+		class = modelpkg.ErrContextLengthExceeded
+	case strings.Contains(kind, "authentication"), strings.Contains(kind, "invalid_api_key"), strings.Contains(kind, "permission"):
+		class = modelpkg.ErrAuth
+	case strings.Contains(kind, "timeout"):
+		class = modelpkg.ErrTimeout
+	case strings.Contains(kind, "invalid_request"):
+		class = modelpkg.ErrBadRequest
+	}
+	return &modelpkg.Error{Class: class, Provider: "openai", Message: "stream error: " + truncate(data, 400)}
+}
+
+type toolCallDelta struct {
+	Index    int    `json:"index"`
+	ID       string `json:"id"`
+	Function struct {
+		Name      string `json:"name"`
+		Arguments string `json:"arguments"`
+	} `json:"function"`
+}
+
+// ChatCompletionStream sends a streaming chat completion request and consumes
+// the SSE chunks. Content deltas are passed to onDelta as they arrive; tool
+// call fragments are accumulated by index and usage is taken from the final
+// chunk (stream_options.include_usage).
+func (c *Client) ChatCompletionStream(ctx context.Context, messages []ctxpkg.Message, tools []modelpkg.ToolDefinition, onDelta func(delta string)) (modelpkg.CompletionResponse, error) {
+	reqBody := chatRequest{
+		Model:         c.model,
+		Messages:      toInternalMessages(messages),
+		Temperature:   0.2,
+		Stream:        true,
+		StreamOptions: &streamOptions{IncludeUsage: true},
+	}
+	if len(tools) > 0 {
+		reqBody.Tools = toToolSpecs(tools)
+		reqBody.ToolChoice = "auto"
+	}
+
+	resp, err := c.post(ctx, reqBody)
+	if err != nil {
+		return modelpkg.CompletionResponse{}, err
+	}
+	defer resp.Body.Close()
+
+	var content strings.Builder
+	calls := map[int]*toolCall{}
+	result := modelpkg.CompletionResponse{}
+
+	scanner := bufio.NewScanner(resp.Body)
+	scanner.Buffer(make([]byte, 0, 64*1024), 4*1024*1024)
+	for scanner.Scan() {
+		line := strings.TrimSpace(scanner.Text())
+		if !strings.HasPrefix(line, "data:") {
+			continue
+		}
+		data := strings.TrimSpace(strings.TrimPrefix(line, "data:"))
+		if data == "[DONE]" {
+			break
+		}
+		var chunk streamChunk
+		if err := json.Unmarshal([]byte(data), &chunk); err != nil {
+			return modelpkg.CompletionResponse{}, &modelpkg.Error{Class: modelpkg.ErrServer, Provider: "openai", Message: "failed to parse stream chunk: " + truncate(data, 400)}
+		}
+		if chunk.Error != nil {
+			return modelpkg.CompletionResponse{}, chunk.Error.toModelError(data)
+		}
+		if chunk.Usage != nil {
+			result.InputTokens = chunk.Usage.PromptTokens
+			result.OutputTokens = chunk.Usage.CompletionTokens
+		}
+		if len(chunk.Choices) == 0 {
+			continue
+		}
+		delta := chunk.Choices[0].Delta
+		if delta.Content != "" {
+			content.WriteString(delta.Content)
+			if onDelta != nil {
+				onDelta(delta.Content)
+			}
+		}
+		for _, d := range delta.ToolCalls {
+			tc, ok := calls[d.Index]
+			if !ok {
+				tc = &toolCall{Type: "function"}
+				calls[d.Index] = tc
+			}
+			if d.ID != "" {
+				tc.ID = d.ID
+			}
+			tc.Function.Name += d.Function.Name
+			tc.Function.Arguments += d.Function.Arguments
+		}
+	}
+	if err := scanner.Err(); err != nil {
+		return modelpkg.CompletionResponse{}, modelpkg.TransportError("openai", fmt.Errorf("failed reading stream: %w", err))
+	}
+
+	indexes := make([]int, 0, len(calls))
+	for i := range calls {
+		indexes = append(indexes, i)
+	}
+	sort.Ints(indexes)
+	ordered := make([]toolCall, 0, len(indexes))
+	for _, i := range indexes {
+		ordered = append(ordered, *calls[i])
+	}
+	result.ToolCalls = fromInternalToolCalls(ordered)
+
+	result.Content = strings.TrimSpace(content.String())
+	if result.Content == "" && len(result.ToolCalls) == 0 {
+		result.Content = "(empty model response)"
+	}
+	return result, nil
+}
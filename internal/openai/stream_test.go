@@ -0,0 +1,124 @@
+package openai
+
+import (
+	"context"
+	"encoding/json"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+
+	ctxpkg "github.com/stupiduntilnot/autonous/internal/context"
+	modelpkg "github.com/stupiduntilnot/autonous/internal/model"
+)
+
+func TestChatCompletionStream_ContentAndUsage(t *testing.T) {
+	var captured map[string]any
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if err := json.NewDecoder(r.Body).Decode(&captured); err != nil {
+			t.Errorf("decode request: %v", err)
+		}
+		w.Header().Set("Content-Type", "text/event-stream")
+		io.WriteString(w, "data: {\"choices\":[{\"delta\":{\"role\":\"assistant\"}}]}\n\n")
+		io.WriteString(w, "data: {\"choices\":[{\"delta\":{\"content\":\"Hel\"}}]}\n\n")
+		io.WriteString(w, "data: {\"choices\":[{\"delta\":{\"content\":\"lo!\"}}]}\n\n")
+		io.WriteString(w, "data: {\"choices\":[],\"usage\":{\"prompt_tokens\":12,\"completion_tokens\":2}}\n\n")
+		io.WriteString(w, "data: [DONE]\n\n")
+	}))
+	defer server.Close()
+
+	client := NewClient("test-key", server.URL, "test-model", 5*time.Second)
+	var deltas []string
+	result, err := client.ChatCompletionStream(context.Background(), []ctxpkg.Message{{Role: "user", Content: "hi"}}, nil, func(d string) {
+		deltas = append(deltas, d)
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if captured["stream"] != true {
+		t.Errorf("expected stream=true in request, got %v", captured["stream"])
+	}
+	if strings.Join(deltas, "|") != "Hel|lo!" {
+		t.Errorf("unexpected deltas: %v", deltas)
+	}
+	if result.Content != "Hello!" {
+		t.Errorf("expected content 'Hello!', got %q", result.Content)
+	}
+	if result.InputTokens != 12 || result.OutputTokens != 2 {
+		t.Errorf("unexpected usage: in=%d out=%d", result.InputTokens, result.OutputTokens)
+	}
+}
+
+func TestChatCompletionStream_AccumulatesToolCalls(t *testing.T) {
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("Content-Type", "text/event-stream")
+		io.WriteString(w, "data: {\"choices\":[{\"delta\":{\"tool_calls\":[{\"index\":0,\"id\":\"call_1\",\"function\":{\"name\":\"ls\",\"arguments\":\"\"}}]}}]}\n\n")
+		io.WriteString(w, "data: {\"choices\":[{\"delta\":{\"tool_calls\":[{\"index\":0,\"function\":{\"arguments\":\"{\\\"path\\\":\"}}]}}]}\n\n")
+		io.WriteString(w, "data: {\"choices\":[{\"delta\":{\"tool_calls\":[{\"index\":0,\"function\":{\"arguments\":\"\\\".\\\"}\"}}]}}]}\n\n")
+		io.WriteString(w, "data: [DONE]\n\n")
+	}))
+	defer server.Close()
+
+	client := NewClient("test-key", server.URL, "test-model", 5*time.Second)
+	result, err := client.ChatCompletionStream(context.Background(), []ctxpkg.Message{{Role: "user", Content: "hi"}}, nil, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if result.Content != "" {
+		t.Errorf("expected empty content with tool calls, got %q", result.Content)
+	}
+	if len(result.ToolCalls) != 1 {
+		t.Fatalf("expected 1 tool call, got %d", len(result.ToolCalls))
+	}
+	tc := result.ToolCalls[0]
+	if tc.ID != "call_1" || tc.Name != "ls" || string(tc.Arguments) != `{"path":"."}` {
+		t.Errorf("unexpected tool call: %+v (args=%s)", tc, tc.Arguments)
+	}
+}
+
+func TestChatCompletionStream_HTTPError(t *testing.T) {
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.WriteHeader(http.StatusInternalServerError)
+		w.Write([]byte(`{"error":"boom"}`))
+	}))
+	defer server.Close()
+
+	client := NewClient("test-key", server.URL, "test-model", 5*time.Second)
+	_, err := client.ChatCompletionStream(context.Background(), []ctxpkg.Message{{Role: "user", Content: "hi"}}, nil, nil)
+	if err == nil {
+		t.Fatal("expected error for 500 response")
+	}
+}
+
+func TestChatCompletionStream_ErrorMidStream(t *testing.T) {
+	cases := map[string]modelpkg.ErrorClass{
+		`{"message":"The server had an error","type":"server_error","code":null}`:                          modelpkg.ErrServer,
+		`{"message":"Rate limit reached","type":"requests","code":"rate_limit_exceeded"}`:                  modelpkg.ErrRateLimited,
+		`{"message":"too long","type":"invalid_request_error","code":"context_length_exceeded"}`:           modelpkg.ErrContextLengthExceeded,
+		`{"message":"bad tool schema","type":"invalid_request_error","code":"invalid_value"}`:              modelpkg.ErrBadRequest,
+		`{"message":"Incorrect API key provided","type":"invalid_request_error","code":"invalid_api_key"}`: modelpkg.ErrAuth,
+	}
+	for object, want := range cases {
+		server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			w.Header().Set("Content-Type", "text/event-stream")
+			io.WriteString(w, "data: {\"choices\":[{\"delta\":{\"content\":\"Hel\"}}]}\n\n")
+			io.WriteString(w, "data: {\"error\":"+object+"}\n\n")
+		}))
+		client := NewClient("test-key", server.URL, "test-model", 5*time.Second)
+		var deltas []string
+		_, err := client.ChatCompletionStream(context.Background(), []ctxpkg.Message{{Role: "user", Content: "hi"}}, nil, func(d string) {
+			deltas = append(deltas, d)
+		})
+		server.Close()
+		perr, ok := modelpkg.AsError(err)
+		if !ok || perr.Class != want {
+			t.Fatalf("%s: expected %s error, got %v", object, want, err)
+		}
+		if !strings.Contains(perr.Message, "stream error") || len(deltas) != 1 {
+			t.Fatalf("%s: unexpected message %q or deltas %v", object, perr.Message, deltas)
+		}
+	}
+}
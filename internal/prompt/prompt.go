@@ -0,0 +1,221 @@
+// Package prompt resolves the worker's system prompt. Prompts are Go
+// text/template files in the config dir that can include other files from
+// it and use per-task variables; a chat may override the main file. Files
+// are re-read whenever their modification time or size changes, so edits
+// take effect on the next task without a restart.
+package prompt
+
+import (
+	"bytes"
+	"crypto/sha256"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"hash"
+	"os"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"sync"
+	"text/template"
+	"time"
+)
+
+// Sources of a resolved prompt, in order of precedence.
+const (
+	SourceChatFile = "chat_file"
+	SourceFile     = "file"
+	SourceEnv      = "env"
+	SourceBuiltin  = "builtin"
+)
+
+// maxIncludeDepth bounds nested includes, which also stops include cycles.
+const maxIncludeDepth = 8
+
+// Vars are the data prompt templates are executed with.
+type Vars struct {
+	Now       time.Time
+	ChatID    int64
+	Workspace string
+	ConfigDir string
+	Tools     []string
+	// HeadFunc resolves GitHead; it only runs when a template uses it.
+	HeadFunc func() string
+}
+
+// Date is Now as YYYY-MM-DD.
+func (v Vars) Date() string { return v.Now.Format("2006-01-02") }
+
+// GitHead is the workspace's current git revision, or "" when unknown.
+func (v Vars) GitHead() string {
+	if v.HeadFunc == nil {
+		return ""
+	}
+	return v.HeadFunc()
+}
+
+// Result is a resolved prompt.
+type Result struct {
+	Text   string
+	Source string
+	// Path is the main template file, empty for env and builtin prompts.
+	Path string
+	// Includes are the files pulled in by include, relative to the config dir.
+	Includes []string
+	// Hash identifies the template sources, not the rendered text, so it
+	// only changes when a file does.
+	Hash string
+	// SizeBytes is the size of the main template.
+	SizeBytes int
+	// Changed reports a Hash different from the last one resolved for the
+	// same chat.
+	Changed bool
+}
+
+// Loader resolves prompts with precedence chat file > file > env > builtin.
+// The chat file of chat N is ChatsDir()/N.md. It is safe for concurrent use.
+type Loader struct {
+	ConfigDir string
+	File      string
+	Env       string
+	Builtin   string
+
+	mu    sync.Mutex
+	files map[string]*cachedFile
+	last  map[int64]string
+}
+
+type cachedFile struct {
+	text    string
+	modTime time.Time
+	size    int64
+}
+
+// ChatsDir is where per-chat override files live.
+func (l *Loader) ChatsDir() string {
+	return filepath.Join(l.ConfigDir, "chats")
+}
+
+// Load resolves the prompt for vars.ChatID. A file that cannot be read is
+// skipped for the next source, and a template that fails to parse or execute
+// is used as plain text; either failure is returned alongside the result.
+func (l *Loader) Load(vars Vars) (Result, error) {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	if vars.ConfigDir == "" {
+		vars.ConfigDir = l.ConfigDir
+	}
+	var errs []error
+	res, ok := Result{}, false
+	if vars.ChatID != 0 {
+		path := filepath.Join(l.ChatsDir(), strconv.FormatInt(vars.ChatID, 10)+".md")
+		res, ok = l.fromFile(SourceChatFile, path, vars, &errs)
+	}
+	if !ok {
+		res, ok = l.fromFile(SourceFile, l.File, vars, &errs)
+	}
+	if !ok && strings.TrimSpace(l.Env) != "" {
+		res, ok = l.render(SourceEnv, "", l.Env, vars, &errs), true
+	}
+	if !ok {
+		res = l.render(SourceBuiltin, "", l.Builtin, vars, &errs)
+	}
+	if l.last == nil {
+		l.last = map[int64]string{}
+	}
+	res.Changed = l.last[vars.ChatID] != res.Hash
+	l.last[vars.ChatID] = res.Hash
+	return res, errors.Join(errs...)
+}
+
+func (l *Loader) fromFile(source, path string, vars Vars, errs *[]error) (Result, bool) {
+	if path == "" {
+		return Result{}, false
+	}
+	text, err := l.read(path)
+	if errors.Is(err, os.ErrNotExist) {
+		return Result{}, false
+	}
+	if err != nil {
+		*errs = append(*errs, err)
+		return Result{}, false
+	}
+	return l.render(source, path, text, vars, errs), true
+}
+
+// render executes text as a template, falling back to the raw text on error.
+func (l *Loader) render(source, path, text string, vars Vars, errs *[]error) Result {
+	res := Result{Source: source, Path: path, SizeBytes: len(text)}
+	h := sha256.New()
+	h.Write([]byte(text))
+	out, err := l.execute(path, text, vars, 0, &res, h)
+	if err != nil {
+		*errs = append(*errs, fmt.Errorf("prompt template %s: %w", source, err))
+		out = text
+	}
+	res.Text = out
+	res.Hash = hex.EncodeToString(h.Sum(nil))
+	return res
+}
+
+func (l *Loader) execute(name, text string, vars Vars, depth int, res *Result, h hash.Hash) (string, error) {
+	tmpl, err := template.New(name).Option("missingkey=zero").Funcs(template.FuncMap{
+		"include": func(rel string) (string, error) {
+			if depth+1 > maxIncludeDepth {
+				return "", fmt.Errorf("include %s: nested more than %d deep", rel, maxIncludeDepth)
+			}
+			path, err := l.includePath(rel)
+			if err != nil {
+				return "", err
+			}
+			data, err := l.read(path)
+			if err != nil {
+				return "", err
+			}
+			res.Includes = append(res.Includes, filepath.ToSlash(filepath.Clean(rel)))
+			h.Write([]byte("\x00" + rel + "\x00" + data))
+			return l.execute(path, data, vars, depth+1, res, h)
+		},
+	}).Parse(text)
+	if err != nil {
+		return "", err
+	}
+	var b bytes.Buffer
+	if err := tmpl.Execute(&b, vars); err != nil {
+		return "", err
+	}
+	return b.String(), nil
+}
+
+// includePath resolves rel inside the config dir.
+func (l *Loader) includePath(rel string) (string, error) {
+	clean := filepath.Clean(rel)
+	if rel == "" || filepath.IsAbs(clean) || clean == ".." || strings.HasPrefix(clean, ".."+string(filepath.Separator)) {
+		return "", fmt.Errorf("include %q: path must be relative to the config dir", rel)
+	}
+	return filepath.Join(l.ConfigDir, clean), nil
+}
+
+// read returns the file's text, re-reading it only when its modification
+// time or size changed since the last read.
+func (l *Loader) read(path string) (string, error) {
+	info, err := os.Stat(path)
+	if err != nil {
+		return "", err
+	}
+	if info.IsDir() {
+		return "", fmt.Errorf("read %s: is a directory", path)
+	}
+	if f, ok := l.files[path]; ok && f.modTime.Equal(info.ModTime()) && f.size == info.Size() {
+		return f.text, nil
+	}
+	data, err := os.ReadFile(path)
+	if err != nil {
+		return "", err
+	}
+	if l.files == nil {
+		l.files = map[string]*cachedFile{}
+	}
+	l.files[path] = &cachedFile{text: string(data), modTime: info.ModTime(), size: info.Size()}
+	return string(data), nil
+}
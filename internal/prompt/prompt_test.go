@@ -0,0 +1,121 @@
+package prompt
+
+import (
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+)
+
+func write(t *testing.T, path, content string, mtime time.Time) {
+	t.Helper()
+	if err := os.MkdirAll(filepath.Dir(path), 0o755); err != nil {
+		t.Fatal(err)
+	}
+	if err := os.WriteFile(path, []byte(content), 0o644); err != nil {
+		t.Fatal(err)
+	}
+	if err := os.Chtimes(path, mtime, mtime); err != nil {
+		t.Fatal(err)
+	}
+}
+
+func TestLoader_RendersVariablesAndIncludes(t *testing.T) {
+	dir := t.TempDir()
+	now := time.Now()
+	write(t, filepath.Join(dir, "AUTONOUS.md"), `today {{.Date}} chat {{.ChatID}} in {{.Workspace}} at {{.GitHead}}
+tools: {{join .Tools ", "}}
+{{include "parts/rules.md"}}`, now)
+	write(t, filepath.Join(dir, "parts/rules.md"), `rules for {{.ChatID}}`, now)
+	l := &Loader{ConfigDir: dir, File: filepath.Join(dir, "AUTONOUS.md"), Builtin: "builtin"}
+	vars := Vars{
+		Now: time.Date(2026, 3, 1, 8, 0, 0, 0, time.UTC), ChatID: 42, Workspace: "/workspace",
+		Tools: []string{"ls", "read"}, HeadFunc: func() string { return "abc123" },
+	}
+
+	res, err := l.Load(vars)
+	if err == nil || res.Source != SourceFile {
+		t.Fatalf("expected the undefined join function to fail the template, got %+v err=%v", res, err)
+	}
+	if !strings.HasPrefix(res.Text, "today {{.Date}}") {
+		t.Fatalf("expected raw text when the template fails, got %q", res.Text)
+	}
+
+	write(t, filepath.Join(dir, "AUTONOUS.md"), `today {{.Date}} chat {{.ChatID}} in {{.Workspace}} at {{.GitHead}}
+tools: {{range .Tools}}{{.}} {{end}}
+{{include "parts/rules.md"}}`, now.Add(time.Second))
+	res, err = l.Load(vars)
+	if err != nil {
+		t.Fatal(err)
+	}
+	want := "today 2026-03-01 chat 42 in /workspace at abc123\ntools: ls read \nrules for 42"
+	if res.Text != want || !res.Changed {
+		t.Fatalf("unexpected render %q changed=%v", res.Text, res.Changed)
+	}
+	if len(res.Includes) != 1 || res.Includes[0] != "parts/rules.md" || res.Hash == "" {
+		t.Fatalf("unexpected includes %v hash %q", res.Includes, res.Hash)
+	}
+	if again, _ := l.Load(vars); again.Changed || again.Hash != res.Hash {
+		t.Fatalf("expected an unchanged prompt, got %+v", again)
+	}
+
+	write(t, filepath.Join(dir, "parts/rules.md"), `new rules`, now.Add(2*time.Second))
+	if res, _ := l.Load(vars); !res.Changed || !strings.HasSuffix(res.Text, "new rules") {
+		t.Fatalf("expected an edited include picked up, got %+v", res)
+	}
+}
+
+func TestLoader_ChatOverrideAndFallbacks(t *testing.T) {
+	dir := t.TempDir()
+	now := time.Now()
+	l := &Loader{ConfigDir: dir, File: filepath.Join(dir, "AUTONOUS.md"), Env: "env {{.ChatID}}", Builtin: "builtin"}
+	if res, err := l.Load(Vars{ChatID: 7}); err != nil || res.Source != SourceEnv || res.Text != "env 7" {
+		t.Fatalf("expected env prompt without files, got %+v err=%v", res, err)
+	}
+	write(t, filepath.Join(dir, "AUTONOUS.md"), "main", now)
+	write(t, filepath.Join(l.ChatsDir(), "7.md"), "chat seven", now)
+	if res, _ := l.Load(Vars{ChatID: 7}); res.Source != SourceChatFile || res.Text != "chat seven" {
+		t.Fatalf("expected the chat override, got %+v", res)
+	}
+	if res, _ := l.Load(Vars{ChatID: 8}); res.Source != SourceFile || res.Text != "main" {
+		t.Fatalf("expected the main file for another chat, got %+v", res)
+	}
+	l.Env = ""
+	if err := os.Remove(filepath.Join(dir, "AUTONOUS.md")); err != nil {
+		t.Fatal(err)
+	}
+	if res, _ := l.Load(Vars{ChatID: 8}); res.Source != SourceBuiltin || res.Text != "builtin" || !res.Changed {
+		t.Fatalf("expected builtin after the file is removed, got %+v", res)
+	}
+}
+
+func TestLoader_FileReadErrorFallsBackToEnv(t *testing.T) {
+	dir := t.TempDir()
+	// A directory cannot be read as a file, unlike a missing one.
+	l := &Loader{ConfigDir: dir, File: dir, Env: "env-fallback", Builtin: "builtin"}
+	res, err := l.Load(Vars{})
+	if err == nil || res.Source != SourceEnv || res.Text != "env-fallback" {
+		t.Fatalf("expected the read error reported with the env prompt, got %+v err=%v", res, err)
+	}
+	write(t, filepath.Join(dir, "AUTONOUS.md"), "系统指令", time.Now())
+	l.File = filepath.Join(dir, "AUTONOUS.md")
+	if res, err := l.Load(Vars{}); err != nil || res.Source != SourceFile || res.SizeBytes != len("系统指令") {
+		t.Fatalf("expected the file prompt and its size, got %+v err=%v", res, err)
+	}
+}
+
+func TestLoader_IncludeStaysInConfigDir(t *testing.T) {
+	dir := t.TempDir()
+	now := time.Now()
+	write(t, filepath.Join(dir, "AUTONOUS.md"), `{{include "../secret"}}`, now)
+	write(t, filepath.Join(dir, "loop.md"), `{{include "loop.md"}}`, now)
+	l := &Loader{ConfigDir: dir, File: filepath.Join(dir, "AUTONOUS.md")}
+	if _, err := l.Load(Vars{}); err == nil || !strings.Contains(err.Error(), "relative to the config dir") {
+		t.Fatalf("expected an include outside the config dir rejected, got %v", err)
+	}
+	l.File = filepath.Join(dir, "loop.md")
+	if _, err := l.Load(Vars{}); err == nil || !strings.Contains(err.Error(), "nested more than") {
+		t.Fatalf("expected an include cycle stopped, got %v", err)
+	}
+}
@@ -0,0 +1,37 @@
+// Package redact masks credentials in text that is about to be stored.
+package redact
+
+import (
+	"regexp"
+	"strings"
+)
+
+var secretPatterns = []*regexp.Regexp{
+	regexp.MustCompile(`(?i)\bBearer\s+[A-Za-z0-9._\-=/+]+`),
+	regexp.MustCompile(`(?i)\b(sk-[A-Za-z0-9\-_]{8,})\b`),
+	regexp.MustCompile(`(?i)\b([A-Za-z0-9_]*(TOKEN|SECRET|PASSWORD|API_KEY))\b\s*[:=]\s*["']?([^\s"']+)`),
+}
+
+// Secrets masks bearer tokens, sk- keys and TOKEN/SECRET/PASSWORD/API_KEY
+// assignments in text and reports whether anything was masked. Masking
+// already-masked text leaves it unchanged.
+func Secrets(text string) (string, bool) {
+	out := text
+	redacted := false
+	for _, p := range secretPatterns {
+		next := p.ReplaceAllStringFunc(out, func(m string) string {
+			redacted = true
+			parts := strings.SplitN(m, "=", 2)
+			if len(parts) == 2 && strings.Contains(m, "=") {
+				return parts[0] + "=***REDACTED***"
+			}
+			if strings.Contains(m, ":") {
+				kv := strings.SplitN(m, ":", 2)
+				return kv[0] + ": ***REDACTED***"
+			}
+			return "***REDACTED***"
+		})
+		out = next
+	}
+	return out, redacted
+}
@@ -0,0 +1,20 @@
+package redact
+
+import (
+	"strings"
+	"testing"
+)
+
+func TestSecrets(t *testing.T) {
+	in := "Authorization: Bearer abc123 TOKEN=xyz sk-test-secret"
+	out, redacted := Secrets(in)
+	if !redacted {
+		t.Fatal("expected redacted=true")
+	}
+	if strings.Contains(out, "abc123") || strings.Contains(out, "xyz") || strings.Contains(out, "sk-test-secret") {
+		t.Fatalf("secret leak after redaction: %q", out)
+	}
+	if again, _ := Secrets(out); again != out {
+		t.Fatalf("expected redaction to be stable, got %q then %q", out, again)
+	}
+}
@@ -0,0 +1,334 @@
+// Package repomap builds a compact outline of the Go packages in a
+// workspace, listing each package's files and exported symbols, so the model
+// can find code without spending turns on ls, find and grep. Parsed files are
+// cached and re-parsed only when their modification time or size changes.
+package repomap
+
+import (
+	"fmt"
+	"go/ast"
+	"go/parser"
+	"go/token"
+	"go/types"
+	"io/fs"
+	"log"
+	"path/filepath"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+	"unicode"
+
+	"github.com/stupiduntilnot/autonous/internal/tokenizer"
+)
+
+// Header starts the system message carrying the map.
+const Header = "Repository map (Go packages, files and exported symbols; paths relative to "
+
+// File is the outline of one parsed Go source file.
+type File struct {
+	// Path is relative to the map root, with forward slashes.
+	Path    string
+	Package string
+	Symbols []string
+	modTime time.Time
+	size    int64
+}
+
+// Package groups the files of one directory.
+type Package struct {
+	Dir   string
+	Name  string
+	Files []*File
+}
+
+// Map outlines the Go code under Root and renders the part most relevant to
+// a query within BudgetTokens. It is safe for concurrent use.
+type Map struct {
+	Root         string
+	Tokenizer    tokenizer.Tokenizer
+	BudgetTokens int
+
+	mu    sync.Mutex
+	files map[string]*File
+}
+
+// New returns a map of root rendered within budget tokens.
+func New(root string, tok tokenizer.Tokenizer, budget int) *Map {
+	return &Map{Root: root, Tokenizer: tok, BudgetTokens: budget, files: map[string]*File{}}
+}
+
+// Packages walks Root, re-parses new and changed non-test Go files, forgets
+// deleted ones and returns the packages sorted by directory.
+func (m *Map) Packages() ([]Package, error) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	if m.files == nil {
+		m.files = map[string]*File{}
+	}
+	seen := map[string]bool{}
+	err := filepath.WalkDir(m.Root, func(path string, d fs.DirEntry, err error) error {
+		if err != nil {
+			return nil
+		}
+		name := d.Name()
+		if d.IsDir() {
+			if path != m.Root && (strings.HasPrefix(name, ".") || name == "vendor" || name == "testdata" || name == "node_modules") {
+				return filepath.SkipDir
+			}
+			return nil
+		}
+		if !strings.HasSuffix(name, ".go") || strings.HasSuffix(name, "_test.go") {
+			return nil
+		}
+		info, err := d.Info()
+		if err != nil {
+			return nil
+		}
+		rel, err := filepath.Rel(m.Root, path)
+		if err != nil {
+			return nil
+		}
+		rel = filepath.ToSlash(rel)
+		seen[rel] = true
+		if f, ok := m.files[rel]; ok && f.modTime.Equal(info.ModTime()) && f.size == info.Size() {
+			return nil
+		}
+		f, err := parseFile(path, rel)
+		if err != nil {
+			// Keep the previous outline of a file being edited into shape.
+			if _, ok := m.files[rel]; !ok {
+				return nil
+			}
+			f = m.files[rel]
+		}
+		f.modTime, f.size = info.ModTime(), info.Size()
+		m.files[rel] = f
+		return nil
+	})
+	if err != nil {
+		return nil, err
+	}
+	byDir := map[string]*Package{}
+	for rel, f := range m.files {
+		if !seen[rel] {
+			delete(m.files, rel)
+			continue
+		}
+		dir := filepath.ToSlash(filepath.Dir(rel))
+		p, ok := byDir[dir]
+		if !ok {
+			p = &Package{Dir: dir, Name: f.Package}
+			byDir[dir] = p
+		}
+		p.Files = append(p.Files, f)
+	}
+	pkgs := make([]Package, 0, len(byDir))
+	for _, p := range byDir {
+		sort.Slice(p.Files, func(i, j int) bool { return p.Files[i].Path < p.Files[j].Path })
+		pkgs = append(pkgs, *p)
+	}
+	sort.Slice(pkgs, func(i, j int) bool { return pkgs[i].Dir < pkgs[j].Dir })
+	return pkgs, nil
+}
+
+// SystemMessage renders the packages most relevant to query within
+// BudgetTokens, or "" when there is no Go code or the budget is zero.
+// Failures are logged and yield "".
+func (m *Map) SystemMessage(query string) string {
+	if m.BudgetTokens <= 0 {
+		return ""
+	}
+	pkgs, err := m.Packages()
+	if err != nil {
+		log.Printf("[repomap] failed to index %s: %v", m.Root, err)
+		return ""
+	}
+	return Render(m.Root, pkgs, query, m.Tokenizer, m.BudgetTokens)
+}
+
+// Render lists packages in directory order, keeping those most relevant to
+// query when all of them do not fit in budget tokens. Packages whose path,
+// file names or symbols contain words of the query rank first; the rest keep
+// directory order.
+func Render(root string, pkgs []Package, query string, tok tokenizer.Tokenizer, budget int) string {
+	if len(pkgs) == 0 {
+		return ""
+	}
+	header := Header + root + "):"
+	used := tok.Count(header)
+	terms := queryTerms(query)
+	order := make([]int, len(pkgs))
+	scores := make([]int, len(pkgs))
+	for i := range pkgs {
+		order[i] = i
+		scores[i] = relevance(pkgs[i], terms)
+	}
+	sort.SliceStable(order, func(a, b int) bool { return scores[order[a]] > scores[order[b]] })
+
+	blocks := make([]string, len(pkgs))
+	omitted := 0
+	for _, i := range order {
+		block := renderPackage(pkgs[i])
+		cost := tok.Count(block)
+		if used+cost > budget {
+			omitted++
+			continue
+		}
+		used += cost
+		blocks[i] = block
+	}
+	var b strings.Builder
+	b.WriteString(header)
+	for _, block := range blocks {
+		if block != "" {
+			b.WriteString("\n")
+			b.WriteString(block)
+		}
+	}
+	if omitted == len(pkgs) {
+		return ""
+	}
+	if omitted > 0 {
+		fmt.Fprintf(&b, "\n(%d more packages omitted)", omitted)
+	}
+	return b.String()
+}
+
+func renderPackage(p Package) string {
+	var b strings.Builder
+	fmt.Fprintf(&b, "%s/ (package %s)", p.Dir, p.Name)
+	for _, f := range p.Files {
+		b.WriteString("\n  ")
+		b.WriteString(filepath.Base(f.Path))
+		if len(f.Symbols) > 0 {
+			b.WriteString(": ")
+			b.WriteString(strings.Join(f.Symbols, "; "))
+		}
+	}
+	return b.String()
+}
+
+func relevance(p Package, terms []string) int {
+	score := 0
+	for _, term := range terms {
+		if strings.Contains(strings.ToLower(p.Dir), term) {
+			score += 3
+		}
+		for _, f := range p.Files {
+			if strings.Contains(strings.ToLower(filepath.Base(f.Path)), term) {
+				score += 2
+			}
+			for _, s := range f.Symbols {
+				if strings.Contains(strings.ToLower(s), term) {
+					score++
+				}
+			}
+		}
+	}
+	return score
+}
+
+// queryTerms returns the distinct lowercase ASCII words of at least three
+// characters in query.
+func queryTerms(query string) []string {
+	seen := map[string]bool{}
+	var terms []string
+	for _, w := range strings.FieldsFunc(strings.ToLower(query), func(r rune) bool {
+		return r > unicode.MaxASCII || !(unicode.IsLetter(r) || unicode.IsDigit(r))
+	}) {
+		if len(w) >= 3 && !seen[w] {
+			seen[w] = true
+			terms = append(terms, w)
+		}
+	}
+	return terms
+}
+
+// parseFile outlines the exported declarations of one Go file.
+func parseFile(path, rel string) (*File, error) {
+	fset := token.NewFileSet()
+	af, err := parser.ParseFile(fset, path, nil, parser.SkipObjectResolution)
+	if err != nil {
+		return nil, err
+	}
+	f := &File{Path: rel, Package: af.Name.Name}
+	for _, decl := range af.Decls {
+		switch d := decl.(type) {
+		case *ast.FuncDecl:
+			if !d.Name.IsExported() {
+				continue
+			}
+			if d.Recv != nil && len(d.Recv.List) > 0 {
+				recv := receiverName(d.Recv.List[0].Type)
+				if !ast.IsExported(strings.TrimPrefix(recv, "*")) {
+					continue
+				}
+				f.Symbols = append(f.Symbols, "func ("+recv+") "+d.Name.Name)
+				continue
+			}
+			f.Symbols = append(f.Symbols, "func "+d.Name.Name)
+		case *ast.GenDecl:
+			var names []string
+			for _, spec := range d.Specs {
+				switch s := spec.(type) {
+				case *ast.TypeSpec:
+					if s.Name.IsExported() {
+						f.Symbols = append(f.Symbols, "type "+s.Name.Name+" "+typeKind(s.Type))
+					}
+				case *ast.ValueSpec:
+					for _, n := range s.Names {
+						if n.IsExported() {
+							names = append(names, n.Name)
+						}
+					}
+				}
+			}
+			if len(names) > 0 {
+				f.Symbols = append(f.Symbols, d.Tok.String()+" "+strings.Join(names, ", "))
+			}
+		}
+	}
+	return f, nil
+}
+
+func receiverName(expr ast.Expr) string {
+	switch t := expr.(type) {
+	case *ast.StarExpr:
+		return "*" + receiverName(t.X)
+	case *ast.IndexExpr:
+		return receiverName(t.X)
+	case *ast.IndexListExpr:
+		return receiverName(t.X)
+	case *ast.Ident:
+		return t.Name
+	default:
+		return "?"
+	}
+}
+
+func typeKind(expr ast.Expr) string {
+	switch expr.(type) {
+	case *ast.StructType:
+		return "struct"
+	case *ast.InterfaceType:
+		return "interface"
+	case *ast.FuncType:
+		return "func"
+	case *ast.MapType:
+		return "map"
+	case *ast.ArrayType:
+		return "slice"
+	case *ast.ChanType:
+		return "chan"
+	default:
+		return truncate(types.ExprString(expr), 40)
+	}
+}
+
+func truncate(s string, n int) string {
+	if len(s) <= n {
+		return s
+	}
+	return s[:n] + "…"
+}
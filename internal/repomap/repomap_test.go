@@ -0,0 +1,134 @@
+package repomap
+
+import (
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/stupiduntilnot/autonous/internal/tokenizer"
+)
+
+func writeFile(t *testing.T, root, name, content string) {
+	t.Helper()
+	path := filepath.Join(root, name)
+	if err := os.MkdirAll(filepath.Dir(path), 0o755); err != nil {
+		t.Fatal(err)
+	}
+	if err := os.WriteFile(path, []byte(content), 0o644); err != nil {
+		t.Fatal(err)
+	}
+}
+
+func TestPackages_OutlinesExportedSymbols(t *testing.T) {
+	root := t.TempDir()
+	writeFile(t, root, "store/store.go", `package store
+
+type Store struct{}
+type Reader interface{ Read() }
+type ID int64
+type private struct{}
+
+const Version, internal = 1, 2
+
+func New() *Store { return nil }
+func (s *Store) Get() {}
+func (p private) Exported() {}
+func helper() {}
+`)
+	writeFile(t, root, "store/store_test.go", "package store\n\nfunc TestX() {}\n")
+	writeFile(t, root, ".git/hooks/x.go", "package hooks\n\nfunc Hidden() {}\n")
+
+	pkgs, err := New(root, nil, 0).Packages()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(pkgs) != 1 || pkgs[0].Dir != "store" || pkgs[0].Name != "store" || len(pkgs[0].Files) != 1 {
+		t.Fatalf("expected only package store with one file, got %+v", pkgs)
+	}
+	got := strings.Join(pkgs[0].Files[0].Symbols, "; ")
+	want := "type Store struct; type Reader interface; type ID int64; const Version; func New; func (*Store) Get"
+	if got != want {
+		t.Fatalf("unexpected symbols:\n got %s\nwant %s", got, want)
+	}
+}
+
+func TestPackages_ReparsesChangedFiles(t *testing.T) {
+	root := t.TempDir()
+	writeFile(t, root, "a/a.go", "package a\n\nfunc Old() {}\n")
+	writeFile(t, root, "b/b.go", "package b\n\nfunc B() {}\n")
+	m := New(root, nil, 0)
+	if _, err := m.Packages(); err != nil {
+		t.Fatal(err)
+	}
+
+	path := filepath.Join(root, "a/a.go")
+	writeFile(t, root, "a/a.go", "package a\n\nfunc Renamed() {}\n")
+	later := time.Now().Add(time.Minute)
+	if err := os.Chtimes(path, later, later); err != nil {
+		t.Fatal(err)
+	}
+	if err := os.RemoveAll(filepath.Join(root, "b")); err != nil {
+		t.Fatal(err)
+	}
+	pkgs, err := m.Packages()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(pkgs) != 1 || pkgs[0].Files[0].Symbols[0] != "func Renamed" {
+		t.Fatalf("expected a re-parsed and b forgotten, got %+v", pkgs)
+	}
+
+	writeFile(t, root, "a/a.go", "package a\n\nfunc Broken( {\n")
+	if err := os.Chtimes(path, later.Add(time.Minute), later.Add(time.Minute)); err != nil {
+		t.Fatal(err)
+	}
+	pkgs, _ = m.Packages()
+	if len(pkgs) != 1 || pkgs[0].Files[0].Symbols[0] != "func Renamed" {
+		t.Fatalf("expected last good outline kept for a broken file, got %+v", pkgs)
+	}
+}
+
+func TestRender_PrefersRelevantPackagesWithinBudget(t *testing.T) {
+	root := t.TempDir()
+	writeFile(t, root, "alpha/alpha.go", "package alpha\n\nfunc Alpha() {}\n")
+	writeFile(t, root, "billing/invoice.go", "package billing\n\nfunc CreateInvoice() {}\n")
+	writeFile(t, root, "gamma/gamma.go", "package gamma\n\nfunc Gamma() {}\n")
+	tok := tokenizer.Get(tokenizer.CL100K)
+	pkgs, err := New(root, tok, 0).Packages()
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	full := Render(root, pkgs, "", tok, 10000)
+	if !strings.HasPrefix(full, Header+root+"):") || strings.Contains(full, "omitted") {
+		t.Fatalf("expected every package under a large budget, got %q", full)
+	}
+	if strings.Index(full, "alpha/") > strings.Index(full, "gamma/") {
+		t.Fatalf("expected directory order, got %q", full)
+	}
+
+	budget := tok.Count(Header+root+"):") + tok.Count(renderPackage(pkgs[1])) + 1
+	tight := Render(root, pkgs, "fix the invoice rounding", tok, budget)
+	if !strings.Contains(tight, "billing/ (package billing)\n  invoice.go: func CreateInvoice") {
+		t.Fatalf("expected the invoice package kept, got %q", tight)
+	}
+	if strings.Contains(tight, "alpha/") || !strings.HasSuffix(tight, "(2 more packages omitted)") {
+		t.Fatalf("expected other packages omitted, got %q", tight)
+	}
+	if got := Render(root, pkgs, "", tok, 1); got != "" {
+		t.Fatalf("expected nothing when no package fits, got %q", got)
+	}
+}
+
+func TestSystemMessage_DisabledByZeroBudget(t *testing.T) {
+	root := t.TempDir()
+	writeFile(t, root, "a/a.go", "package a\n\nfunc A() {}\n")
+	if got := New(root, tokenizer.Get(tokenizer.CL100K), 0).SystemMessage("a"); got != "" {
+		t.Fatalf("expected no map with zero budget, got %q", got)
+	}
+	if got := New(root, tokenizer.Get(tokenizer.CL100K), 500).SystemMessage("a"); !strings.Contains(got, "func A") {
+		t.Fatalf("expected map, got %q", got)
+	}
+}
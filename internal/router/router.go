@@ -0,0 +1,221 @@
+package router
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"strings"
+	"sync"
+	"time"
+
+	ctxpkg "github.com/stupiduntilnot/autonous/internal/context"
+	"github.com/stupiduntilnot/autonous/internal/control"
+	modelpkg "github.com/stupiduntilnot/autonous/internal/model"
+)
+
+// Backend is one provider in a router chain.
+type Backend struct {
+	Name     string
+	Model    string
+	Provider modelpkg.Provider
+}
+
+// Router is a model.Provider that tries an ordered chain of backends, failing
+// over to the next one on typed provider errors. Each backend has its own
+// circuit breaker so an unhealthy backend is skipped until its cooldown ends.
+type Router struct {
+	backends []Backend
+	breakers []*control.CircuitBreaker
+	now      func() time.Time
+
+	mu sync.Mutex
+}
+
+// toolRouter is returned when every backend supports native tool calls.
+type toolRouter struct {
+	*Router
+}
+
+// streamRouter is returned when every backend also streams.
+type streamRouter struct {
+	*toolRouter
+}
+
+// New creates a router over backends. Only retryable model.Error failures
+// (rate limits, server errors, timeouts) and auth failures trigger failover;
+// other errors are returned as-is. The result implements
+// model.ToolCaller, and model.Streamer, only when every backend does.
+func New(backends []Backend, threshold int, cooldown time.Duration) (modelpkg.Provider, error) {
+	if len(backends) == 0 {
+		return nil, fmt.Errorf("router requires at least one provider")
+	}
+	r := &Router{
+		backends: backends,
+		breakers: make([]*control.CircuitBreaker, len(backends)),
+		now:      time.Now,
+	}
+	native, streams := true, true
+	for i, b := range backends {
+		if b.Provider == nil {
+			return nil, fmt.Errorf("router provider %q is nil", b.Name)
+		}
+		r.breakers[i] = control.NewCircuitBreaker(threshold, cooldown)
+		if _, ok := b.Provider.(modelpkg.ToolCaller); !ok {
+			native = false
+		}
+		if _, ok := b.Provider.(modelpkg.Streamer); !ok {
+			streams = false
+		}
+	}
+	switch {
+	case native && streams:
+		return &streamRouter{&toolRouter{Router: r}}, nil
+	case native:
+		return &toolRouter{Router: r}, nil
+	default:
+		return r, nil
+	}
+}
+
+// ChatCompletion sends messages to the first healthy backend.
+func (r *Router) ChatCompletion(ctx context.Context, messages []ctxpkg.Message) (modelpkg.CompletionResponse, error) {
+	return r.dispatch(ctx, func(p modelpkg.Provider) (modelpkg.CompletionResponse, bool, error) {
+		resp, err := p.ChatCompletion(ctx, messages)
+		return resp, false, err
+	})
+}
+
+// ChatCompletionWithTools sends messages and tool declarations to the first
+// healthy backend.
+func (r *toolRouter) ChatCompletionWithTools(ctx context.Context, messages []ctxpkg.Message, tools []modelpkg.ToolDefinition) (modelpkg.CompletionResponse, error) {
+	return r.dispatch(ctx, func(p modelpkg.Provider) (modelpkg.CompletionResponse, bool, error) {
+		resp, err := p.(modelpkg.ToolCaller).ChatCompletionWithTools(ctx, messages, tools)
+		return resp, false, err
+	})
+}
+
+// ChatCompletionStream streams a completion from the first healthy backend.
+// A backend that fails after emitting content is not failed over: the next
+// backend's answer would be spliced onto text the caller already showed.
+func (r *streamRouter) ChatCompletionStream(ctx context.Context, messages []ctxpkg.Message, tools []modelpkg.ToolDefinition, onDelta func(delta string)) (modelpkg.CompletionResponse, error) {
+	return r.dispatch(ctx, func(p modelpkg.Provider) (modelpkg.CompletionResponse, bool, error) {
+		streamed := false
+		resp, err := p.(modelpkg.Streamer).ChatCompletionStream(ctx, messages, tools, func(delta string) {
+			streamed = true
+			onDelta(delta)
+		})
+		return resp, streamed, err
+	})
+}
+
+// States returns the breaker state of each backend keyed by name.
+func (r *Router) States() map[string]control.CircuitState {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	out := make(map[string]control.CircuitState, len(r.backends))
+	for i, b := range r.backends {
+		out[b.Name] = r.breakers[i].State()
+	}
+	return out
+}
+
+// Failure is one backend's part in a dispatch that found no answer.
+type Failure struct {
+	Backend string `json:"backend"`
+	Error   string `json:"error"`
+}
+
+// Error is returned when no backend answered. Failures lists every backend in
+// chain order with why it was skipped or failed; Err is the last backend's
+// error, or a server-class model.Error when every circuit was open.
+type Error struct {
+	Failures []Failure
+	Err      error
+}
+
+func (e *Error) Error() string {
+	parts := make([]string, len(e.Failures))
+	for i, f := range e.Failures {
+		parts[i] = f.Backend + ": " + f.Error
+	}
+	return "router: all model providers failed: " + strings.Join(parts, "; ")
+}
+
+func (e *Error) Unwrap() error {
+	return e.Err
+}
+
+// AsError returns the router error in err's chain, if any.
+func AsError(err error) (*Error, bool) {
+	var rerr *Error
+	if errors.As(err, &rerr) {
+		return rerr, true
+	}
+	return nil, false
+}
+
+// dispatch tries call on each healthy backend in turn. call also reports
+// whether the backend already delivered output, which rules out failover.
+func (r *Router) dispatch(ctx context.Context, call func(modelpkg.Provider) (modelpkg.CompletionResponse, bool, error)) (modelpkg.CompletionResponse, error) {
+	var failures []Failure
+	var lastErr error
+	failovers := 0
+	for i, b := range r.backends {
+		if !r.allow(i) {
+			failures = append(failures, Failure{Backend: b.Name, Error: "circuit open"})
+			continue
+		}
+		resp, delivered, err := call(b.Provider)
+		if err == nil {
+			r.recordSuccess(i)
+			resp.Route = &modelpkg.Route{Backend: b.Name, Model: b.Model, Failovers: failovers}
+			return resp, nil
+		}
+		if ctx.Err() != nil {
+			// The caller gave up; neither fail over nor blame the backend.
+			return resp, err
+		}
+		perr, ok := modelpkg.AsError(err)
+		if !ok || !failsOver(perr.Class) {
+			// Request-shaped failures such as bad_request or
+			// context_length_exceeded would fail on every backend too, and
+			// say nothing about this one's health.
+			return resp, err
+		}
+		r.recordFailure(i, string(perr.Class))
+		if delivered {
+			return resp, err
+		}
+		failures = append(failures, Failure{Backend: b.Name, Error: err.Error()})
+		lastErr = err
+		failovers++
+	}
+	if lastErr == nil {
+		lastErr = &modelpkg.Error{Class: modelpkg.ErrServer, Provider: "router", Message: "no healthy provider"}
+	}
+	return modelpkg.CompletionResponse{}, &Error{Failures: failures, Err: lastErr}
+}
+
+// failsOver reports whether a backend failing with class should be skipped
+// in favour of the next one.
+func failsOver(class modelpkg.ErrorClass) bool {
+	return class.Retryable() || class == modelpkg.ErrAuth
+}
+
+func (r *Router) allow(i int) bool {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	return r.breakers[i].Allow(r.now())
+}
+
+func (r *Router) recordSuccess(i int) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	r.breakers[i].RecordSuccess()
+}
+
+func (r *Router) recordFailure(i int, class string) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	r.breakers[i].RecordFailure(class, r.now())
+}
@@ -0,0 +1,314 @@
+package router
+
+import (
+	"context"
+	"errors"
+	"strings"
+	"testing"
+	"time"
+
+	ctxpkg "github.com/stupiduntilnot/autonous/internal/context"
+	"github.com/stupiduntilnot/autonous/internal/control"
+	modelpkg "github.com/stupiduntilnot/autonous/internal/model"
+)
+
+type fakeProvider struct {
+	content string
+	errs    []error
+	calls   int
+}
+
+func (f *fakeProvider) ChatCompletion(ctx context.Context, messages []ctxpkg.Message) (modelpkg.CompletionResponse, error) {
+	i := f.calls
+	f.calls++
+	if i < len(f.errs) && f.errs[i] != nil {
+		return modelpkg.CompletionResponse{}, f.errs[i]
+	}
+	return modelpkg.CompletionResponse{Content: f.content}, nil
+}
+
+type fakeToolProvider struct {
+	fakeProvider
+	tools int
+}
+
+func (f *fakeToolProvider) ChatCompletionWithTools(ctx context.Context, messages []ctxpkg.Message, tools []modelpkg.ToolDefinition) (modelpkg.CompletionResponse, error) {
+	f.tools = len(tools)
+	return f.ChatCompletion(ctx, messages)
+}
+
+type fakeStreamProvider struct {
+	fakeToolProvider
+	deltas []string
+}
+
+func (f *fakeStreamProvider) ChatCompletionStream(ctx context.Context, messages []ctxpkg.Message, tools []modelpkg.ToolDefinition, onDelta func(delta string)) (modelpkg.CompletionResponse, error) {
+	for _, d := range f.deltas {
+		onDelta(d)
+	}
+	return f.ChatCompletion(ctx, messages)
+}
+
+var errProvider = &modelpkg.Error{Class: modelpkg.ErrServer, Provider: "openai", StatusCode: 503}
+
+func TestRouter_FailsOverOnProviderError(t *testing.T) {
+	primary := &fakeProvider{content: "primary", errs: []error{errProvider}}
+	secondary := &fakeProvider{content: "secondary"}
+	p, err := New([]Backend{
+		{Name: "openai", Model: "gpt", Provider: primary},
+		{Name: "anthropic", Model: "claude", Provider: secondary},
+	}, 3, time.Minute)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	resp, err := p.ChatCompletion(context.Background(), []ctxpkg.Message{{Role: "user", Content: "hi"}})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if resp.Content != "secondary" {
+		t.Fatalf("expected secondary to serve, got %q", resp.Content)
+	}
+	if resp.Route == nil || resp.Route.Backend != "anthropic" || resp.Route.Model != "claude" || resp.Route.Failovers != 1 {
+		t.Fatalf("unexpected route: %+v", resp.Route)
+	}
+}
+
+func TestRouter_DoesNotFailOverOnOtherErrors(t *testing.T) {
+	primary := &fakeProvider{errs: []error{errors.New("sqlite busy")}}
+	secondary := &fakeProvider{content: "secondary"}
+	p, err := New([]Backend{
+		{Name: "openai", Provider: primary},
+		{Name: "anthropic", Provider: secondary},
+	}, 3, time.Minute)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if _, err := p.ChatCompletion(context.Background(), nil); err == nil || err.Error() != "sqlite busy" {
+		t.Fatalf("expected original error, got %v", err)
+	}
+	if secondary.calls != 0 {
+		t.Fatalf("expected no failover, secondary calls=%d", secondary.calls)
+	}
+}
+
+func TestRouter_SkipsOpenBreakerUntilCooldown(t *testing.T) {
+	primary := &fakeProvider{content: "primary", errs: []error{errProvider, errProvider}}
+	secondary := &fakeProvider{content: "secondary"}
+	p, err := New([]Backend{
+		{Name: "openai", Model: "gpt", Provider: primary},
+		{Name: "anthropic", Model: "claude", Provider: secondary},
+	}, 2, time.Minute)
+	if err != nil {
+		t.Fatal(err)
+	}
+	r := p.(*Router)
+	now := time.Now()
+	r.now = func() time.Time { return now }
+
+	for i := 0; i < 3; i++ {
+		if _, err := r.ChatCompletion(context.Background(), nil); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if primary.calls != 2 {
+		t.Fatalf("expected primary skipped once its breaker opened, calls=%d", primary.calls)
+	}
+	if r.States()["openai"] != control.CircuitOpen {
+		t.Fatalf("expected openai breaker open, got %s", r.States()["openai"])
+	}
+
+	now = now.Add(2 * time.Minute)
+	resp, err := r.ChatCompletion(context.Background(), nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if resp.Route.Backend != "openai" || r.States()["openai"] != control.CircuitClosed {
+		t.Fatalf("expected half-open probe to recover openai, route=%+v state=%s", resp.Route, r.States()["openai"])
+	}
+}
+
+func TestRouter_AllBackendsFail(t *testing.T) {
+	p, err := New([]Backend{
+		{Name: "openai", Provider: &fakeProvider{errs: []error{errProvider}}},
+		{Name: "anthropic", Provider: &fakeProvider{errs: []error{errProvider}}},
+	}, 3, time.Minute)
+	if err != nil {
+		t.Fatal(err)
+	}
+	_, err = p.ChatCompletion(context.Background(), nil)
+	if err == nil {
+		t.Fatal("expected error when all backends fail")
+	}
+	if !strings.HasPrefix(err.Error(), "router:") || !strings.Contains(err.Error(), "anthropic:") {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	if perr, ok := modelpkg.AsError(err); !ok || perr.Class != modelpkg.ErrServer {
+		t.Fatalf("expected wrapped typed error, got %v", err)
+	}
+	rerr, ok := AsError(err)
+	if !ok || len(rerr.Failures) != 2 || rerr.Failures[0].Backend != "openai" || rerr.Failures[1].Backend != "anthropic" {
+		t.Fatalf("expected a failure per backend, got %v", err)
+	}
+}
+
+func TestRouter_NoHealthyBackend(t *testing.T) {
+	p, err := New([]Backend{
+		{Name: "openai", Provider: &fakeProvider{errs: []error{errProvider}}},
+		{Name: "anthropic", Provider: &fakeProvider{errs: []error{errProvider}}},
+	}, 1, time.Minute)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, err := p.ChatCompletion(context.Background(), nil); err == nil {
+		t.Fatal("expected error when all backends fail")
+	}
+	_, err = p.ChatCompletion(context.Background(), nil)
+	rerr, ok := AsError(err)
+	if !ok || len(rerr.Failures) != 2 || rerr.Failures[0].Error != "circuit open" || rerr.Failures[1].Error != "circuit open" {
+		t.Fatalf("expected both backends skipped, got %v", err)
+	}
+	if perr, ok := modelpkg.AsError(err); !ok || perr.Provider != "router" || perr.Class != modelpkg.ErrServer {
+		t.Fatalf("expected no-healthy-provider error, got %v", err)
+	}
+}
+
+func TestRouter_RequestErrorsDoNotFailOver(t *testing.T) {
+	for _, class := range []modelpkg.ErrorClass{modelpkg.ErrBadRequest, modelpkg.ErrContextLengthExceeded} {
+		reqErr := &modelpkg.Error{Class: class, Provider: "openai", StatusCode: 400}
+		secondary := &fakeProvider{content: "ok"}
+		p, err := New([]Backend{
+			{Name: "openai", Provider: &fakeProvider{errs: []error{reqErr}}},
+			{Name: "anthropic", Provider: secondary},
+		}, 1, time.Minute)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if _, err := p.ChatCompletion(context.Background(), nil); !errors.Is(err, reqErr) {
+			t.Fatalf("%s: expected the original error, got %v", class, err)
+		}
+		if secondary.calls != 0 {
+			t.Fatalf("%s: expected no failover, secondary calls=%d", class, secondary.calls)
+		}
+		if state := p.(*Router).States()["openai"]; state != control.CircuitClosed {
+			t.Fatalf("%s: expected breaker to stay closed, got %s", class, state)
+		}
+	}
+}
+
+func TestRouter_FailsOverOnAuthAndRateLimit(t *testing.T) {
+	for _, class := range []modelpkg.ErrorClass{modelpkg.ErrAuth, modelpkg.ErrRateLimited} {
+		p, err := New([]Backend{
+			{Name: "openai", Provider: &fakeProvider{errs: []error{&modelpkg.Error{Class: class, Provider: "openai"}}}},
+			{Name: "anthropic", Provider: &fakeProvider{content: "ok"}},
+		}, 1, time.Minute)
+		if err != nil {
+			t.Fatal(err)
+		}
+		resp, err := p.ChatCompletion(context.Background(), nil)
+		if err != nil || resp.Route.Backend != "anthropic" {
+			t.Fatalf("%s: expected failover to anthropic, resp=%+v err=%v", class, resp.Route, err)
+		}
+	}
+}
+
+func TestNew_ToolCallerOnlyWhenAllBackendsSupportTools(t *testing.T) {
+	mixed, err := New([]Backend{
+		{Name: "openai", Provider: &fakeToolProvider{}},
+		{Name: "dummy", Provider: &fakeProvider{}},
+	}, 3, time.Minute)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, ok := mixed.(modelpkg.ToolCaller); ok {
+		t.Fatal("expected mixed chain not to implement ToolCaller")
+	}
+
+	tp := &fakeToolProvider{fakeProvider: fakeProvider{content: "ok"}}
+	native, err := New([]Backend{{Name: "openai", Provider: tp}}, 3, time.Minute)
+	if err != nil {
+		t.Fatal(err)
+	}
+	tc, ok := native.(modelpkg.ToolCaller)
+	if !ok {
+		t.Fatal("expected native chain to implement ToolCaller")
+	}
+	if _, err := tc.ChatCompletionWithTools(context.Background(), nil, []modelpkg.ToolDefinition{{Name: "ls"}}); err != nil {
+		t.Fatal(err)
+	}
+	if tp.tools != 1 {
+		t.Fatalf("expected tools forwarded, got %d", tp.tools)
+	}
+}
+
+func TestRouter_CancelledContextDoesNotFailOver(t *testing.T) {
+	primary := &fakeProvider{errs: []error{modelpkg.TransportError("openai", context.Canceled)}}
+	secondary := &fakeProvider{content: "secondary"}
+	p, err := New([]Backend{
+		{Name: "openai", Provider: primary},
+		{Name: "anthropic", Provider: secondary},
+	}, 1, time.Minute)
+	if err != nil {
+		t.Fatal(err)
+	}
+	ctx, cancel := context.WithCancel(context.Background())
+	cancel()
+	if _, err := p.ChatCompletion(ctx, nil); !errors.Is(err, context.Canceled) {
+		t.Fatalf("expected cancellation error, got %v", err)
+	}
+	if secondary.calls != 0 {
+		t.Fatalf("expected no failover after cancellation, secondary calls=%d", secondary.calls)
+	}
+	if state := p.(*Router).States()["openai"]; state != control.CircuitClosed {
+		t.Fatalf("expected cancellation not to open breaker, got %s", state)
+	}
+}
+
+func TestRouter_StreamsOnlyWhenEveryBackendStreams(t *testing.T) {
+	mixed, err := New([]Backend{
+		{Name: "openai", Provider: &fakeStreamProvider{}},
+		{Name: "anthropic", Provider: &fakeToolProvider{}},
+	}, 3, time.Minute)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, ok := mixed.(modelpkg.Streamer); ok {
+		t.Fatal("expected mixed chain not to implement Streamer")
+	}
+
+	// A failure before any content fails over; the caller sees one answer.
+	primary := &fakeStreamProvider{fakeToolProvider: fakeToolProvider{fakeProvider: fakeProvider{errs: []error{errProvider}}}}
+	secondary := &fakeStreamProvider{fakeToolProvider: fakeToolProvider{fakeProvider: fakeProvider{content: "hello"}}, deltas: []string{"hel", "lo"}}
+	p, err := New([]Backend{{Name: "openai", Provider: primary}, {Name: "backup", Provider: secondary}}, 3, time.Minute)
+	if err != nil {
+		t.Fatal(err)
+	}
+	st, ok := p.(modelpkg.Streamer)
+	if !ok {
+		t.Fatal("expected streaming chain to implement Streamer")
+	}
+	var got strings.Builder
+	resp, err := st.ChatCompletionStream(context.Background(), nil, nil, func(d string) { got.WriteString(d) })
+	if err != nil || resp.Route.Backend != "backup" || got.String() != "hello" {
+		t.Fatalf("unexpected stream route=%+v deltas=%q err=%v", resp.Route, got.String(), err)
+	}
+}
+
+func TestRouter_DoesNotFailOverAfterStreamedContent(t *testing.T) {
+	primary := &fakeStreamProvider{fakeToolProvider: fakeToolProvider{fakeProvider: fakeProvider{errs: []error{errProvider}}}, deltas: []string{"partial"}}
+	secondary := &fakeStreamProvider{fakeToolProvider: fakeToolProvider{fakeProvider: fakeProvider{content: "other"}}}
+	p, err := New([]Backend{{Name: "openai", Provider: primary}, {Name: "backup", Provider: secondary}}, 1, time.Minute)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, err := p.(modelpkg.Streamer).ChatCompletionStream(context.Background(), nil, nil, func(string) {}); !errors.Is(err, errProvider) {
+		t.Fatalf("expected the mid-stream error, got %v", err)
+	}
+	if secondary.calls != 0 {
+		t.Fatalf("expected no failover after content was streamed, secondary calls=%d", secondary.calls)
+	}
+	if state := p.(*streamRouter).States()["openai"]; state != control.CircuitOpen {
+		t.Fatalf("expected the failure to count against openai, got %s", state)
+	}
+}
@@ -0,0 +1,186 @@
+// Package summary folds the oldest conversation history into a rolling
+// summary stored in the summaries table, so long discussions keep their
+// earlier decisions after the raw messages leave the prompt.
+package summary
+
+import (
+	"context"
+	"database/sql"
+	"fmt"
+	"strings"
+
+	ctxpkg "github.com/stupiduntilnot/autonous/internal/context"
+	"github.com/stupiduntilnot/autonous/internal/db"
+	modelpkg "github.com/stupiduntilnot/autonous/internal/model"
+)
+
+// SummaryPrefix starts the system message that stands in for summarized
+// history.
+const SummaryPrefix = "Summary of the earlier conversation:\n"
+
+const instruction = `You maintain a running summary of a chat between a user and an assistant.
+Merge the new messages into the previous summary. Keep decisions, facts, names, open questions and stated preferences; drop greetings and small talk.
+Write in the language the conversation uses. Reply with the updated summary only.`
+
+// Caller makes the summarization model call.
+type Caller func(ctx context.Context, messages []ctxpkg.Message) (modelpkg.CompletionResponse, error)
+
+// Result describes the history a Summarize call produced.
+type Result struct {
+	// Messages is the history with the summary in place of the messages it
+	// covers.
+	Messages []ctxpkg.Message
+	// Summary is the summary in use, nil when the chat has none.
+	Summary *db.Summary
+	// Created reports that this call generated Summary; Folded messages
+	// were added to it by Response.
+	Created  bool
+	Folded   int
+	Response modelpkg.CompletionResponse
+}
+
+// Compressor summarizes history once more than Threshold unsummarized
+// messages exist, leaving the newest Keep verbatim. Compress itself only
+// delegates to Next; callers run Summarize first.
+type Compressor struct {
+	DB        *sql.DB
+	Threshold int
+	Keep      int
+	Next      ctxpkg.Compressor
+}
+
+// New returns a summarizing compressor in front of next. The result
+// implements ctxpkg.BudgetCompressor when next does.
+func New(database *sql.DB, threshold, keep int, next ctxpkg.Compressor) ctxpkg.Compressor {
+	c := &Compressor{DB: database, Threshold: threshold, Keep: keep, Next: next}
+	if bc, ok := next.(ctxpkg.BudgetCompressor); ok {
+		return &budgetCompressor{Compressor: c, next: bc}
+	}
+	return c
+}
+
+type budgetCompressor struct {
+	*Compressor
+	next ctxpkg.BudgetCompressor
+}
+
+func (b *budgetCompressor) CompressWithin(messages []ctxpkg.Message, reservedTokens int) ([]ctxpkg.Message, ctxpkg.CompressionReport) {
+	return b.next.CompressWithin(messages, reservedTokens)
+}
+
+// Compress passes messages to Next.
+func (c *Compressor) Compress(messages []ctxpkg.Message) []ctxpkg.Message {
+	if c.Next == nil {
+		return messages
+	}
+	return c.Next.Compress(messages)
+}
+
+// Summarize replaces history already covered by the chat's summary with that
+// summary and, when the remaining messages exceed Threshold, folds the
+// oldest of them into a new summary using call. Retrieved messages are never
+// folded; they follow the summary unchanged. On a failed call the previous
+// summary is still applied and the error returned alongside it.
+func (c *Compressor) Summarize(ctx context.Context, chatID int64, history []ctxpkg.Message, call Caller) (Result, error) {
+	prev, err := db.LatestSummary(c.DB, chatID)
+	if err != nil {
+		return Result{Messages: history}, err
+	}
+	var retrieved []ctxpkg.Message
+	fresh := make([]ctxpkg.Message, 0, len(history))
+	for _, msg := range history {
+		switch {
+		case msg.Retrieved:
+			retrieved = append(retrieved, msg)
+		case prev == nil || msg.HistoryID == 0 || msg.HistoryID > prev.ToHistoryID:
+			fresh = append(fresh, msg)
+		}
+	}
+	res := Result{Summary: prev}
+
+	if fold := c.foldCount(fresh); fold > 0 {
+		resp, err := call(ctx, prompt(prev, fresh[:fold]))
+		text := strings.TrimSpace(resp.Content)
+		if err == nil && text == "" {
+			err = fmt.Errorf("summary: model returned an empty summary")
+		}
+		if err != nil {
+			res.Messages = withSummary(prev, retrieved, fresh)
+			return res, err
+		}
+		next := &db.Summary{
+			ChatID:        chatID,
+			FromHistoryID: fresh[0].HistoryID,
+			ToHistoryID:   fresh[fold-1].HistoryID,
+			Text:          text,
+			MessageCount:  fold,
+			InputTokens:   resp.InputTokens,
+			OutputTokens:  resp.OutputTokens,
+		}
+		if prev != nil {
+			next.FromHistoryID = prev.FromHistoryID
+			next.MessageCount += prev.MessageCount
+		}
+		if err := db.InsertSummary(c.DB, next); err != nil {
+			res.Messages = withSummary(prev, retrieved, fresh)
+			return res, err
+		}
+		res.Summary, res.Created, res.Folded, res.Response = next, true, fold, resp
+		fresh = fresh[fold:]
+	}
+	res.Messages = withSummary(res.Summary, retrieved, fresh)
+	return res, nil
+}
+
+// foldCount returns how many of the oldest messages to summarize: all but
+// the newest Keep once Threshold is exceeded, extended past tool results so
+// they stay with the call that produced them. Only stored history can be
+// folded.
+func (c *Compressor) foldCount(fresh []ctxpkg.Message) int {
+	if c.Threshold <= 0 || len(fresh) <= c.Threshold {
+		return 0
+	}
+	fold := len(fresh) - max(c.Keep, 0)
+	for fold < len(fresh) && fresh[fold].Role == "tool" {
+		fold++
+	}
+	for i := 0; i < fold; i++ {
+		if fresh[i].HistoryID == 0 {
+			return 0
+		}
+	}
+	return fold
+}
+
+func prompt(prev *db.Summary, messages []ctxpkg.Message) []ctxpkg.Message {
+	var b strings.Builder
+	b.WriteString("Previous summary:\n")
+	if prev != nil {
+		b.WriteString(prev.Text)
+	} else {
+		b.WriteString("(none)")
+	}
+	b.WriteString("\n\nNew messages:\n")
+	for _, msg := range messages {
+		b.WriteString(msg.Role)
+		b.WriteString(": ")
+		b.WriteString(msg.Content)
+		for _, call := range msg.ToolCalls {
+			fmt.Fprintf(&b, "\n[tool call %s %s]", call.Name, string(call.Arguments))
+		}
+		b.WriteString("\n")
+	}
+	return []ctxpkg.Message{
+		{Role: "system", Content: instruction},
+		{Role: "user", Content: b.String()},
+	}
+}
+
+func withSummary(s *db.Summary, retrieved, messages []ctxpkg.Message) []ctxpkg.Message {
+	out := make([]ctxpkg.Message, 0, len(retrieved)+len(messages)+1)
+	if s != nil {
+		out = append(out, ctxpkg.Message{Role: "system", Content: SummaryPrefix + s.Text})
+	}
+	out = append(out, retrieved...)
+	return append(out, messages...)
+}
@@ -0,0 +1,152 @@
+package summary
+
+import (
+	"context"
+	"database/sql"
+	"errors"
+	"fmt"
+	"strings"
+	"testing"
+
+	ctxpkg "github.com/stupiduntilnot/autonous/internal/context"
+	"github.com/stupiduntilnot/autonous/internal/db"
+	modelpkg "github.com/stupiduntilnot/autonous/internal/model"
+)
+
+func testDB(t *testing.T) *sql.DB {
+	t.Helper()
+	database, err := db.OpenDB(t.TempDir() + "/summary.db")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := db.InitSchema(database); err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { _ = database.Close() })
+	return database
+}
+
+// addTurns appends n user/assistant exchanges to chat 1 and returns the full
+// history as the worker would load it.
+func addTurns(t *testing.T, database *sql.DB, from, n int) []ctxpkg.Message {
+	t.Helper()
+	for i := from; i < from+n; i++ {
+		for _, role := range []string{"user", "assistant"} {
+			if _, err := database.Exec("INSERT INTO history (chat_id, role, text) VALUES (1, ?, ?)", role, fmt.Sprintf("%s %d", role, i)); err != nil {
+				t.Fatal(err)
+			}
+		}
+	}
+	history, err := (&ctxpkg.SQLiteProvider{DB: database}).GetHistory(1, 100)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return history
+}
+
+type fakeCaller struct {
+	prompts [][]ctxpkg.Message
+	replies []string
+	err     error
+}
+
+func (f *fakeCaller) call(ctx context.Context, messages []ctxpkg.Message) (modelpkg.CompletionResponse, error) {
+	f.prompts = append(f.prompts, messages)
+	if f.err != nil {
+		return modelpkg.CompletionResponse{}, f.err
+	}
+	reply := f.replies[0]
+	f.replies = f.replies[1:]
+	return modelpkg.CompletionResponse{Content: reply, InputTokens: 50, OutputTokens: 10}, nil
+}
+
+func TestSummarize_FoldsOldestOnceOverThreshold(t *testing.T) {
+	database := testDB(t)
+	c := &Compressor{DB: database, Threshold: 6, Keep: 2}
+	caller := &fakeCaller{replies: []string{"decided to use sqlite", "decided sqlite; renamed tool"}}
+
+	history := addTurns(t, database, 0, 3)
+	res, err := c.Summarize(context.Background(), 1, history, caller.call)
+	if err != nil || res.Created || len(caller.prompts) != 0 || len(res.Messages) != 6 {
+		t.Fatalf("expected no summary at threshold, got %+v err=%v", res, err)
+	}
+
+	history = addTurns(t, database, 3, 1)
+	res, err = c.Summarize(context.Background(), 1, history, caller.call)
+	if err != nil || !res.Created || res.Folded != 6 {
+		t.Fatalf("expected 6 messages folded, got %+v err=%v", res, err)
+	}
+	if !strings.Contains(caller.prompts[0][1].Content, "user 0") || strings.Contains(caller.prompts[0][1].Content, "user 3") {
+		t.Fatalf("expected prompt to cover only the oldest messages, got %q", caller.prompts[0][1].Content)
+	}
+	if len(res.Messages) != 3 || res.Messages[0].Content != SummaryPrefix+"decided to use sqlite" || res.Messages[1].Content != "user 3" {
+		t.Fatalf("expected summary plus kept messages, got %+v", res.Messages)
+	}
+	stored, err := db.LatestSummary(database, 1)
+	if err != nil || stored == nil || stored.FromHistoryID != 1 || stored.ToHistoryID != 6 || stored.InputTokens != 50 {
+		t.Fatalf("unexpected stored summary %+v err=%v", stored, err)
+	}
+
+	// The next task reuses the summary and only folds again past the threshold.
+	history = addTurns(t, database, 4, 1)
+	res, err = c.Summarize(context.Background(), 1, history, caller.call)
+	if err != nil || res.Created || len(res.Messages) != 5 || res.Summary.ID != stored.ID {
+		t.Fatalf("expected stored summary reused, got %+v err=%v", res, err)
+	}
+	history = addTurns(t, database, 5, 2)
+	res, err = c.Summarize(context.Background(), 1, history, caller.call)
+	if err != nil || !res.Created || res.Folded != 6 {
+		t.Fatalf("expected rolling summary, got %+v err=%v", res, err)
+	}
+	if !strings.Contains(caller.prompts[1][1].Content, "decided to use sqlite") {
+		t.Fatal("expected previous summary in the rolling prompt")
+	}
+	if res.Summary.FromHistoryID != 1 || res.Summary.ToHistoryID != 12 || res.Summary.MessageCount != 12 {
+		t.Fatalf("expected rolling summary to cover rows 1..12, got %+v", res.Summary)
+	}
+}
+
+func TestSummarize_FailedCallKeepsPreviousSummary(t *testing.T) {
+	database := testDB(t)
+	if err := db.InsertSummary(database, &db.Summary{ChatID: 1, FromHistoryID: 1, ToHistoryID: 2, Text: "old", MessageCount: 2}); err != nil {
+		t.Fatal(err)
+	}
+	c := &Compressor{DB: database, Threshold: 2, Keep: 1}
+	history := addTurns(t, database, 0, 3)
+	caller := &fakeCaller{err: errors.New("provider down")}
+	res, err := c.Summarize(context.Background(), 1, history, caller.call)
+	if err == nil || res.Created {
+		t.Fatalf("expected call error, got %+v", res)
+	}
+	if len(res.Messages) != 5 || res.Messages[0].Content != SummaryPrefix+"old" {
+		t.Fatalf("expected previous summary plus unsummarized rows, got %+v", res.Messages)
+	}
+}
+
+func TestNew_PreservesBudgetCapability(t *testing.T) {
+	budget := &ctxpkg.TokenBudgetCompressor{}
+	if _, ok := New(nil, 10, 4, budget).(ctxpkg.BudgetCompressor); !ok {
+		t.Fatal("expected budget capability to be preserved")
+	}
+	if _, ok := New(nil, 10, 4, &ctxpkg.SimpleCompressor{}).(ctxpkg.BudgetCompressor); ok {
+		t.Fatal("expected no budget capability over a simple compressor")
+	}
+}
+
+func TestSummarize_KeepsRetrievedMessages(t *testing.T) {
+	database := testDB(t)
+	c := &Compressor{DB: database, Threshold: 4, Keep: 2}
+	history := addTurns(t, database, 0, 3)
+	history = append([]ctxpkg.Message{{Role: "user", Content: "old decision", HistoryID: 1, Retrieved: true}}, history...)
+	caller := &fakeCaller{replies: []string{"summary"}}
+	res, err := c.Summarize(context.Background(), 1, history, caller.call)
+	if err != nil || !res.Created || res.Folded != 4 {
+		t.Fatalf("expected the 4 oldest recent messages folded, got %+v err=%v", res, err)
+	}
+	if strings.Contains(caller.prompts[0][1].Content, "old decision") {
+		t.Fatal("expected retrieved messages kept out of the summary prompt")
+	}
+	if len(res.Messages) != 4 || !res.Messages[1].Retrieved || res.Messages[1].Content != "old decision" {
+		t.Fatalf("expected summary, retrieved message, then kept messages, got %+v", res.Messages)
+	}
+}
@@ -1,6 +1,7 @@
 package telegram
 
 import (
+	"context"
 	"encoding/json"
 	"fmt"
 	"io"
@@ -60,18 +61,18 @@ func (c *Client) GetUpdates(offset int64, timeout int) ([]Update, error) {
 
 	resp, err := c.httpClient.Get(c.apiBase + "/getUpdates?" + params.Encode())
 	if err != nil {
-		return nil, fmt.Errorf("telegram getUpdates request failed: %w", err)
+		return nil, apiError("telegram getUpdates request failed: %w", err)
 	}
 	defer resp.Body.Close()
 
 	body, err := io.ReadAll(resp.Body)
 	if err != nil {
-		return nil, fmt.Errorf("failed to read getUpdates response: %w", err)
+		return nil, apiError("failed to read getUpdates response: %w", err)
 	}
 
 	var tgResp Response
 	if err := json.Unmarshal(body, &tgResp); err != nil {
-		return nil, fmt.Errorf("failed to parse getUpdates response: %w", err)
+		return nil, apiError("failed to parse getUpdates response: %w", err)
 	}
 
 	if !tgResp.OK {
@@ -80,7 +81,7 @@ func (c *Client) GetUpdates(offset int64, timeout int) ([]Update, error) {
 
 	var raws []tgRawUpdate
 	if err := json.Unmarshal(tgResp.Result, &raws); err != nil {
-		return nil, fmt.Errorf("failed to parse getUpdates result: %w", err)
+		return nil, apiError("failed to parse getUpdates result: %w", err)
 	}
 	updates := make([]Update, 0, len(raws))
 	for _, ru := range raws {
@@ -103,25 +104,77 @@ func (c *Client) GetUpdates(offset int64, timeout int) ([]Update, error) {
 }
 
 // SendMessage sends a text message to the given chat.
-func (c *Client) SendMessage(chatID int64, text string) error {
+func (c *Client) SendMessage(ctx context.Context, chatID int64, text string) error {
 	limited := truncate(text, 3900)
 	payload := fmt.Sprintf(`{"chat_id":%d,"text":%s}`, chatID, jsonString(limited))
 
-	resp, err := c.httpClient.Post(
-		c.apiBase+"/sendMessage",
-		"application/json",
-		strings.NewReader(payload),
-	)
+	resp, err := c.postJSON(ctx, "/sendMessage", payload)
 	if err != nil {
-		return fmt.Errorf("telegram sendMessage request failed: %w", err)
+		return apiError("telegram sendMessage request failed: %w", err)
 	}
 	defer resp.Body.Close()
 	io.ReadAll(resp.Body) // drain
 	return nil
 }
 
+// SendMessageWithID sends a text message and returns its Telegram message_id.
+func (c *Client) SendMessageWithID(ctx context.Context, chatID int64, text string) (int64, error) {
+	limited := truncate(text, 3900)
+	payload := fmt.Sprintf(`{"chat_id":%d,"text":%s}`, chatID, jsonString(limited))
+
+	resp, err := c.postJSON(ctx, "/sendMessage", payload)
+	if err != nil {
+		return 0, apiError("telegram sendMessage request failed: %w", err)
+	}
+	defer resp.Body.Close()
+
+	body, err := io.ReadAll(resp.Body)
+	if err != nil {
+		return 0, apiError("failed to read sendMessage response: %w", err)
+	}
+	var tgResp Response
+	if err := json.Unmarshal(body, &tgResp); err != nil {
+		return 0, apiError("failed to parse sendMessage response: %w", err)
+	}
+	if !tgResp.OK {
+		return 0, apiError("telegram sendMessage not ok: %s", truncate(string(body), 400))
+	}
+	var sent struct {
+		MessageID int64 `json:"message_id"`
+	}
+	if err := json.Unmarshal(tgResp.Result, &sent); err != nil {
+		return 0, apiError("failed to parse sendMessage result: %w", err)
+	}
+	return sent.MessageID, nil
+}
+
+// EditMessageText replaces the text of a previously sent message.
+func (c *Client) EditMessageText(ctx context.Context, chatID int64, messageID int64, text string) error {
+	limited := truncate(text, 3900)
+	payload := fmt.Sprintf(`{"chat_id":%d,"message_id":%d,"text":%s}`, chatID, messageID, jsonString(limited))
+
+	resp, err := c.postJSON(ctx, "/editMessageText", payload)
+	if err != nil {
+		return apiError("telegram editMessageText request failed: %w", err)
+	}
+	defer resp.Body.Close()
+
+	body, err := io.ReadAll(resp.Body)
+	if err != nil {
+		return apiError("failed to read editMessageText response: %w", err)
+	}
+	var tgResp Response
+	if err := json.Unmarshal(body, &tgResp); err != nil {
+		return apiError("failed to parse editMessageText response: %w", err)
+	}
+	if !tgResp.OK {
+		return apiError("telegram editMessageText not ok: %s", truncate(string(body), 400))
+	}
+	return nil
+}
+
 // SendApprovalRequest sends a message with inline approve/cancel buttons.
-func (c *Client) SendApprovalRequest(chatID int64, text string, txID string) error {
+func (c *Client) SendApprovalRequest(ctx context.Context, chatID int64, text string, txID string) error {
 	limited := truncate(text, 3900)
 	approve := jsonString("approve " + txID)
 	cancel := jsonString("cancel " + txID)
@@ -129,13 +182,9 @@ func (c *Client) SendApprovalRequest(chatID int64, text string, txID string) err
 		`{"chat_id":%d,"text":%s,"reply_markup":{"inline_keyboard":[[{"text":"Approve","callback_data":%s},{"text":"Cancel","callback_data":%s}]]}}`,
 		chatID, jsonString(limited), approve, cancel,
 	)
-	resp, err := c.httpClient.Post(
-		c.apiBase+"/sendMessage",
-		"application/json",
-		strings.NewReader(payload),
-	)
+	resp, err := c.postJSON(ctx, "/sendMessage", payload)
 	if err != nil {
-		return fmt.Errorf("telegram sendApprovalRequest failed: %w", err)
+		return apiError("telegram sendApprovalRequest failed: %w", err)
 	}
 	defer resp.Body.Close()
 	_, _ = io.ReadAll(resp.Body)
@@ -161,6 +210,22 @@ func (c *Client) answerCallbackQuery(callbackID string) error {
 	return nil
 }
 
+// postJSON posts a JSON payload to the given Bot API method, abandoning the
+// request when ctx is done.
+func (c *Client) postJSON(ctx context.Context, method string, payload string) (*http.Response, error) {
+	req, err := http.NewRequestWithContext(ctx, http.MethodPost, c.apiBase+method, strings.NewReader(payload))
+	if err != nil {
+		return nil, err
+	}
+	req.Header.Set("Content-Type", "application/json")
+	return c.httpClient.Do(req)
+}
+
+// apiError formats a failed Bot API call as a commander error.
+func apiError(format string, args ...any) error {
+	return &cmdpkg.Error{Source: "telegram", Err: fmt.Errorf(format, args...)}
+}
+
 func truncate(s string, maxChars int) string {
 	runes := []rune(s)
 	if len(runes) <= maxChars {
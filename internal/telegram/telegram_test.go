@@ -1,12 +1,15 @@
 package telegram
 
 import (
+	"context"
 	"io"
 	"net/http"
 	"net/http/httptest"
 	"strings"
 	"testing"
 	"time"
+
+	cmdpkg "github.com/stupiduntilnot/autonous/internal/commander"
 )
 
 func TestGetUpdates_MapsCallbackQueryToMessage(t *testing.T) {
@@ -54,7 +57,7 @@ func TestSendApprovalRequest_SendsInlineKeyboard(t *testing.T) {
 	defer srv.Close()
 
 	c := NewClient(srv.URL, 2*time.Second)
-	if err := c.SendApprovalRequest(123, "update stage 成功：tx_id=tx-abc sha256=deadbeef", "tx-abc"); err != nil {
+	if err := c.SendApprovalRequest(context.Background(), 123, "update stage 成功：tx_id=tx-abc sha256=deadbeef", "tx-abc"); err != nil {
 		t.Fatalf("SendApprovalRequest failed: %v", err)
 	}
 	if !strings.Contains(gotBody, `"inline_keyboard"`) {
@@ -70,3 +73,51 @@ func TestSendApprovalRequest_SendsInlineKeyboard(t *testing.T) {
 		t.Fatalf("expected merged stage success text, got: %s", gotBody)
 	}
 }
+
+func TestSendMessageWithIDAndEdit(t *testing.T) {
+	var editBody string
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		switch r.URL.Path {
+		case "/sendMessage":
+			_, _ = io.WriteString(w, `{"ok":true,"result":{"message_id":77,"chat":{"id":123}}}`)
+		case "/editMessageText":
+			body, _ := io.ReadAll(r.Body)
+			editBody = string(body)
+			_, _ = io.WriteString(w, `{"ok":true,"result":{"message_id":77}}`)
+		default:
+			http.NotFound(w, r)
+		}
+	}))
+	defer srv.Close()
+
+	c := NewClient(srv.URL, 2*time.Second)
+	id, err := c.SendMessageWithID(context.Background(), 123, "placeholder")
+	if err != nil {
+		t.Fatalf("SendMessageWithID failed: %v", err)
+	}
+	if id != 77 {
+		t.Fatalf("unexpected message_id: %d", id)
+	}
+	if err := c.EditMessageText(context.Background(), 123, id, "final text"); err != nil {
+		t.Fatalf("EditMessageText failed: %v", err)
+	}
+	if !strings.Contains(editBody, `"message_id":77`) || !strings.Contains(editBody, `"final text"`) {
+		t.Fatalf("unexpected edit payload: %s", editBody)
+	}
+}
+
+func TestEditMessageText_NotOK(t *testing.T) {
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		_, _ = io.WriteString(w, `{"ok":false,"description":"Bad Request: message is not modified"}`)
+	}))
+	defer srv.Close()
+
+	c := NewClient(srv.URL, 2*time.Second)
+	err := c.EditMessageText(context.Background(), 123, 1, "same")
+	if err == nil {
+		t.Fatal("expected error for not-ok response")
+	}
+	if cerr, ok := cmdpkg.AsError(err); !ok || cerr.Source != "telegram" {
+		t.Fatalf("expected a telegram commander error, got %T %v", err, err)
+	}
+}
@@ -0,0 +1,122 @@
+package tokenizer
+
+import (
+	"fmt"
+	"math"
+)
+
+// BPE is a byte-level byte pair encoder using tiktoken's merge rule: ranks map
+// byte strings to token ids, and the adjacent pair whose concatenation has
+// the lowest rank is merged first until no pair is in the vocabulary.
+type BPE struct {
+	name  string
+	ranks map[string]int
+}
+
+// NewBPE builds an encoder for encoding (one of the encoding names, which
+// selects the pre-tokenizer) over ranks. Every single byte must have a rank so that any
+// input can be encoded.
+func NewBPE(encoding string, ranks map[string]int) (*BPE, error) {
+	if _, err := Split(encoding, ""); err != nil {
+		return nil, err
+	}
+	for b := 0; b < 256; b++ {
+		if _, ok := ranks[string([]byte{byte(b)})]; !ok {
+			return nil, fmt.Errorf("%s ranks missing byte 0x%02x", encoding, b)
+		}
+	}
+	return &BPE{name: encoding, ranks: ranks}, nil
+}
+
+// Name returns the encoding name.
+func (e *BPE) Name() string {
+	return e.name
+}
+
+// Encode returns the token ids of text.
+func (e *BPE) Encode(text string) []int {
+	var ids []int
+	for _, piece := range e.pieces(text) {
+		if rank, ok := e.ranks[piece]; ok {
+			ids = append(ids, rank)
+			continue
+		}
+		bounds := e.merge(piece)
+		for i := 0; i+1 < len(bounds); i++ {
+			ids = append(ids, e.ranks[piece[bounds[i]:bounds[i+1]]])
+		}
+	}
+	return ids
+}
+
+// Count returns the number of tokens in text.
+func (e *BPE) Count(text string) int {
+	n := 0
+	for _, piece := range e.pieces(text) {
+		if _, ok := e.ranks[piece]; ok {
+			n++
+			continue
+		}
+		n += len(e.merge(piece)) - 1
+	}
+	return n
+}
+
+type part struct {
+	start int
+	rank  int
+}
+
+// merge returns the byte offsets of the tokens piece encodes to, including
+// len(piece) as the final boundary. It is a port of tiktoken's
+// byte_pair_merge.
+func (e *BPE) merge(piece string) []int {
+	parts := make([]part, 0, len(piece)+1)
+	for i := 0; i < len(piece)+1; i++ {
+		parts = append(parts, part{start: i, rank: math.MaxInt})
+	}
+	for i := 0; i+2 < len(parts); i++ {
+		parts[i].rank = e.rankOf(piece, parts[i].start, parts[i+2].start)
+	}
+	pairRank := func(i int) int {
+		if i+3 < len(parts) {
+			return e.rankOf(piece, parts[i].start, parts[i+3].start)
+		}
+		return math.MaxInt
+	}
+	for len(parts) > 1 {
+		minRank, minIdx := math.MaxInt, -1
+		for i := 0; i+1 < len(parts); i++ {
+			if parts[i].rank < minRank {
+				minRank, minIdx = parts[i].rank, i
+			}
+		}
+		if minIdx < 0 {
+			break
+		}
+		parts[minIdx].rank = pairRank(minIdx)
+		if minIdx > 0 {
+			parts[minIdx-1].rank = pairRank(minIdx - 1)
+		}
+		parts = append(parts[:minIdx+1], parts[minIdx+2:]...)
+	}
+	bounds := make([]int, len(parts))
+	for i, p := range parts {
+		bounds[i] = p.start
+	}
+	return bounds
+}
+
+func (e *BPE) rankOf(piece string, start, end int) int {
+	if rank, ok := e.ranks[piece[start:end]]; ok {
+		return rank
+	}
+	return math.MaxInt
+}
+
+func (e *BPE) pieces(text string) []string {
+	if e.name == O200K {
+		return splitO200K(text)
+	}
+	return splitCL100K(text)
+}
@@ -0,0 +1,255 @@
+package tokenizer
+
+import (
+	"fmt"
+	"unicode"
+	"unicode/utf8"
+)
+
+// The splitters below reproduce tiktoken's pre-tokenization patterns by hand,
+// because RE2 cannot express their trailing-whitespace lookahead `\s+(?!\S)`.
+//
+// cl100k_base:
+//
+//	(?i:'s|'t|'re|'ve|'m|'ll|'d)|[^\r\n\p{L}\p{N}]?\p{L}+|\p{N}{1,3}|
+//	 ?[^\s\p{L}\p{N}]+[\r\n]*|\s*[\r\n]+|\s+(?!\S)|\s+
+//
+// o200k_base:
+//
+//	[^\r\n\p{L}\p{N}]?[\p{Lu}\p{Lt}\p{Lm}\p{Lo}\p{M}]*[\p{Ll}\p{Lm}\p{Lo}\p{M}]+(?i:'s|'t|'re|'ve|'m|'ll|'d)?|
+//	[^\r\n\p{L}\p{N}]?[\p{Lu}\p{Lt}\p{Lm}\p{Lo}\p{M}]+[\p{Ll}\p{Lm}\p{Lo}\p{M}]*(?i:'s|'t|'re|'ve|'m|'ll|'d)?|
+//	\p{N}{1,3}| ?[^\s\p{L}\p{N}]+[\r\n/]*|\s*[\r\n]+|\s+(?!\S)|\s+
+//
+// Each matcher returns the end (exclusive, in runes) of the alternative
+// matching at i, or i when it does not match, following the leftmost-first
+// backtracking order of the original regex.
+
+// splitCL100K splits text into cl100k_base pre-tokens.
+func splitCL100K(text string) []string {
+	return splitWith(text, func(r []rune, i int) int {
+		if end := matchContraction(r, i); end > i {
+			return end
+		}
+		if end := matchLetters(r, i); end > i {
+			return end
+		}
+		if end := matchDigits(r, i); end > i {
+			return end
+		}
+		if end := matchPunct(r, i, false); end > i {
+			return end
+		}
+		return matchSpace(r, i)
+	})
+}
+
+// splitO200K splits text into o200k_base pre-tokens.
+func splitO200K(text string) []string {
+	return splitWith(text, func(r []rune, i int) int {
+		if end := matchCasedWord(r, i, true); end > i {
+			return end
+		}
+		if end := matchCasedWord(r, i, false); end > i {
+			return end
+		}
+		if end := matchDigits(r, i); end > i {
+			return end
+		}
+		if end := matchPunct(r, i, true); end > i {
+			return end
+		}
+		return matchSpace(r, i)
+	})
+}
+
+func splitWith(text string, match func(r []rune, i int) int) []string {
+	if text == "" {
+		return nil
+	}
+	// offsets[i] is the byte offset of r[i]; invalid bytes decode to one
+	// RuneError each, as in the original regex engines.
+	r := make([]rune, 0, len(text))
+	offsets := make([]int, 0, len(text)+1)
+	for off := 0; off < len(text); {
+		c, size := utf8.DecodeRuneInString(text[off:])
+		r = append(r, c)
+		offsets = append(offsets, off)
+		off += size
+	}
+	offsets = append(offsets, len(text))
+	var pieces []string
+	for i := 0; i < len(r); {
+		end := match(r, i)
+		if end <= i {
+			end = i + 1
+		}
+		pieces = append(pieces, text[offsets[i]:offsets[end]])
+		i = end
+	}
+	return pieces
+}
+
+func isLetter(c rune) bool { return unicode.IsLetter(c) }
+func isNumber(c rune) bool { return unicode.IsNumber(c) }
+func isSpace(c rune) bool  { return unicode.IsSpace(c) }
+func isNewline(c rune) bool {
+	return c == '\r' || c == '\n'
+}
+
+// isPrefix matches [^\r\n\p{L}\p{N}].
+func isPrefix(c rune) bool {
+	return !isNewline(c) && !isLetter(c) && !isNumber(c)
+}
+
+// isUpperish matches [\p{Lu}\p{Lt}\p{Lm}\p{Lo}\p{M}].
+func isUpperish(c rune) bool {
+	return unicode.In(c, unicode.Lu, unicode.Lt, unicode.Lm, unicode.Lo, unicode.M)
+}
+
+// isLowerish matches [\p{Ll}\p{Lm}\p{Lo}\p{M}].
+func isLowerish(c rune) bool {
+	return unicode.In(c, unicode.Ll, unicode.Lm, unicode.Lo, unicode.M)
+}
+
+// matchContraction matches (?i:'s|'t|'re|'ve|'m|'ll|'d).
+func matchContraction(r []rune, i int) int {
+	if i >= len(r) || r[i] != '\'' || i+1 >= len(r) {
+		return i
+	}
+	switch unicode.ToLower(r[i+1]) {
+	case 's', 't', 'm', 'd':
+		return i + 2
+	case 'r', 'v':
+		if i+2 < len(r) && unicode.ToLower(r[i+2]) == 'e' {
+			return i + 3
+		}
+	case 'l':
+		if i+2 < len(r) && unicode.ToLower(r[i+2]) == 'l' {
+			return i + 3
+		}
+	}
+	return i
+}
+
+// matchLetters matches [^\r\n\p{L}\p{N}]?\p{L}+.
+func matchLetters(r []rune, i int) int {
+	start := i
+	if isPrefix(r[i]) && i+1 < len(r) && isLetter(r[i+1]) {
+		start = i + 1
+	}
+	end := start
+	for end < len(r) && isLetter(r[end]) {
+		end++
+	}
+	if end == start {
+		return i
+	}
+	return end
+}
+
+// matchCasedWord matches one of o200k's two word alternatives:
+// [^\r\n\p{L}\p{N}]?U*L+C? when lowerTail is set, [^\r\n\p{L}\p{N}]?U+L*C?
+// otherwise.
+func matchCasedWord(r []rune, i int, lowerTail bool) int {
+	starts := []int{i}
+	if isPrefix(r[i]) {
+		starts = []int{i + 1, i}
+	}
+	for _, start := range starts {
+		upper := start
+		for upper < len(r) && isUpperish(r[upper]) {
+			upper++
+		}
+		var mid int
+		if lowerTail {
+			// Give back uppercase-class runes until a lowercase-class one follows.
+			mid = -1
+			for k := upper; k >= start; k-- {
+				if k < len(r) && isLowerish(r[k]) {
+					mid = k
+					break
+				}
+			}
+			if mid < 0 {
+				continue
+			}
+		} else {
+			if upper == start {
+				continue
+			}
+			mid = upper
+		}
+		end := mid
+		for end < len(r) && isLowerish(r[end]) {
+			end++
+		}
+		if c := matchContraction(r, end); c > end {
+			end = c
+		}
+		return end
+	}
+	return i
+}
+
+// matchDigits matches \p{N}{1,3}.
+func matchDigits(r []rune, i int) int {
+	end := i
+	for end < len(r) && end-i < 3 && isNumber(r[end]) {
+		end++
+	}
+	return end
+}
+
+// matchPunct matches ` ?[^\s\p{L}\p{N}]+[\r\n]*`, also allowing trailing
+// slashes for o200k.
+func matchPunct(r []rune, i int, slash bool) int {
+	start := i
+	if r[i] == ' ' {
+		start++
+	}
+	end := start
+	for end < len(r) && !isSpace(r[end]) && !isLetter(r[end]) && !isNumber(r[end]) {
+		end++
+	}
+	if end == start {
+		return i
+	}
+	for end < len(r) && (isNewline(r[end]) || (slash && r[end] == '/')) {
+		end++
+	}
+	return end
+}
+
+// matchSpace matches \s*[\r\n]+|\s+(?!\S)|\s+.
+func matchSpace(r []rune, i int) int {
+	end := i
+	for end < len(r) && isSpace(r[end]) {
+		end++
+	}
+	if end == i {
+		return i
+	}
+	// \s*[\r\n]+ ends just after the last newline in the run.
+	for k := end - 1; k >= i; k-- {
+		if isNewline(r[k]) {
+			return k + 1
+		}
+	}
+	// \s+(?!\S) leaves the last space to prefix the following word.
+	if end < len(r) && end-1 > i {
+		return end - 1
+	}
+	return end
+}
+
+// Split returns the pre-tokenization pieces of text for an encoding. BPE
+// merges never cross piece boundaries.
+func Split(encoding, text string) ([]string, error) {
+	switch encoding {
+	case CL100K:
+		return splitCL100K(text), nil
+	case O200K:
+		return splitO200K(text), nil
+	}
+	return nil, fmt.Errorf("unknown encoding %q", encoding)
+}
@@ -0,0 +1,138 @@
+// Package tokenizer counts tokens the way OpenAI-style BPE models do, so
+// context budgeting does not depend on a characters-per-token guess.
+//
+// The encoder is a byte-level BPE with tiktoken's merge rule and hand-ported
+// cl100k_base and o200k_base pre-tokenizers. Because the worker must run
+// offline, OpenAI's published rank files are embedded gzipped under vocab/,
+// unmodified (see embeddedSHA256), so counts match tiktoken's.
+package tokenizer
+
+import (
+	"bufio"
+	"bytes"
+	"compress/gzip"
+	_ "embed"
+	"encoding/base64"
+	"fmt"
+	"io"
+	"strconv"
+	"strings"
+	"sync"
+)
+
+// Encoding names.
+const (
+	CL100K = "cl100k_base"
+	O200K  = "o200k_base"
+)
+
+// Tokenizer encodes text into model tokens.
+type Tokenizer interface {
+	// Name returns the encoding name, e.g. "o200k_base".
+	Name() string
+	// Encode returns the token ids of text.
+	Encode(text string) []int
+	// Count returns the number of tokens in text.
+	Count(text string) int
+}
+
+// o200kPrefixes lists the model families that use o200k_base. Everything
+// else, including non-OpenAI models whose tokenizers are not public, is
+// counted with cl100k_base.
+var o200kPrefixes = []string{"gpt-4o", "chatgpt-4o", "gpt-4.1", "gpt-4.5", "gpt-5", "o1", "o3", "o4"}
+
+// EncodingForModel returns the encoding name used for model.
+func EncodingForModel(model string) string {
+	name := strings.ToLower(strings.TrimSpace(model))
+	for _, prefix := range o200kPrefixes {
+		if name == prefix || strings.HasPrefix(name, prefix+"-") {
+			return O200K
+		}
+	}
+	return CL100K
+}
+
+// ForModel returns the embedded tokenizer for model's encoding.
+func ForModel(model string) Tokenizer {
+	return Get(EncodingForModel(model))
+}
+
+var (
+	//go:embed vocab/cl100k_base.tiktoken.gz
+	cl100kVocab []byte
+	//go:embed vocab/o200k_base.tiktoken.gz
+	o200kVocab []byte
+
+	embedded = map[string]*lazyBPE{
+		CL100K: {data: cl100kVocab},
+		O200K:  {data: o200kVocab},
+	}
+
+	// embeddedSHA256 holds the digests OpenAI publishes for the uncompressed
+	// rank files (openaipublic.blob.core.windows.net/encodings/<name>.tiktoken,
+	// as pinned by tiktoken_ext/openai_public.py); the tests check the
+	// embedded copies against them.
+	embeddedSHA256 = map[string]string{
+		CL100K: "223921b76ee99bde995b7ff738513eef100fb51d18c93597a113bcffe865b2a7",
+		O200K:  "446a9538cb6c348e3516120d7c08b09f57c36495e2acfffe59a5bf8b0cfb1a2d",
+	}
+)
+
+type lazyBPE struct {
+	once sync.Once
+	data []byte
+	bpe  *BPE
+}
+
+// Get returns the embedded tokenizer for an encoding name; unknown names get
+// cl100k_base. Rank tables are decoded on first use.
+func Get(encoding string) Tokenizer {
+	l, ok := embedded[encoding]
+	if !ok {
+		encoding, l = CL100K, embedded[CL100K]
+	}
+	l.once.Do(func() {
+		zr, err := gzip.NewReader(bytes.NewReader(l.data))
+		if err != nil {
+			panic(fmt.Sprintf("tokenizer: embedded %s vocabulary: %v", encoding, err))
+		}
+		bpe, err := Load(encoding, zr)
+		if err != nil {
+			panic(fmt.Sprintf("tokenizer: embedded %s vocabulary: %v", encoding, err))
+		}
+		l.bpe = bpe
+	})
+	return l.bpe
+}
+
+// Load reads a rank table in tiktoken's format ("<base64 token> <rank>" per
+// line) and returns an encoder for encoding.
+func Load(encoding string, r io.Reader) (*BPE, error) {
+	ranks := map[string]int{}
+	scanner := bufio.NewScanner(r)
+	line := 0
+	for scanner.Scan() {
+		line++
+		text := strings.TrimSpace(scanner.Text())
+		if text == "" {
+			continue
+		}
+		token, rank, ok := strings.Cut(text, " ")
+		if !ok {
+			return nil, fmt.Errorf("line %d: want \"<base64> <rank>\"", line)
+		}
+		raw, err := base64.StdEncoding.DecodeString(token)
+		if err != nil {
+			return nil, fmt.Errorf("line %d: %w", line, err)
+		}
+		id, err := strconv.Atoi(rank)
+		if err != nil {
+			return nil, fmt.Errorf("line %d: %w", line, err)
+		}
+		ranks[string(raw)] = id
+	}
+	if err := scanner.Err(); err != nil {
+		return nil, err
+	}
+	return NewBPE(encoding, ranks)
+}
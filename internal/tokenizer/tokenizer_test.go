@@ -0,0 +1,187 @@
+package tokenizer
+
+import (
+	"bytes"
+	"compress/gzip"
+	"crypto/sha256"
+	"encoding/base64"
+	"encoding/hex"
+	"fmt"
+	"io"
+	"reflect"
+	"strings"
+	"testing"
+)
+
+func byteRanks(extra ...string) map[string]int {
+	ranks := map[string]int{}
+	for b := 0; b < 256; b++ {
+		ranks[string([]byte{byte(b)})] = b
+	}
+	for i, tok := range extra {
+		ranks[tok] = 256 + i
+	}
+	return ranks
+}
+
+func TestBPE_MergesLowestRankFirst(t *testing.T) {
+	// "bc" outranks "ab" although "ab" comes first in the text; "abc" then
+	// outranks "bcd".
+	bpe, err := NewBPE(CL100K, byteRanks("bc", "ab", "abc", "bcd"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	got := bpe.Encode("abcd")
+	want := []int{256 + 2, 'd'}
+	if !reflect.DeepEqual(got, want) {
+		t.Fatalf("got %v, want %v", got, want)
+	}
+	if got := bpe.Encode("abc"); !reflect.DeepEqual(got, []int{256 + 2}) {
+		t.Fatalf("expected whole-piece rank for abc, got %v", got)
+	}
+	if n := bpe.Count("abcd abc"); n != 4 {
+		t.Fatalf("expected 4 tokens (abc, d, ' ', abc), got %d", n)
+	}
+}
+
+func TestLoad_ParsesTiktokenFormat(t *testing.T) {
+	var sb strings.Builder
+	for tok, rank := range byteRanks("he", "hel") {
+		fmt.Fprintf(&sb, "%s %d\n", base64.StdEncoding.EncodeToString([]byte(tok)), rank)
+	}
+	bpe, err := Load(O200K, strings.NewReader(sb.String()))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if got := bpe.Encode("help"); !reflect.DeepEqual(got, []int{257, 'p'}) {
+		t.Fatalf("unexpected encoding %v", got)
+	}
+	if _, err := Load(CL100K, strings.NewReader("aGk= 1\n")); err == nil || !strings.Contains(err.Error(), "missing byte") {
+		t.Fatalf("expected missing byte error, got %v", err)
+	}
+	if _, err := Load(CL100K, strings.NewReader("aGk=\n")); err == nil {
+		t.Fatal("expected malformed line error")
+	}
+	if _, err := NewBPE("p50k_base", byteRanks()); err == nil {
+		t.Fatal("expected unknown encoding error")
+	}
+}
+
+func TestSplit_MatchesTiktokenPatterns(t *testing.T) {
+	cases := []struct {
+		encoding string
+		text     string
+		want     []string
+	}{
+		{CL100K, "Hello world  foo\n\nbar's 12345", []string{"Hello", " world", " ", " foo", "\n\n", "bar", "'s", " ", "123", "45"}},
+		{CL100K, "don't HelloWorld", []string{"don", "'t", " HelloWorld"}},
+		{CL100K, "a := b(c)\n\treturn", []string{"a", " :=", " b", "(c", ")\n", "\treturn"}},
+		{CL100K, "  end  ", []string{" ", " end", "  "}},
+		{O200K, "don't HelloWorld", []string{"don't", " Hello", "World"}},
+		{O200K, "see a/b/ now", []string{"see", " a", "/b", "/", " now"}},
+		{O200K, " ./ x", []string{" ./", " x"}},
+		{CL100K, "你好，世界。", []string{"你好", "，世界", "。"}},
+	}
+	for _, tc := range cases {
+		got, err := Split(tc.encoding, tc.text)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if !reflect.DeepEqual(got, tc.want) {
+			t.Fatalf("%s %q: got %q, want %q", tc.encoding, tc.text, got, tc.want)
+		}
+	}
+}
+
+func TestSplit_CoversInput(t *testing.T) {
+	inputs := []string{
+		"mixed 中文 and English\r\n\r\n  code: x[i] += 42 // ok\n",
+		"invalid \xff\xfe bytes and � replacement",
+		"ÉCOLE école Ǆemal naïve é",
+		"",
+	}
+	for _, enc := range []string{CL100K, O200K} {
+		for _, in := range inputs {
+			pieces, _ := Split(enc, in)
+			if got := strings.Join(pieces, ""); got != in {
+				t.Fatalf("%s: pieces %q do not rebuild %q", enc, pieces, in)
+			}
+			for _, p := range pieces {
+				if p == "" {
+					t.Fatalf("%s: empty piece splitting %q", enc, in)
+				}
+			}
+		}
+	}
+}
+
+func TestEncodingForModel(t *testing.T) {
+	cases := map[string]string{
+		"gpt-4o-mini":       O200K,
+		"GPT-4.1":           O200K,
+		"gpt-5-nano":        O200K,
+		"o3-mini":           O200K,
+		"gpt-4":             CL100K,
+		"gpt-4omni":         CL100K,
+		"gpt-3.5-turbo":     CL100K,
+		"claude-sonnet-4-5": CL100K,
+		"dummy":             CL100K,
+	}
+	for model, want := range cases {
+		if got := EncodingForModel(model); got != want {
+			t.Fatalf("%s: got %s, want %s", model, got, want)
+		}
+	}
+	if got := ForModel("gpt-4o").Name(); got != O200K {
+		t.Fatalf("expected o200k tokenizer, got %s", got)
+	}
+}
+
+func TestEmbeddedTokenizers_MatchTiktoken(t *testing.T) {
+	// Golden outputs of OpenAI's tiktoken (encode_ordinary) for the
+	// published rank files.
+	want := []int{15339, 1917, 0, 57668, 53901, 3922, 3574, 244, 98220, 6447}
+	if got := Get(CL100K).Encode("hello world!你好，世界！"); !reflect.DeepEqual(got, want) {
+		t.Fatalf("cl100k_base: got %v, want %v", got, want)
+	}
+	cases := []struct {
+		text          string
+		cl100k, o200k int
+	}{
+		{"hallo world!", 4, 4},
+		{"你好世界！", 6, 3},
+		{"こんにちは世界！", 5, 3},
+		{"안녕하세요 세계!", 10, 4},
+		{"Привет мир!", 6, 4},
+		{"¡Hola mundo!", 4, 4},
+		{"Hej världen!", 7, 3},
+		{"Hallo verden!", 4, 3},
+	}
+	for _, tc := range cases {
+		for enc, want := range map[string]int{CL100K: tc.cl100k, O200K: tc.o200k} {
+			tok := Get(enc)
+			if n := tok.Count(tc.text); n != want || len(tok.Encode(tc.text)) != n {
+				t.Fatalf("%s %q: got %d tokens (%d encoded), want %d", enc, tc.text, n, len(tok.Encode(tc.text)), want)
+			}
+		}
+	}
+	if Get(O200K).Name() != O200K || Get("unknown").Name() != CL100K {
+		t.Fatal("expected o200k_base by name and cl100k_base for unknown names")
+	}
+}
+
+func TestEmbeddedVocab_IsOfficial(t *testing.T) {
+	for name, l := range embedded {
+		zr, err := gzip.NewReader(bytes.NewReader(l.data))
+		if err != nil {
+			t.Fatal(err)
+		}
+		h := sha256.New()
+		if _, err := io.Copy(h, zr); err != nil {
+			t.Fatal(err)
+		}
+		if got := hex.EncodeToString(h.Sum(nil)); got != embeddedSHA256[name] {
+			t.Fatalf("%s: sha256 %s, want %s", name, got, embeddedSHA256[name])
+		}
+	}
+}
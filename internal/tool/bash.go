@@ -44,6 +44,14 @@ func NewBash(policy *Policy, baseDir string, timeout time.Duration, limits Limit
 
 func (t *Bash) Name() string { return "bash" }
 
+func (t *Bash) Description() string {
+	return "Run a shell command with bash -lc."
+}
+
+func (t *Bash) Schema() json.RawMessage {
+	return json.RawMessage(`{"type":"object","properties":{"command":{"type":"string"},"cwd":{"type":"string","description":"Working directory under an allowed root."}},"required":["command"]}`)
+}
+
 func (t *Bash) Validate(raw json.RawMessage) error {
 	var in BashInput
 	if err := json.Unmarshal(raw, &in); err != nil {
@@ -64,7 +72,7 @@ func (t *Bash) Execute(ctx context.Context, raw json.RawMessage) (Result, error)
 
 	command := resolveBashCommand(in)
 	if t.Policy.IsBashDenied(command) {
-		err := fmt.Errorf("bash command denied by policy")
+		err := &Error{Class: ErrPolicy, Err: fmt.Errorf("bash command denied by policy")}
 		return Result{OK: false, ExitCode: 2, Stderr: err.Error()}, err
 	}
 
@@ -82,6 +90,9 @@ func (t *Bash) Execute(ctx context.Context, raw json.RawMessage) (Result, error)
 
 	cmd := exec.CommandContext(toolCtx, "bash", "-lc", command)
 	cmd.Dir = resolvedCwd
+	killProcessGroupOnCancel(cmd)
+	// A child that escaped the group may hold the output pipes open.
+	cmd.WaitDelay = time.Second
 
 	var stdout bytes.Buffer
 	var stderr bytes.Buffer
@@ -109,7 +120,7 @@ func (t *Bash) Execute(ctx context.Context, raw json.RawMessage) (Result, error)
 		TruncatedBytes: truncBytesOut || truncBytesErr,
 	}
 	if runErr != nil {
-		return result, fmt.Errorf("bash execution failed: %w", runErr)
+		return result, execFailure(toolCtx, "bash", runErr)
 	}
 	return result, nil
 }
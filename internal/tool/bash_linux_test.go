@@ -0,0 +1,69 @@
+package tool
+
+import (
+	"context"
+	"encoding/json"
+	"os"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestBash_CancelKillsChildProcesses(t *testing.T) {
+	base := t.TempDir()
+	policy, err := NewPolicy(base, "")
+	if err != nil {
+		t.Fatalf("policy err: %v", err)
+	}
+	bashTool := NewBash(policy, base, 30*time.Second, Limits{MaxLines: 100, MaxBytes: 4096})
+	pidFile := filepath.Join(base, "child.pid")
+
+	ctx, cancel := context.WithCancel(context.Background())
+	go func() {
+		for ctx.Err() == nil {
+			if data, err := os.ReadFile(pidFile); err == nil && strings.HasSuffix(string(data), "\n") {
+				cancel()
+				return
+			}
+			time.Sleep(10 * time.Millisecond)
+		}
+	}()
+	raw, _ := json.Marshal(BashInput{Command: "sleep 30 & echo $! > child.pid; wait"})
+	started := time.Now()
+	_, execErr := bashTool.Execute(ctx, raw)
+	if ClassOf(execErr) != ErrCancelled {
+		t.Fatalf("expected cancelled error, got %v", execErr)
+	}
+	if elapsed := time.Since(started); elapsed > 5*time.Second {
+		t.Fatalf("expected cancel to return promptly, took %s", elapsed)
+	}
+	data, err := os.ReadFile(pidFile)
+	if err != nil {
+		t.Fatal(err)
+	}
+	pid, err := strconv.Atoi(strings.TrimSpace(string(data)))
+	if err != nil {
+		t.Fatal(err)
+	}
+	deadline := time.Now().Add(2 * time.Second)
+	for processRunning(pid) {
+		if time.Now().After(deadline) {
+			t.Fatalf("background child %d survived the cancel", pid)
+		}
+		time.Sleep(20 * time.Millisecond)
+	}
+}
+
+// processRunning reports whether pid exists and is not a zombie.
+func processRunning(pid int) bool {
+	stat, err := os.ReadFile(filepath.Join("/proc", strconv.Itoa(pid), "stat"))
+	if err != nil {
+		return false
+	}
+	// The state follows the parenthesized command name.
+	s := string(stat)
+	i := strings.LastIndex(s, ")")
+	return i < 0 || i+2 >= len(s) || s[i+2] != 'Z'
+}
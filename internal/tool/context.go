@@ -0,0 +1,33 @@
+package tool
+
+import "context"
+
+type contextKey int
+
+const (
+	chatIDKey contextKey = iota
+	eventIDKey
+)
+
+// WithChatID returns ctx carrying the chat a tool call is made for.
+func WithChatID(ctx context.Context, chatID int64) context.Context {
+	return context.WithValue(ctx, chatIDKey, chatID)
+}
+
+// ChatIDFrom returns the chat set by WithChatID.
+func ChatIDFrom(ctx context.Context) (int64, bool) {
+	id, ok := ctx.Value(chatIDKey).(int64)
+	return id, ok
+}
+
+// WithEventID returns ctx carrying the tool_call.started event of the call,
+// so tools can record their own events under it.
+func WithEventID(ctx context.Context, eventID int64) context.Context {
+	return context.WithValue(ctx, eventIDKey, eventID)
+}
+
+// EventIDFrom returns the event set by WithEventID.
+func EventIDFrom(ctx context.Context) (int64, bool) {
+	id, ok := ctx.Value(eventIDKey).(int64)
+	return id, ok
+}
@@ -45,6 +45,14 @@ func NewEdit(policy *Policy, baseDir string, timeout time.Duration, limits Limit
 
 func (t *Edit) Name() string { return "edit" }
 
+func (t *Edit) Description() string {
+	return "Replace exact text in a file."
+}
+
+func (t *Edit) Schema() json.RawMessage {
+	return json.RawMessage(`{"type":"object","properties":{"path":{"type":"string"},"old_text":{"type":"string"},"new_text":{"type":"string"},"all":{"type":"boolean","description":"Replace all occurrences instead of only the first."}},"required":["path","old_text","new_text"]}`)
+}
+
 func (t *Edit) Validate(raw json.RawMessage) error {
 	var in EditInput
 	if err := json.Unmarshal(raw, &in); err != nil {
@@ -108,7 +116,7 @@ func (t *Edit) Execute(ctx context.Context, raw json.RawMessage) (Result, error)
 		TruncatedBytes: truncBytesOut || truncBytesErr,
 	}
 	if runErr != nil {
-		return result, fmt.Errorf("edit execution failed: %w", runErr)
+		return result, execFailure(toolCtx, "edit", runErr)
 	}
 	return result, nil
 }
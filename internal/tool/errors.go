@@ -0,0 +1,65 @@
+package tool
+
+import (
+	"context"
+	"errors"
+	"fmt"
+)
+
+// ErrorClass categorizes tool failures.
+type ErrorClass string
+
+const (
+	ErrValidation ErrorClass = "validation"
+	ErrPolicy     ErrorClass = "policy"
+	ErrTimeout    ErrorClass = "timeout"
+	ErrExec       ErrorClass = "tool_exec"
+	ErrCancelled  ErrorClass = "cancelled"
+)
+
+// Error is a classified tool failure. Its message is that of the wrapped error.
+type Error struct {
+	Class ErrorClass
+	Err   error
+}
+
+func (e *Error) Error() string {
+	return e.Err.Error()
+}
+
+func (e *Error) Unwrap() error {
+	return e.Err
+}
+
+// ClassOf returns the class of a tool error. Unclassified errors are
+// tool_exec, except context deadline errors which are timeout.
+func ClassOf(err error) ErrorClass {
+	var terr *Error
+	if errors.As(err, &terr) {
+		return terr.Class
+	}
+	if errors.Is(err, context.DeadlineExceeded) {
+		return ErrTimeout
+	}
+	return ErrExec
+}
+
+func classified(class ErrorClass, err error) error {
+	var terr *Error
+	if err == nil || errors.As(err, &terr) {
+		return err
+	}
+	return &Error{Class: class, Err: err}
+}
+
+// execFailure classifies a failed command run under ctx: timeout when ctx
+// expired, cancelled when it was cancelled, tool_exec otherwise.
+func execFailure(ctx context.Context, toolName string, runErr error) error {
+	if errors.Is(ctx.Err(), context.DeadlineExceeded) {
+		return &Error{Class: ErrTimeout, Err: fmt.Errorf("%s execution timed out: %w", toolName, runErr)}
+	}
+	if errors.Is(ctx.Err(), context.Canceled) {
+		return &Error{Class: ErrCancelled, Err: fmt.Errorf("%s execution cancelled: %w", toolName, runErr)}
+	}
+	return &Error{Class: ErrExec, Err: fmt.Errorf("%s execution failed: %w", toolName, runErr)}
+}
@@ -45,6 +45,14 @@ func NewFind(policy *Policy, baseDir string, timeout time.Duration, limits Limit
 
 func (t *Find) Name() string { return "find" }
 
+func (t *Find) Description() string {
+	return "Find files by name pattern under an allowed root."
+}
+
+func (t *Find) Schema() json.RawMessage {
+	return json.RawMessage(`{"type":"object","properties":{"path":{"type":"string"},"name_pattern":{"type":"string","description":"Glob matched against file names."},"max_depth":{"type":"integer","minimum":0},"limit":{"type":"integer","minimum":0}},"required":["path"]}`)
+}
+
 func (t *Find) Validate(raw json.RawMessage) error {
 	var in FindInput
 	if err := json.Unmarshal(raw, &in); err != nil {
@@ -110,7 +118,7 @@ func (t *Find) Execute(ctx context.Context, raw json.RawMessage) (Result, error)
 		TruncatedBytes: truncBytesOut || truncBytesErr,
 	}
 	if runErr != nil {
-		return result, fmt.Errorf("find execution failed: %w", runErr)
+		return result, execFailure(toolCtx, "find", runErr)
 	}
 	if in.Limit > 0 {
 		result.Stdout = limitLines(result.Stdout, in.Limit)
@@ -45,6 +45,14 @@ func NewGrep(policy *Policy, baseDir string, timeout time.Duration, limits Limit
 
 func (t *Grep) Name() string { return "grep" }
 
+func (t *Grep) Description() string {
+	return "Search file contents with a regular expression."
+}
+
+func (t *Grep) Schema() json.RawMessage {
+	return json.RawMessage(`{"type":"object","properties":{"path":{"type":"string"},"pattern":{"type":"string"},"glob":{"type":"string"},"limit":{"type":"integer","minimum":0}},"required":["path","pattern"]}`)
+}
+
 func (t *Grep) Validate(raw json.RawMessage) error {
 	var in GrepInput
 	if err := json.Unmarshal(raw, &in); err != nil {
@@ -108,7 +116,7 @@ func (t *Grep) Execute(ctx context.Context, raw json.RawMessage) (Result, error)
 		TruncatedBytes: truncBytesOut || truncBytesErr,
 	}
 	if runErr != nil {
-		return result, fmt.Errorf("grep execution failed: %w", runErr)
+		return result, execFailure(toolCtx, "grep", runErr)
 	}
 	return result, nil
 }
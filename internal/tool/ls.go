@@ -43,6 +43,14 @@ func NewLS(policy *Policy, baseDir string, timeout time.Duration, limits Limits)
 
 func (t *LS) Name() string { return "ls" }
 
+func (t *LS) Description() string {
+	return "List directory entries under an allowed root."
+}
+
+func (t *LS) Schema() json.RawMessage {
+	return json.RawMessage(`{"type":"object","properties":{"path":{"type":"string","description":"Directory to list; use \".\" for the workspace."},"recursive":{"type":"boolean"},"limit":{"type":"integer","minimum":0}},"required":["path"]}`)
+}
+
 func (t *LS) Validate(raw json.RawMessage) error {
 	var in LSInput
 	if err := json.Unmarshal(raw, &in); err != nil {
@@ -106,7 +114,7 @@ func (t *LS) Execute(ctx context.Context, raw json.RawMessage) (Result, error) {
 		TruncatedBytes: truncBytesOut || truncBytesErr,
 	}
 	if runErr != nil {
-		return result, fmt.Errorf("ls execution failed: %w", runErr)
+		return result, execFailure(toolCtx, "ls", runErr)
 	}
 	return result, nil
 }
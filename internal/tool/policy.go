@@ -56,7 +56,7 @@ func ParseAllowedRoots(raw string) ([]string, error) {
 // ResolveAllowedPath validates the input path against allowlist and returns a safe absolute path.
 func (p *Policy) ResolveAllowedPath(path string, baseDir string) (string, error) {
 	if strings.TrimSpace(path) == "" {
-		return "", fmt.Errorf("path is empty")
+		return "", &Error{Class: ErrValidation, Err: fmt.Errorf("path is empty")}
 	}
 	if baseDir == "" {
 		baseDir = "/workspace"
@@ -76,7 +76,7 @@ func (p *Policy) ResolveAllowedPath(path string, baseDir string) (string, error)
 			return candidate, nil
 		}
 	}
-	return "", fmt.Errorf("path outside allowlist: %s", path)
+	return "", &Error{Class: ErrPolicy, Err: fmt.Errorf("path outside allowlist: %s", path)}
 }
 
 func (p *Policy) IsBashDenied(cmd string) bool {
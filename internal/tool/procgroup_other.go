@@ -0,0 +1,9 @@
+//go:build !unix
+
+package tool
+
+import "os/exec"
+
+// killProcessGroupOnCancel leaves cmd as is: only the command itself is
+// killed when its context is cancelled.
+func killProcessGroupOnCancel(cmd *exec.Cmd) {}
@@ -44,6 +44,14 @@ func NewRead(policy *Policy, baseDir string, timeout time.Duration, limits Limit
 
 func (t *Read) Name() string { return "read" }
 
+func (t *Read) Description() string {
+	return "Read a text file by line offset and limit."
+}
+
+func (t *Read) Schema() json.RawMessage {
+	return json.RawMessage(`{"type":"object","properties":{"path":{"type":"string"},"offset":{"type":"integer","minimum":0},"limit":{"type":"integer","minimum":1}},"required":["path","limit"]}`)
+}
+
 func (t *Read) Validate(raw json.RawMessage) error {
 	var in ReadInput
 	if err := json.Unmarshal(raw, &in); err != nil {
@@ -108,7 +116,7 @@ func (t *Read) Execute(ctx context.Context, raw json.RawMessage) (Result, error)
 		TruncatedBytes: truncBytesOut || truncBytesErr,
 	}
 	if runErr != nil {
-		return result, fmt.Errorf("read execution failed: %w", runErr)
+		return result, execFailure(toolCtx, "read", runErr)
 	}
 	return result, nil
 }
@@ -68,3 +68,37 @@ func TestRegistry_RegisterInvalid(t *testing.T) {
 		t.Fatal("expected empty-name error")
 	}
 }
+
+func TestRegistry_Definitions(t *testing.T) {
+	r := NewRegistry()
+	p, err := NewPolicy(t.TempDir(), "")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := r.Register(NewLS(p, "", 0, Limits{})); err != nil {
+		t.Fatal(err)
+	}
+	if err := r.Register(&mockTool{name: "custom"}); err != nil {
+		t.Fatal(err)
+	}
+
+	defs := r.Definitions()
+	if len(defs) != 2 {
+		t.Fatalf("expected 2 definitions, got %d", len(defs))
+	}
+	if defs[0].Name != "custom" || defs[0].Description != "" {
+		t.Fatalf("unexpected custom definition: %+v", defs[0])
+	}
+	if defs[1].Name != "ls" || defs[1].Description == "" {
+		t.Fatalf("unexpected ls definition: %+v", defs[1])
+	}
+	for _, d := range defs {
+		var schema map[string]any
+		if err := json.Unmarshal(d.Parameters, &schema); err != nil {
+			t.Fatalf("invalid schema for %s: %v", d.Name, err)
+		}
+		if schema["type"] != "object" {
+			t.Fatalf("expected object schema for %s, got %v", d.Name, schema["type"])
+		}
+	}
+}
@@ -28,14 +28,15 @@ func (r *Runner) RunOne(ctx context.Context, call Call) (Result, error) {
 	}
 	toolName := strings.TrimSpace(call.Name)
 	if toolName == "" {
-		return Result{}, fmt.Errorf("validation: empty tool name")
+		return Result{}, &Error{Class: ErrValidation, Err: fmt.Errorf("validation: empty tool name")}
 	}
 	t, ok := r.registry.Get(toolName)
 	if !ok {
-		return Result{}, fmt.Errorf("validation: unknown tool: %s", toolName)
+		return Result{}, &Error{Class: ErrValidation, Err: fmt.Errorf("validation: unknown tool: %s", toolName)}
 	}
 	if err := t.Validate(call.Arguments); err != nil {
-		return Result{}, err
+		return Result{}, classified(ErrValidation, err)
 	}
-	return t.Execute(ctx, call.Arguments)
+	res, err := t.Execute(ctx, call.Arguments)
+	return res, classified(ErrExec, err)
 }
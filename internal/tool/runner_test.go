@@ -34,4 +34,33 @@ func TestRunner_RunOne_UnknownTool(t *testing.T) {
 	if err == nil {
 		t.Fatal("expected unknown tool error")
 	}
+	if ClassOf(err) != ErrValidation {
+		t.Fatalf("expected validation class, got %s", ClassOf(err))
+	}
+}
+
+func TestRunner_RunOne_ClassifiesErrors(t *testing.T) {
+	base := t.TempDir()
+	p, err := NewPolicy(base, "")
+	if err != nil {
+		t.Fatal(err)
+	}
+	reg := NewRegistry()
+	if err := reg.Register(NewLS(p, base, 2*time.Second, Limits{MaxLines: 100, MaxBytes: 4096})); err != nil {
+		t.Fatal(err)
+	}
+	r := NewRunner(reg)
+
+	_, err = r.RunOne(context.Background(), Call{Name: "ls", Arguments: json.RawMessage(`{"path":"/"}`)})
+	if ClassOf(err) != ErrPolicy {
+		t.Fatalf("expected policy class for path outside allowlist, got %s (%v)", ClassOf(err), err)
+	}
+	_, err = r.RunOne(context.Background(), Call{Name: "ls", Arguments: json.RawMessage(`{"path":""}`)})
+	if ClassOf(err) != ErrValidation {
+		t.Fatalf("expected validation class for missing path, got %s (%v)", ClassOf(err), err)
+	}
+	_, err = r.RunOne(context.Background(), Call{Name: "ls", Arguments: json.RawMessage(`{"path":"missing-dir"}`)})
+	if ClassOf(err) != ErrExec {
+		t.Fatalf("expected tool_exec class for failing ls, got %s (%v)", ClassOf(err), err)
+	}
 }
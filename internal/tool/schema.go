@@ -0,0 +1,41 @@
+package tool
+
+import "encoding/json"
+
+// Describer is implemented by tools that can describe themselves to models
+// with native function calling.
+type Describer interface {
+	Description() string
+	Schema() json.RawMessage
+}
+
+// Definition is the provider-neutral declaration of a callable tool.
+type Definition struct {
+	Name        string
+	Description string
+	Parameters  json.RawMessage
+}
+
+const openObjectSchema = `{"type":"object","properties":{},"additionalProperties":true}`
+
+// Definitions returns declarations for all registered tools, sorted by name.
+// Tools that do not implement Describer get an open object schema.
+func (r *Registry) Definitions() []Definition {
+	metas := r.MustList()
+	out := make([]Definition, 0, len(metas))
+	for _, meta := range metas {
+		t, ok := r.Get(meta.Name)
+		if !ok {
+			continue
+		}
+		def := Definition{Name: meta.Name, Parameters: json.RawMessage(openObjectSchema)}
+		if d, ok := t.(Describer); ok {
+			def.Description = d.Description()
+			if schema := d.Schema(); len(schema) > 0 {
+				def.Parameters = schema
+			}
+		}
+		out = append(out, def)
+	}
+	return out
+}
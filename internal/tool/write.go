@@ -44,6 +44,14 @@ func NewWrite(policy *Policy, baseDir string, timeout time.Duration, limits Limi
 
 func (t *Write) Name() string { return "write" }
 
+func (t *Write) Description() string {
+	return "Write or append content to a file."
+}
+
+func (t *Write) Schema() json.RawMessage {
+	return json.RawMessage(`{"type":"object","properties":{"path":{"type":"string"},"content":{"type":"string"},"append":{"type":"boolean"}},"required":["path","content"]}`)
+}
+
 func (t *Write) Validate(raw json.RawMessage) error {
 	var in WriteInput
 	if err := json.Unmarshal(raw, &in); err != nil {
@@ -102,7 +110,7 @@ func (t *Write) Execute(ctx context.Context, raw json.RawMessage) (Result, error
 		TruncatedBytes: truncBytesErr,
 	}
 	if runErr != nil {
-		return result, fmt.Errorf("write execution failed: %w", runErr)
+		return result, execFailure(toolCtx, "write", runErr)
 	}
 	return result, nil
 }
@@ -0,0 +1,230 @@
+package vector
+
+import (
+	"bufio"
+	"bytes"
+	"context"
+	"crypto/sha256"
+	"database/sql"
+	"encoding/hex"
+	"fmt"
+	"io/fs"
+	"os"
+	"path/filepath"
+	"strings"
+	"unicode/utf8"
+
+	"github.com/stupiduntilnot/autonous/internal/db"
+	modelpkg "github.com/stupiduntilnot/autonous/internal/model"
+)
+
+const (
+	defaultBatchSize  = 32
+	defaultMaxChars   = 4000
+	defaultChunkLines = 40
+	maxFileBytes      = 256 << 10
+)
+
+// skipDirs are never walked when indexing workspace files.
+var skipDirs = map[string]bool{".git": true, "node_modules": true, "vendor": true, "bin": true}
+
+// textExts are the file extensions indexed as workspace text.
+var textExts = map[string]bool{
+	".go": true, ".md": true, ".txt": true, ".sh": true, ".py": true, ".js": true, ".ts": true,
+	".json": true, ".yaml": true, ".yml": true, ".toml": true, ".sql": true,
+}
+
+// Indexer embeds history rows and workspace files that are new or changed
+// since the last run. Zero fields take defaults.
+type Indexer struct {
+	DB       *sql.DB
+	Embedder modelpkg.Embedder
+	// BatchSize is the number of texts per Embed call.
+	BatchSize int
+	// MaxChars cuts each embedded text to this many characters.
+	MaxChars int
+	// ChunkLines is the number of lines per file chunk.
+	ChunkLines int
+}
+
+// IndexHistory embeds every user and assistant history row that has no
+// vector for the embedder's model yet and returns how many it embedded.
+func (ix *Indexer) IndexHistory(ctx context.Context) (int, error) {
+	model := ix.Embedder.Model()
+	total := 0
+	for {
+		pending, err := db.PendingHistoryEmbeddings(ix.DB, model, ix.batchSize())
+		if err != nil || len(pending) == 0 {
+			return total, err
+		}
+		texts := make([]string, len(pending))
+		for i, p := range pending {
+			texts[i] = ix.clip(p.Text)
+		}
+		vectors, err := ix.embed(ctx, texts)
+		if err != nil {
+			return total, err
+		}
+		items := make([]db.Embedding, len(pending))
+		for i, p := range pending {
+			items[i] = db.Embedding{Model: model, Source: db.EmbeddingSourceHistory, HistoryID: p.ID, ChatID: p.ChatID, Vector: vectors[i]}
+		}
+		if err := db.InsertEmbeddings(ix.DB, items); err != nil {
+			return total, err
+		}
+		total += len(items)
+	}
+}
+
+// IndexFiles embeds text files under root in chunks of ChunkLines lines.
+// Files whose content is unchanged are skipped, changed files are re-chunked
+// and chunks of deleted files removed. Paths are stored relative to root. It
+// returns the number of chunks embedded.
+func (ix *Indexer) IndexFiles(ctx context.Context, root string) (int, error) {
+	model := ix.Embedder.Model()
+	stored, err := db.FileEmbeddingHashes(ix.DB, model)
+	if err != nil {
+		return 0, err
+	}
+	seen := map[string]bool{}
+	total := 0
+	err = filepath.WalkDir(root, func(path string, d fs.DirEntry, err error) error {
+		if err != nil {
+			return nil
+		}
+		if d.IsDir() {
+			if path != root && (skipDirs[d.Name()] || strings.HasPrefix(d.Name(), ".")) {
+				return filepath.SkipDir
+			}
+			return nil
+		}
+		if !textExts[filepath.Ext(path)] && d.Name() != "Dockerfile" {
+			return nil
+		}
+		info, err := d.Info()
+		if err != nil || info.Size() > maxFileBytes {
+			return nil
+		}
+		data, err := os.ReadFile(path)
+		if err != nil || !utf8.Valid(data) {
+			return nil
+		}
+		rel, err := filepath.Rel(root, path)
+		if err != nil {
+			return nil
+		}
+		seen[rel] = true
+		sum := sha256.Sum256(data)
+		hash := hex.EncodeToString(sum[:])
+		if stored[rel] == hash {
+			return nil
+		}
+		n, err := ix.indexFile(ctx, model, rel, hash, data)
+		total += n
+		return err
+	})
+	if err != nil {
+		return total, err
+	}
+	for path := range stored {
+		if !seen[path] {
+			if err := db.DeleteFileEmbeddings(ix.DB, model, path); err != nil {
+				return total, err
+			}
+		}
+	}
+	return total, nil
+}
+
+func (ix *Indexer) indexFile(ctx context.Context, model, rel, hash string, data []byte) (int, error) {
+	chunks := ix.chunk(data)
+	items := make([]db.Embedding, 0, len(chunks))
+	for start := 0; start < len(chunks); start += ix.batchSize() {
+		batch := chunks[start:min(start+ix.batchSize(), len(chunks))]
+		texts := make([]string, len(batch))
+		for i, c := range batch {
+			texts[i] = ix.clip(rel + "\n" + c.text)
+		}
+		vectors, err := ix.embed(ctx, texts)
+		if err != nil {
+			return 0, err
+		}
+		for i, c := range batch {
+			items = append(items, db.Embedding{
+				Model: model, Source: db.EmbeddingSourceFile, Path: rel,
+				StartLine: c.start, EndLine: c.end, Content: c.text, ContentHash: hash,
+				Vector: vectors[i],
+			})
+		}
+	}
+	if err := db.DeleteFileEmbeddings(ix.DB, model, rel); err != nil {
+		return 0, err
+	}
+	return len(items), db.InsertEmbeddings(ix.DB, items)
+}
+
+type chunk struct {
+	start, end int
+	text       string
+}
+
+// chunk splits data into runs of ChunkLines lines, skipping blank chunks.
+func (ix *Indexer) chunk(data []byte) []chunk {
+	size := ix.ChunkLines
+	if size <= 0 {
+		size = defaultChunkLines
+	}
+	var out []chunk
+	var lines []string
+	line := 0
+	flush := func() {
+		text := strings.Join(lines, "\n")
+		if strings.TrimSpace(text) != "" {
+			out = append(out, chunk{start: line - len(lines) + 1, end: line, text: text})
+		}
+		lines = lines[:0]
+	}
+	sc := bufio.NewScanner(bytes.NewReader(data))
+	sc.Buffer(make([]byte, 0, 64<<10), maxFileBytes)
+	for sc.Scan() {
+		line++
+		lines = append(lines, sc.Text())
+		if len(lines) == size {
+			flush()
+		}
+	}
+	if len(lines) > 0 {
+		flush()
+	}
+	return out
+}
+
+// embed returns one vector per text or an error.
+func (ix *Indexer) embed(ctx context.Context, texts []string) ([][]float32, error) {
+	resp, err := ix.Embedder.Embed(ctx, texts)
+	if err != nil {
+		return nil, err
+	}
+	if len(resp.Vectors) != len(texts) {
+		return nil, fmt.Errorf("vector: embedder returned %d vectors for %d texts", len(resp.Vectors), len(texts))
+	}
+	return resp.Vectors, nil
+}
+
+func (ix *Indexer) batchSize() int {
+	if ix.BatchSize <= 0 {
+		return defaultBatchSize
+	}
+	return ix.BatchSize
+}
+
+func (ix *Indexer) clip(text string) string {
+	limit := ix.MaxChars
+	if limit <= 0 {
+		limit = defaultMaxChars
+	}
+	if utf8.RuneCountInString(text) <= limit {
+		return text
+	}
+	return string([]rune(text)[:limit])
+}
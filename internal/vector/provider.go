@@ -0,0 +1,135 @@
+package vector
+
+import (
+	"context"
+	"database/sql"
+	"errors"
+	"fmt"
+	"log"
+	"sort"
+	"strings"
+
+	ctxpkg "github.com/stupiduntilnot/autonous/internal/context"
+	"github.com/stupiduntilnot/autonous/internal/db"
+)
+
+// Provider adds semantically related older messages, and optionally
+// workspace file chunks, to the history returned by Next. Added messages are
+// marked Retrieved; file chunks use Role "file" and are only meant to be
+// rendered by the assembler's retrieved block. Embedding failures are logged
+// and leave Next's history unchanged, so a down embeddings endpoint never
+// blocks a reply.
+type Provider struct {
+	Next    ctxpkg.Provider
+	Indexer *Indexer
+	// TopK is the number of older history messages to add.
+	TopK int
+	// FileTopK is the number of workspace file chunks to add.
+	FileTopK int
+	// MinScore is the lowest cosine similarity worth adding.
+	MinScore float32
+}
+
+// GetHistory returns Next's history.
+func (p *Provider) GetHistory(chatID int64, limit int) ([]ctxpkg.Message, error) {
+	return p.Next.GetHistory(chatID, limit)
+}
+
+// IndexHistory embeds history rows written since the last call.
+func (p *Provider) IndexHistory(ctx context.Context) (int, error) {
+	return p.Indexer.IndexHistory(ctx)
+}
+
+// GetHistoryFor returns Next's history for query with the TopK most similar
+// older messages of the chat's active session and the FileTopK most similar
+// file chunks added in front.
+func (p *Provider) GetHistoryFor(ctx context.Context, chatID int64, limit int, query string) ([]ctxpkg.Message, error) {
+	var history []ctxpkg.Message
+	var err error
+	if qp, ok := p.Next.(ctxpkg.QueryProvider); ok {
+		history, err = qp.GetHistoryFor(ctx, chatID, limit, query)
+	} else {
+		history, err = p.Next.GetHistory(chatID, limit)
+	}
+	if err != nil || strings.TrimSpace(query) == "" || (p.TopK <= 0 && p.FileTopK <= 0) {
+		return history, err
+	}
+	if _, err := p.Indexer.IndexHistory(ctx); err != nil {
+		log.Printf("[vector] history indexing failed: %v", err)
+	}
+	resp, err := p.Indexer.Embedder.Embed(ctx, []string{p.Indexer.clip(query)})
+	if err != nil || len(resp.Vectors) != 1 {
+		log.Printf("[vector] query embedding failed: %v", err)
+		return history, nil
+	}
+	vec := resp.Vectors[0]
+
+	var retrieved, recent []ctxpkg.Message
+	present := map[int64]bool{}
+	var oldest int64
+	for _, msg := range history {
+		present[msg.HistoryID] = true
+		if msg.Retrieved {
+			retrieved = append(retrieved, msg)
+			continue
+		}
+		if oldest == 0 && msg.HistoryID != 0 {
+			oldest = msg.HistoryID
+		}
+		recent = append(recent, msg)
+	}
+
+	if p.TopK > 0 && oldest > 0 {
+		filter := db.EmbeddingFilter{Model: p.Indexer.Embedder.Model(), Source: db.EmbeddingSourceHistory, ChatID: chatID, BeforeHistoryID: oldest, ActiveSession: true}
+		hits, err := Search(p.Indexer.DB, filter, vec, p.TopK+len(retrieved), p.MinScore)
+		if err != nil {
+			return nil, err
+		}
+		var ids []int64
+		for _, h := range hits {
+			if !present[h.HistoryID] && len(ids) < p.TopK {
+				ids = append(ids, h.HistoryID)
+			}
+		}
+		found, err := p.loadHistory(ctx, ids)
+		if err != nil {
+			return nil, err
+		}
+		retrieved = append(retrieved, found...)
+		sort.SliceStable(retrieved, func(i, j int) bool { return retrieved[i].HistoryID < retrieved[j].HistoryID })
+	}
+
+	if p.FileTopK > 0 {
+		filter := db.EmbeddingFilter{Model: p.Indexer.Embedder.Model(), Source: db.EmbeddingSourceFile}
+		hits, err := Search(p.Indexer.DB, filter, vec, p.FileTopK, p.MinScore)
+		if err != nil {
+			return nil, err
+		}
+		for _, h := range hits {
+			retrieved = append(retrieved, ctxpkg.Message{
+				Role:      "file",
+				Content:   fmt.Sprintf("%s:%d-%d\n%s", h.Path, h.StartLine, h.EndLine, h.Content),
+				Retrieved: true,
+			})
+		}
+	}
+	return append(retrieved, recent...), nil
+}
+
+// loadHistory reads the given history rows, which may since have been
+// deleted.
+func (p *Provider) loadHistory(ctx context.Context, ids []int64) ([]ctxpkg.Message, error) {
+	out := make([]ctxpkg.Message, 0, len(ids))
+	for _, id := range ids {
+		msg := ctxpkg.Message{HistoryID: id, Retrieved: true}
+		err := p.Indexer.DB.QueryRowContext(ctx, "SELECT role, text FROM history WHERE id = ?", id).Scan(&msg.Role, &msg.Content)
+		if errors.Is(err, sql.ErrNoRows) {
+			continue
+		}
+		if err != nil {
+			return nil, err
+		}
+		out = append(out, msg)
+	}
+	return out, nil
+}
@@ -0,0 +1,60 @@
+// Package vector keeps embeddings of conversation history and workspace files
+// in the SQLite embeddings table and searches them by brute-force cosine
+// similarity in Go.
+package vector
+
+import (
+	"database/sql"
+	"math"
+	"sort"
+
+	"github.com/stupiduntilnot/autonous/internal/db"
+)
+
+// Hit is a stored embedding with its similarity to a query.
+type Hit struct {
+	db.Embedding
+	Score float32
+}
+
+// Cosine returns the cosine similarity of a and b, or 0 when they differ in
+// length or either is zero.
+func Cosine(a, b []float32) float32 {
+	if len(a) != len(b) || len(a) == 0 {
+		return 0
+	}
+	var dot, na, nb float64
+	for i := range a {
+		dot += float64(a[i]) * float64(b[i])
+		na += float64(a[i]) * float64(a[i])
+		nb += float64(b[i]) * float64(b[i])
+	}
+	if na == 0 || nb == 0 {
+		return 0
+	}
+	return float32(dot / (math.Sqrt(na) * math.Sqrt(nb)))
+}
+
+// Search scans the embeddings matching filter and returns the k most similar
+// to query with a score of at least minScore, best first.
+func Search(database *sql.DB, filter db.EmbeddingFilter, query []float32, k int, minScore float32) ([]Hit, error) {
+	if k <= 0 {
+		return nil, nil
+	}
+	var hits []Hit
+	err := db.ScanEmbeddings(database, filter, func(e db.Embedding) error {
+		score := Cosine(query, e.Vector)
+		if score < minScore || (len(hits) == k && score <= hits[k-1].Score) {
+			return nil
+		}
+		e.Vector = nil
+		i := sort.Search(len(hits), func(i int) bool { return hits[i].Score < score })
+		if len(hits) < k {
+			hits = append(hits, Hit{})
+		}
+		copy(hits[i+1:], hits[i:])
+		hits[i] = Hit{Embedding: e, Score: score}
+		return nil
+	})
+	return hits, err
+}
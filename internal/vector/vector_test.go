@@ -0,0 +1,190 @@
+package vector
+
+import (
+	"context"
+	"database/sql"
+	"errors"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+
+	ctxpkg "github.com/stupiduntilnot/autonous/internal/context"
+	"github.com/stupiduntilnot/autonous/internal/db"
+	"github.com/stupiduntilnot/autonous/internal/dummy"
+	modelpkg "github.com/stupiduntilnot/autonous/internal/model"
+)
+
+func testDB(t *testing.T) *sql.DB {
+	t.Helper()
+	database, err := db.OpenDB(t.TempDir() + "/vector.db")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := db.InitSchema(database); err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { _ = database.Close() })
+	return database
+}
+
+func addHistory(t *testing.T, database *sql.DB, chatID int64, role, text string) {
+	t.Helper()
+	if _, err := database.Exec("INSERT INTO history (chat_id, role, text) VALUES (?, ?, ?)", chatID, role, text); err != nil {
+		t.Fatal(err)
+	}
+}
+
+func TestCosine(t *testing.T) {
+	if got := Cosine([]float32{1, 0}, []float32{2, 0}); got < 0.999 {
+		t.Fatalf("expected parallel vectors to score 1, got %f", got)
+	}
+	if got := Cosine([]float32{1, 0}, []float32{0, 1}); got != 0 {
+		t.Fatalf("expected orthogonal vectors to score 0, got %f", got)
+	}
+	if got := Cosine([]float32{1}, []float32{1, 0}); got != 0 {
+		t.Fatalf("expected mismatched lengths to score 0, got %f", got)
+	}
+}
+
+func TestSearch_TopKAboveMinScore(t *testing.T) {
+	database := testDB(t)
+	items := []db.Embedding{
+		{Model: "m", Source: db.EmbeddingSourceHistory, HistoryID: 1, ChatID: 1, Vector: []float32{1, 0}},
+		{Model: "m", Source: db.EmbeddingSourceHistory, HistoryID: 2, ChatID: 1, Vector: []float32{1, 1}},
+		{Model: "m", Source: db.EmbeddingSourceHistory, HistoryID: 3, ChatID: 1, Vector: []float32{0, 1}},
+		{Model: "m", Source: db.EmbeddingSourceHistory, HistoryID: 4, ChatID: 1, Vector: []float32{-1, 0}},
+	}
+	if err := db.InsertEmbeddings(database, items); err != nil {
+		t.Fatal(err)
+	}
+	filter := db.EmbeddingFilter{Model: "m", Source: db.EmbeddingSourceHistory}
+	hits, err := Search(database, filter, []float32{1, 0.1}, 2, 0)
+	if err != nil || len(hits) != 2 || hits[0].HistoryID != 1 || hits[1].HistoryID != 2 {
+		t.Fatalf("expected rows 1 and 2 best first, got %+v err=%v", hits, err)
+	}
+	hits, _ = Search(database, filter, []float32{1, 0.1}, 10, 0.5)
+	if len(hits) != 2 {
+		t.Fatalf("expected min score to cut weak matches, got %+v", hits)
+	}
+}
+
+func TestIndexer_IndexHistoryIsIncremental(t *testing.T) {
+	database := testDB(t)
+	ix := &Indexer{DB: database, Embedder: dummy.NewEmbedder(32), BatchSize: 1}
+	addHistory(t, database, 1, "user", "hello")
+	addHistory(t, database, 1, "assistant", "hi")
+	if n, err := ix.IndexHistory(context.Background()); err != nil || n != 2 {
+		t.Fatalf("expected 2 rows embedded, got %d err=%v", n, err)
+	}
+	if n, _ := ix.IndexHistory(context.Background()); n != 0 {
+		t.Fatalf("expected nothing left to embed, got %d", n)
+	}
+	addHistory(t, database, 1, "user", "again")
+	if n, _ := ix.IndexHistory(context.Background()); n != 1 {
+		t.Fatalf("expected only the new row embedded, got %d", n)
+	}
+}
+
+func TestIndexer_IndexFilesTracksChanges(t *testing.T) {
+	database := testDB(t)
+	root := t.TempDir()
+	write := func(name, content string) {
+		t.Helper()
+		path := filepath.Join(root, name)
+		if err := os.MkdirAll(filepath.Dir(path), 0o755); err != nil {
+			t.Fatal(err)
+		}
+		if err := os.WriteFile(path, []byte(content), 0o644); err != nil {
+			t.Fatal(err)
+		}
+	}
+	write("a.go", strings.Repeat("package a\n", 5))
+	write("docs/b.md", "# B\n")
+	write(".git/config", "ignored")
+	write("image.png", "ignored")
+	ix := &Indexer{DB: database, Embedder: dummy.NewEmbedder(32), ChunkLines: 2}
+
+	if n, err := ix.IndexFiles(context.Background(), root); err != nil || n != 4 {
+		t.Fatalf("expected 3 chunks of a.go and 1 of b.md, got %d err=%v", n, err)
+	}
+	if n, _ := ix.IndexFiles(context.Background(), root); n != 0 {
+		t.Fatalf("expected unchanged files skipped, got %d", n)
+	}
+	write("a.go", "package a\n")
+	if err := os.Remove(filepath.Join(root, "docs/b.md")); err != nil {
+		t.Fatal(err)
+	}
+	if n, _ := ix.IndexFiles(context.Background(), root); n != 1 {
+		t.Fatalf("expected only changed a.go re-embedded, got %d", n)
+	}
+	hashes, err := db.FileEmbeddingHashes(database, ix.Embedder.Model())
+	if err != nil || len(hashes) != 1 || hashes["a.go"] == "" {
+		t.Fatalf("expected only a.go indexed, got %v err=%v", hashes, err)
+	}
+}
+
+type failingEmbedder struct{}
+
+func (failingEmbedder) Model() string { return "failing" }
+func (failingEmbedder) Embed(context.Context, []string) (modelpkg.EmbeddingResponse, error) {
+	return modelpkg.EmbeddingResponse{}, errors.New("embeddings endpoint down")
+}
+
+func TestProvider_AddsRelatedOlderMessagesAndFiles(t *testing.T) {
+	database := testDB(t)
+	addHistory(t, database, 1, "user", "数据库迁移方案定为先备份再迁移")
+	addHistory(t, database, 1, "assistant", "好的，数据库迁移先备份")
+	addHistory(t, database, 1, "user", "晚饭吃什么")
+	addHistory(t, database, 2, "user", "数据库迁移 in another chat")
+	for _, text := range []string{"今天天气不错", "明天要开会", "会议室在三楼"} {
+		addHistory(t, database, 1, "user", text)
+	}
+	root := t.TempDir()
+	if err := os.WriteFile(filepath.Join(root, "migrate.md"), []byte("数据库迁移步骤：先备份"), 0o644); err != nil {
+		t.Fatal(err)
+	}
+	ix := &Indexer{DB: database, Embedder: dummy.NewEmbedder(256)}
+	if _, err := ix.IndexFiles(context.Background(), root); err != nil {
+		t.Fatal(err)
+	}
+	p := &Provider{Next: &ctxpkg.SQLiteProvider{DB: database}, Indexer: ix, TopK: 1, FileTopK: 1, MinScore: 0.2}
+
+	msgs, err := p.GetHistoryFor(context.Background(), 1, 3, "数据库迁移怎么做来着")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(msgs) != 5 {
+		t.Fatalf("expected 1 history hit, 1 file chunk and 3 recent messages, got %+v", msgs)
+	}
+	if !msgs[0].Retrieved || msgs[0].HistoryID > 2 || !strings.Contains(msgs[0].Content, "数据库迁移") {
+		t.Fatalf("expected an older migration message retrieved, got %+v", msgs[0])
+	}
+	if msgs[1].Role != "file" || !strings.HasPrefix(msgs[1].Content, "migrate.md:1-1\n") {
+		t.Fatalf("expected the migration doc chunk, got %+v", msgs[1])
+	}
+	if msgs[2].Retrieved || msgs[2].Content != "今天天气不错" {
+		t.Fatalf("expected recent window after retrieved messages, got %+v", msgs[2])
+	}
+
+	// A new session recalls nothing from the ones before it.
+	if _, err := db.NewSession(database, 1); err != nil {
+		t.Fatal(err)
+	}
+	for _, text := range []string{"新话题", "继续新话题", "还是新话题", "最后一句"} {
+		if err := db.AppendHistory(database, 1, "user", text, nil, nil); err != nil {
+			t.Fatal(err)
+		}
+	}
+	p.FileTopK = 0
+	msgs, err = p.GetHistoryFor(context.Background(), 1, 3, "数据库迁移怎么做来着")
+	if err != nil || len(msgs) != 3 || msgs[0].Retrieved {
+		t.Fatalf("expected only the new session's recent window, got %+v err=%v", msgs, err)
+	}
+
+	down := &Provider{Next: &ctxpkg.SQLiteProvider{DB: database}, Indexer: &Indexer{DB: database, Embedder: failingEmbedder{}}, TopK: 1}
+	msgs, err = down.GetHistoryFor(context.Background(), 1, 3, "数据库迁移")
+	if err != nil || len(msgs) != 3 {
+		t.Fatalf("expected recent window only when embedding fails, got %d err=%v", len(msgs), err)
+	}
+}